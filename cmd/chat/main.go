@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/liverlong/rpc-learning/internal/client"
+	"github.com/liverlong/rpc-learning/internal/tlsconfig"
 )
 
 const (
@@ -20,6 +21,9 @@ func main() {
 	if len(os.Args) < 3 {
 		fmt.Println("用法: go run cmd/chat/main.go <用户ID> <用户名>")
 		fmt.Println("示例: go run cmd/chat/main.go 1 张三")
+		fmt.Println("连接多租户服务器时用环境变量 TENANT 指定租户，例如 TENANT=acme go run cmd/chat/main.go 1 张三")
+		fmt.Println("连接要求认证的服务器时用环境变量 TOKEN 指定访问令牌")
+		fmt.Println("连接启用 TLS 的服务器时用环境变量 TLS_CA 指定 CA 证书，双向 TLS 再用 TLS_CERT、TLS_KEY 指定客户端证书和私钥")
 		os.Exit(1)
 	}
 
@@ -32,7 +36,21 @@ func main() {
 	username := os.Args[2]
 
 	// 创建客户端
-	userClient, err := client.NewUserClient(serverAddr)
+	var opts []client.Option
+	if tenant := os.Getenv("TENANT"); tenant != "" {
+		opts = append(opts, client.WithTenant(tenant))
+	}
+	if token := os.Getenv("TOKEN"); token != "" {
+		opts = append(opts, client.WithBearerToken(token))
+	}
+	if caFile, certFile := os.Getenv("TLS_CA"), os.Getenv("TLS_CERT"); caFile != "" || certFile != "" {
+		config, err := tlsconfig.Client(tlsconfig.ClientOptions{CAFile: caFile, CertFile: certFile, KeyFile: os.Getenv("TLS_KEY")})
+		if err != nil {
+			log.Fatalf("加载TLS配置失败: %v", err)
+		}
+		opts = append(opts, client.WithTLS(config))
+	}
+	userClient, err := client.NewUserClient(serverAddr, opts...)
 	if err != nil {
 		log.Fatalf("连接服务器失败: %v", err)
 	}
@@ -2,25 +2,88 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"os"
 	"time"
 
 	"github.com/liverlong/rpc-learning/internal/client"
+	"github.com/liverlong/rpc-learning/internal/tlsconfig"
 )
 
 const (
 	serverAddr = "localhost:50051"
 )
 
+var (
+	format      = flag.String("format", "", "导入导出的文件格式: csv, jsonl（默认按文件扩展名判断）")
+	filter      = flag.String("filter", "", "导出时的过滤表达式，语法与 ListUsers 的 filter 相同")
+	showDeleted = flag.Bool("show-deleted", false, "导出时包含已删除的用户")
+	tenant      = flag.String("tenant", "", "租户ID，连接以 -multi-tenant 启动的服务器时必须指定")
+	token       = flag.String("token", "", "访问令牌或 API key，连接以 -auth 启动的服务器时必须指定")
+	useTLS      = flag.Bool("tls", false, "用 TLS 连接服务器（指定 -tls-ca 或 -tls-cert 时自动启用）")
+	tlsCA       = flag.String("tls-ca", "", "校验服务器证书的 CA 证书文件（PEM），默认使用系统根证书")
+	tlsCert     = flag.String("tls-cert", "", "双向 TLS 的客户端证书文件（PEM）")
+	tlsKey      = flag.String("tls-key", "", "双向 TLS 的客户端私钥文件（PEM）")
+	tlsServer   = flag.String("tls-server-name", "", "校验服务器证书时使用的名字，默认为连接地址中的主机名")
+)
+
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "用法:\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s                          运行演示\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s [选项] import <文件>      从CSV或JSONL文件导入用户\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s [选项] export <文件|->    导出用户到CSV或JSONL文件，- 表示标准输出\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
 	// 创建客户端
-	userClient, err := client.NewUserClient(serverAddr)
+	var opts []client.Option
+	if *tenant != "" {
+		opts = append(opts, client.WithTenant(*tenant))
+	}
+	if *token != "" {
+		opts = append(opts, client.WithBearerToken(*token))
+	}
+	if *useTLS || *tlsCA != "" || *tlsCert != "" {
+		config, err := tlsconfig.Client(tlsconfig.ClientOptions{
+			CAFile:     *tlsCA,
+			CertFile:   *tlsCert,
+			KeyFile:    *tlsKey,
+			ServerName: *tlsServer,
+		})
+		if err != nil {
+			log.Fatalf("failed to load TLS config: %v", err)
+		}
+		opts = append(opts, client.WithTLS(config))
+	}
+	userClient, err := client.NewUserClient(serverAddr, opts...)
 	if err != nil {
 		log.Fatalf("failed to create client: %v", err)
 	}
 	defer userClient.Close()
 
+	switch args := flag.Args(); {
+	case len(args) == 0:
+		runDemo(userClient)
+	case len(args) == 2 && args[0] == "import":
+		err = importUsers(userClient, args[1], *format)
+	case len(args) == 2 && args[0] == "export":
+		err = exportUsers(userClient, args[1], *format, *filter, *showDeleted)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runDemo 依次演示各个接口
+func runDemo(userClient *client.UserClient) {
 	fmt.Println("=== gRPC用户服务客户端演示 ===")
 
 	// 1. 创建用户
@@ -90,6 +153,11 @@ func main() {
 		} else {
 			fmt.Printf("用户 ID=%d 删除成功\n", user2.Id)
 		}
+
+		// 根据错误类型而不是错误信息判断失败原因
+		if _, err := userClient.GetUser(user2.Id); errors.Is(err, client.ErrDeleted) {
+			fmt.Printf("用户 ID=%d 已被删除，可以通过 UndeleteUser 恢复\n", user2.Id)
+		}
 	}
 
 	// 6. 再次列出用户，验证删除
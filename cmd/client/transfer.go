@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/liverlong/rpc-learning/internal/client"
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+)
+
+// fileFormat 确定导入导出的文件格式，未指定时按扩展名判断
+func fileFormat(path, format string) (string, error) {
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".csv":
+			format = "csv"
+		case ".jsonl", ".ndjson":
+			format = "jsonl"
+		default:
+			return "", fmt.Errorf("无法根据文件名 %q 判断格式，请使用 -format csv 或 -format jsonl", path)
+		}
+	}
+	if format != "csv" && format != "jsonl" {
+		return "", fmt.Errorf("不支持的格式 %q，可用格式: csv, jsonl", format)
+	}
+	return format, nil
+}
+
+// importUsers 从文件导入用户并打印失败的记录
+func importUsers(userClient *client.UserClient, path, format string) error {
+	format, err := fileFormat(path, format)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var src client.UserReader
+	if format == "csv" {
+		src = client.NewCSVUserReader(f)
+	} else {
+		src = client.NewJSONLUserReader(f)
+	}
+
+	resp, err := userClient.ImportUsers(context.Background(), src)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(resp.Message)
+	for _, e := range resp.Errors {
+		fmt.Printf("  第%d条记录: %s\n", e.Row, e.Status.Message)
+	}
+	if int(resp.Failed) > len(resp.Errors) {
+		fmt.Printf("  另有%d条失败记录未列出\n", int(resp.Failed)-len(resp.Errors))
+	}
+	return nil
+}
+
+// exportUsers 导出用户到文件，path 为 - 时写到标准输出
+func exportUsers(userClient *client.UserClient, path, format, filter string, showDeleted bool) error {
+	if path == "-" && format == "" {
+		format = "jsonl"
+	}
+	format, err := fileFormat(path, format)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	var dst client.UserWriter
+	if format == "csv" {
+		dst = client.NewCSVUserWriter(w)
+	} else {
+		dst = client.NewJSONLUserWriter(w)
+	}
+
+	req := &pb.ExportUsersRequest{Filter: filter, ShowDeleted: showDeleted}
+	count, err := userClient.ExportUsers(context.Background(), req, dst)
+	if err != nil {
+		return err
+	}
+
+	if path != "-" {
+		fmt.Printf("已导出%d个用户到 %s\n", count, path)
+	}
+	return nil
+}
@@ -1,12 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"flag"
+	"fmt"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/liverlong/rpc-learning/internal/audit"
+	"github.com/liverlong/rpc-learning/internal/auth"
+	"github.com/liverlong/rpc-learning/internal/idgen"
 	"github.com/liverlong/rpc-learning/internal/server"
-	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+	"github.com/liverlong/rpc-learning/internal/store"
+	"github.com/liverlong/rpc-learning/internal/tlsconfig"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/reflection"
 )
 
@@ -14,7 +28,72 @@ const (
 	port = ":50051"
 )
 
+var (
+	storeType      = flag.String("store", "memory", "存储类型: memory, file, wal, sqlite")
+	dataDir        = flag.String("data", "data", "持久化存储使用的数据目录")
+	snapshotEvery  = flag.Int("snapshot-every", store.DefaultSnapshotEvery, "wal存储每写入多少条日志做一次快照")
+	retention      = flag.Duration("retention", server.DefaultRetention, "软删除用户的保留期，超过后被彻底清除")
+	purgeInterval  = flag.Duration("purge-interval", time.Hour, "清理软删除用户的间隔")
+	watchHistory   = flag.Int("watch-history", server.DefaultWatchHistory, "WatchUsers 为断线重连保留的最近事件数")
+	idempotencyTTL = flag.Duration("idempotency-ttl", server.DefaultIdempotencyTTL, "服务器记住成功修改请求的 request_id 的时间")
+	idGenerator    = flag.String("id-generator", idgen.KindSequential, "新用户的ID生成器: sequential, snowflake, ulid, uuidv7")
+	nodeID         = flag.Int64("node-id", 0, "snowflake ID生成器的节点号（0-1023），多个服务器实例必须使用不同的节点号")
+	multiTenant    = flag.Bool("multi-tenant", false, "按请求元数据 x-tenant-id 隔离各租户的数据，缺少租户ID的请求被拒绝")
+	tenantNames    = flag.String("tenants", "", "多租户模式下允许使用的租户ID，逗号分隔；已有数据的租户总是可以使用，其他租户的请求返回 NOT_FOUND")
+	tokenKeyFile   = flag.String("token-key-file", "", "签名令牌的密钥文件（至少32字节），为空时使用随机密钥，重启后令牌失效")
+	accessTTL      = flag.Duration("access-token-ttl", auth.DefaultAccessTokenTTL, "访问令牌的有效期")
+	refreshTTL     = flag.Duration("refresh-token-ttl", auth.DefaultRefreshTokenTTL, "刷新令牌的有效期")
+	maxFailures    = flag.Int("max-login-failures", auth.DefaultMaxFailures, "连续登录失败多少次后锁定账号")
+	lockoutFor     = flag.Duration("lockout", auth.DefaultLockoutDuration, "账号被锁定的时长")
+	requireAuth    = flag.Bool("auth", false, "要求请求带有访问令牌或 API key（authorization: Bearer <令牌>），并按角色检查权限")
+	apiKeysFile    = flag.String("api-keys", "", "服务使用的 API key 文件，JSON格式: [{\"name\":\"billing\",\"key\":\"...\",\"role\":\"admin\"}]")
+	publicMethods  = flag.String("public-methods", strings.Join(server.DefaultPublicMethods, ","), "启用 -auth 时不需要认证的方法，逗号分隔，/包名.服务名/* 表示整个服务")
+	tlsCert        = flag.String("tls-cert", "", "服务器证书文件（PEM），与 -tls-key 一起指定时启用 TLS，文件更新后自动重新加载")
+	tlsKey         = flag.String("tls-key", "", "服务器私钥文件（PEM）")
+	tlsClientCA    = flag.String("tls-client-ca", "", "签发客户端证书的 CA 文件（PEM），指定时启用双向 TLS")
+	requireCert    = flag.Bool("tls-require-client-cert", false, "拒绝没有客户端证书的连接，默认客户端可以改用令牌认证")
+	clientCerts    = flag.String("client-certs", "", "启用 -auth 时客户端证书主题到服务身份的映射，JSON格式: [{\"subject\":\"CN=billing,O=Acme\",\"name\":\"billing\",\"role\":\"admin\"}]")
+	auditPath      = flag.String("audit-log", "", "审计日志文件，默认持久化存储时为数据目录下的 audit.log，memory 存储时保存在内存中")
+)
+
 func main() {
+	flag.Parse()
+	if *purgeInterval <= 0 {
+		log.Fatalf("invalid -purge-interval %v: must be positive", *purgeInterval)
+	}
+	if *maxFailures <= 0 {
+		log.Fatalf("invalid -max-login-failures %d: must be positive", *maxFailures)
+	}
+	if (*tlsClientCA != "" || *requireCert) && (*tlsCert == "" || *tlsKey == "") {
+		log.Fatalf("-tls-client-ca and -tls-require-client-cert need -tls-cert and -tls-key")
+	}
+
+	// 打开审计日志
+	auditLog, err := newAuditLog(*auditPath, *storeType, *dataDir)
+	if err != nil {
+		log.Fatalf("failed to open audit log: %v", err)
+	}
+	defer auditLog.Close()
+
+	// 打开密码存储
+	creds, err := newCredentials(*storeType, *dataDir)
+	if err != nil {
+		log.Fatalf("failed to open credentials: %v", err)
+	}
+	defer creds.Close()
+
+	// 创建令牌签发器
+	tokens, err := newTokenIssuer(*tokenKeyFile)
+	if err != nil {
+		log.Fatalf("failed to create token issuer: %v", err)
+	}
+
+	// 创建ID生成器
+	ids, err := idgen.New(*idGenerator, *nodeID)
+	if err != nil {
+		log.Fatalf("failed to create id generator: %v", err)
+	}
+
 	// 创建监听器
 	lis, err := net.Listen("tcp", port)
 	if err != nil {
@@ -22,22 +101,217 @@ func main() {
 	}
 
 	// 创建gRPC服务器
-	s := grpc.NewServer()
+	var serverOpts []grpc.ServerOption
+	if *tlsCert != "" || *tlsKey != "" {
+		config, err := tlsconfig.Server(tlsconfig.ServerOptions{
+			CertFile:          *tlsCert,
+			KeyFile:           *tlsKey,
+			ClientCAFile:      *tlsClientCA,
+			RequireClientCert: *requireCert,
+		})
+		if err != nil {
+			log.Fatalf("failed to load TLS config: %v", err)
+		}
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(config)))
+	} else {
+		log.Printf("TLS is disabled: connections are plaintext")
+	}
+	if *requireAuth {
+		authenticator, err := newAuthenticator(tokens, *apiKeysFile, *clientCerts, *publicMethods)
+		if err != nil {
+			log.Fatalf("failed to create authenticator: %v", err)
+		}
+		serverOpts = append(serverOpts,
+			// 先认证再按角色授权
+			grpc.ChainUnaryInterceptor(authenticator.UnaryInterceptor(), server.AuthorizeUnary),
+			grpc.ChainStreamInterceptor(authenticator.StreamInterceptor(), server.AuthorizeStream),
+		)
+	} else {
+		log.Printf("Authentication is disabled (-auth=false): any client can call every method")
+	}
+	s := grpc.NewServer(serverOpts...)
 
-	// 注册用户服务
-	userServer := server.NewUserServer()
-	pb.RegisterUserServiceServer(s, userServer)
+	// 创建用户存储和用户服务
+	opts := []server.Option{
+		server.WithWatchHistory(*watchHistory),
+		server.WithAuditLog(auditLog),
+		server.WithIdempotencyTTL(*idempotencyTTL),
+		server.WithIDGenerator(ids),
+		server.WithCredentials(creds),
+		server.WithTokenIssuer(tokens),
+		server.WithLockout(auth.NewLockout(*maxFailures, *lockoutFor)),
+	}
+	var userServer *server.UserServer
+	if *multiTenant {
+		tenants, err := newTenants(*storeType, *dataDir)
+		if err != nil {
+			log.Fatalf("failed to open store: %v", err)
+		}
+		var allowed []string
+		if *tenantNames != "" {
+			allowed = strings.Split(*tenantNames, ",")
+		} else if *storeType == "memory" {
+			log.Fatalf("-multi-tenant with the memory store needs -tenants: memory tenants have no existing data")
+		}
+		userServer = server.NewMultiTenantServer(tenants, append(opts, server.WithTenants(allowed...))...)
+		defer userServer.Close()
+	} else {
+		userStore, err := newStore(*storeType, *dataDir)
+		if err != nil {
+			log.Fatalf("failed to open store: %v", err)
+		}
+		defer userStore.Close()
+		userServer = server.NewUserServer(userStore, opts...)
+	}
+
+	// 注册用户服务（user.UserService 和 user.v2.UserService）
+	server.RegisterServices(s, userServer)
+
+	// 后台清理超过保留期的软删除用户
+	purgeCtx, stopPurger := context.WithCancel(context.Background())
+	defer stopPurger()
+	go userServer.RunPurger(purgeCtx, *retention, *purgeInterval)
 
 	// 注册反射服务（用于grpcurl等工具）
 	reflection.Register(s)
 
-	log.Printf("gRPC server listening on %v", port)
+	log.Printf("gRPC server listening on %v (store: %s, id generator: %s, multi-tenant: %v, auth: %v, tls: %v)", port, *storeType, *idGenerator, *multiTenant, *requireAuth, *tlsCert != "")
 	log.Printf("你可以使用以下命令测试服务:")
 	log.Printf("grpcurl -plaintext localhost:50051 list")
 	log.Printf("grpcurl -plaintext localhost:50051 user.UserService/ListUsers")
+	log.Printf("grpcurl -plaintext localhost:50051 user.v2.UserService/ListUsers")
 
 	// 启动服务器
 	if err := s.Serve(lis); err != nil {
 		log.Fatalf("failed to serve: %v", err)
 	}
 }
+
+// newAuditLog 打开审计日志；哈希链校验失败时返回 audit.ErrTampered
+func newAuditLog(path, storeKind, dir string) (audit.Log, error) {
+	if path == "" {
+		if storeKind == "memory" {
+			return audit.NewMemoryLog(), nil
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		path = filepath.Join(dir, "audit.log")
+	}
+	return audit.OpenFileLog(path)
+}
+
+// newCredentials 打开密码存储：memory 存储时保存在内存中，否则保存在数据目录下的 credentials.json
+func newCredentials(storeKind, dir string) (store.Credentials, error) {
+	if storeKind == "memory" {
+		return store.NewMemoryCredentials(), nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return store.OpenFileCredentials(filepath.Join(dir, "credentials.json"))
+}
+
+// newTokenIssuer 用密钥文件的内容创建令牌签发器，没有密钥文件时使用随机密钥
+func newTokenIssuer(keyFile string) (*auth.TokenIssuer, error) {
+	key := make([]byte, 32)
+	if keyFile == "" {
+		log.Printf("No -token-key-file given, using a random key: tokens will be invalid after restart")
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	} else {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = bytes.TrimSpace(data)
+	}
+	return auth.NewTokenIssuer(key, *accessTTL, *refreshTTL)
+}
+
+// newAuthenticator 创建认证器，apiKeysFile 为空时不接受 API key，clientCertsFile 为空时不接受客户端证书
+func newAuthenticator(tokens *auth.TokenIssuer, apiKeysFile, clientCertsFile, publicMethods string) (*server.Authenticator, error) {
+	var apiKeys auth.APIKeys
+	if apiKeysFile != "" {
+		var err error
+		if apiKeys, err = auth.LoadAPIKeys(apiKeysFile); err != nil {
+			return nil, err
+		}
+		log.Printf("Loaded %d API keys from %s", len(apiKeys), apiKeysFile)
+	}
+
+	var public []string
+	for _, method := range strings.Split(publicMethods, ",") {
+		if method = strings.TrimSpace(method); method != "" {
+			public = append(public, method)
+		}
+	}
+	var opts []server.AuthenticatorOption
+	if clientCertsFile != "" {
+		certs, err := auth.LoadClientCerts(clientCertsFile)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Loaded %d client certificate subjects from %s", len(certs), clientCertsFile)
+		opts = append(opts, server.WithClientCerts(certs))
+	}
+	return server.NewAuthenticator(tokens, apiKeys, public, opts...), nil
+}
+
+// newStore 根据存储类型创建用户存储
+func newStore(kind, dir string) (store.UserStore, error) {
+	switch kind {
+	case "memory":
+		return store.NewMemoryStore(), nil
+	case "file":
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		return store.NewFileStore(filepath.Join(dir, "users.json"))
+	case "wal":
+		return store.NewJournalStore(dir, *snapshotEvery)
+	case "sqlite":
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		return openSQLite(filepath.Join(dir, "users.db"))
+	default:
+		return nil, fmt.Errorf("unknown store type: %s", kind)
+	}
+}
+
+// newTenants 根据存储类型创建多租户存储，每个租户的数据位于数据目录的 tenants/{租户ID}/ 下
+func newTenants(kind, dir string) (store.Tenants, error) {
+	switch kind {
+	case "memory":
+		return store.MemoryTenants{}, nil
+	case "file", "wal", "sqlite":
+		return store.DirTenants{
+			Dir: filepath.Join(dir, "tenants"),
+			OpenDir: func(dir string) (store.UserStore, error) {
+				return newStore(kind, dir)
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown store type: %s", kind)
+	}
+}
+
+// openSQLite 打开SQLite存储并把数据库结构迁移到最新版本
+func openSQLite(path string) (*store.SQLiteStore, error) {
+	s, err := store.NewSQLiteStore(path)
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := s.Migrate(context.Background())
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("migrate %s: %w", path, err)
+	}
+	if len(applied) > 0 {
+		log.Printf("Applied schema migrations %v to %s", applied, path)
+	}
+	return s, nil
+}
@@ -0,0 +1,54 @@
+package audit
+
+import (
+	"strconv"
+
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+)
+
+// auditedFields 审计记录中比较的字段；id、版本号和更新时间每次都会变化，不单独记录
+var auditedFields = []struct {
+	name  string
+	value func(*pb.User) string
+}{
+	{"name", func(u *pb.User) string { return u.Name }},
+	{"email", func(u *pb.User) string { return u.Email }},
+	{"age", func(u *pb.User) string { return formatInt(int64(u.Age)) }},
+	{"phone", func(u *pb.User) string { return u.Phone }},
+	{"deleted_at", func(u *pb.User) string { return formatInt(u.DeletedAt) }},
+	{"role", formatRole},
+}
+
+// Diff 返回修改前后发生变化的字段，before 或 after 为 nil 表示用户不存在
+func Diff(before, after *pb.User) []*pb.FieldChange {
+	var changes []*pb.FieldChange
+	for _, f := range auditedFields {
+		var b, a string
+		if before != nil {
+			b = f.value(before)
+		}
+		if after != nil {
+			a = f.value(after)
+		}
+		if a != b {
+			changes = append(changes, &pb.FieldChange{Field: f.name, Before: b, After: a})
+		}
+	}
+	return changes
+}
+
+// formatRole 把角色格式化为字符串，默认的 ROLE_USER 视为未设置
+func formatRole(u *pb.User) string {
+	if u.Role == pb.Role_ROLE_USER {
+		return ""
+	}
+	return u.Role.String()
+}
+
+// formatInt 把数值字段格式化为字符串，0 视为未设置
+func formatInt(n int64) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.FormatInt(n, 10)
+}
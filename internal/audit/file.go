@@ -0,0 +1,106 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// FileLog 持久化到文件的审计日志
+//
+// 每条记录是一行JSON，文件以追加模式打开，写入后 fsync。
+// 打开时读取全部记录并校验哈希链，校验失败返回 ErrTampered；
+// 崩溃时写了一半的最后一行会被丢弃并截断。
+type FileLog struct {
+	mem  *MemoryLog
+	file *os.File
+	size int64 // 文件中已确认写入的字节数
+}
+
+// OpenFileLog 打开（或创建）审计日志文件并校验其中的记录
+func OpenFileLog(path string) (*FileLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+
+	l := &FileLog{mem: NewMemoryLog(), file: f}
+	if err := l.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := Verify(l.mem.events); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// load 读取已有的记录；最后一行不完整时截断文件
+func (l *FileLog) load() error {
+	r := bufio.NewReader(l.file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("Discarding torn audit record at offset %d (%d bytes)", l.size, len(line))
+				if err := l.file.Truncate(l.size); err != nil {
+					return fmt.Errorf("truncate audit log: %w", err)
+				}
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read audit log: %w", err)
+		}
+
+		event := &pb.AuditEvent{}
+		if err := protojson.Unmarshal(bytes.TrimSpace(line), event); err != nil {
+			return fmt.Errorf("%w: invalid record at offset %d: %v", ErrTampered, l.size, err)
+		}
+		l.mem.events = append(l.mem.events, event)
+		l.size += int64(len(line))
+	}
+}
+
+// Append 追加记录并落盘，写入失败时不改变日志
+func (l *FileLog) Append(ctx context.Context, event *pb.AuditEvent) error {
+	l.mem.mu.Lock()
+	defer l.mem.mu.Unlock()
+
+	l.mem.chain(event)
+	line, err := protojson.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if _, err := l.file.Write(line); err != nil {
+		l.file.Truncate(l.size)
+		return fmt.Errorf("write audit log: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		l.file.Truncate(l.size)
+		return fmt.Errorf("sync audit log: %w", err)
+	}
+	l.size += int64(len(line))
+	l.mem.events = append(l.mem.events, event)
+	return nil
+}
+
+// List 按 id 升序返回满足条件的记录
+func (l *FileLog) List(ctx context.Context, q Query) ([]*pb.AuditEvent, error) {
+	return l.mem.List(ctx, q)
+}
+
+// Close 关闭日志文件
+func (l *FileLog) Close() error {
+	return l.file.Close()
+}
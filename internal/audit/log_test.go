@@ -0,0 +1,153 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+)
+
+// appendEvents 依次追加一组测试记录
+func appendEvents(t *testing.T, l Log) {
+	t.Helper()
+	events := []*pb.AuditEvent{
+		{Timestamp: 100, Method: "CreateUser", Caller: "alice", UserId: 1, Changes: Diff(nil, &pb.User{Id: 1, Name: "张三", Email: "a@example.com"})},
+		{Timestamp: 200, Method: "UpdateUser", Caller: "bob", UserId: 1, Changes: Diff(&pb.User{Email: "a@example.com"}, &pb.User{Email: "b@example.com"})},
+		{Timestamp: 300, Method: "CreateUser", Caller: "alice", UserId: 2},
+		{Timestamp: 400, Method: "DeleteUser", Caller: "bob", UserId: 1},
+	}
+	for _, e := range events {
+		if err := l.Append(context.Background(), e); err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+	}
+}
+
+func TestLog_ListAndVerify(t *testing.T) {
+	logs := map[string]func(t *testing.T) Log{
+		"memory": func(t *testing.T) Log { return NewMemoryLog() },
+		"file": func(t *testing.T) Log {
+			l, err := OpenFileLog(filepath.Join(t.TempDir(), "audit.log"))
+			if err != nil {
+				t.Fatalf("OpenFileLog() error = %v", err)
+			}
+			t.Cleanup(func() { l.Close() })
+			return l
+		},
+	}
+
+	for name, newLog := range logs {
+		t.Run(name, func(t *testing.T) {
+			l := newLog(t)
+			appendEvents(t, l)
+
+			all, err := l.List(context.Background(), Query{})
+			if err != nil {
+				t.Fatalf("List() error = %v", err)
+			}
+			if err := Verify(all); err != nil {
+				t.Errorf("Verify() error = %v", err)
+			}
+			if len(all) != 4 || all[1].PrevHash != all[0].Hash || all[0].PrevHash != "" {
+				t.Fatalf("List() = %v, want 4 chained events", all)
+			}
+			if c := all[1].Changes; len(c) != 1 || c[0].Field != "email" || c[0].Before != "a@example.com" || c[0].After != "b@example.com" {
+				t.Errorf("update changes = %v, want email a@ -> b@", c)
+			}
+
+			tests := []struct {
+				name string
+				q    Query
+				want []int64
+			}{
+				{name: "by user", q: Query{UserID: 1}, want: []int64{1, 2, 4}},
+				{name: "by method", q: Query{Method: "CreateUser"}, want: []int64{1, 3}},
+				{name: "by time range", q: Query{Start: 200, End: 400}, want: []int64{2, 3}},
+				{name: "page", q: Query{UserID: 1, AfterID: 1, Limit: 1}, want: []int64{2}},
+				{name: "other tenant", q: Query{Tenant: "acme"}, want: nil},
+			}
+			for _, tt := range tests {
+				got, err := l.List(context.Background(), tt.q)
+				if err != nil {
+					t.Fatalf("List(%s) error = %v", tt.name, err)
+				}
+				var ids []int64
+				for _, e := range got {
+					ids = append(ids, e.Id)
+				}
+				if fmt.Sprint(ids) != fmt.Sprint(tt.want) {
+					t.Errorf("List(%s) ids = %v, want %v", tt.name, ids, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFileLog_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := OpenFileLog(path)
+	if err != nil {
+		t.Fatalf("OpenFileLog() error = %v", err)
+	}
+	appendEvents(t, l)
+	l.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+
+	tests := []struct {
+		name       string
+		content    string
+		wantErr    error
+		wantEvents int
+	}{
+		{name: "intact", content: string(data), wantEvents: 4},
+		{name: "torn final write", content: string(data) + `{"id":"5","method":"Upd`, wantEvents: 4},
+		{name: "edited field", content: strings.Replace(string(data), "b@example.com", "c@example.com", 1), wantErr: ErrTampered},
+		{name: "removed event", content: lines[0] + lines[2] + lines[3], wantErr: ErrTampered},
+		{name: "truncated history", content: lines[1] + lines[2] + lines[3], wantErr: ErrTampered},
+		{name: "garbage line", content: lines[0] + "not json\n", wantErr: ErrTampered},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatalf("WriteFile() error = %v", err)
+			}
+
+			l, err := OpenFileLog(path)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("OpenFileLog() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("OpenFileLog() error = %v", err)
+			}
+			defer l.Close()
+
+			events, _ := l.List(context.Background(), Query{})
+			if len(events) != tt.wantEvents {
+				t.Fatalf("reopened log has %d events, want %d", len(events), tt.wantEvents)
+			}
+			// 重新打开后继续追加，哈希链保持完整
+			if err := l.Append(context.Background(), &pb.AuditEvent{Timestamp: 500, Method: "UpdateUser", UserId: 2}); err != nil {
+				t.Fatalf("Append() error = %v", err)
+			}
+			events, _ = l.List(context.Background(), Query{})
+			if err := Verify(events); err != nil || events[len(events)-1].Id != int64(tt.wantEvents)+1 {
+				t.Errorf("after append: Verify() = %v, last id = %d", err, events[len(events)-1].Id)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPassword(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatalf("HashPassword() error = %v", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=19456,t=2,p=1$") {
+		t.Errorf("HashPassword() = %q, want an argon2id PHC string", hash)
+	}
+	if again, _ := HashPassword("correct horse"); again == hash {
+		t.Error("HashPassword() returned the same hash twice, want a random salt")
+	}
+
+	if err := CheckPassword(hash, "correct horse"); err != nil {
+		t.Errorf("CheckPassword() error = %v", err)
+	}
+	if err := CheckPassword(hash, "wrong horse"); !errors.Is(err, ErrPasswordMismatch) {
+		t.Errorf("CheckPassword(wrong) error = %v, want ErrPasswordMismatch", err)
+	}
+	for _, bad := range []string{"", "plain", "$bcrypt$x$y$z$w", strings.Replace(hash, "v=19", "v=16", 1)} {
+		if err := CheckPassword(bad, "correct horse"); err == nil || errors.Is(err, ErrPasswordMismatch) {
+			t.Errorf("CheckPassword(%q) error = %v, want a format error", bad, err)
+		}
+	}
+}
+
+func TestTokenIssuer(t *testing.T) {
+	if _, err := NewTokenIssuer([]byte("short"), 0, 0); err == nil {
+		t.Error("NewTokenIssuer() with a short key succeeded")
+	}
+	key := []byte(strings.Repeat("k", 32))
+	issuer, err := NewTokenIssuer(key, time.Minute, time.Hour)
+	if err != nil {
+		t.Fatalf("NewTokenIssuer() error = %v", err)
+	}
+	now := time.Unix(1700000000, 0)
+	issuer.now = func() time.Time { return now }
+
+	tokens, err := issuer.Issue("acme", "42", RoleUser)
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+	if !tokens.AccessExpiresAt.Equal(now.Add(time.Minute)) || !tokens.RefreshExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("Issue() expiry = %v, %v", tokens.AccessExpiresAt, tokens.RefreshExpiresAt)
+	}
+
+	claims, err := issuer.Verify(tokens.Access, AccessToken)
+	if err != nil {
+		t.Fatalf("Verify(access) error = %v", err)
+	}
+	if claims.Subject != "42" || claims.Tenant != "acme" || claims.Role != RoleUser || claims.ID == "" {
+		t.Errorf("Verify(access) = %+v", claims)
+	}
+	if _, err := issuer.Verify(tokens.Refresh, RefreshToken); err != nil {
+		t.Errorf("Verify(refresh) error = %v", err)
+	}
+
+	// 类型不对、篡改、其他密钥签名的令牌都无效
+	other, _ := NewTokenIssuer([]byte(strings.Repeat("o", 32)), 0, 0)
+	tampered := tokens.Access[:len(tokens.Access)-2] + "xx"
+	for name, check := range map[string]func() error{
+		"refresh as access": func() error { _, err := issuer.Verify(tokens.Refresh, AccessToken); return err },
+		"tampered":          func() error { _, err := issuer.Verify(tampered, AccessToken); return err },
+		"other key":         func() error { _, err := other.Verify(tokens.Access, AccessToken); return err },
+		"garbage":           func() error { _, err := issuer.Verify("a.b", AccessToken); return err },
+	} {
+		if err := check(); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Verify(%s) error = %v, want ErrInvalidToken", name, err)
+		}
+	}
+
+	now = now.Add(time.Minute)
+	if _, err := issuer.Verify(tokens.Access, AccessToken); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("Verify(expired access) error = %v, want ErrTokenExpired", err)
+	}
+	if _, err := issuer.Verify(tokens.Refresh, RefreshToken); err != nil {
+		t.Errorf("Verify(refresh) after access expiry error = %v", err)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	l := NewLockout(3, time.Minute)
+	now := time.Unix(1700000000, 0)
+	l.now = func() time.Time { return now }
+
+	for i := 1; i < 3; i++ {
+		if _, locked := l.Fail("alice"); locked {
+			t.Fatalf("Fail() #%d locked the account, want 3 failures", i)
+		}
+	}
+	// 登录成功后重新计数
+	l.Succeed("alice")
+	for i := 1; i < 3; i++ {
+		l.Fail("alice")
+	}
+	until, locked := l.Fail("alice")
+	if !locked || !until.Equal(now.Add(time.Minute)) {
+		t.Fatalf("third Fail() = %v, %v, want locked for a minute", until, locked)
+	}
+	if _, locked := l.Locked("alice"); !locked {
+		t.Error("Locked() = false right after locking")
+	}
+	if _, locked := l.Locked("bob"); locked {
+		t.Error("Locked(bob) = true, want accounts counted separately")
+	}
+
+	now = now.Add(time.Minute)
+	if _, locked := l.Locked("alice"); locked {
+		t.Error("Locked() = true after the lockout ended")
+	}
+	if _, locked := l.Fail("alice"); locked {
+		t.Error("Fail() after the lockout ended locked again, want a fresh count")
+	}
+
+	// 很久以前的失败不再计数
+	now = now.Add(2 * time.Minute)
+	l.Fail("alice")
+	if _, locked := l.Fail("alice"); locked {
+		t.Error("Fail() counted failures older than the lockout duration")
+	}
+
+	// 过期记录每个锁定时长清理一次，而不是每次失败都清理
+	for i := range 100 {
+		l.Fail(fmt.Sprintf("user%d", i))
+	}
+	now = now.Add(30 * time.Second)
+	l.Fail("carol")
+	if len(l.accounts) != 102 {
+		t.Errorf("accounts = %d within the lockout duration, want 102", len(l.accounts))
+	}
+	now = now.Add(2 * time.Minute)
+	l.Fail("carol")
+	if len(l.accounts) != 1 {
+		t.Errorf("accounts = %d after the lockout duration, want only carol", len(l.accounts))
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	key := strings.Repeat("b", 32)
+	keys, err := NewAPIKeys([]APIKey{{Name: "billing", Key: key, Role: RoleAdmin}})
+	if err != nil {
+		t.Fatalf("NewAPIKeys() error = %v", err)
+	}
+	id, ok := keys.Lookup(key)
+	if !ok || id.Name != "services/billing" || !id.IsService() || !id.IsAdmin() {
+		t.Errorf("Lookup() = %+v, %v, want services/billing", id, ok)
+	}
+	if _, ok := keys.Lookup(key + "x"); ok {
+		t.Error("Lookup() of an unknown key succeeded")
+	}
+
+	for name, bad := range map[string][]APIKey{
+		"short key": {{Name: "billing", Key: "short", Role: RoleAdmin}},
+		"no name":   {{Key: key, Role: RoleAdmin}},
+		"no role":   {{Name: "billing", Key: key}},
+		"bad role":  {{Name: "billing", Key: key, Role: "root"}},
+		"duplicate": {{Name: "billing", Key: key, Role: RoleAdmin}, {Name: "billing", Key: key + "2", Role: RoleAdmin}},
+	} {
+		if _, err := NewAPIKeys(bad); err == nil {
+			t.Errorf("NewAPIKeys(%s) succeeded", name)
+		}
+	}
+}
+
+func TestClientCerts(t *testing.T) {
+	certs, err := NewClientCerts([]ClientCert{{Subject: "CN=billing,O=Acme", Name: "billing", Role: RoleUser}})
+	if err != nil {
+		t.Fatalf("NewClientCerts() error = %v", err)
+	}
+	id, ok := certs.Lookup(pkix.Name{CommonName: "billing", Organization: []string{"Acme"}})
+	if !ok || id.Name != "services/billing" || id.IsAdmin() {
+		t.Errorf("Lookup() = %+v, %v, want services/billing", id, ok)
+	}
+	if _, ok := certs.Lookup(pkix.Name{CommonName: "billing"}); ok {
+		t.Error("Lookup() of another subject succeeded")
+	}
+
+	for name, bad := range map[string][]ClientCert{
+		"no subject":        {{Name: "billing", Role: RoleUser}},
+		"no role":           {{Subject: "CN=billing", Name: "billing"}},
+		"duplicate subject": {{Subject: "CN=billing", Name: "billing", Role: RoleUser}, {Subject: "CN=billing", Name: "ops", Role: RoleAdmin}},
+		"duplicate name":    {{Subject: "CN=billing", Name: "billing", Role: RoleUser}, {Subject: "CN=ops", Name: "billing", Role: RoleAdmin}},
+	} {
+		if _, err := NewClientCerts(bad); err == nil {
+			t.Errorf("NewClientCerts(%s) succeeded", name)
+		}
+	}
+}
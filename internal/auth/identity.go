@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// 调用方的角色
+const (
+	RoleAdmin = "admin" // 可以调用所有接口
+	RoleUser  = "user"  // 只能读取和修改自己的信息
+)
+
+// Identity 通过认证的调用方
+type Identity struct {
+	// Name 调用方的名字：用户为 users/{id}，服务为 services/{name}
+	Name string
+	// UserID 用户的ID，服务为0
+	UserID int64
+	// Tenant 用户所属的租户，单租户模式和服务为空
+	Tenant string
+	// Role RoleAdmin 或 RoleUser
+	Role string
+}
+
+// IsAdmin 调用方是否是管理员
+func (id Identity) IsAdmin() bool {
+	return id.Role == RoleAdmin
+}
+
+// IsService 调用方是否是用 API key 认证的服务
+func (id Identity) IsService() bool {
+	return id.UserID == 0
+}
+
+// UserIdentity 租户 tenant 中角色为 role 的用户 userID 的身份
+func UserIdentity(tenant string, userID int64, role string) Identity {
+	return Identity{Name: "users/" + strconv.FormatInt(userID, 10), UserID: userID, Tenant: tenant, Role: role}
+}
+
+type identityKey struct{}
+
+// NewContext 返回带有调用方身份的 ctx
+func NewContext(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext 返回 ctx 中的调用方身份，未认证时 ok 为 false
+func FromContext(ctx context.Context) (id Identity, ok bool) {
+	id, ok = ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+// APIKey 服务使用的静态 API key
+type APIKey struct {
+	Name string `json:"name"` // 服务名，身份为 services/{name}
+	Key  string `json:"key"`  // 至少32个字符
+	Role string `json:"role"` // RoleAdmin 或 RoleUser
+}
+
+// APIKeys 按 API key 查找服务身份，只保存 key 的 SHA-256
+type APIKeys map[[sha256.Size]byte]Identity
+
+// NewAPIKeys 检查 key 的长度、角色和服务名是否重复，返回查找表
+func NewAPIKeys(keys []APIKey) (APIKeys, error) {
+	table := make(APIKeys, len(keys))
+	names := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		id, err := serviceIdentity(names, "api key", k.Name, k.Role)
+		if err != nil {
+			return nil, err
+		}
+		if len(k.Key) < 32 {
+			return nil, fmt.Errorf("auth: api key of %q must be at least 32 characters", k.Name)
+		}
+		table[sha256.Sum256([]byte(k.Key))] = id
+	}
+	return table, nil
+}
+
+// serviceIdentity 检查服务名和角色，返回服务 name 的身份；names 记录已使用的服务名
+func serviceIdentity(names map[string]bool, kind, name, role string) (Identity, error) {
+	if name == "" {
+		return Identity{}, fmt.Errorf("auth: %s without a name", kind)
+	}
+	if role != RoleAdmin && role != RoleUser {
+		return Identity{}, fmt.Errorf("auth: %s of %q has invalid role %q, want %q or %q", kind, name, role, RoleAdmin, RoleUser)
+	}
+	if names[name] {
+		return Identity{}, fmt.Errorf("auth: duplicate %s name %q", kind, name)
+	}
+	names[name] = true
+	return Identity{Name: "services/" + name, Role: role}, nil
+}
+
+// LoadAPIKeys 从JSON文件读取 API key，文件内容为 [{"name":"billing","key":"...","role":"admin"}]
+func LoadAPIKeys(path string) (APIKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", path, err)
+	}
+	return NewAPIKeys(keys)
+}
+
+// Lookup 返回 key 对应的服务身份
+func (k APIKeys) Lookup(key string) (Identity, bool) {
+	id, ok := k[sha256.Sum256([]byte(key))]
+	return id, ok
+}
+
+// ClientCert 双向 TLS 中客户端证书的主题对应的服务
+type ClientCert struct {
+	// Subject 证书主题，RFC 2253 格式，例如 "CN=billing,O=Acme"（与 openssl x509 -subject -nameopt RFC2253 的输出相同）
+	Subject string `json:"subject"`
+	Name    string `json:"name"` // 服务名，身份为 services/{name}
+	Role    string `json:"role"` // RoleAdmin 或 RoleUser
+}
+
+// ClientCerts 按客户端证书的主题查找服务身份
+type ClientCerts map[string]Identity
+
+// NewClientCerts 检查主题、角色和服务名是否重复，返回查找表
+func NewClientCerts(certs []ClientCert) (ClientCerts, error) {
+	table := make(ClientCerts, len(certs))
+	names := make(map[string]bool, len(certs))
+	for _, c := range certs {
+		id, err := serviceIdentity(names, "client certificate", c.Name, c.Role)
+		if err != nil {
+			return nil, err
+		}
+		if c.Subject == "" {
+			return nil, fmt.Errorf("auth: client certificate of %q without a subject", c.Name)
+		}
+		if _, ok := table[c.Subject]; ok {
+			return nil, fmt.Errorf("auth: duplicate client certificate subject %q", c.Subject)
+		}
+		table[c.Subject] = id
+	}
+	return table, nil
+}
+
+// LoadClientCerts 从JSON文件读取客户端证书的映射，文件内容为 [{"subject":"CN=billing,O=Acme","name":"billing","role":"admin"}]
+func LoadClientCerts(path string) (ClientCerts, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certs []ClientCert
+	if err := json.Unmarshal(data, &certs); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", path, err)
+	}
+	return NewClientCerts(certs)
+}
+
+// Lookup 返回证书主题对应的服务身份
+func (c ClientCerts) Lookup(subject pkix.Name) (Identity, bool) {
+	id, ok := c[subject.String()]
+	return id, ok
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// 登录失败锁定的默认参数
+const (
+	DefaultMaxFailures     = 5
+	DefaultLockoutDuration = 15 * time.Minute
+)
+
+// Lockout 记录每个账号连续登录失败的次数，达到上限后在一段时间内拒绝该账号的登录，并发安全
+//
+// 锁定期间的尝试不再计数也不延长锁定；锁定结束、登录成功或距上次失败超过 duration 后重新计数。
+// 计数只保存在内存中，服务器重启后清零。
+type Lockout struct {
+	maxFailures int
+	duration    time.Duration
+	now         func() time.Time
+
+	mu       sync.Mutex
+	accounts map[string]*failures
+	pruned   time.Time // 上一次清理过期记录的时间
+}
+
+type failures struct {
+	count       int
+	lockedUntil time.Time
+	last        time.Time
+}
+
+// NewLockout 创建锁定策略：连续失败 maxFailures 次后锁定 duration
+func NewLockout(maxFailures int, duration time.Duration) *Lockout {
+	return &Lockout{
+		maxFailures: maxFailures,
+		duration:    duration,
+		now:         time.Now,
+		accounts:    make(map[string]*failures),
+	}
+}
+
+// Locked 返回账号是否处于锁定中，以及锁定结束的时间
+func (l *Lockout) Locked(account string) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, ok := l.accounts[account]
+	if !ok || !l.now().Before(f.lockedUntil) {
+		return time.Time{}, false
+	}
+	return f.lockedUntil, true
+}
+
+// Fail 记录一次失败的登录，达到上限时锁定账号并返回锁定结束的时间
+func (l *Lockout) Fail(account string) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	// 每个锁定时长最多清理一次全部记录，平摊后每次失败的开销是常数
+	if now.Sub(l.pruned) >= l.duration {
+		l.prune(now)
+		l.pruned = now
+	}
+	f, ok := l.accounts[account]
+	if !ok {
+		f = &failures{}
+		l.accounts[account] = f
+	}
+	if now.Before(f.lockedUntil) {
+		return f.lockedUntil, true
+	}
+	if !f.lockedUntil.IsZero() || l.expired(f, now) {
+		*f = failures{} // 锁定已结束或上次失败已过期，重新计数
+	}
+	f.count++
+	f.last = now
+	if f.count >= l.maxFailures {
+		f.lockedUntil = now.Add(l.duration)
+		return f.lockedUntil, true
+	}
+	return time.Time{}, false
+}
+
+// Succeed 登录成功，清除账号的失败记录
+func (l *Lockout) Succeed(account string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.accounts, account)
+}
+
+// expired 记录的锁定已结束，且最后一次失败早于一个锁定时长之前
+func (l *Lockout) expired(f *failures, now time.Time) bool {
+	return now.Sub(f.last) > l.duration && !now.Before(f.lockedUntil)
+}
+
+// prune 删除过期的记录，避免不存在的账号无限累积，调用方持有锁
+func (l *Lockout) prune(now time.Time) {
+	for account, f := range l.accounts {
+		if l.expired(f, now) {
+			delete(l.accounts, account)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidToken 令牌格式不对、签名不匹配或类型不对
+	ErrInvalidToken = errors.New("auth: invalid token")
+	// ErrTokenExpired 令牌已过期
+	ErrTokenExpired = errors.New("auth: token expired")
+)
+
+// 令牌类型，对应 Claims.Type
+const (
+	AccessToken  = "access"
+	RefreshToken = "refresh"
+)
+
+// 令牌的默认有效期
+const (
+	DefaultAccessTokenTTL  = 15 * time.Minute
+	DefaultRefreshTokenTTL = 7 * 24 * time.Hour
+)
+
+// Claims 令牌中的声明
+type Claims struct {
+	Subject   string `json:"sub"`           // 用户ID
+	Tenant    string `json:"tid,omitempty"` // 单租户模式下为空
+	Role      string `json:"role"`          // 签发时用户的角色，RoleAdmin 或 RoleUser
+	Type      string `json:"typ"`           // AccessToken 或 RefreshToken
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+}
+
+// Tokens Authenticate 和 RefreshToken 签发的一对令牌
+type Tokens struct {
+	Access           string
+	AccessExpiresAt  time.Time
+	Refresh          string
+	RefreshExpiresAt time.Time
+}
+
+// TokenIssuer 用 HMAC-SHA256 签发和校验 JWT 格式的令牌
+type TokenIssuer struct {
+	key        []byte
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	now        func() time.Time
+}
+
+// NewTokenIssuer 创建令牌签发器，key 至少32字节；ttl 为0时使用默认有效期
+func NewTokenIssuer(key []byte, accessTTL, refreshTTL time.Duration) (*TokenIssuer, error) {
+	if len(key) < 32 {
+		return nil, fmt.Errorf("auth: token key must be at least 32 bytes, got %d", len(key))
+	}
+	if accessTTL <= 0 {
+		accessTTL = DefaultAccessTokenTTL
+	}
+	if refreshTTL <= 0 {
+		refreshTTL = DefaultRefreshTokenTTL
+	}
+	return &TokenIssuer{key: key, accessTTL: accessTTL, refreshTTL: refreshTTL, now: time.Now}, nil
+}
+
+// Issue 为租户 tenant 中角色为 role 的用户 subject 签发访问令牌和刷新令牌
+func (i *TokenIssuer) Issue(tenant, subject, role string) (*Tokens, error) {
+	now := i.now()
+	tokens := &Tokens{
+		AccessExpiresAt:  time.Unix(now.Add(i.accessTTL).Unix(), 0),
+		RefreshExpiresAt: time.Unix(now.Add(i.refreshTTL).Unix(), 0),
+	}
+	var err error
+	tokens.Access, err = i.sign(Claims{Subject: subject, Tenant: tenant, Role: role, Type: AccessToken,
+		IssuedAt: now.Unix(), ExpiresAt: tokens.AccessExpiresAt.Unix()})
+	if err != nil {
+		return nil, err
+	}
+	tokens.Refresh, err = i.sign(Claims{Subject: subject, Tenant: tenant, Role: role, Type: RefreshToken,
+		IssuedAt: now.Unix(), ExpiresAt: tokens.RefreshExpiresAt.Unix()})
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// jwtHeader 所有令牌共用的 JWT 头部
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// sign 为声明分配随机的 jti 并签名
+func (i *TokenIssuer) sign(c Claims) (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	c.ID = hex.EncodeToString(id[:])
+
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(i.mac(unsigned)), nil
+}
+
+func (i *TokenIssuer) mac(unsigned string) []byte {
+	h := hmac.New(sha256.New, i.key)
+	h.Write([]byte(unsigned))
+	return h.Sum(nil)
+}
+
+// Verify 校验令牌的签名、类型和有效期，返回其中的声明
+func (i *TokenIssuer) Verify(token, typ string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return nil, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, i.mac(parts[0]+"."+parts[1])) {
+		return nil, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var c Claims
+	if err := json.Unmarshal(payload, &c); err != nil || c.Type != typ || c.Subject == "" {
+		return nil, ErrInvalidToken
+	}
+	if i.now().Unix() >= c.ExpiresAt {
+		return nil, ErrTokenExpired
+	}
+	return &c, nil
+}
@@ -0,0 +1,164 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorDomain 服务器在 ErrorInfo 中使用的 domain，其他 domain 的 reason 被忽略
+const errorDomain = "user.rpc-learning"
+
+// 服务器错误对应的类型，可以用 errors.Is 判断，例如 errors.Is(err, client.ErrNotFound)
+var (
+	ErrNotFound      = errors.New("user not found")
+	ErrAlreadyExists = errors.New("user already exists")
+	ErrDeleted       = errors.New("user has been deleted")
+	ErrConflict      = errors.New("user has been modified by another request")
+	// ErrUnauthenticated 邮箱或密码错误，或令牌无效、已过期
+	ErrUnauthenticated = errors.New("unauthenticated")
+	// ErrAccountLocked 连续登录失败次数过多，账号暂时被锁定
+	ErrAccountLocked = errors.New("account locked")
+	// ErrPermissionDenied 调用方的角色不允许调用该方法，或访问了其他租户
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+// FieldViolation 请求中一个不合法的字段
+type FieldViolation struct {
+	Field       string
+	Description string
+}
+
+// ValidationError 服务器以 INVALID_ARGUMENT 拒绝了请求，可以用 errors.As 取出
+type ValidationError struct {
+	Violations []FieldViolation
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		parts[i] = v.Field + ": " + v.Description
+	}
+	return "invalid argument: " + strings.Join(parts, "; ")
+}
+
+// Invalid 返回字段 field 不合法的原因，字段合法时 ok 为 false
+func (e *ValidationError) Invalid(field string) (description string, ok bool) {
+	for _, v := range e.Violations {
+		if v.Field == field {
+			return v.Description, true
+		}
+	}
+	return "", false
+}
+
+// Error 服务器返回的错误，保留gRPC状态码和错误详情
+//
+// Unwrap 返回 ErrNotFound 等错误类型或 *ValidationError，
+// GRPCStatus 返回原始状态，因此 status.Code(err) 仍然可用。
+type Error struct {
+	Op           string         // 出错的操作，例如 "create user"
+	Code         codes.Code     // gRPC 状态码
+	Message      string         // 服务器的错误信息
+	Reason       pb.ErrorReason // ErrorInfo 中的 reason，服务器没有提供时为 ERROR_REASON_UNSPECIFIED
+	Metadata     map[string]string
+	ResourceType string // ResourceInfo 中的资源类型，例如 "user"
+	ResourceName string // ResourceInfo 中的资源名，例如 "users/1"
+
+	status *status.Status
+	kind   error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("failed to %s: %v", e.Op, e.status.Err())
+}
+
+func (e *Error) Unwrap() error {
+	return e.kind
+}
+
+// GRPCStatus 返回服务器返回的原始状态
+func (e *Error) GRPCStatus() *status.Status {
+	return e.status
+}
+
+// rpcError 把 op 调用返回的gRPC错误转换为 *Error，其他错误原样包装
+func rpcError(op string, err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return fmt.Errorf("failed to %s: %w", op, err)
+	}
+
+	e := &Error{Op: op, Code: st.Code(), Message: st.Message(), status: st}
+	var violations []FieldViolation
+	for _, detail := range st.Details() {
+		switch d := detail.(type) {
+		case *errdetails.ErrorInfo:
+			if d.Domain == errorDomain {
+				e.Reason = pb.ErrorReason(pb.ErrorReason_value[d.Reason])
+				e.Metadata = d.Metadata
+			}
+		case *errdetails.ResourceInfo:
+			e.ResourceType, e.ResourceName = d.ResourceType, d.ResourceName
+		case *errdetails.BadRequest:
+			for _, fv := range d.FieldViolations {
+				violations = append(violations, FieldViolation{Field: fv.Field, Description: fv.Description})
+			}
+		}
+	}
+
+	switch e.Code {
+	case codes.NotFound:
+		e.kind = ErrNotFound
+	case codes.AlreadyExists:
+		e.kind = ErrAlreadyExists
+	case codes.InvalidArgument:
+		e.kind = &ValidationError{Violations: violations}
+	case codes.FailedPrecondition:
+		if e.Reason == pb.ErrorReason_USER_DELETED {
+			e.kind = ErrDeleted
+		}
+	case codes.Aborted:
+		if e.Reason != pb.ErrorReason_BATCH_ABORTED {
+			e.kind = ErrConflict
+		}
+	case codes.OutOfRange:
+		switch e.Reason {
+		case pb.ErrorReason_REVISION_COMPACTED:
+			e.kind = ErrCompacted
+		case pb.ErrorReason_REVISION_NOT_REACHED:
+			e.kind = ErrRevisionNotReached
+		}
+	case codes.Unauthenticated:
+		e.kind = ErrUnauthenticated
+	case codes.PermissionDenied:
+		e.kind = ErrPermissionDenied
+	case codes.ResourceExhausted:
+		if e.Reason == pb.ErrorReason_ACCOUNT_LOCKED {
+			e.kind = ErrAccountLocked
+		}
+	case codes.DeadlineExceeded:
+		e.kind = context.DeadlineExceeded
+	case codes.Canceled:
+		e.kind = context.Canceled
+	}
+	return e
+}
+
+// BatchItemError 把批量接口中单个条目的状态转换为错误，成功时返回 nil
+//
+// 返回的错误与单条接口的错误一样可以用 errors.Is/errors.As 判断。
+func BatchItemError(s *pb.BatchStatus) error {
+	if s.GetCode() == int32(codes.OK) {
+		return nil
+	}
+	st := status.FromProto(&spb.Status{Code: s.Code, Message: s.Message, Details: s.Details})
+	return rpcError("process batch item", st.Err())
+}
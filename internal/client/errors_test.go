@@ -0,0 +1,168 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/liverlong/rpc-learning/internal/server"
+	"github.com/liverlong/rpc-learning/internal/store"
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestUserClient 创建连接到内存中用户服务的客户端，opts 用于配置测试服务器
+func newTestUserClient(t *testing.T, opts ...grpc.ServerOption) *UserClient {
+	t.Helper()
+
+	dialer := serveTestServer(t, server.NewUserServer(store.NewMemoryStore()), opts...)
+	c, err := NewUserClient("passthrough:///bufnet", WithDialOptions(dialer))
+	if err != nil {
+		t.Fatalf("Failed to dial test server: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// serveTestServer 在内存连接上运行 userServer，返回连接它所需的 dial 选项
+func serveTestServer(t *testing.T, userServer *server.UserServer, opts ...grpc.ServerOption) grpc.DialOption {
+	t.Helper()
+
+	lis := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer(opts...)
+	pb.RegisterUserServiceServer(s, userServer)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	return grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	})
+}
+
+func TestUserClient_TypedErrors(t *testing.T) {
+	c := newTestUserClient(t)
+
+	user, err := c.CreateUser("张三", "zhangsan@example.com", 25, "")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+
+	_, err = c.GetUser(999)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetUser(999) error = %v, want ErrNotFound", err)
+	}
+	var rpcErr *Error
+	if !errors.As(err, &rpcErr) {
+		t.Fatalf("GetUser(999) error %T is not *Error", err)
+	}
+	if rpcErr.Reason != pb.ErrorReason_USER_NOT_FOUND || rpcErr.ResourceName != "users/999" {
+		t.Errorf("GetUser(999) reason = %v, resource = %q", rpcErr.Reason, rpcErr.ResourceName)
+	}
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("status.Code(err) = %v, want NotFound", status.Code(err))
+	}
+
+	_, err = c.CreateUser("李四", "ZhangSan@example.com", 30, "")
+	if !errors.Is(err, ErrAlreadyExists) || !errors.As(err, &rpcErr) || rpcErr.Reason != pb.ErrorReason_EMAIL_ALREADY_EXISTS {
+		t.Errorf("CreateUser() with duplicate email error = %v, want ErrAlreadyExists", err)
+	}
+
+	_, err = c.CreateUser("", "bad", 200, "")
+	var validation *ValidationError
+	if !errors.As(err, &validation) {
+		t.Fatalf("CreateUser() with invalid fields error = %v, want *ValidationError", err)
+	}
+	for _, field := range []string{"name", "email", "age"} {
+		if _, ok := validation.Invalid(field); !ok {
+			t.Errorf("ValidationError.Invalid(%q) = false, violations = %v", field, validation.Violations)
+		}
+	}
+	if _, ok := validation.Invalid("phone"); ok {
+		t.Errorf("ValidationError.Invalid(\"phone\") = true for an empty phone")
+	}
+
+	if err := c.DeleteUserAtVersion(user.Id, user.Version+1); !errors.Is(err, ErrConflict) {
+		t.Errorf("DeleteUserAtVersion() with stale version error = %v, want ErrConflict", err)
+	}
+	if err := c.DeleteUser(user.Id); err != nil {
+		t.Fatalf("DeleteUser() error = %v", err)
+	}
+	if _, err := c.GetUser(user.Id); !errors.Is(err, ErrDeleted) || errors.Is(err, ErrNotFound) {
+		t.Errorf("GetUser() after delete error = %v, want ErrDeleted", err)
+	}
+
+	// 批量接口中每个条目的状态可以转换为同样的错误
+	results, err := c.BatchGetUsers([]int64{user.Id, 999, 0})
+	if err != nil {
+		t.Fatalf("BatchGetUsers() error = %v", err)
+	}
+	if err := BatchItemError(results[1].Status); !errors.Is(err, ErrNotFound) {
+		t.Errorf("BatchItemError(results[1]) = %v, want ErrNotFound", err)
+	}
+	if err := BatchItemError(results[2].Status); !errors.As(err, &validation) {
+		t.Errorf("BatchItemError(results[2]) = %v, want *ValidationError", err)
+	}
+
+	created, err := c.BatchCreateUsers([]*pb.CreateUserRequest{
+		{Name: "王五", Email: "wangwu@example.com"},
+		{Name: "赵六", Email: "bad"},
+	}, true)
+	if err != nil {
+		t.Fatalf("BatchCreateUsers() error = %v", err)
+	}
+	if err := BatchItemError(created[0].Status); err == nil || errors.Is(err, ErrConflict) {
+		t.Errorf("BatchItemError(skipped item) = %v, want a non-conflict error", err)
+	}
+	if err := BatchItemError(&pb.BatchStatus{}); err != nil {
+		t.Errorf("BatchItemError(OK) = %v, want nil", err)
+	}
+
+	// OUT_OF_RANGE 按 reason 区分已压缩和尚未产生的 revision
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ignore := func(*pb.UserEvent) error { return nil }
+	if err := c.WatchUsers(ctx, 1, ignore); !errors.Is(err, ErrCompacted) || errors.Is(err, ErrRevisionNotReached) {
+		t.Errorf("WatchUsers(compacted revision) error = %v, want ErrCompacted", err)
+	}
+	if err := c.WatchUsers(ctx, 1<<62, ignore); !errors.Is(err, ErrRevisionNotReached) || errors.Is(err, ErrCompacted) {
+		t.Errorf("WatchUsers(future revision) error = %v, want ErrRevisionNotReached", err)
+	}
+}
+
+func TestUserClient_RetryWithRequestID(t *testing.T) {
+	// 服务器执行了第一次 CreateUser，但响应“丢失”，客户端只看到 UNAVAILABLE
+	var calls, dropped int
+	dropFirst := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		resp, err := handler(ctx, req)
+		if info.FullMethod != pb.UserService_CreateUser_FullMethodName {
+			return resp, err
+		}
+		calls++
+		if dropped == 0 && err == nil {
+			dropped++
+			return nil, status.Error(codes.Unavailable, "connection reset")
+		}
+		return resp, err
+	}
+	c := newTestUserClient(t, grpc.UnaryInterceptor(dropFirst))
+
+	user, err := c.CreateUser("张三", "zhangsan@example.com", 25, "")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v, want the retried response", err)
+	}
+	if calls != 2 {
+		t.Errorf("CreateUser() calls = %d, want 2", calls)
+	}
+	users, total, err := c.ListUsers(1, 10)
+	if err != nil {
+		t.Fatalf("ListUsers() error = %v", err)
+	}
+	if total != 1 || users[0].Id != user.Id {
+		t.Errorf("ListUsers() = %v, want only user %d", users, user.Id)
+	}
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+// tenantHeader 多租户服务器从请求元数据中读取租户ID的键
+const tenantHeader = "x-tenant-id"
+
+// Option 配置 UserClient 的可选参数
+type Option func(*options)
+
+type options struct {
+	dialOptions []grpc.DialOption
+	transport   credentials.TransportCredentials
+}
+
+// WithDialOptions 追加建立连接时使用的 gRPC 选项，例如 grpc.WithContextDialer
+func WithDialOptions(opts ...grpc.DialOption) Option {
+	return func(o *options) {
+		o.dialOptions = append(o.dialOptions, opts...)
+	}
+}
+
+// WithTLS 用 TLS 连接服务器，config 可以由 tlsconfig.Client 创建；不设置时使用明文连接
+func WithTLS(config *tls.Config) Option {
+	return func(o *options) {
+		o.transport = credentials.NewTLS(config)
+	}
+}
+
+// WithTenant 在每个请求的元数据 x-tenant-id 中带上租户ID，连接多租户服务器时必须设置
+func WithTenant(tenant string) Option {
+	return WithDialOptions(
+		grpc.WithChainUnaryInterceptor(func(ctx context.Context, method string, req, reply any,
+			cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			return invoker(metadata.AppendToOutgoingContext(ctx, tenantHeader, tenant), method, req, reply, cc, opts...)
+		}),
+		grpc.WithChainStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc,
+			cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			return streamer(metadata.AppendToOutgoingContext(ctx, tenantHeader, tenant), desc, cc, method, opts...)
+		}),
+	)
+}
+
+// WithPerRPCCredentials 为每个请求附加 creds 提供的凭据
+func WithPerRPCCredentials(creds credentials.PerRPCCredentials) Option {
+	return WithDialOptions(grpc.WithPerRPCCredentials(creds))
+}
+
+// WithBearerToken 在每个请求的元数据中带上 authorization: Bearer <token>，
+// token 可以是 Authenticate 返回的访问令牌，也可以是服务的 API key
+func WithBearerToken(token string) Option {
+	return WithPerRPCCredentials(bearerToken(token))
+}
+
+// bearerToken 固定的 Bearer 凭据
+type bearerToken string
+
+func (t bearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+// RequireTransportSecurity 返回 false，以便在本地的明文连接上使用；生产环境应同时使用 WithTLS
+func (t bearerToken) RequireTransportSecurity() bool {
+	return false
+}
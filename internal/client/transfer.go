@@ -0,0 +1,267 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// UserReader 逐条读取待导入的用户，读完时返回 io.EOF
+type UserReader interface {
+	Read() (*pb.CreateUserRequest, error)
+}
+
+// UserWriter 逐条写出导出的用户，全部写完后调用 Flush
+type UserWriter interface {
+	Write(user *pb.User) error
+	Flush() error
+}
+
+// ImportUsers 把 src 中的全部记录通过 ImportUsers 流发送给服务器，返回服务器的汇总结果
+//
+// 单条记录创建失败不会中断导入，失败的行在响应的 Errors 中；
+// src 读取出错时中止导入并返回该错误，此前发送的记录已经创建。
+func (c *UserClient) ImportUsers(ctx context.Context, src UserReader) (*pb.ImportUsersResponse, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := c.client.ImportUsers(ctx)
+	if err != nil {
+		return nil, rpcError("start import", err)
+	}
+
+	for row := 1; ; row++ {
+		req, err := src.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read record %d: %v", row, err)
+		}
+		if err := stream.Send(req); err != nil {
+			// 服务器已关闭流，真正的错误由 CloseAndRecv 返回
+			if err == io.EOF {
+				break
+			}
+			return nil, rpcError(fmt.Sprintf("send record %d", row), err)
+		}
+	}
+
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return nil, rpcError("import users", err)
+	}
+
+	log.Printf("导入用户完成: %s", resp.Message)
+	return resp, nil
+}
+
+// ExportUsers 通过 ExportUsers 流接收用户并写入 dst，返回导出的用户数
+func (c *UserClient) ExportUsers(ctx context.Context, req *pb.ExportUsersRequest, dst UserWriter) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := c.client.ExportUsers(ctx, req)
+	if err != nil {
+		return 0, rpcError("start export", err)
+	}
+
+	count := 0
+	for {
+		user, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, rpcError("export users", err)
+		}
+		if err := dst.Write(user); err != nil {
+			return count, fmt.Errorf("failed to write user %d: %v", user.Id, err)
+		}
+		count++
+	}
+	if err := dst.Flush(); err != nil {
+		return count, fmt.Errorf("failed to write users: %v", err)
+	}
+
+	log.Printf("导出用户完成: 共%d个用户", count)
+	return count, nil
+}
+
+// csvColumns 导出CSV的列，导入时只读取其中的 name、email、age、phone，其他列被忽略
+var csvColumns = []string{"id", "name", "email", "age", "phone", "created_at", "updated_at", "version", "deleted_at"}
+
+// csvUserReader 从带表头的CSV读取用户
+type csvUserReader struct {
+	r       *csv.Reader
+	columns map[string]int
+}
+
+// NewCSVUserReader 创建CSV读取器
+//
+// 第一行必须是表头，至少包含 name 和 email 列，列的顺序不限，
+// 因此 NewCSVUserWriter 导出的文件可以直接再导入。
+func NewCSVUserReader(r io.Reader) UserReader {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	return &csvUserReader{r: cr}
+}
+
+func (c *csvUserReader) Read() (*pb.CreateUserRequest, error) {
+	if c.columns == nil {
+		header, err := c.r.Read()
+		if err != nil {
+			if err == io.EOF {
+				return nil, fmt.Errorf("missing CSV header")
+			}
+			return nil, err
+		}
+		c.columns = make(map[string]int, len(header))
+		for i, name := range header {
+			c.columns[strings.ToLower(strings.TrimSpace(name))] = i
+		}
+		for _, required := range []string{"name", "email"} {
+			if _, ok := c.columns[required]; !ok {
+				return nil, fmt.Errorf("CSV header has no %q column", required)
+			}
+		}
+	}
+
+	record, err := c.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	field := func(name string) string {
+		if i, ok := c.columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	req := &pb.CreateUserRequest{
+		Name:  field("name"),
+		Email: field("email"),
+		Phone: field("phone"),
+	}
+	if age := field("age"); age != "" {
+		n, err := strconv.ParseInt(age, 10, 32)
+		if err != nil {
+			line, _ := c.r.FieldPos(c.columns["age"])
+			return nil, fmt.Errorf("line %d: invalid age %q", line, age)
+		}
+		req.Age = int32(n)
+	}
+	return req, nil
+}
+
+// csvUserWriter 把用户写为CSV，第一行是表头
+type csvUserWriter struct {
+	w           *csv.Writer
+	wroteHeader bool
+}
+
+// NewCSVUserWriter 创建CSV写入器，列见 csvColumns
+func NewCSVUserWriter(w io.Writer) UserWriter {
+	return &csvUserWriter{w: csv.NewWriter(w)}
+}
+
+func (c *csvUserWriter) Write(user *pb.User) error {
+	if !c.wroteHeader {
+		if err := c.w.Write(csvColumns); err != nil {
+			return err
+		}
+		c.wroteHeader = true
+	}
+	return c.w.Write([]string{
+		strconv.FormatInt(user.Id, 10),
+		user.Name,
+		user.Email,
+		strconv.FormatInt(int64(user.Age), 10),
+		user.Phone,
+		strconv.FormatInt(user.CreatedAt, 10),
+		strconv.FormatInt(user.UpdatedAt, 10),
+		strconv.FormatInt(user.Version, 10),
+		strconv.FormatInt(user.DeletedAt, 10),
+	})
+}
+
+func (c *csvUserWriter) Flush() error {
+	if !c.wroteHeader {
+		if err := c.w.Write(csvColumns); err != nil {
+			return err
+		}
+		c.wroteHeader = true
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// jsonlUserReader 从每行一个JSON对象的文件读取用户
+type jsonlUserReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+// NewJSONLUserReader 创建JSONL读取器
+//
+// 每行是一个 CreateUserRequest 的JSON（字段名使用 proto 中的名字），空行被跳过，
+// 未知字段被忽略，因此 NewJSONLUserWriter 导出的文件可以直接再导入。
+func NewJSONLUserReader(r io.Reader) UserReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	return &jsonlUserReader{scanner: scanner}
+}
+
+func (j *jsonlUserReader) Read() (*pb.CreateUserRequest, error) {
+	for j.scanner.Scan() {
+		j.line++
+		line := bytes.TrimSpace(j.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		req := &pb.CreateUserRequest{}
+		if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(line, req); err != nil {
+			return nil, fmt.Errorf("line %d: %v", j.line, err)
+		}
+		return req, nil
+	}
+	if err := j.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// jsonlUserWriter 把每个用户写为一行JSON
+type jsonlUserWriter struct {
+	w *bufio.Writer
+}
+
+// NewJSONLUserWriter 创建JSONL写入器
+func NewJSONLUserWriter(w io.Writer) UserWriter {
+	return &jsonlUserWriter{w: bufio.NewWriter(w)}
+}
+
+func (j *jsonlUserWriter) Write(user *pb.User) error {
+	line, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(user)
+	if err != nil {
+		return err
+	}
+	if _, err := j.w.Write(line); err != nil {
+		return err
+	}
+	return j.w.WriteByte('\n')
+}
+
+func (j *jsonlUserWriter) Flush() error {
+	return j.w.Flush()
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+	"google.golang.org/protobuf/proto"
+)
+
+// readAll 读出 src 中的全部记录
+func readAll(t *testing.T, src UserReader) ([]*pb.CreateUserRequest, error) {
+	t.Helper()
+	var reqs []*pb.CreateUserRequest
+	for {
+		req, err := src.Read()
+		if err == io.EOF {
+			return reqs, nil
+		}
+		if err != nil {
+			return reqs, err
+		}
+		reqs = append(reqs, req)
+	}
+}
+
+func TestUserReaders(t *testing.T) {
+	want := []*pb.CreateUserRequest{
+		{Name: "张三", Email: "zhangsan@example.com", Age: 25, Phone: "13800138001"},
+		{Name: "李四, Jr.", Email: "lisi@example.com"},
+	}
+
+	tests := []struct {
+		name    string
+		newRead func(io.Reader) UserReader
+		input   string
+		wantErr string
+	}{
+		{
+			name:    "csv with reordered and extra columns",
+			newRead: NewCSVUserReader,
+			input:   "email,name,nickname,age,phone\nzhangsan@example.com,张三,小张,25,13800138001\nlisi@example.com,\"李四, Jr.\",,,\n",
+		},
+		{
+			name:    "csv missing email column",
+			newRead: NewCSVUserReader,
+			input:   "name,age\n张三,25\n",
+			wantErr: `no "email" column`,
+		},
+		{
+			name:    "csv invalid age",
+			newRead: NewCSVUserReader,
+			input:   "name,email,age\n张三,zhangsan@example.com,二十五\n",
+			wantErr: "line 2: invalid age",
+		},
+		{
+			name:    "jsonl with blank lines and unknown fields",
+			newRead: NewJSONLUserReader,
+			input:   `{"name":"张三","email":"zhangsan@example.com","age":25,"phone":"13800138001","id":"7"}` + "\n\n" + `{"name":"李四, Jr.","email":"lisi@example.com"}`,
+		},
+		{
+			name:    "jsonl malformed line",
+			newRead: NewJSONLUserReader,
+			input:   `{"name":"张三","email":"zhangsan@example.com"}` + "\n{oops\n",
+			wantErr: "line 2:",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readAll(t, tt.newRead(strings.NewReader(tt.input)))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Read() error = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Read() error = %v", err)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("Read() returned %d records, want %d", len(got), len(want))
+			}
+			for i := range want {
+				if !proto.Equal(got[i], want[i]) {
+					t.Errorf("record %d = %v, want %v", i, got[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestUserWriters_RoundTrip(t *testing.T) {
+	users := []*pb.User{
+		{Id: 1, Name: "张三", Email: "zhangsan@example.com", Age: 25, Phone: "13800138001", CreatedAt: 1700000000, Version: 2},
+		{Id: 2, Name: "李四, \"Jr.\"", Email: "lisi@example.com", DeletedAt: 1700000100},
+	}
+
+	formats := []struct {
+		name     string
+		newWrite func(io.Writer) UserWriter
+		newRead  func(io.Reader) UserReader
+	}{
+		{name: "csv", newWrite: NewCSVUserWriter, newRead: NewCSVUserReader},
+		{name: "jsonl", newWrite: NewJSONLUserWriter, newRead: NewJSONLUserReader},
+	}
+
+	for _, f := range formats {
+		t.Run(f.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := f.newWrite(&buf)
+			for _, u := range users {
+				if err := w.Write(u); err != nil {
+					t.Fatalf("Write() error = %v", err)
+				}
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatalf("Flush() error = %v", err)
+			}
+
+			got, err := readAll(t, f.newRead(&buf))
+			if err != nil {
+				t.Fatalf("Read() error = %v", err)
+			}
+			if len(got) != len(users) {
+				t.Fatalf("Read() returned %d records, want %d", len(got), len(users))
+			}
+			for i, u := range users {
+				want := &pb.CreateUserRequest{Name: u.Name, Email: u.Email, Age: u.Age, Phone: u.Phone}
+				if !proto.Equal(got[i], want) {
+					t.Errorf("record %d = %v, want %v", i, got[i], want)
+				}
+			}
+		})
+	}
+}
@@ -2,15 +2,28 @@ package client
 
 import (
 	"context"
+	"crypto/rand"
 	"fmt"
 	"log"
 	"time"
 
 	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 )
 
+// maxModifyAttempts ModifyUser 遇到版本冲突时的最大尝试次数
+const maxModifyAttempts = 5
+
+// batchTimeout 批量请求的超时时间，一个批量请求最多包含1000个条目
+const batchTimeout = 30 * time.Second
+
+// maxRetryAttempts 带 request_id 的修改请求在超时或服务器不可用时的最大尝试次数
+const maxRetryAttempts = 3
+
 // UserClient 用户服务客户端
 type UserClient struct {
 	conn   *grpc.ClientConn
@@ -18,9 +31,19 @@ type UserClient struct {
 }
 
 // NewUserClient 创建新的用户服务客户端
-func NewUserClient(serverAddr string) (*UserClient, error) {
+func NewUserClient(serverAddr string, opts ...Option) (*UserClient, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	// 建立连接
-	conn, err := grpc.Dial(serverAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	transport := o.transport
+	if transport == nil {
+		transport = insecure.NewCredentials()
+	}
+	dialOptions := append([]grpc.DialOption{grpc.WithTransportCredentials(transport)}, o.dialOptions...)
+	conn, err := grpc.Dial(serverAddr, dialOptions...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to server: %v", err)
 	}
@@ -40,20 +63,22 @@ func (c *UserClient) Close() error {
 }
 
 // CreateUser 创建用户
+//
+// 请求带有随机的 request_id，超时或服务器不可用时用同一个 request_id 重试，不会重复创建。
 func (c *UserClient) CreateUser(name, email string, age int32, phone string) (*pb.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
 	req := &pb.CreateUserRequest{
-		Name:  name,
-		Email: email,
-		Age:   age,
-		Phone: phone,
+		Name:      name,
+		Email:     email,
+		Age:       age,
+		Phone:     phone,
+		RequestId: newRequestID(),
 	}
 
-	resp, err := c.client.CreateUser(ctx, req)
+	resp, err := retry(func(ctx context.Context) (*pb.CreateUserResponse, error) {
+		return c.client.CreateUser(ctx, req)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to create user: %v", err)
+		return nil, rpcError("create user", err)
 	}
 
 	log.Printf("创建用户成功: %s", resp.Message)
@@ -69,51 +94,228 @@ func (c *UserClient) GetUser(id int64) (*pb.User, error) {
 
 	resp, err := c.client.GetUser(ctx, req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get user: %v", err)
+		return nil, rpcError("get user", err)
 	}
 
 	log.Printf("获取用户成功: %s", resp.Message)
 	return resp.User, nil
 }
 
-// UpdateUser 更新用户
-func (c *UserClient) UpdateUser(id int64, name, email string, age int32, phone string) (*pb.User, error) {
+// GetUserByUID 按字符串ID获取用户，服务器使用 ulid 或 uuidv7 ID生成器时可用
+func (c *UserClient) GetUserByUID(uid string) (*pb.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &pb.GetUserRequest{Uid: uid}
+
+	resp, err := c.client.GetUser(ctx, req)
+	if err != nil {
+		return nil, rpcError("get user", err)
+	}
+
+	log.Printf("获取用户成功: %s", resp.Message)
+	return resp.User, nil
+}
+
+// GetUserByEmail 按邮箱获取用户
+func (c *UserClient) GetUserByEmail(email string) (*pb.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &pb.GetUserByEmailRequest{Email: email}
+
+	resp, err := c.client.GetUserByEmail(ctx, req)
+	if err != nil {
+		return nil, rpcError("get user by email", err)
+	}
+
+	log.Printf("按邮箱获取用户成功: %s", resp.Message)
+	return resp.User, nil
+}
+
+// GetUserByPhone 按手机号获取用户
+func (c *UserClient) GetUserByPhone(phone string) (*pb.User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	req := &pb.GetUserByPhoneRequest{Phone: phone}
+
+	resp, err := c.client.GetUserByPhone(ctx, req)
+	if err != nil {
+		return nil, rpcError("get user by phone", err)
+	}
+
+	log.Printf("按手机号获取用户成功: %s", resp.Message)
+	return resp.User, nil
+}
+
+// UpdateUser 更新用户
+func (c *UserClient) UpdateUser(id int64, name, email string, age int32, phone string) (*pb.User, error) {
 	req := &pb.UpdateUserRequest{
-		Id:    id,
-		Name:  name,
-		Email: email,
-		Age:   age,
-		Phone: phone,
+		Id:        id,
+		Name:      name,
+		Email:     email,
+		Age:       age,
+		Phone:     phone,
+		RequestId: newRequestID(),
 	}
 
-	resp, err := c.client.UpdateUser(ctx, req)
+	resp, err := retry(func(ctx context.Context) (*pb.UpdateUserResponse, error) {
+		return c.client.UpdateUser(ctx, req)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to update user: %v", err)
+		return nil, rpcError("update user", err)
 	}
 
 	log.Printf("更新用户成功: %s", resp.Message)
 	return resp.User, nil
 }
 
+// UpdateUserFields 只更新 paths 中列出的字段，值取自 user
+//
+// 列出的字段按 user 中的值原样写入，因此可以把手机号清空或把年龄设为 0，
+// 例如 UpdateUserFields(id, &pb.User{}, "phone") 会清空手机号。
+// 可用字段为 name、email、age、phone，"*" 表示全部。
+func (c *UserClient) UpdateUserFields(id int64, user *pb.User, paths ...string) (*pb.User, error) {
+	req := &pb.UpdateUserRequest{
+		Id:         id,
+		Name:       user.GetName(),
+		Email:      user.GetEmail(),
+		Age:        user.GetAge(),
+		Phone:      user.GetPhone(),
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: paths},
+		RequestId:  newRequestID(),
+	}
+
+	resp, err := retry(func(ctx context.Context) (*pb.UpdateUserResponse, error) {
+		return c.client.UpdateUser(ctx, req)
+	})
+	if err != nil {
+		return nil, rpcError("update user", err)
+	}
+
+	log.Printf("更新用户成功: %s", resp.Message)
+	return resp.User, nil
+}
+
+// retry 调用 call，超时或服务器不可用时重试，最多 maxRetryAttempts 次，每次调用单独计算5秒超时
+//
+// 只用于带 request_id 的请求：服务器已经执行过的请求会返回第一次的响应，重试不会重复修改。
+func retry[Resp any](call func(ctx context.Context) (Resp, error)) (Resp, error) {
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		resp, err := call(ctx)
+		cancel()
+
+		code := status.Code(err)
+		if (code != codes.DeadlineExceeded && code != codes.Unavailable) || attempt == maxRetryAttempts {
+			return resp, err
+		}
+		log.Printf("请求失败，重试 (%d/%d): %v", attempt, maxRetryAttempts, err)
+		time.Sleep(time.Duration(attempt) * 200 * time.Millisecond)
+	}
+}
+
+// newRequestID 生成随机的 request_id（UUID 第4版格式）
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err) // crypto/rand 不会失败
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// ModifyUser 以“读取-修改-写回”的方式更新用户
+//
+// modify 在最新读到的用户副本上修改字段，写回时带上读到的版本号；
+// 如果期间用户被其他请求修改（服务端返回 ABORTED），会重新读取并再次调用 modify，
+// 最多尝试 maxModifyAttempts 次。modify 返回错误时立即放弃。
+// 写回时带上完整的 update_mask，modify 中清空的字段也会被写入。
+func (c *UserClient) ModifyUser(id int64, modify func(user *pb.User) error) (*pb.User, error) {
+	var lastErr error
+	for attempt := 1; attempt <= maxModifyAttempts; attempt++ {
+		user, err := c.GetUser(id)
+		if err != nil {
+			return nil, err
+		}
+		if err := modify(user); err != nil {
+			return nil, err
+		}
+
+		req := &pb.UpdateUserRequest{
+			Id:              id,
+			Name:            user.Name,
+			Email:           user.Email,
+			Age:             user.Age,
+			Phone:           user.Phone,
+			ExpectedVersion: user.Version,
+			UpdateMask:      &fieldmaskpb.FieldMask{Paths: []string{"*"}},
+			RequestId:       newRequestID(),
+		}
+		resp, err := retry(func(ctx context.Context) (*pb.UpdateUserResponse, error) {
+			return c.client.UpdateUser(ctx, req)
+		})
+		if err == nil {
+			log.Printf("更新用户成功: %s", resp.Message)
+			return resp.User, nil
+		}
+		if status.Code(err) != codes.Aborted {
+			return nil, rpcError("update user", err)
+		}
+
+		lastErr = err
+		log.Printf("用户 %d 版本冲突，重试 (%d/%d)", id, attempt, maxModifyAttempts)
+	}
+	return nil, rpcError(fmt.Sprintf("update user after %d attempts", maxModifyAttempts), lastErr)
+}
+
 // DeleteUser 删除用户
 func (c *UserClient) DeleteUser(id int64) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	req := &pb.DeleteUserRequest{Id: id, RequestId: newRequestID()}
 
-	req := &pb.DeleteUserRequest{Id: id}
+	resp, err := retry(func(ctx context.Context) (*pb.DeleteUserResponse, error) {
+		return c.client.DeleteUser(ctx, req)
+	})
+	if err != nil {
+		return rpcError("delete user", err)
+	}
+
+	log.Printf("删除用户成功: %s", resp.Message)
+	return nil
+}
 
-	resp, err := c.client.DeleteUser(ctx, req)
+// DeleteUserAtVersion 仅当用户当前版本等于 version 时删除用户
+func (c *UserClient) DeleteUserAtVersion(id, version int64) error {
+	req := &pb.DeleteUserRequest{Id: id, ExpectedVersion: version, RequestId: newRequestID()}
+
+	resp, err := retry(func(ctx context.Context) (*pb.DeleteUserResponse, error) {
+		return c.client.DeleteUser(ctx, req)
+	})
 	if err != nil {
-		return fmt.Errorf("failed to delete user: %v", err)
+		return rpcError("delete user", err)
 	}
 
 	log.Printf("删除用户成功: %s", resp.Message)
 	return nil
 }
 
+// UndeleteUser 恢复已删除的用户
+func (c *UserClient) UndeleteUser(id int64) (*pb.User, error) {
+	req := &pb.UndeleteUserRequest{Id: id, RequestId: newRequestID()}
+
+	resp, err := retry(func(ctx context.Context) (*pb.UndeleteUserResponse, error) {
+		return c.client.UndeleteUser(ctx, req)
+	})
+	if err != nil {
+		return nil, rpcError("undelete user", err)
+	}
+
+	log.Printf("恢复用户成功: %s", resp.Message)
+	return resp.User, nil
+}
+
 // ListUsers 列出用户
 func (c *UserClient) ListUsers(page, pageSize int32) ([]*pb.User, int32, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -126,19 +328,222 @@ func (c *UserClient) ListUsers(page, pageSize int32) ([]*pb.User, int32, error)
 
 	resp, err := c.client.ListUsers(ctx, req)
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to list users: %v", err)
+		return nil, 0, rpcError("list users", err)
 	}
 
 	log.Printf("获取用户列表成功: %s", resp.Message)
 	return resp.Users, resp.Total, nil
 }
 
+// ListUsersPage 使用翻页令牌列出用户，返回本页用户和下一页的令牌
+//
+// 首次调用 pageToken 传空字符串，返回的令牌为空表示没有更多结果。
+func (c *UserClient) ListUsersPage(pageSize int32, pageToken string) ([]*pb.User, string, error) {
+	return c.ListUsersFiltered("", "", pageSize, pageToken)
+}
+
+// ListUsersFiltered 按过滤表达式和排序字段列出用户，返回本页用户和下一页的令牌
+//
+// filter 和 order_by 的语法见 api/proto/user.proto 中的 ListUsersRequest。
+// 翻页时 filter 和 orderBy 必须与首次请求一致。
+func (c *UserClient) ListUsersFiltered(filter, orderBy string, pageSize int32, pageToken string) ([]*pb.User, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &pb.ListUsersRequest{
+		PageSize:  pageSize,
+		PageToken: pageToken,
+		Filter:    filter,
+		OrderBy:   orderBy,
+	}
+
+	resp, err := c.client.ListUsers(ctx, req)
+	if err != nil {
+		return nil, "", rpcError("list users", err)
+	}
+
+	log.Printf("获取用户列表成功: %s", resp.Message)
+	return resp.Users, resp.NextPageToken, nil
+}
+
+// SearchUsers 按姓名、邮箱或手机号片段搜索用户，结果按相关度排序
+func (c *UserClient) SearchUsers(query string, limit int32) ([]*pb.SearchResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &pb.SearchUsersRequest{
+		Query:    query,
+		PageSize: limit,
+	}
+
+	resp, err := c.client.SearchUsers(ctx, req)
+	if err != nil {
+		return nil, rpcError("search users", err)
+	}
+
+	log.Printf("搜索用户成功: %s", resp.Message)
+	return resp.Results, nil
+}
+
+// BatchCreateUsers 批量创建用户，返回与 reqs 一一对应的结果
+//
+// 每个结果的 Status.Code 为 0 表示创建成功。atomic 为 true 时任一条目失败则全部不生效，
+// 失败的条目返回原因，其余条目返回 ABORTED。
+func (c *UserClient) BatchCreateUsers(reqs []*pb.CreateUserRequest, atomic bool) ([]*pb.BatchCreateUserResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), batchTimeout)
+	defer cancel()
+
+	req := &pb.BatchCreateUsersRequest{
+		Requests: reqs,
+		Atomic:   atomic,
+	}
+
+	resp, err := c.client.BatchCreateUsers(ctx, req)
+	if err != nil {
+		return nil, rpcError("batch create users", err)
+	}
+
+	log.Printf("批量创建用户: %s", resp.Message)
+	return resp.Results, nil
+}
+
+// BatchGetUsers 批量获取用户，返回与 ids 一一对应的结果
+func (c *UserClient) BatchGetUsers(ids []int64) ([]*pb.BatchGetUserResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), batchTimeout)
+	defer cancel()
+
+	resp, err := c.client.BatchGetUsers(ctx, &pb.BatchGetUsersRequest{Ids: ids})
+	if err != nil {
+		return nil, rpcError("batch get users", err)
+	}
+
+	log.Printf("批量获取用户: %s", resp.Message)
+	return resp.Results, nil
+}
+
+// BatchDeleteUsers 批量删除用户，返回与 ids 一一对应的结果，atomic 的语义与 BatchCreateUsers 相同
+func (c *UserClient) BatchDeleteUsers(ids []int64, atomic bool) ([]*pb.BatchDeleteUserResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), batchTimeout)
+	defer cancel()
+
+	req := &pb.BatchDeleteUsersRequest{Atomic: atomic}
+	for _, id := range ids {
+		req.Requests = append(req.Requests, &pb.DeleteUserRequest{Id: id})
+	}
+
+	resp, err := c.client.BatchDeleteUsers(ctx, req)
+	if err != nil {
+		return nil, rpcError("batch delete users", err)
+	}
+
+	log.Printf("批量删除用户: %s", resp.Message)
+	return resp.Results, nil
+}
+
+// ListAuditEvents 查询审计记录，返回本页记录和下一页的令牌
+//
+// 查询条件见 api/proto/user.proto 中的 ListAuditEventsRequest，翻页时把令牌填入 req.PageToken。
+func (c *UserClient) ListAuditEvents(req *pb.ListAuditEventsRequest) ([]*pb.AuditEvent, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := c.client.ListAuditEvents(ctx, req)
+	if err != nil {
+		return nil, "", rpcError("list audit events", err)
+	}
+
+	log.Printf("查询审计记录成功: %s", resp.Message)
+	return resp.Events, resp.NextPageToken, nil
+}
+
+// SetPassword 设置或修改用户的密码，用户已有密码时 currentPassword 必须是当前密码
+func (c *UserClient) SetPassword(id int64, password, currentPassword string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &pb.SetPasswordRequest{Id: id, Password: password, CurrentPassword: currentPassword}
+
+	resp, err := c.client.SetPassword(ctx, req)
+	if err != nil {
+		return rpcError("set password", err)
+	}
+
+	log.Printf("设置密码成功: %s", resp.Message)
+	return nil
+}
+
+// SetRole 设置用户的角色，只有管理员可以调用，新角色在用户下次登录或刷新令牌后生效
+func (c *UserClient) SetRole(id int64, role pb.Role) (*pb.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &pb.SetRoleRequest{Id: id, Role: role}
+
+	resp, err := c.client.SetRole(ctx, req)
+	if err != nil {
+		return nil, rpcError("set role", err)
+	}
+
+	log.Printf("设置角色成功: %s", resp.Message)
+	return resp.User, nil
+}
+
+// Authenticate 用邮箱和密码登录，返回访问令牌和刷新令牌
+//
+// 密码错误时返回的错误满足 errors.Is(err, ErrUnauthenticated)，账号被锁定时满足 errors.Is(err, ErrAccountLocked)。
+func (c *UserClient) Authenticate(email, password string) (*pb.Tokens, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &pb.AuthenticateRequest{Email: email, Password: password}
+
+	resp, err := c.client.Authenticate(ctx, req)
+	if err != nil {
+		return nil, rpcError("authenticate", err)
+	}
+
+	log.Printf("登录成功: %s", resp.User.GetEmail())
+	return resp.Tokens, nil
+}
+
+// RefreshToken 用刷新令牌换取新的一对令牌
+func (c *UserClient) RefreshToken(refreshToken string) (*pb.Tokens, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &pb.RefreshTokenRequest{RefreshToken: refreshToken}
+
+	resp, err := c.client.RefreshToken(ctx, req)
+	if err != nil {
+		return nil, rpcError("refresh token", err)
+	}
+
+	log.Printf("刷新令牌成功: %s", resp.Message)
+	return resp.Tokens, nil
+}
+
+// ListTenants 列出多租户服务器中的全部租户及其用量
+func (c *UserClient) ListTenants() ([]*pb.TenantUsage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := c.client.ListTenants(ctx, &pb.ListTenantsRequest{})
+	if err != nil {
+		return nil, rpcError("list tenants", err)
+	}
+
+	log.Printf("列出租户成功: %s", resp.Message)
+	return resp.Tenants, nil
+}
+
 // StartChat 启动聊天功能
+//
+// 以 userID 对应的用户加入聊天室，该用户必须存在；其他用户看到的名字取自服务器上的用户信息，username 只用于本地显示。
 func (c *UserClient) StartChat(ctx context.Context, userID int64, username string) error {
 	// 创建双向流
 	stream, err := c.client.Chat(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to start chat: %v", err)
+		return rpcError("start chat", err)
 	}
 
 	log.Printf("聊天连接已建立，用户: %s (ID: %d)", username, userID)
@@ -151,7 +556,7 @@ func (c *UserClient) StartChat(ctx context.Context, userID int64, username strin
 	}
 
 	if err := stream.Send(joinReq); err != nil {
-		return fmt.Errorf("failed to join chat: %v", err)
+		return rpcError("join chat", err)
 	}
 
 	// 启动接收消息的goroutine
@@ -0,0 +1,186 @@
+package client
+
+import (
+	"crypto/x509/pkix"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liverlong/rpc-learning/internal/auth"
+	"github.com/liverlong/rpc-learning/internal/server"
+	"github.com/liverlong/rpc-learning/internal/store"
+	"github.com/liverlong/rpc-learning/internal/tlsconfig"
+	"github.com/liverlong/rpc-learning/internal/tlsconfig/tlstest"
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+func TestUserClient_Tenant(t *testing.T) {
+	dialer := serveTestServer(t, server.NewMultiTenantServer(store.MemoryTenants{}, server.WithTenants("acme", "globex")))
+	newClient := func(opts ...Option) *UserClient {
+		c, err := NewUserClient("passthrough:///bufnet", append(opts, WithDialOptions(dialer))...)
+		if err != nil {
+			t.Fatalf("NewUserClient() error = %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	acme := newClient(WithTenant("acme"))
+	globex := newClient(WithTenant("globex"))
+
+	// 同一个邮箱可以在不同租户中分别使用
+	for _, c := range []*UserClient{acme, globex} {
+		if _, err := c.CreateUser("张三", "zhangsan@example.com", 25, ""); err != nil {
+			t.Fatalf("CreateUser() error = %v", err)
+		}
+	}
+	if _, err := acme.CreateUser("李四", "lisi@example.com", 30, ""); err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	if _, err := globex.GetUserByEmail("lisi@example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetUserByEmail() in other tenant error = %v, want ErrNotFound", err)
+	}
+
+	// 没有租户的请求被拒绝
+	var validation *ValidationError
+	if _, err := newClient().GetUser(1); !errors.As(err, &validation) {
+		t.Errorf("GetUser() without tenant error = %v, want *ValidationError", err)
+	}
+
+	tenants, err := newClient().ListTenants()
+	if err != nil {
+		t.Fatalf("ListTenants() error = %v", err)
+	}
+	if len(tenants) != 2 || tenants[0].Tenant != "acme" || tenants[0].UserCount != 2 ||
+		tenants[1].Tenant != "globex" || tenants[1].UserCount != 1 {
+		t.Errorf("ListTenants() = %v, want acme with 2 users and globex with 1", tenants)
+	}
+}
+
+func TestUserClient_Authenticate(t *testing.T) {
+	userServer := server.NewUserServer(store.NewMemoryStore(), server.WithLockout(auth.NewLockout(2, time.Minute)))
+	c, err := NewUserClient("passthrough:///bufnet", WithDialOptions(serveTestServer(t, userServer)))
+	if err != nil {
+		t.Fatalf("NewUserClient() error = %v", err)
+	}
+	defer c.Close()
+
+	user, err := c.CreateUser("张三", "zhangsan@example.com", 25, "")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	if err := c.SetPassword(user.Id, "secret-password", ""); err != nil {
+		t.Fatalf("SetPassword() error = %v", err)
+	}
+	tokens, err := c.Authenticate("zhangsan@example.com", "secret-password")
+	if err != nil {
+		t.Fatalf("Authenticate() error = %v", err)
+	}
+	if _, err := c.RefreshToken(tokens.RefreshToken); err != nil {
+		t.Errorf("RefreshToken() error = %v", err)
+	}
+
+	if _, err := c.Authenticate("zhangsan@example.com", "wrong-password"); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("Authenticate(wrong) error = %v, want ErrUnauthenticated", err)
+	}
+	if _, err := c.Authenticate("zhangsan@example.com", "wrong-password"); !errors.Is(err, ErrAccountLocked) {
+		t.Errorf("Authenticate(wrong) again error = %v, want ErrAccountLocked", err)
+	}
+}
+
+func TestUserClient_BearerToken(t *testing.T) {
+	apiKey := strings.Repeat("k", 32)
+	apiKeys, err := auth.NewAPIKeys([]auth.APIKey{{Name: "billing", Key: apiKey, Role: auth.RoleAdmin}})
+	if err != nil {
+		t.Fatalf("NewAPIKeys() error = %v", err)
+	}
+	tokens, err := auth.NewTokenIssuer([]byte(strings.Repeat("t", 32)), 0, 0)
+	if err != nil {
+		t.Fatalf("NewTokenIssuer() error = %v", err)
+	}
+	authenticator := server.NewAuthenticator(tokens, apiKeys, server.DefaultPublicMethods)
+	dialer := serveTestServer(t, server.NewUserServer(store.NewMemoryStore(), server.WithTokenIssuer(tokens)),
+		grpc.ChainUnaryInterceptor(authenticator.UnaryInterceptor(), server.AuthorizeUnary),
+		grpc.ChainStreamInterceptor(authenticator.StreamInterceptor(), server.AuthorizeStream))
+	newClient := func(opts ...Option) *UserClient {
+		c, err := NewUserClient("passthrough:///bufnet", append(opts, WithDialOptions(dialer))...)
+		if err != nil {
+			t.Fatalf("NewUserClient() error = %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+
+	if _, err := newClient().CreateUser("张三", "zhangsan@example.com", 25, ""); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("CreateUser() without credentials error = %v, want ErrUnauthenticated", err)
+	}
+	service := newClient(WithBearerToken(apiKey))
+	user, err := service.CreateUser("张三", "zhangsan@example.com", 25, "")
+	if err != nil {
+		t.Fatalf("CreateUser() with API key error = %v", err)
+	}
+	if err := service.SetPassword(user.Id, "secret-password", ""); err != nil {
+		t.Fatalf("SetPassword() error = %v", err)
+	}
+
+	login, err := newClient().Authenticate("zhangsan@example.com", "secret-password")
+	if err != nil {
+		t.Fatalf("Authenticate() error = %v", err)
+	}
+	asUser := newClient(WithBearerToken(login.AccessToken))
+	if _, err := asUser.GetUser(user.Id); err != nil {
+		t.Errorf("GetUser() with access token error = %v", err)
+	}
+	if _, _, err := asUser.ListUsers(1, 10); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("ListUsers() as user error = %v, want ErrPermissionDenied", err)
+	}
+
+	// 提升为管理员后重新登录
+	if promoted, err := service.SetRole(user.Id, pb.Role_ROLE_ADMIN); err != nil || promoted.Role != pb.Role_ROLE_ADMIN {
+		t.Fatalf("SetRole() = %v, %v", promoted, err)
+	}
+	login, err = newClient().Authenticate("zhangsan@example.com", "secret-password")
+	if err != nil {
+		t.Fatalf("Authenticate() error = %v", err)
+	}
+	if _, _, err := newClient(WithBearerToken(login.AccessToken)).ListUsers(1, 10); err != nil {
+		t.Errorf("ListUsers() as admin error = %v", err)
+	}
+}
+
+func TestUserClient_TLS(t *testing.T) {
+	ca := tlstest.NewCA(t, "test CA")
+	serverCert, serverKey := ca.Issue(t, "server", pkix.Name{CommonName: "user-service"}, "localhost")
+	serverTLS, err := tlsconfig.Server(tlsconfig.ServerOptions{CertFile: serverCert, KeyFile: serverKey})
+	if err != nil {
+		t.Fatalf("tlsconfig.Server() error = %v", err)
+	}
+	dialer := serveTestServer(t, server.NewUserServer(store.NewMemoryStore()), grpc.Creds(credentials.NewTLS(serverTLS)))
+
+	clientTLS, err := tlsconfig.Client(tlsconfig.ClientOptions{CAFile: ca.CertFile, ServerName: "localhost"})
+	if err != nil {
+		t.Fatalf("tlsconfig.Client() error = %v", err)
+	}
+	c, err := NewUserClient("passthrough:///bufnet", WithTLS(clientTLS), WithDialOptions(dialer))
+	if err != nil {
+		t.Fatalf("NewUserClient() error = %v", err)
+	}
+	defer c.Close()
+	if _, err := c.CreateUser("张三", "zhangsan@example.com", 25, ""); err != nil {
+		t.Errorf("CreateUser() over TLS error = %v", err)
+	}
+
+	// 明文客户端无法连接 TLS 服务器
+	plain, err := NewUserClient("passthrough:///bufnet", WithDialOptions(dialer))
+	if err != nil {
+		t.Fatalf("NewUserClient() error = %v", err)
+	}
+	defer plain.Close()
+	if _, err := plain.GetUser(1); status.Code(err) != codes.Unavailable {
+		t.Errorf("GetUser() over plaintext error = %v, want Unavailable", err)
+	}
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strconv"
+	"time"
+
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// ErrCompacted 要恢复的 revision 之后的事件已被服务器丢弃，调用方需要重新全量同步
+	ErrCompacted = errors.New("watch revision has been compacted")
+	// ErrRevisionNotReached 要恢复的 revision 比服务器当前的 revision 还新，通常是 revision 来自其他服务器
+	ErrRevisionNotReached = errors.New("watch revision has not been reached")
+)
+
+// watchRetryDelay WatchUsers 连接中断后重连的最长等待时间
+const watchRetryDelay = 5 * time.Second
+
+// WatchUsers 监听用户变更，对每个事件调用 handle，直到 ctx 被取消或 handle 返回错误
+//
+// afterRevision 为0时从服务器当前的 revision 开始，否则从它之后继续。
+// 连接中断时自动从最后收到的事件的 revision 重连，不会遗漏或重复事件；
+// 需要的事件已被服务器压缩时返回的错误满足 errors.Is(err, ErrCompacted)，
+// afterRevision 超过服务器当前的 revision 时满足 errors.Is(err, ErrRevisionNotReached)。
+func (c *UserClient) WatchUsers(ctx context.Context, afterRevision int64, handle func(event *pb.UserEvent) error) error {
+	delay := 100 * time.Millisecond
+	for {
+		received, err := c.watchOnce(ctx, &afterRevision, handle)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		switch status.Code(err) {
+		case codes.OutOfRange:
+			return rpcError("watch users", err)
+		case codes.Unavailable, codes.Internal, codes.OK:
+			// 连接中断或服务器结束了流，稍后从最后的 revision 重连
+		default:
+			if _, ok := status.FromError(err); ok {
+				return rpcError("watch users", err)
+			}
+			return err
+		}
+
+		if received {
+			delay = 100 * time.Millisecond
+		}
+		log.Printf("监听中断，%v 后从 revision %d 重连: %v", delay, afterRevision, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay = min(2*delay, watchRetryDelay)
+	}
+}
+
+// watchOnce 建立一次 WatchUsers 流，并随着收到的事件推进 *after；received 表示是否收到过事件
+func (c *UserClient) watchOnce(ctx context.Context, after *int64, handle func(event *pb.UserEvent) error) (received bool, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := c.client.WatchUsers(ctx, &pb.WatchUsersRequest{AfterRevision: *after})
+	if err != nil {
+		return false, err
+	}
+
+	// 从当前开始监听时，记下服务器返回的起始 revision，重连时从这里继续
+	if *after == 0 {
+		header, err := stream.Header()
+		if err != nil {
+			return false, err
+		}
+		if values := header.Get("revision"); len(values) > 0 {
+			if *after, err = strconv.ParseInt(values[0], 10, 64); err != nil {
+				return false, status.Errorf(codes.Internal, "invalid revision header %q", values[0])
+			}
+		}
+	}
+
+	for {
+		event, err := stream.Recv()
+		if err == io.EOF {
+			return received, nil
+		}
+		if err != nil {
+			return received, err
+		}
+		received = true
+		if err := handle(event); err != nil {
+			return received, err
+		}
+		*after = event.Revision
+	}
+}
@@ -0,0 +1,203 @@
+// Package idgen 为新用户生成ID
+package idgen
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Generator 为新用户生成ID
+//
+// 用户的 int64 id 是存储中的主键，uid 是可选的对外字符串ID。
+// id 为0表示由存储分配递增的ID；uid 为空表示用户只有数字ID。
+// 实现必须是并发安全的。
+type Generator interface {
+	NewID() (id int64, uid string, err error)
+}
+
+// 生成器的名称，用于 New 和命令行参数
+const (
+	KindSequential = "sequential"
+	KindSnowflake  = "snowflake"
+	KindULID       = "ulid"
+	KindUUIDv7     = "uuidv7"
+)
+
+// New 按名称创建生成器，node 只用于 snowflake
+func New(kind string, node int64) (Generator, error) {
+	switch kind {
+	case KindSequential, "":
+		return Sequential{}, nil
+	case KindSnowflake:
+		return NewSnowflake(node)
+	case KindULID:
+		return NewULID(), nil
+	case KindUUIDv7:
+		return NewUUIDv7(), nil
+	default:
+		return nil, fmt.Errorf("unknown id generator: %s", kind)
+	}
+}
+
+// Sequential 由存储分配从1开始递增的ID，与之前的行为相同
+//
+// ID容易被猜到，内存存储重启后从1重新开始，多个服务器实例的ID会冲突。
+type Sequential struct{}
+
+// NewID 总是返回0，由存储分配ID
+func (Sequential) NewID() (int64, string, error) {
+	return 0, "", nil
+}
+
+// Snowflake 的位布局：41位毫秒时间戳（自 Epoch 起，约69年）、10位节点号、12位序号
+const (
+	nodeBits = 10
+	seqBits  = 12
+	MaxNode  = 1<<nodeBits - 1
+	maxSeq   = 1<<seqBits - 1
+)
+
+// Epoch Snowflake 时间戳的起点
+var Epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Snowflake 生成按时间递增的64位ID，不同节点号的实例生成的ID不会冲突
+//
+// 每个节点每毫秒最多生成4096个ID。时钟回拨或序号用尽时沿用（或提前使用）最近的毫秒，
+// 因此同一个实例生成的ID严格递增；但实例重启前后时钟回拨仍可能产生重复的ID。
+type Snowflake struct {
+	mu   sync.Mutex
+	node int64
+	last int64 // 上一个ID的毫秒时间戳
+	seq  int64
+	now  func() time.Time
+}
+
+// NewSnowflake 创建节点号为 node（0 到 MaxNode）的 Snowflake 生成器
+func NewSnowflake(node int64) (*Snowflake, error) {
+	if node < 0 || node > MaxNode {
+		return nil, fmt.Errorf("snowflake node id must be between 0 and %d, got %d", MaxNode, node)
+	}
+	return &Snowflake{node: node, last: -1, now: time.Now}, nil
+}
+
+// NewID 返回新的ID，uid 为空
+func (s *Snowflake) NewID() (int64, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ms := s.now().Sub(Epoch).Milliseconds()
+	if ms < 0 {
+		return 0, "", errors.New("snowflake: clock is before epoch")
+	}
+	if ms <= s.last {
+		ms = s.last
+		s.seq = (s.seq + 1) & maxSeq
+		if s.seq == 0 {
+			ms++ // 本毫秒的序号用尽，提前使用下一毫秒
+		}
+	} else {
+		s.seq = 0
+	}
+	s.last = ms
+	return ms<<(nodeBits+seqBits) | s.node<<seqBits | s.seq, "", nil
+}
+
+// ULID 生成 ULID 格式的 uid：48位毫秒时间戳 + 80位随机数，编码为26个字符的 Crockford Base32
+//
+// 同一毫秒内生成的 ULID 在上一个的基础上加1，保证按字符串排序与生成顺序一致。数字ID由存储分配。
+type ULID struct {
+	mu     sync.Mutex
+	last   int64 // 上一个 ULID 的毫秒时间戳
+	random [10]byte
+	now    func() time.Time
+	rand   io.Reader
+}
+
+// NewULID 创建 ULID 生成器
+func NewULID() *ULID {
+	return &ULID{now: time.Now, rand: rand.Reader}
+}
+
+// NewID 返回 id 0 和新的 ULID
+func (u *ULID) NewID() (int64, string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	ms := u.now().UnixMilli()
+	if ms <= u.last && increment(u.random[:]) {
+		ms = u.last
+	} else {
+		if _, err := io.ReadFull(u.rand, u.random[:]); err != nil {
+			return 0, "", fmt.Errorf("ulid: %w", err)
+		}
+		ms = max(ms, u.last+1)
+	}
+	u.last = ms
+
+	var b [16]byte
+	putMillis(b[:], ms)
+	copy(b[6:], u.random[:])
+	return 0, encodeBase32(b), nil
+}
+
+// UUIDv7 生成 RFC 9562 UUID 第7版格式的 uid：48位毫秒时间戳，其余为随机数。数字ID由存储分配。
+type UUIDv7 struct {
+	now  func() time.Time
+	rand io.Reader
+}
+
+// NewUUIDv7 创建 UUIDv7 生成器
+func NewUUIDv7() *UUIDv7 {
+	return &UUIDv7{now: time.Now, rand: rand.Reader}
+}
+
+// NewID 返回 id 0 和新的 UUID
+func (g *UUIDv7) NewID() (int64, string, error) {
+	var b [16]byte
+	if _, err := io.ReadFull(g.rand, b[6:]); err != nil {
+		return 0, "", fmt.Errorf("uuidv7: %w", err)
+	}
+	putMillis(b[:], g.now().UnixMilli())
+	b[6] = b[6]&0x0f | 0x70 // 版本 7
+	b[8] = b[8]&0x3f | 0x80 // RFC 9562 变体
+	return 0, fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// putMillis 把毫秒时间戳的低48位以大端序写入 b[0:6]
+func putMillis(b []byte, ms int64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(ms))
+	copy(b[:6], buf[2:])
+}
+
+// increment 把 b 当作大端序整数加1，溢出时返回 false
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// crockford Crockford Base32 字母表，不含 I、L、O、U
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// encodeBase32 把128位编码为26个字符，最高位补两个0位
+func encodeBase32(b [16]byte) string {
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	out := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out)
+}
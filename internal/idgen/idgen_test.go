@@ -0,0 +1,129 @@
+package idgen
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestSnowflake(t *testing.T) {
+	now := Epoch.Add(time.Hour)
+	s, err := NewSnowflake(5)
+	if err != nil {
+		t.Fatalf("NewSnowflake() error = %v", err)
+	}
+	s.now = func() time.Time { return now }
+
+	var prev int64
+	for i := 0; i < maxSeq+10; i++ {
+		id, uid, err := s.NewID()
+		if err != nil {
+			t.Fatalf("NewID() error = %v", err)
+		}
+		if uid != "" {
+			t.Errorf("NewID() uid = %q, want empty", uid)
+		}
+		if id <= prev {
+			t.Fatalf("NewID() = %d after %d, want increasing ids", id, prev)
+		}
+		if node := id >> seqBits & MaxNode; node != 5 {
+			t.Fatalf("NewID() node = %d, want 5", node)
+		}
+		prev = id
+	}
+	// 4096个序号用尽后提前使用下一毫秒
+	if ms := prev >> (nodeBits + seqBits); ms != time.Hour.Milliseconds()+1 {
+		t.Errorf("timestamp after exhausting the sequence = %d, want %d", ms, time.Hour.Milliseconds()+1)
+	}
+
+	// 时钟回拨时ID仍然递增
+	now = now.Add(-time.Second)
+	if id, _, _ := s.NewID(); id <= prev {
+		t.Errorf("NewID() after clock moved back = %d, want > %d", id, prev)
+	}
+
+	// 不同节点同一毫秒的ID不同
+	other, _ := NewSnowflake(6)
+	other.now = s.now
+	a, _, _ := other.NewID()
+	b, _, _ := s.NewID()
+	if a == b {
+		t.Errorf("nodes 5 and 6 generated the same id %d", a)
+	}
+
+	for _, node := range []int64{-1, MaxNode + 1} {
+		if _, err := NewSnowflake(node); err == nil {
+			t.Errorf("NewSnowflake(%d) error = nil, want out of range", node)
+		}
+	}
+}
+
+func TestULID(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	u := NewULID()
+	u.now = func() time.Time { return now }
+
+	valid := regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)
+	var prev string
+	for i := 0; i < 100; i++ {
+		id, uid, err := u.NewID()
+		if err != nil {
+			t.Fatalf("NewID() error = %v", err)
+		}
+		if id != 0 {
+			t.Errorf("NewID() id = %d, want 0 (assigned by the store)", id)
+		}
+		if !valid.MatchString(uid) {
+			t.Fatalf("NewID() uid = %q, not a ULID", uid)
+		}
+		if uid <= prev {
+			t.Fatalf("NewID() = %q after %q, want increasing ULIDs", uid, prev)
+		}
+		prev = uid
+		if i == 50 {
+			now = now.Add(-time.Minute) // 时钟回拨
+		}
+	}
+
+	// 时间戳部分与 ULID 规范一致
+	u = NewULID()
+	u.now = func() time.Time { return time.UnixMilli(1469918176385) }
+	u.rand = bytes.NewReader(make([]byte, 10))
+	if _, uid, _ := u.NewID(); uid != "01ARYZ6S41"+"0000000000000000" {
+		t.Errorf("NewID() = %q, want timestamp prefix 01ARYZ6S41", uid)
+	}
+}
+
+func TestUUIDv7(t *testing.T) {
+	g := NewUUIDv7()
+	valid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id, uid, err := g.NewID()
+		if err != nil {
+			t.Fatalf("NewID() error = %v", err)
+		}
+		if id != 0 || !valid.MatchString(uid) {
+			t.Fatalf("NewID() = %d, %q, want 0 and a version 7 UUID", id, uid)
+		}
+		if seen[uid] {
+			t.Fatalf("NewID() returned %q twice", uid)
+		}
+		seen[uid] = true
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, kind := range []string{"", KindSequential, KindSnowflake, KindULID, KindUUIDv7} {
+		if _, err := New(kind, 1); err != nil {
+			t.Errorf("New(%q) error = %v", kind, err)
+		}
+	}
+	if _, err := New("random", 1); err == nil {
+		t.Errorf("New(\"random\") error = nil, want unknown generator")
+	}
+	if _, err := New(KindSnowflake, MaxNode+1); err == nil {
+		t.Errorf("New(snowflake, %d) error = nil, want out of range", MaxNode+1)
+	}
+}
@@ -0,0 +1,223 @@
+// Package search 提供用户的进程内全文检索
+package search
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+)
+
+// field 被索引的用户字段，用位掩码记录一个词元出现在哪些字段中
+type field uint8
+
+const (
+	fieldName field = 1 << iota
+	fieldEmail
+	fieldPhone
+)
+
+// fieldWeights 各字段命中时的权重，姓名命中比邮箱、手机号更重要
+var fieldWeights = []struct {
+	field  field
+	weight float64
+}{
+	{fieldName, 3},
+	{fieldEmail, 2},
+	{fieldPhone, 2},
+}
+
+// 查询与某个字段完全相同或是其前缀时，分数乘以的系数
+const (
+	exactBonus  = 3
+	prefixBonus = 2
+)
+
+// Result 一条检索结果
+type Result struct {
+	ID    int64
+	Score float64
+}
+
+// document 一个被索引用户的规范化文本
+type document struct {
+	name, email, phone string
+	grams              map[string]field
+}
+
+// Index 按姓名、邮箱和手机号建立的倒排索引，并发安全
+//
+// 查询同样被切分为词元，只有包含全部查询词元、且每个查询片段都连续出现在某个字段中的用户才会命中；
+// 命中的用户按 TF-IDF 风格的分数排序：越少见的词元权重越高，姓名命中权重最高。
+type Index struct {
+	mu       sync.RWMutex
+	postings map[string]map[int64]field // 词元 -> 用户ID -> 出现的字段
+	docs     map[int64]*document
+}
+
+// NewIndex 创建空索引
+func NewIndex() *Index {
+	return &Index{
+		postings: make(map[string]map[int64]field),
+		docs:     make(map[int64]*document),
+	}
+}
+
+// Put 索引用户，已存在时替换旧的索引内容
+func (ix *Index) Put(u *pb.User) {
+	doc := &document{
+		name:  strings.ToLower(u.Name),
+		email: strings.ToLower(u.Email),
+		phone: digits(u.Phone),
+		grams: make(map[string]field),
+	}
+	for _, g := range grams(u.Name) {
+		doc.grams[g] |= fieldName
+	}
+	for _, g := range grams(u.Email) {
+		doc.grams[g] |= fieldEmail
+	}
+	for _, g := range grams(doc.phone) {
+		doc.grams[g] |= fieldPhone
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	ix.remove(u.Id)
+	ix.docs[u.Id] = doc
+	for g, f := range doc.grams {
+		posting := ix.postings[g]
+		if posting == nil {
+			posting = make(map[int64]field)
+			ix.postings[g] = posting
+		}
+		posting[u.Id] = f
+	}
+}
+
+// Remove 从索引中删除用户
+func (ix *Index) Remove(id int64) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	ix.remove(id)
+}
+
+func (ix *Index) remove(id int64) {
+	doc, exists := ix.docs[id]
+	if !exists {
+		return
+	}
+	for g := range doc.grams {
+		posting := ix.postings[g]
+		delete(posting, id)
+		if len(posting) == 0 {
+			delete(ix.postings, g)
+		}
+	}
+	delete(ix.docs, id)
+}
+
+// Len 返回已索引的用户数
+func (ix *Index) Len() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	return len(ix.docs)
+}
+
+// Search 返回与查询匹配的用户，按分数从高到低排列，最多 limit 条
+func (ix *Index) Search(query string, limit int) []Result {
+	queryGrams := unique(grams(query))
+	if len(queryGrams) == 0 || limit <= 0 {
+		return nil
+	}
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	// 从最少见的词元开始求交集，候选集合最小
+	sort.Slice(queryGrams, func(i, j int) bool {
+		return len(ix.postings[queryGrams[i]]) < len(ix.postings[queryGrams[j]])
+	})
+
+	total := float64(len(ix.docs))
+	scores := make(map[int64]float64)
+	for i, g := range queryGrams {
+		posting := ix.postings[g]
+		if len(posting) == 0 {
+			return nil
+		}
+		idf := math.Log(1 + total/float64(len(posting)))
+
+		if i == 0 {
+			for id, f := range posting {
+				scores[id] = idf * weight(f)
+			}
+			continue
+		}
+		for id := range scores {
+			f, ok := posting[id]
+			if !ok {
+				delete(scores, id)
+				continue
+			}
+			scores[id] += idf * weight(f)
+		}
+	}
+
+	q := strings.ToLower(strings.TrimSpace(query))
+	qDigits := digits(query)
+	qTerms := terms(query)
+	results := make([]Result, 0, len(scores))
+	for id, score := range scores {
+		doc := ix.docs[id]
+		// 词元分散命中不算匹配，例如查询 "138001" 不应命中 "13800138002"
+		if !doc.contains(qTerms) {
+			continue
+		}
+		switch {
+		case doc.name == q || doc.email == q || (qDigits != "" && doc.phone == qDigits):
+			score *= exactBonus
+		case strings.HasPrefix(doc.name, q) || strings.HasPrefix(doc.email, q) ||
+			(qDigits != "" && strings.HasPrefix(doc.phone, qDigits)):
+			score *= prefixBonus
+		}
+		results = append(results, Result{ID: id, Score: score})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].ID < results[j].ID
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// contains 判断每个查询片段是否都连续出现在某个字段中
+func (doc *document) contains(qTerms []string) bool {
+	for _, t := range qTerms {
+		if !strings.Contains(doc.name, t) && !strings.Contains(doc.email, t) &&
+			!(digits(t) == t && strings.Contains(doc.phone, t)) {
+			return false
+		}
+	}
+	return true
+}
+
+// weight 返回词元出现的字段中最高的权重
+func weight(f field) float64 {
+	for _, fw := range fieldWeights {
+		if f&fw.field != 0 {
+			return fw.weight
+		}
+	}
+	return 0
+}
@@ -0,0 +1,92 @@
+package search
+
+import (
+	"fmt"
+	"testing"
+
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+)
+
+func TestGrams(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{text: "张三", want: []string{"张", "张三", "三"}},
+		{text: "张三丰", want: []string{"张", "张三", "三", "三丰", "丰"}},
+		{text: "Zhang San", want: []string{"zh", "ha", "an", "ng", "sa", "an"}},
+		{text: "a@b.cn", want: []string{"a", "b", "cn"}},
+		{text: "小明Tom", want: []string{"小", "小明", "明", "to", "om"}},
+		{text: "", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			if got := grams(tt.text); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("grams(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIndex_Search(t *testing.T) {
+	ix := NewIndex()
+	for _, u := range []*pb.User{
+		{Id: 1, Name: "张三", Email: "zhangsan@example.com", Phone: "13800138001"},
+		{Id: 2, Name: "李四", Email: "lisi@example.com", Phone: "13800138002"},
+		{Id: 3, Name: "张三丰", Email: "sanfeng@wudang.cn", Phone: "+86 139-0000-0003"},
+		{Id: 4, Name: "王五", Email: "wangwu@example.com"},
+	} {
+		ix.Put(u)
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []int64
+	}{
+		{name: "full CJK name ranks exact first", query: "张三", want: []int64{1, 3}},
+		{name: "partial CJK name", query: "三丰", want: []int64{3}},
+		{name: "single CJK character", query: "四", want: []int64{2}},
+		{name: "email fragment", query: "wudang", want: []int64{3}},
+		{name: "email local part prefix", query: "zhangs", want: []int64{1}},
+		{name: "phone digits with separators", query: "0000-0003", want: []int64{3}},
+		{name: "phone suffix", query: "138002", want: []int64{2}},
+		{name: "scattered grams do not match", query: "013801", want: nil},
+		{name: "no match", query: "赵六", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int64
+			for _, r := range ix.Search(tt.query, 10) {
+				got = append(got, r.ID)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("Search(%q) = %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIndex_PutRemove(t *testing.T) {
+	ix := NewIndex()
+	ix.Put(&pb.User{Id: 1, Name: "张三", Email: "zhangsan@example.com"})
+
+	// 更新后旧的姓名不再命中
+	ix.Put(&pb.User{Id: 1, Name: "李四", Email: "zhangsan@example.com"})
+	if got := ix.Search("张三", 10); len(got) != 0 {
+		t.Errorf("Search() old name after update = %v, want none", got)
+	}
+	if got := ix.Search("李四", 10); len(got) != 1 {
+		t.Errorf("Search() new name after update = %v, want user 1", got)
+	}
+
+	ix.Remove(1)
+	if got := ix.Search("zhangsan", 10); len(got) != 0 {
+		t.Errorf("Search() after remove = %v, want none", got)
+	}
+	if ix.Len() != 0 || len(ix.postings) != 0 {
+		t.Errorf("index not empty after remove: %d docs, %d postings", ix.Len(), len(ix.postings))
+	}
+}
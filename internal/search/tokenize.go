@@ -0,0 +1,96 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+)
+
+// isCJK 判断字符是否属于中日韩文字，这些文字之间没有空格分词
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// grams 把文本切分为用于索引和查询的词元
+//
+// 中日韩文字按连续的片段切分，每个片段产生单字和相邻两字组合，
+// 因此“张三丰”可以被“张三”“三丰”或“丰”找到。
+// 字母和数字按连续的片段切分，每个片段产生相邻两个字符的组合
+// （只有一个字符时就是它本身），用于匹配邮箱片段、部分拼音和号码片段。
+// 其他字符（空格、标点、@ 等）只起分隔作用。
+func grams(text string) []string {
+	var out []string
+	var run []rune
+	runCJK := false
+
+	flush := func() {
+		if len(run) == 0 {
+			return
+		}
+		if runCJK {
+			for i := range run {
+				out = append(out, string(run[i]))
+				if i+1 < len(run) {
+					out = append(out, string(run[i:i+2]))
+				}
+			}
+		} else if len(run) == 1 {
+			out = append(out, string(run))
+		} else {
+			for i := 0; i+1 < len(run); i++ {
+				out = append(out, string(run[i:i+2]))
+			}
+		}
+		run = run[:0]
+	}
+
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case isCJK(r):
+			if !runCJK {
+				flush()
+				runCJK = true
+			}
+			run = append(run, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if runCJK {
+				flush()
+				runCJK = false
+			}
+			run = append(run, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return out
+}
+
+// terms 把查询按空格和标点切分为小写的片段
+func terms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// digits 只保留文本中的数字，用于手机号的索引和查询
+func digits(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, text)
+}
+
+// unique 去掉重复的词元，保持首次出现的顺序
+func unique(gs []string) []string {
+	seen := make(map[string]bool, len(gs))
+	out := gs[:0]
+	for _, g := range gs {
+		if !seen[g] {
+			seen[g] = true
+			out = append(out, g)
+		}
+	}
+	return out
+}
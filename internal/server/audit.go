@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/liverlong/rpc-learning/internal/audit"
+	"github.com/liverlong/rpc-learning/internal/auth"
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// callerHeader 请求元数据中标识调用方的键
+const callerHeader = "x-caller"
+
+// callerFromContext 返回请求的调用方身份：通过认证的调用方使用认证的身份（例如 users/1），
+// 否则取元数据中的 x-caller，都没有时用对端地址
+func callerFromContext(ctx context.Context) string {
+	if id, ok := auth.FromContext(ctx); ok {
+		return id.Name
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(callerHeader); len(values) > 0 && values[0] != "" {
+			return values[0]
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return "anonymous@" + p.Addr.String()
+	}
+	return "anonymous"
+}
+
+// methodName 返回产生修改的接口名；不是通过 gRPC 调用时（例如后台清理）使用 fallback
+func methodName(ctx context.Context, fallback string) string {
+	if method, ok := grpc.Method(ctx); ok {
+		return path.Base(method)
+	}
+	return fallback
+}
+
+// record 把租户 tenant 中的一次修改追加到审计日志
+//
+// 修改已经写入存储，审计日志写入失败时无法回退，只记录错误日志。
+func (s *UserServer) record(ctx context.Context, tenant, method string, before, after *pb.User) {
+	userID := before.GetId()
+	if after != nil {
+		userID = after.Id
+	}
+	s.appendAudit(ctx, tenant, method, userID, audit.Diff(before, after))
+}
+
+// appendAudit 把租户 tenant 中用户 userID 的字段变化追加到审计日志，写入失败时只记录错误日志
+func (s *UserServer) appendAudit(ctx context.Context, tenant, method string, userID int64, changes []*pb.FieldChange) {
+	event := &pb.AuditEvent{
+		Tenant:    tenant,
+		Timestamp: time.Now().Unix(),
+		Method:    methodName(ctx, method),
+		Caller:    callerFromContext(ctx),
+		UserId:    userID,
+		Changes:   changes,
+	}
+	if err := s.audit.Append(ctx, event); err != nil {
+		log.Printf("Failed to append audit event for user %d: %v", event.UserId, err)
+	}
+}
+
+// ListAuditEvents 按用户、接口和时间范围查询审计记录
+func (s *UserServer) ListAuditEvents(ctx context.Context, req *pb.ListAuditEventsRequest) (*pb.ListAuditEventsResponse, error) {
+	log.Printf("ListAuditEvents called with: %+v", req)
+
+	t, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pageSize := int(req.PageSize)
+	if pageSize <= 0 {
+		pageSize = 50
+	}
+	if pageSize > 1000 {
+		pageSize = 1000
+	}
+	if req.EndTime != 0 && req.EndTime <= req.StartTime {
+		return nil, invalidArgument(auditEventsResource, "end_time", "end_time 必须大于 start_time")
+	}
+
+	q := audit.Query{
+		Tenant: t.name,
+		UserID: req.UserId,
+		Method: req.Method,
+		Start:  req.StartTime,
+		End:    req.EndTime,
+		Limit:  pageSize + 1, // 多取一条用于判断是否还有下一页
+	}
+	if req.PageToken != "" {
+		after, err := decodeAuditToken(req.PageToken)
+		if err != nil {
+			return nil, invalidArgument(auditEventsResource, "page_token", "无效的page_token")
+		}
+		q.AfterID = after
+	}
+
+	events, err := s.audit.List(ctx, q)
+	if err != nil {
+		log.Printf("Audit log error: %v", err)
+		return nil, newError(codes.Internal, pb.ErrorReason_STORAGE_ERROR, auditEventsResource, nil, "读取审计日志失败")
+	}
+
+	var next string
+	if len(events) > pageSize {
+		events = events[:pageSize]
+		next = encodeAuditToken(events[pageSize-1].Id)
+	}
+
+	return &pb.ListAuditEventsResponse{
+		Events:        events,
+		NextPageToken: next,
+		Message:       fmt.Sprintf("查询到%d条审计记录", len(events)),
+	}, nil
+}
+
+// encodeAuditToken 审计记录的翻页令牌，记录上一页最后一条记录的 id
+func encodeAuditToken(id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(id, 10)))
+}
+
+func decodeAuditToken(token string) (int64, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(data), 10, 64)
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/liverlong/rpc-learning/internal/auth"
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// authorizationHeader 请求元数据中的凭据，格式为 "Bearer <访问令牌或 API key>"
+const authorizationHeader = "authorization"
+
+// DefaultPublicMethods 默认不需要认证的方法：登录、刷新令牌和反射服务
+var DefaultPublicMethods = []string{
+	pb.UserService_Authenticate_FullMethodName,
+	pb.UserService_RefreshToken_FullMethodName,
+	"/grpc.reflection.v1.ServerReflection/*",
+	"/grpc.reflection.v1alpha.ServerReflection/*",
+}
+
+// methodResource 请求的方法，认证失败的错误详情中使用
+func methodResource(fullMethod string) resource {
+	return resource{typ: methodResourceType, name: fullMethod}
+}
+
+// Authenticator 校验请求元数据中的凭据，并把调用方身份放入 context（见 auth.FromContext）
+//
+// 凭据可以是 Authenticate 签发的访问令牌（用户）、静态的 API key（服务），
+// 或者启用 WithClientCerts 时双向 TLS 的客户端证书（服务）。
+// public 中的方法不需要凭据，但带有凭据时仍然会校验并设置身份。
+type Authenticator struct {
+	tokens      *auth.TokenIssuer
+	apiKeys     auth.APIKeys
+	clientCerts auth.ClientCerts
+	public      map[string]bool
+}
+
+// AuthenticatorOption 配置 Authenticator 的可选参数
+type AuthenticatorOption func(*Authenticator)
+
+// WithClientCerts 接受双向 TLS 的客户端证书作为凭据
+//
+// 请求没有 authorization 元数据时，按已通过校验的客户端证书的主题在 certs 中查找服务身份；
+// 带有 authorization 元数据时以元数据为准，例如通过网关转发的用户请求。
+func WithClientCerts(certs auth.ClientCerts) AuthenticatorOption {
+	return func(a *Authenticator) {
+		a.clientCerts = certs
+	}
+}
+
+// NewAuthenticator 创建认证器，tokens 应与 UserServer 签发令牌使用的签发器相同
+//
+// public 中的每一项是方法全名（例如 /user.UserService/Authenticate）或以 /* 结尾的服务（例如 /user.v2.UserService/*）。
+func NewAuthenticator(tokens *auth.TokenIssuer, apiKeys auth.APIKeys, public []string, opts ...AuthenticatorOption) *Authenticator {
+	a := &Authenticator{tokens: tokens, apiKeys: apiKeys, public: make(map[string]bool, len(public))}
+	for _, method := range public {
+		a.public[method] = true
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// isPublic 方法是否不需要认证
+func (a *Authenticator) isPublic(fullMethod string) bool {
+	if a.public[fullMethod] {
+		return true
+	}
+	if i := strings.LastIndexByte(fullMethod, '/'); i > 0 {
+		return a.public[fullMethod[:i]+"/*"]
+	}
+	return false
+}
+
+// authenticate 返回带有调用方身份的 ctx；没有凭据时，公开方法原样返回 ctx，其他方法返回 UNAUTHENTICATED
+func (a *Authenticator) authenticate(ctx context.Context, fullMethod string) (context.Context, error) {
+	res := methodResource(fullMethod)
+	values := metadata.ValueFromIncomingContext(ctx, authorizationHeader)
+	if len(values) == 0 {
+		if id, ok := a.certIdentity(ctx); ok {
+			return auth.NewContext(ctx, id), nil
+		}
+		if a.isPublic(fullMethod) {
+			return ctx, nil
+		}
+		return nil, newError(codes.Unauthenticated, pb.ErrorReason_CREDENTIALS_REQUIRED, res,
+			map[string]string{"header": authorizationHeader}, "缺少认证凭据")
+	}
+
+	scheme, credential, ok := strings.Cut(values[0], " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || credential == "" {
+		return nil, newError(codes.Unauthenticated, pb.ErrorReason_INVALID_TOKEN, res,
+			map[string]string{"header": authorizationHeader}, "认证凭据的格式必须是 Bearer <令牌>")
+	}
+	if id, ok := a.apiKeys.Lookup(credential); ok {
+		return auth.NewContext(ctx, id), nil
+	}
+
+	claims, err := a.tokens.Verify(credential, auth.AccessToken)
+	if err != nil {
+		message := "访问令牌无效"
+		if errors.Is(err, auth.ErrTokenExpired) {
+			message = "访问令牌已过期"
+		}
+		return nil, newError(codes.Unauthenticated, pb.ErrorReason_INVALID_TOKEN, res, nil, message)
+	}
+	id, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || id <= 0 {
+		return nil, newError(codes.Unauthenticated, pb.ErrorReason_INVALID_TOKEN, res, nil, "访问令牌无效")
+	}
+	return auth.NewContext(ctx, auth.UserIdentity(claims.Tenant, id, claims.Role)), nil
+}
+
+// certIdentity 返回连接上已通过校验的客户端证书对应的服务身份
+func (a *Authenticator) certIdentity(ctx context.Context) (auth.Identity, bool) {
+	if a.clientCerts == nil {
+		return auth.Identity{}, false
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return auth.Identity{}, false
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return auth.Identity{}, false
+	}
+	subject := info.State.VerifiedChains[0][0].Subject
+	id, ok := a.clientCerts.Lookup(subject)
+	if !ok {
+		log.Printf("Client certificate %s is not mapped to an identity", subject)
+	}
+	return id, ok
+}
+
+// UnaryInterceptor 认证一元调用
+func (a *Authenticator) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := a.authenticate(ctx, info.FullMethod)
+		if err != nil {
+			log.Printf("Rejected unauthenticated call to %s: %v", info.FullMethod, err)
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamInterceptor 认证流式调用，建立流时校验一次
+func (a *Authenticator) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := a.authenticate(ss.Context(), info.FullMethod)
+		if err != nil {
+			log.Printf("Rejected unauthenticated call to %s: %v", info.FullMethod, err)
+			return err
+		}
+		return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// contextStream 替换了 Context 的服务端流
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/liverlong/rpc-learning/internal/auth"
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+	pbv2 "github.com/liverlong/rpc-learning/pkg/pb/user/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/proto"
+)
+
+// policy 判断非管理员的调用方 id 能否发起请求 req；流式方法在建立流时检查，req 为 nil
+type policy func(id auth.Identity, req any) bool
+
+// anyCaller 所有通过认证的调用方都可以调用
+func anyCaller(auth.Identity, any) bool { return true }
+
+// adminOnly 只有管理员可以调用
+func adminOnly(auth.Identity, any) bool { return false }
+
+// ownRecord 普通用户只能访问自己的记录，userID 返回请求中的用户ID，按 uid 或其他方式指定用户时返回0
+func ownRecord[Req any](userID func(Req) int64) policy {
+	return func(id auth.Identity, req any) bool {
+		r, ok := req.(Req)
+		return ok && id.UserID != 0 && userID(r) == id.UserID
+	}
+}
+
+// ownName 与 ownRecord 相同，但请求中的用户是 v2 的资源名 users/{id}
+func ownName[Req any](name func(Req) string) policy {
+	return func(id auth.Identity, req any) bool {
+		r, ok := req.(Req)
+		return ok && !id.IsService() && name(r) == id.Name
+	}
+}
+
+// getUserID GetUser 请求的用户ID；uid 非空时 GetUser 忽略 id，返回0使普通用户不能按 uid 获取
+func getUserID(req *pb.GetUserRequest) int64 {
+	if req.Uid != "" {
+		return 0
+	}
+	return req.Id
+}
+
+// policies 每个方法的访问策略，管理员可以调用所有方法，不在表中的方法只允许管理员调用
+//
+// 键是方法全名或以 /* 结尾的服务，与 DefaultPublicMethods 的格式相同。
+var policies = map[string]policy{
+	pb.UserService_CreateUser_FullMethodName:       adminOnly,
+	pb.UserService_GetUser_FullMethodName:          ownRecord(getUserID),
+	pb.UserService_GetUserByEmail_FullMethodName:   adminOnly,
+	pb.UserService_GetUserByPhone_FullMethodName:   adminOnly,
+	pb.UserService_UpdateUser_FullMethodName:       ownRecord((*pb.UpdateUserRequest).GetId),
+	pb.UserService_DeleteUser_FullMethodName:       adminOnly,
+	pb.UserService_UndeleteUser_FullMethodName:     adminOnly,
+	pb.UserService_ListUsers_FullMethodName:        adminOnly,
+	pb.UserService_SearchUsers_FullMethodName:      adminOnly,
+	pb.UserService_BatchCreateUsers_FullMethodName: adminOnly,
+	pb.UserService_BatchGetUsers_FullMethodName:    adminOnly,
+	pb.UserService_BatchDeleteUsers_FullMethodName: adminOnly,
+	pb.UserService_ImportUsers_FullMethodName:      adminOnly,
+	pb.UserService_ExportUsers_FullMethodName:      adminOnly,
+	pb.UserService_WatchUsers_FullMethodName:       adminOnly,
+	pb.UserService_ListAuditEvents_FullMethodName:  adminOnly,
+	pb.UserService_ListTenants_FullMethodName:      adminOnly,
+	pb.UserService_SetPassword_FullMethodName:      ownRecord((*pb.SetPasswordRequest).GetId),
+	pb.UserService_SetRole_FullMethodName:          adminOnly,
+	pb.UserService_Authenticate_FullMethodName:     anyCaller,
+	pb.UserService_RefreshToken_FullMethodName:     anyCaller,
+	pb.UserService_Chat_FullMethodName:             anyCaller,
+
+	pbv2.UserService_CreateUser_FullMethodName:      adminOnly,
+	pbv2.UserService_GetUser_FullMethodName:         ownName((*pbv2.GetUserRequest).GetName),
+	pbv2.UserService_UpdateUser_FullMethodName:      ownName(func(r *pbv2.UpdateUserRequest) string { return r.GetUser().GetName() }),
+	pbv2.UserService_DeleteUser_FullMethodName:      adminOnly,
+	pbv2.UserService_UndeleteUser_FullMethodName:    adminOnly,
+	pbv2.UserService_ListUsers_FullMethodName:       adminOnly,
+	pbv2.UserService_SearchUsers_FullMethodName:     adminOnly,
+	pbv2.UserService_WatchUsers_FullMethodName:      adminOnly,
+	pbv2.UserService_ListAuditEvents_FullMethodName: adminOnly,
+	pbv2.UserService_Chat_FullMethodName:            anyCaller,
+
+	"/grpc.reflection.v1.ServerReflection/*":      anyCaller,
+	"/grpc.reflection.v1alpha.ServerReflection/*": anyCaller,
+}
+
+// serviceOnly 返回所有租户数据的方法，只有用 API key 或客户端证书认证的管理员服务可以调用，
+// 租户中的管理员用户也不能调用
+var serviceOnly = map[string]bool{
+	pb.UserService_ListTenants_FullMethodName: true,
+}
+
+// lookupPolicy 返回方法的访问策略
+func lookupPolicy(fullMethod string) policy {
+	if p, ok := policies[fullMethod]; ok {
+		return p
+	}
+	if i := strings.LastIndexByte(fullMethod, '/'); i > 0 {
+		if p, ok := policies[fullMethod[:i]+"/*"]; ok {
+			return p
+		}
+	}
+	return adminOnly
+}
+
+// authorize 检查 ctx 中的调用方能否发起请求；ctx 中没有身份时不检查，由 Authenticator 决定是否允许匿名调用
+func authorize(ctx context.Context, fullMethod string, req any) error {
+	id, ok := auth.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	if serviceOnly[fullMethod] {
+		if id.IsService() && id.IsAdmin() {
+			return nil
+		}
+		log.Printf("Denied %s (role %q, tenant %q) access to %s", id.Name, id.Role, id.Tenant, fullMethod)
+		return newError(codes.PermissionDenied, pb.ErrorReason_PERMISSION_DENIED, methodResource(fullMethod),
+			map[string]string{"role": id.Role}, "没有权限调用该方法，只有管理员服务可以访问所有租户的数据")
+	}
+	if id.IsAdmin() || lookupPolicy(fullMethod)(id, req) {
+		return nil
+	}
+	log.Printf("Denied %s (role %q) access to %s", id.Name, id.Role, fullMethod)
+	return newError(codes.PermissionDenied, pb.ErrorReason_PERMISSION_DENIED, methodResource(fullMethod),
+		map[string]string{"role": id.Role}, "没有权限调用该方法，普通用户只能读取和修改自己的信息")
+}
+
+// AuthorizeUnary 按 policies 检查一元调用的权限，必须在 Authenticator 的拦截器之后
+func AuthorizeUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := authorize(ctx, info.FullMethod, req); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// AuthorizeStream 按 policies 检查流式调用的权限，建立流时检查一次，必须在 Authenticator 的拦截器之后
+func AuthorizeStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := authorize(ss.Context(), info.FullMethod, nil); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// roleName 令牌和身份中使用的角色名
+func roleName(role pb.Role) string {
+	if role == pb.Role_ROLE_ADMIN {
+		return auth.RoleAdmin
+	}
+	return auth.RoleUser
+}
+
+// SetRole 设置用户的角色，新角色在用户下次登录或刷新令牌后生效
+func (s *UserServer) SetRole(ctx context.Context, req *pb.SetRoleRequest) (*pb.SetRoleResponse, error) {
+	log.Printf("SetRole called with: %+v", req)
+
+	t, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := userResource(req.Id)
+	var v violations
+	if req.Id <= 0 {
+		v.add("id", "用户ID必须大于0")
+	}
+	if _, ok := pb.Role_name[int32(req.Role)]; !ok {
+		v.add("role", "未知的角色 %d", req.Role)
+	}
+	if err := v.err(res); err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	user, err := res.live(t.store.Get(ctx, req.Id))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVersion(user, req.ExpectedVersion); err != nil {
+		return nil, err
+	}
+	if user.Role == req.Role {
+		return &pb.SetRoleResponse{User: user, Message: "角色未改变"}, nil
+	}
+
+	before := proto.Clone(user).(*pb.User)
+	user.Role = req.Role
+	user.UpdatedAt = time.Now().Unix()
+	user.Version++
+	user, err = t.store.Update(ctx, user)
+	if err != nil {
+		return nil, res.storeError(err)
+	}
+	t.changed(ctx, "SetRole", before, user)
+
+	return &pb.SetRoleResponse{
+		User:    user,
+		Message: "角色设置成功",
+	}, nil
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxBatchSize 单个批量请求最多包含的条目数
+const maxBatchSize = 1000
+
+// checkBatchSize 拒绝空的或过大的批量请求，field 是条目所在的请求字段
+func checkBatchSize(field string, n int) error {
+	if n == 0 {
+		return invalidArgument(usersResource, field, "批量请求不能为空")
+	}
+	if n > maxBatchSize {
+		return invalidArgument(usersResource, field, "批量请求最多包含%d个条目，实际%d个", maxBatchSize, n)
+	}
+	return nil
+}
+
+// batchStatus 把单个条目的错误转换为结果状态，nil 表示成功
+func batchStatus(err error) *pb.BatchStatus {
+	if err == nil {
+		return &pb.BatchStatus{Code: int32(codes.OK)}
+	}
+	st := status.Convert(err).Proto()
+	return &pb.BatchStatus{Code: st.Code, Message: st.Message, Details: st.Details}
+}
+
+// skippedStatus 原子批量操作中因第 failed 项失败而未生效的条目状态（failed 从0开始）
+func skippedStatus(failed int) *pb.BatchStatus {
+	return batchStatus(newError(codes.Aborted, pb.ErrorReason_BATCH_ABORTED, usersResource,
+		map[string]string{"failed_index": strconv.Itoa(failed)},
+		fmt.Sprintf("第%d项失败，批量操作未生效", failed+1)))
+}
+
+// undoLog 原子批量操作中已执行写入的撤销函数
+type undoLog []func() error
+
+// rollback 按相反顺序撤销已执行的写入
+//
+// 调用方持有 t.mu，其他写请求无法插入，因此撤销只会在存储层本身出错时失败；
+// 这种情况只记录日志，继续撤销剩下的写入。
+func (u undoLog) rollback() {
+	for i := len(u) - 1; i >= 0; i-- {
+		if err := u[i](); err != nil {
+			log.Printf("Failed to roll back batch item: %v", err)
+		}
+	}
+}
+
+// change 原子批量操作中暂存的一次修改，整批成功后才写入审计日志
+type change struct {
+	method        string
+	before, after *pb.User
+}
+
+// hold 开始暂存变更事件和审计记录，直到 release；调用方持有 t.mu
+func (t *tenant) hold() {
+	t.feed.hold()
+	t.holding = true
+}
+
+// release 结束暂存，commit 为 true 时发布暂存的事件并写入审计记录，否则都丢弃；调用方持有 t.mu
+func (t *tenant) release(ctx context.Context, commit bool) {
+	t.feed.release(commit)
+	held := t.held
+	t.held, t.holding = nil, false
+	if commit {
+		for _, c := range held {
+			t.server.record(ctx, t.name, c.method, c.before, c.after)
+		}
+	}
+}
+
+// BatchCreateUsers 批量创建用户
+//
+// 非原子模式下逐条创建，每条的结果单独返回；atomic 为 true 时在 t.mu 保护下执行，
+// 任一条目失败则撤销已创建的用户，其余条目返回 ABORTED，WatchUsers 不会收到这批事件，审计日志中也没有记录。
+func (s *UserServer) BatchCreateUsers(ctx context.Context, req *pb.BatchCreateUsersRequest) (*pb.BatchCreateUsersResponse, error) {
+	log.Printf("BatchCreateUsers called with %d requests, atomic=%v", len(req.Requests), req.Atomic)
+
+	t, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkBatchSize("requests", len(req.Requests)); err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// 原子模式下，变更事件和审计记录在整批成功后才发布
+	if req.Atomic {
+		t.hold()
+	}
+
+	results := make([]*pb.BatchCreateUserResult, len(req.Requests))
+	var undo undoLog
+	succeeded := 0
+	for i, r := range req.Requests {
+		user, err := t.createUser(ctx, r)
+		results[i] = &pb.BatchCreateUserResult{User: user, Status: batchStatus(err)}
+		if err == nil {
+			succeeded++
+			undo = append(undo, func() error {
+				if err := t.store.Delete(ctx, user.Id); err != nil {
+					return err
+				}
+				t.changed(ctx, "BatchCreateUsers", user, nil)
+				return nil
+			})
+			continue
+		}
+		if req.Atomic {
+			undo.rollback()
+			t.release(ctx, false)
+			for j := range results {
+				if j != i {
+					results[j] = &pb.BatchCreateUserResult{Status: skippedStatus(i)}
+				}
+			}
+			return &pb.BatchCreateUsersResponse{
+				Results: results,
+				Message: fmt.Sprintf("第%d项创建失败，批量创建未生效", i+1),
+			}, nil
+		}
+	}
+
+	if req.Atomic {
+		t.release(ctx, true)
+	}
+	return &pb.BatchCreateUsersResponse{
+		Results:      results,
+		SuccessCount: int32(succeeded),
+		Message:      fmt.Sprintf("成功创建%d个用户，失败%d个", succeeded, len(results)-succeeded),
+	}, nil
+}
+
+// BatchGetUsers 批量获取用户，每个ID的结果单独返回
+func (s *UserServer) BatchGetUsers(ctx context.Context, req *pb.BatchGetUsersRequest) (*pb.BatchGetUsersResponse, error) {
+	log.Printf("BatchGetUsers called with %d ids", len(req.Ids))
+
+	t, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkBatchSize("ids", len(req.Ids)); err != nil {
+		return nil, err
+	}
+
+	results := make([]*pb.BatchGetUserResult, len(req.Ids))
+	succeeded := 0
+	for i, id := range req.Ids {
+		var user *pb.User
+		var err error
+		if id <= 0 {
+			err = invalidID(id)
+		} else {
+			user, err = userResource(id).live(t.store.Get(ctx, id))
+		}
+		if err == nil {
+			succeeded++
+		}
+		results[i] = &pb.BatchGetUserResult{Id: id, User: user, Status: batchStatus(err)}
+	}
+
+	return &pb.BatchGetUsersResponse{
+		Results:      results,
+		SuccessCount: int32(succeeded),
+		Message:      fmt.Sprintf("获取到%d个用户，失败%d个", succeeded, len(results)-succeeded),
+	}, nil
+}
+
+// BatchDeleteUsers 批量软删除用户
+//
+// atomic 的语义与 BatchCreateUsers 相同：任一条目失败则恢复已删除的用户，恢复后的版本号比删除时大。
+func (s *UserServer) BatchDeleteUsers(ctx context.Context, req *pb.BatchDeleteUsersRequest) (*pb.BatchDeleteUsersResponse, error) {
+	log.Printf("BatchDeleteUsers called with %d requests, atomic=%v", len(req.Requests), req.Atomic)
+
+	t, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkBatchSize("requests", len(req.Requests)); err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if req.Atomic {
+		t.hold()
+	}
+
+	results := make([]*pb.BatchDeleteUserResult, len(req.Requests))
+	var undo undoLog
+	succeeded := 0
+	for i, r := range req.Requests {
+		before, after, err := t.deleteUser(ctx, r)
+		results[i] = &pb.BatchDeleteUserResult{Id: r.Id, Status: batchStatus(err)}
+		if err == nil {
+			succeeded++
+			undo = append(undo, func() error {
+				// 恢复删除前的内容，但版本号继续递增，读到过已删除状态的客户端不会看到版本回退
+				restored := proto.Clone(before).(*pb.User)
+				restored.Version = after.Version + 1
+				restored, err := t.store.Update(ctx, restored)
+				if err != nil {
+					return err
+				}
+				t.changed(ctx, "BatchDeleteUsers", after, restored)
+				return nil
+			})
+			continue
+		}
+		if req.Atomic {
+			undo.rollback()
+			t.release(ctx, false)
+			for j := range results {
+				if j != i {
+					results[j] = &pb.BatchDeleteUserResult{Id: req.Requests[j].Id, Status: skippedStatus(i)}
+				}
+			}
+			return &pb.BatchDeleteUsersResponse{
+				Results: results,
+				Message: fmt.Sprintf("第%d项删除失败，批量删除未生效", i+1),
+			}, nil
+		}
+	}
+
+	if req.Atomic {
+		t.release(ctx, true)
+	}
+	return &pb.BatchDeleteUsersResponse{
+		Results:      results,
+		SuccessCount: int32(succeeded),
+		Message:      fmt.Sprintf("成功删除%d个用户，失败%d个", succeeded, len(results)-succeeded),
+	}, nil
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/liverlong/rpc-learning/internal/auth"
+	"github.com/liverlong/rpc-learning/internal/store"
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// 密码长度的限制（字符数）
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 128
+)
+
+// dummyPasswordHash 用户不存在或没有设置密码时用来校验的哈希，使这种情况与密码错误的耗时相同，
+// 调用方无法根据响应时间判断邮箱是否已注册
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, err := auth.HashPassword("dummy password")
+	if err != nil {
+		panic(err) // crypto/rand 不会失败
+	}
+	return hash
+})
+
+// randomTokenIssuer 使用随机密钥的令牌签发器
+func randomTokenIssuer() *auth.TokenIssuer {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err) // crypto/rand 不会失败
+	}
+	issuer, err := auth.NewTokenIssuer(key, 0, 0)
+	if err != nil {
+		panic(err)
+	}
+	return issuer
+}
+
+// lockoutKey 登录失败计数的账号：租户内规范化后的邮箱
+func lockoutKey(tenant, email string) string {
+	return tenant + "/" + store.NormalizeEmail(email)
+}
+
+// invalidCredentials 邮箱或密码错误，不区分用户不存在、没有设置密码和密码错误
+func invalidCredentials(res resource) error {
+	return newError(codes.Unauthenticated, pb.ErrorReason_INVALID_CREDENTIALS, res, nil, "邮箱或密码错误")
+}
+
+// accountLocked 账号因连续登录失败被锁定到 until，附带 RetryInfo 告诉调用方何时可以重试
+func accountLocked(res resource, until time.Time) error {
+	return newError(codes.ResourceExhausted, pb.ErrorReason_ACCOUNT_LOCKED, res,
+		map[string]string{"locked_until": strconv.FormatInt(until.Unix(), 10)},
+		"登录失败次数过多，账号已被暂时锁定",
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(time.Until(until).Round(time.Second))})
+}
+
+// checkPassword 校验账号 key 的密码，encoded 为空表示用户不存在或没有设置密码；
+// 失败时计入 key 的失败次数，达到上限时返回 ACCOUNT_LOCKED
+func (s *UserServer) checkPassword(res resource, key, encoded, password string) error {
+	if until, locked := s.lockout.Locked(key); locked {
+		return accountLocked(res, until)
+	}
+
+	var err error
+	if encoded == "" {
+		auth.CheckPassword(dummyPasswordHash(), password)
+		err = auth.ErrPasswordMismatch
+	} else {
+		err = auth.CheckPassword(encoded, password)
+	}
+	if err == nil {
+		s.lockout.Succeed(key)
+		return nil
+	}
+	if !errors.Is(err, auth.ErrPasswordMismatch) {
+		log.Printf("Failed to check password for %s: %v", res.name, err)
+	}
+	if until, locked := s.lockout.Fail(key); locked {
+		log.Printf("Account %s locked until %v", key, until)
+		return accountLocked(res, until)
+	}
+	return invalidCredentials(res)
+}
+
+// passwordHash 返回用户的密码哈希，没有设置密码时返回空
+func (t *tenant) passwordHash(ctx context.Context, userID int64) (string, error) {
+	hash, err := t.server.credentials.PasswordHash(ctx, t.name, userID)
+	if errors.Is(err, store.ErrNoPassword) {
+		return "", nil
+	}
+	if err != nil {
+		log.Printf("Credentials error: %v", err)
+		return "", newError(codes.Internal, pb.ErrorReason_STORAGE_ERROR, userResource(userID), nil, "存储错误")
+	}
+	return hash, nil
+}
+
+// tokensToPB 转换为响应中的令牌
+func tokensToPB(tokens *auth.Tokens) *pb.Tokens {
+	return &pb.Tokens{
+		AccessToken:           tokens.Access,
+		AccessTokenExpiresAt:  tokens.AccessExpiresAt.Unix(),
+		RefreshToken:          tokens.Refresh,
+		RefreshTokenExpiresAt: tokens.RefreshExpiresAt.Unix(),
+		TokenType:             "Bearer",
+	}
+}
+
+// SetPassword 设置或修改用户的密码
+//
+// 用户已有密码时必须提供正确的当前密码，错误的当前密码与登录失败一起计数；管理员重置密码时不需要。
+func (s *UserServer) SetPassword(ctx context.Context, req *pb.SetPasswordRequest) (*pb.SetPasswordResponse, error) {
+	log.Printf("SetPassword called for user %d", req.Id) // 不记录密码
+
+	t, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := userResource(req.Id)
+	var v violations
+	if req.Id <= 0 {
+		v.add("id", "用户ID必须大于0")
+	}
+	switch n := utf8.RuneCountInString(req.Password); {
+	case !utf8.ValidString(req.Password):
+		v.add("password", "密码不是合法的UTF-8字符串")
+	case n < minPasswordLength || n > maxPasswordLength:
+		v.add("password", "密码必须是%d到%d个字符", minPasswordLength, maxPasswordLength)
+	}
+	if err := v.err(res); err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	user, err := res.live(t.store.Get(ctx, req.Id))
+	if err != nil {
+		return nil, err
+	}
+	current, err := t.passwordHash(ctx, user.Id)
+	if err != nil {
+		return nil, err
+	}
+	if id, ok := auth.FromContext(ctx); current != "" && !(ok && id.IsAdmin()) {
+		if req.CurrentPassword == "" {
+			return nil, invalidArgument(res, "current_password", "用户已设置密码，必须提供当前密码")
+		}
+		if err := s.checkPassword(res, lockoutKey(t.name, user.Email), current, req.CurrentPassword); err != nil {
+			return nil, err
+		}
+	}
+
+	hash, err := auth.HashPassword(req.Password)
+	if err != nil {
+		log.Printf("Failed to hash password: %v", err)
+		return nil, newError(codes.Internal, pb.ErrorReason_STORAGE_ERROR, res, nil, "计算密码哈希失败")
+	}
+	if err := s.credentials.SetPassword(ctx, t.name, user.Id, hash); err != nil {
+		log.Printf("Credentials error: %v", err)
+		return nil, newError(codes.Internal, pb.ErrorReason_STORAGE_ERROR, res, nil, "存储错误")
+	}
+	// 审计记录只包含字段名，不包含密码或哈希
+	s.appendAudit(ctx, t.name, "SetPassword", user.Id, []*pb.FieldChange{{Field: "password"}})
+
+	return &pb.SetPasswordResponse{Message: "密码设置成功"}, nil
+}
+
+// Authenticate 用邮箱和密码登录，签发访问令牌和刷新令牌
+//
+// 同一个邮箱连续失败 auth.DefaultMaxFailures 次（可配置）后锁定一段时间，锁定期间即使密码正确也返回 RESOURCE_EXHAUSTED。
+// 用户不存在、已删除、没有设置密码和密码错误都返回同样的 UNAUTHENTICATED。
+func (s *UserServer) Authenticate(ctx context.Context, req *pb.AuthenticateRequest) (*pb.AuthenticateResponse, error) {
+	log.Printf("Authenticate called for %s", req.Email) // 不记录密码
+
+	t, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := userKeyResource(req.Email)
+	var v violations
+	if req.Email == "" {
+		v.add("email", "邮箱不能为空")
+	}
+	if req.Password == "" {
+		v.add("password", "密码不能为空")
+	}
+	if err := v.err(res); err != nil {
+		return nil, err
+	}
+
+	var hash string
+	user, err := t.store.GetByEmail(ctx, req.Email)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+	case err != nil:
+		return nil, res.storeError(err)
+	case user.DeletedAt == 0:
+		if hash, err = t.passwordHash(ctx, user.Id); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.checkPassword(res, lockoutKey(t.name, req.Email), hash, req.Password); err != nil {
+		return nil, err
+	}
+
+	tokens, err := s.tokens.Issue(t.name, strconv.FormatInt(user.Id, 10), roleName(user.Role))
+	if err != nil {
+		log.Printf("Failed to issue tokens: %v", err)
+		return nil, newError(codes.Internal, pb.ErrorReason_STORAGE_ERROR, userResource(user.Id), nil, "签发令牌失败")
+	}
+	return &pb.AuthenticateResponse{
+		Tokens:  tokensToPB(tokens),
+		User:    user,
+		Message: "登录成功",
+	}, nil
+}
+
+// RefreshToken 用未过期的刷新令牌换取新的一对令牌，令牌所属的用户必须仍然存在且未被删除
+func (s *UserServer) RefreshToken(ctx context.Context, req *pb.RefreshTokenRequest) (*pb.RefreshTokenResponse, error) {
+	log.Printf("RefreshToken called")
+
+	t, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	invalid := newError(codes.Unauthenticated, pb.ErrorReason_INVALID_TOKEN, usersResource, nil, "刷新令牌无效或已过期")
+	claims, err := s.tokens.Verify(req.RefreshToken, auth.RefreshToken)
+	if err != nil || claims.Tenant != t.name {
+		return nil, invalid
+	}
+	id, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return nil, invalid
+	}
+	user, err := t.store.Get(ctx, id)
+	if errors.Is(err, store.ErrNotFound) || (err == nil && user.DeletedAt != 0) {
+		return nil, invalid
+	}
+	if err != nil {
+		return nil, userResource(id).storeError(err)
+	}
+
+	// 使用用户当前的角色，角色的修改在刷新令牌后生效
+	tokens, err := s.tokens.Issue(t.name, claims.Subject, roleName(user.Role))
+	if err != nil {
+		log.Printf("Failed to issue tokens: %v", err)
+		return nil, newError(codes.Internal, pb.ErrorReason_STORAGE_ERROR, userResource(id), nil, "签发令牌失败")
+	}
+	return &pb.RefreshTokenResponse{
+		Tokens:  tokensToPB(tokens),
+		Message: "令牌刷新成功",
+	}, nil
+}
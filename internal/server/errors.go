@@ -0,0 +1,118 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/liverlong/rpc-learning/internal/store"
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+)
+
+// errorDomain 错误详情 ErrorInfo 中的 domain
+const errorDomain = "user.rpc-learning"
+
+// 错误详情 ResourceInfo 中的资源类型
+const (
+	userResourceType       = "user"
+	userEventResourceType  = "user_event"
+	auditEventResourceType = "audit_event"
+	tenantResourceType     = "tenant"
+	methodResourceType     = "method"
+)
+
+// resource 错误涉及的资源，对应错误详情中的 google.rpc.ResourceInfo
+type resource struct {
+	typ  string
+	name string
+}
+
+// userResource 按ID定位的用户，资源名为 users/{id}
+func userResource(id int64) resource {
+	return resource{typ: userResourceType, name: "users/" + strconv.FormatInt(id, 10)}
+}
+
+// userKeyResource 按邮箱或手机号定位的用户，资源名为查询使用的值
+func userKeyResource(key string) resource {
+	return resource{typ: userResourceType, name: key}
+}
+
+// 集合级别的资源，用于不针对单个用户的请求
+var (
+	usersResource       = resource{typ: userResourceType, name: "users"}
+	userEventsResource  = resource{typ: userEventResourceType, name: "users/-/events"}
+	auditEventsResource = resource{typ: auditEventResourceType, name: "auditEvents"}
+)
+
+// newError 构造附带 ErrorInfo 和 ResourceInfo 详情的状态错误，extra 是额外的详情（例如 BadRequest）
+func newError(code codes.Code, reason pb.ErrorReason, res resource, metadata map[string]string, message string, extra ...protoadapt.MessageV1) error {
+	details := append([]protoadapt.MessageV1{
+		&errdetails.ErrorInfo{Reason: reason.String(), Domain: errorDomain, Metadata: metadata},
+		&errdetails.ResourceInfo{ResourceType: res.typ, ResourceName: res.name},
+	}, extra...)
+	st, err := status.New(code, message).WithDetails(details...)
+	if err != nil {
+		return status.Error(code, message)
+	}
+	return st.Err()
+}
+
+// invalidArgument 只有一个字段不合法时的 INVALID_ARGUMENT 错误
+func invalidArgument(res resource, field, format string, args ...any) error {
+	var v violations
+	v.add(field, format, args...)
+	return v.err(res)
+}
+
+// invalidID 用户ID不是正数
+func invalidID(id int64) error {
+	return invalidArgument(userResource(id), "id", "用户ID必须大于0")
+}
+
+// live 把存储层对 r 的查询结果转换为handler的返回值，已软删除的用户返回 FAILED_PRECONDITION，
+// 以便调用方区分“已删除（可恢复）”和“不存在”
+func (r resource) live(user *pb.User, err error) (*pb.User, error) {
+	if err != nil {
+		return nil, r.storeError(err)
+	}
+	if user.DeletedAt != 0 {
+		return nil, newError(codes.FailedPrecondition, pb.ErrorReason_USER_DELETED, userResource(user.Id), nil, "用户已被删除")
+	}
+	return user, nil
+}
+
+// storeError 把存储层错误转换为gRPC状态错误
+func (r resource) storeError(err error) error {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return newError(codes.NotFound, pb.ErrorReason_USER_NOT_FOUND, r, nil, "用户不存在")
+	case errors.Is(err, store.ErrEmailExists):
+		return newError(codes.AlreadyExists, pb.ErrorReason_EMAIL_ALREADY_EXISTS, r, map[string]string{"field": "email"}, "邮箱已存在")
+	case errors.Is(err, store.ErrPhoneExists):
+		return newError(codes.AlreadyExists, pb.ErrorReason_PHONE_ALREADY_EXISTS, r, map[string]string{"field": "phone"}, "手机号已存在")
+	case errors.Is(err, store.ErrIDExists):
+		log.Printf("Store error: %v", err)
+		return newError(codes.Internal, pb.ErrorReason_ID_GENERATION_FAILED, r, nil, "生成的用户ID已被使用")
+	default:
+		log.Printf("Store error: %v", err)
+		return newError(codes.Internal, pb.ErrorReason_STORAGE_ERROR, r, nil, "存储错误")
+	}
+}
+
+// checkVersion 乐观并发控制：expected 非0时必须等于用户的当前版本
+func checkVersion(user *pb.User, expected int64) error {
+	if expected != 0 && expected != user.Version {
+		return newError(codes.Aborted, pb.ErrorReason_VERSION_MISMATCH, userResource(user.Id),
+			map[string]string{
+				"expected_version": strconv.FormatInt(expected, 10),
+				"current_version":  strconv.FormatInt(user.Version, 10),
+			},
+			fmt.Sprintf("用户已被修改，期望版本%d，当前版本%d", expected, user.Version))
+	}
+	return nil
+}
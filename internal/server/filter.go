@@ -0,0 +1,344 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+)
+
+// ListUsers 的 filter 表达式，语法参考 AIP-160 的一个子集：
+//
+//	filter    = condition { "AND" condition }
+//	condition = field op value
+//	op        = "=" | "!=" | "<" | "<=" | ">" | ">="
+//
+// 字符串字段（name、email、phone）只支持 = 和 !=，值必须加双引号，
+// 其中的 * 是通配符，例如 name = "张*" 匹配前缀，email = "*@example.com" 匹配邮箱域名。
+// 邮箱比较不区分大小写。
+// 数值字段（id、age）以及时间字段（created_at、updated_at）支持全部比较运算符；
+// 时间字段的值可以是Unix秒数，也可以是带双引号的RFC 3339时间。
+// user.v2 的字段名 display_name、create_time、update_time 分别与 name、created_at、updated_at 相同。
+
+// fieldKind 字段的值类型
+type fieldKind int
+
+const (
+	stringField fieldKind = iota
+	numberField
+	timeField
+)
+
+// filterFields 可以在 filter 和 order_by 中使用的字段
+var filterFields = map[string]fieldKind{
+	"id":         numberField,
+	"name":       stringField,
+	"email":      stringField,
+	"phone":      stringField,
+	"age":        numberField,
+	"created_at": timeField,
+	"updated_at": timeField,
+
+	// user.v2 的字段名
+	"display_name": stringField,
+	"create_time":  timeField,
+	"update_time":  timeField,
+}
+
+// fieldAliases user.v2 的字段名对应的 v1 字段名
+var fieldAliases = map[string]string{
+	"display_name": "name",
+	"create_time":  "created_at",
+	"update_time":  "updated_at",
+}
+
+// stringValue 返回字符串字段的值
+func stringValue(u *pb.User, field string) string {
+	switch field {
+	case "name", "display_name":
+		return u.Name
+	case "email":
+		return u.Email
+	default:
+		return u.Phone
+	}
+}
+
+// numberValue 返回数值或时间字段的值
+func numberValue(u *pb.User, field string) int64 {
+	switch field {
+	case "id":
+		return u.Id
+	case "age":
+		return int64(u.Age)
+	case "created_at", "create_time":
+		return u.CreatedAt
+	default:
+		return u.UpdatedAt
+	}
+}
+
+// ParseError 表达式解析错误，Pos 是出错位置（从1开始的字符序号）
+type ParseError struct {
+	Pos int
+	Msg string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("第%d个字符处: %s", e.Pos, e.Msg)
+}
+
+// token 词法单元
+type token struct {
+	kind string // ident, string, number, op, eof
+	text string
+	pos  int // 从1开始的字符序号
+}
+
+// lexer 把表达式切分为词法单元
+type lexer struct {
+	src string
+	off int // 字节偏移
+	pos int // 已读取的字符数
+}
+
+func (l *lexer) next() (token, error) {
+	for l.off < len(l.src) {
+		r, size := utf8.DecodeRuneInString(l.src[l.off:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		l.off += size
+		l.pos++
+	}
+	start := l.pos + 1
+	if l.off >= len(l.src) {
+		return token{kind: "eof", pos: start}, nil
+	}
+
+	r, size := utf8.DecodeRuneInString(l.src[l.off:])
+	switch {
+	case r == '"':
+		return l.lexString(start)
+	case r == '-' || (r >= '0' && r <= '9'):
+		text := l.take(func(r rune) bool { return r >= '0' && r <= '9' }, size)
+		if text == "-" {
+			return token{}, &ParseError{Pos: start, Msg: "'-' 后面缺少数字"}
+		}
+		return token{kind: "number", text: text, pos: start}, nil
+	case r == '_' || unicode.IsLetter(r):
+		text := l.take(func(r rune) bool { return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) }, size)
+		return token{kind: "ident", text: text, pos: start}, nil
+	case strings.ContainsRune("=!<>", r):
+		text := l.take(func(r rune) bool { return r == '=' }, size)
+		switch text {
+		case "=", "!=", "<", "<=", ">", ">=":
+			return token{kind: "op", text: text, pos: start}, nil
+		}
+		return token{}, &ParseError{Pos: start, Msg: fmt.Sprintf("无效的运算符 %q", text)}
+	case r == ',':
+		l.off += size
+		l.pos++
+		return token{kind: "comma", text: ",", pos: start}, nil
+	}
+	return token{}, &ParseError{Pos: start, Msg: fmt.Sprintf("无法识别的字符 %q", r)}
+}
+
+// take 读取首字符（字节长度 firstSize）以及其后所有满足 ok 的字符
+func (l *lexer) take(ok func(rune) bool, firstSize int) string {
+	begin := l.off
+	l.off += firstSize
+	l.pos++
+	for l.off < len(l.src) {
+		r, size := utf8.DecodeRuneInString(l.src[l.off:])
+		if !ok(r) {
+			break
+		}
+		l.off += size
+		l.pos++
+	}
+	return l.src[begin:l.off]
+}
+
+func (l *lexer) lexString(start int) (token, error) {
+	var b strings.Builder
+	l.off++
+	l.pos++
+	for l.off < len(l.src) {
+		r, size := utf8.DecodeRuneInString(l.src[l.off:])
+		l.off += size
+		l.pos++
+		switch r {
+		case '"':
+			return token{kind: "string", text: b.String(), pos: start}, nil
+		case '\\':
+			if l.off >= len(l.src) {
+				return token{}, &ParseError{Pos: start, Msg: "字符串没有结束"}
+			}
+			r, size = utf8.DecodeRuneInString(l.src[l.off:])
+			l.off += size
+			l.pos++
+		}
+		b.WriteRune(r)
+	}
+	return token{}, &ParseError{Pos: start, Msg: "字符串没有结束"}
+}
+
+// userFilter 编译后的过滤条件，所有条件都满足时用户才被选中
+type userFilter []func(*pb.User) bool
+
+// match 判断用户是否满足过滤条件
+func (f userFilter) match(u *pb.User) bool {
+	for _, cond := range f {
+		if !cond(u) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseFilter 解析 filter 表达式，空表达式匹配所有用户
+func parseFilter(src string) (userFilter, error) {
+	l := &lexer{src: src}
+	tok, err := l.next()
+	if err != nil {
+		return nil, err
+	}
+	if tok.kind == "eof" {
+		return nil, nil
+	}
+
+	var filter userFilter
+	for {
+		cond, err := parseCondition(l, tok)
+		if err != nil {
+			return nil, err
+		}
+		filter = append(filter, cond)
+
+		tok, err = l.next()
+		if err != nil {
+			return nil, err
+		}
+		if tok.kind == "eof" {
+			return filter, nil
+		}
+		if tok.kind != "ident" || tok.text != "AND" {
+			return nil, &ParseError{Pos: tok.pos, Msg: fmt.Sprintf("期望 AND，实际为 %q", tok.text)}
+		}
+		if tok, err = l.next(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseCondition 解析以 fieldTok 开头的一个比较条件
+func parseCondition(l *lexer, fieldTok token) (func(*pb.User) bool, error) {
+	if fieldTok.kind != "ident" {
+		return nil, &ParseError{Pos: fieldTok.pos, Msg: "期望字段名"}
+	}
+	field := fieldTok.text
+	kind, ok := filterFields[field]
+	if !ok {
+		return nil, &ParseError{Pos: fieldTok.pos, Msg: fmt.Sprintf("未知字段 %q", field)}
+	}
+
+	opTok, err := l.next()
+	if err != nil {
+		return nil, err
+	}
+	if opTok.kind != "op" {
+		return nil, &ParseError{Pos: opTok.pos, Msg: "期望比较运算符"}
+	}
+	op := opTok.text
+
+	valTok, err := l.next()
+	if err != nil {
+		return nil, err
+	}
+
+	if kind == stringField {
+		if op != "=" && op != "!=" {
+			return nil, &ParseError{Pos: opTok.pos, Msg: fmt.Sprintf("字段 %s 只支持 = 和 !=", field)}
+		}
+		if valTok.kind != "string" {
+			return nil, &ParseError{Pos: valTok.pos, Msg: "期望带双引号的字符串"}
+		}
+		pattern := valTok.text
+		if field == "email" {
+			pattern = strings.ToLower(pattern)
+		}
+		return func(u *pb.User) bool {
+			v := stringValue(u, field)
+			if field == "email" {
+				v = strings.ToLower(v)
+			}
+			return wildcardMatch(pattern, v) == (op == "=")
+		}, nil
+	}
+
+	var want int64
+	switch {
+	case valTok.kind == "number":
+		want, err = strconv.ParseInt(valTok.text, 10, 64)
+		if err != nil {
+			return nil, &ParseError{Pos: valTok.pos, Msg: fmt.Sprintf("无效的数字 %q", valTok.text)}
+		}
+	case valTok.kind == "string" && kind == timeField:
+		t, err := time.Parse(time.RFC3339, valTok.text)
+		if err != nil {
+			return nil, &ParseError{Pos: valTok.pos, Msg: fmt.Sprintf("无效的RFC 3339时间 %q", valTok.text)}
+		}
+		want = t.Unix()
+	default:
+		return nil, &ParseError{Pos: valTok.pos, Msg: fmt.Sprintf("字段 %s 期望数字", field)}
+	}
+
+	return func(u *pb.User) bool {
+		return compareInt(numberValue(u, field), op, want)
+	}, nil
+}
+
+func compareInt(v int64, op string, want int64) bool {
+	switch op {
+	case "=":
+		return v == want
+	case "!=":
+		return v != want
+	case "<":
+		return v < want
+	case "<=":
+		return v <= want
+	case ">":
+		return v > want
+	default:
+		return v >= want
+	}
+}
+
+// wildcardMatch 判断 s 是否匹配 pattern，pattern 中的 * 匹配任意长度的字符串
+func wildcardMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return s == pattern
+	}
+
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, last)
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/liverlong/rpc-learning/internal/auth"
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// 幂等请求的默认配置
+const (
+	DefaultIdempotencyTTL = 24 * time.Hour // 记住成功请求的时间
+	maxIdempotencyKeys    = 100000         // 最多记住的请求数，超过后丢弃最早的
+	maxRequestIDLength    = 128
+)
+
+// 幂等键相关的元数据
+const (
+	idempotencyKeyHeader = "idempotency-key"     // 请求中的幂等键，与 request_id 字段等价
+	replayedHeader       = "idempotent-replayed" // 响应头，值为 "true" 表示响应是第一次请求的重放
+)
+
+// idempotentRequest 带 request_id 字段的修改请求
+type idempotentRequest interface {
+	proto.Message
+	GetRequestId() string
+}
+
+// requestCache 最近成功的修改请求及其响应，按 RPC、调用方和 request_id 索引
+//
+// 只保存在内存中，服务器重启后之前的 request_id 会被当作新请求。
+// 失败的请求不会被记住：失败时没有修改数据，重试会重新执行。
+type requestCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*list.Element // 值为 *cachedResponse
+	order   *list.List               // 按记录时间排序，最早的在前
+}
+
+type cachedResponse struct {
+	key         string
+	fingerprint [sha256.Size]byte // 去掉 request_id 后的请求内容的哈希
+	response    proto.Message
+	expires     time.Time
+}
+
+func newRequestCache(ttl time.Duration) *requestCache {
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+	return &requestCache{
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get 返回 key 对应的未过期记录
+func (c *requestCache) get(key string, now time.Time) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire(now)
+	if e, ok := c.entries[key]; ok {
+		return e.Value.(*cachedResponse)
+	}
+	return nil
+}
+
+// put 记住 key 对应的响应
+func (c *requestCache) put(entry *cachedResponse, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.expires = now.Add(c.ttl)
+	c.entries[entry.key] = c.order.PushBack(entry)
+	for c.order.Len() > maxIdempotencyKeys {
+		c.remove(c.order.Front())
+	}
+}
+
+// expire 丢弃已过期的记录，记录按时间顺序加入且有效期相同，只需检查开头
+func (c *requestCache) expire(now time.Time) {
+	for e := c.order.Front(); e != nil && !now.Before(e.Value.(*cachedResponse).expires); e = c.order.Front() {
+		c.remove(e)
+	}
+}
+
+func (c *requestCache) remove(e *list.Element) {
+	delete(c.entries, c.order.Remove(e).(*cachedResponse).key)
+}
+
+// idempotent 按请求的 request_id（或 idempotency-key 元数据）执行 call
+//
+// 没有 request_id 时直接执行；同一个调用方在同一个 RPC 中的 request_id 已经成功执行过时不再执行，
+// 直接返回第一次响应的副本，并在响应头中设置 idempotent-replayed；
+// request_id 相同但请求内容不同时返回 INVALID_ARGUMENT。
+// 调用方持有 t.mu，因此同一个 request_id 的并发请求也只会执行一次。
+func idempotent[Req idempotentRequest, Resp proto.Message](ctx context.Context, c *requestCache, res resource, req Req,
+	call func(context.Context, Req) (Resp, error)) (Resp, error) {
+	var zero Resp
+
+	id, err := requestID(ctx, res, req)
+	if err != nil {
+		return zero, err
+	}
+	if id == "" {
+		return call(ctx, req)
+	}
+
+	now := time.Now()
+	key := requestKey(ctx, req, id)
+	fingerprint := requestFingerprint(req)
+	if cached := c.get(key, now); cached != nil {
+		if cached.fingerprint != fingerprint {
+			return zero, newError(codes.InvalidArgument, pb.ErrorReason_REQUEST_ID_REUSED, res,
+				map[string]string{"request_id": id}, "request_id 已被内容不同的请求使用",
+				&errdetails.BadRequest{FieldViolations: []*errdetails.BadRequest_FieldViolation{{
+					Field:       "request_id",
+					Description: "request_id 已被内容不同的请求使用",
+				}}})
+		}
+		// 不在gRPC调用中（例如测试直接调用handler）时无法设置响应头，忽略即可
+		_ = grpc.SetHeader(ctx, metadata.Pairs(replayedHeader, "true"))
+		return proto.Clone(cached.response).(Resp), nil
+	}
+
+	resp, err := call(ctx, req)
+	if err != nil {
+		return zero, err
+	}
+	c.put(&cachedResponse{key: key, fingerprint: fingerprint, response: proto.Clone(resp)}, now)
+	return resp, nil
+}
+
+// requestKey 请求在 requestCache 中的键，由 RPC、通过认证的调用方和 request_id 组成，
+// 不同调用方的相同 request_id 互不影响；request_id 不含控制字符，用换行分隔不会产生歧义
+func requestKey(ctx context.Context, req idempotentRequest, id string) string {
+	var subject string
+	if caller, ok := auth.FromContext(ctx); ok {
+		subject = caller.Name
+	}
+	return string(req.ProtoReflect().Descriptor().FullName()) + "\n" + subject + "\n" + id
+}
+
+// requestID 返回请求的 request_id，字段为空时取 idempotency-key 元数据，两者都设置时必须相同
+func requestID(ctx context.Context, res resource, req idempotentRequest) (string, error) {
+	id := req.GetRequestId()
+	if values := metadata.ValueFromIncomingContext(ctx, idempotencyKeyHeader); len(values) > 0 {
+		switch {
+		case id == "":
+			id = values[0]
+		case id != values[0]:
+			return "", invalidArgument(res, "request_id", "request_id 与 %s 元数据不一致", idempotencyKeyHeader)
+		}
+	}
+
+	switch {
+	case id == "":
+		return "", nil
+	case len(id) > maxRequestIDLength:
+		return "", invalidArgument(res, "request_id", "request_id 不能超过%d个字符", maxRequestIDLength)
+	case strings.TrimSpace(id) == "" || strings.IndexFunc(id, unicode.IsControl) >= 0:
+		return "", invalidArgument(res, "request_id", "request_id 不能为空白或包含控制字符")
+	}
+	return id, nil
+}
+
+// requestFingerprint 去掉 request_id 后的请求内容的哈希，用于识别复用 request_id 的不同请求
+func requestFingerprint(req idempotentRequest) [sha256.Size]byte {
+	m := proto.Clone(req).ProtoReflect()
+	m.Clear(m.Descriptor().Fields().ByName("request_id"))
+	data, _ := proto.MarshalOptions{Deterministic: true}.Marshal(m.Interface())
+	return sha256.Sum256(data)
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"cmp"
+	"fmt"
+	"strings"
+
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+)
+
+// orderKey order_by 中的一个排序字段
+type orderKey struct {
+	field string
+	desc  bool
+}
+
+// userOrder 编译后的排序规则，最后总是按ID升序决定并列用户的顺序
+type userOrder []orderKey
+
+// parseOrderBy 解析形如 "age desc, name" 的 order_by 表达式，空表达式表示按ID升序
+func parseOrderBy(src string) (userOrder, error) {
+	l := &lexer{src: src}
+	tok, err := l.next()
+	if err != nil {
+		return nil, err
+	}
+	if tok.kind == "eof" {
+		return nil, nil
+	}
+
+	var order userOrder
+	for {
+		if tok.kind != "ident" {
+			return nil, &ParseError{Pos: tok.pos, Msg: "期望字段名"}
+		}
+		if _, ok := filterFields[tok.text]; !ok {
+			return nil, &ParseError{Pos: tok.pos, Msg: fmt.Sprintf("未知字段 %q", tok.text)}
+		}
+		// 别名统一为 v1 字段名，翻页令牌中的排序键只按 v1 字段名记录
+		key := orderKey{field: tok.text}
+		if field, ok := fieldAliases[tok.text]; ok {
+			key.field = field
+		}
+
+		if tok, err = l.next(); err != nil {
+			return nil, err
+		}
+		if tok.kind == "ident" {
+			switch strings.ToLower(tok.text) {
+			case "asc":
+			case "desc":
+				key.desc = true
+			default:
+				return nil, &ParseError{Pos: tok.pos, Msg: fmt.Sprintf("期望 asc 或 desc，实际为 %q", tok.text)}
+			}
+			if tok, err = l.next(); err != nil {
+				return nil, err
+			}
+		}
+		order = append(order, key)
+
+		switch tok.kind {
+		case "eof":
+			return order, nil
+		case "comma":
+			if tok, err = l.next(); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, &ParseError{Pos: tok.pos, Msg: fmt.Sprintf("期望 ',' 或结束，实际为 %q", tok.text)}
+		}
+	}
+}
+
+// compare 按排序规则比较两个用户，返回负数表示 a 排在 b 之前
+func (o userOrder) compare(a, b *pb.User) int {
+	for _, key := range o {
+		var c int
+		if filterFields[key.field] == stringField {
+			c = strings.Compare(stringValue(a, key.field), stringValue(b, key.field))
+		} else {
+			c = cmp.Compare(numberValue(a, key.field), numberValue(b, key.field))
+		}
+		if key.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(a.Id, b.Id)
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+)
+
+// pageToken ListUsers 翻页令牌的内容
+//
+// 令牌记录上一页最后一个用户的排序键，下一页从排在它之后的用户开始（keyset分页），
+// 因此翻页期间新建或删除用户不会让结果重复或遗漏。
+// 令牌同时记录影响结果集的请求参数，用于拒绝参数不一致的翻页请求。
+type pageToken struct {
+	After       cursor `json:"after"`
+	ShowDeleted bool   `json:"show_deleted,omitempty"`
+	Filter      string `json:"filter,omitempty"`
+	OrderBy     string `json:"order_by,omitempty"`
+}
+
+// cursor 用户的排序键，只记录ID和 order_by 中出现的字段
+type cursor struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name,omitempty"`
+	Email     string `json:"email,omitempty"`
+	Phone     string `json:"phone,omitempty"`
+	Age       int32  `json:"age,omitempty"`
+	CreatedAt int64  `json:"created_at,omitempty"`
+	UpdatedAt int64  `json:"updated_at,omitempty"`
+}
+
+// cursorOf 提取用户在给定排序规则下的排序键
+func cursorOf(u *pb.User, order userOrder) cursor {
+	c := cursor{ID: u.Id}
+	for _, key := range order {
+		switch key.field {
+		case "name":
+			c.Name = u.Name
+		case "email":
+			c.Email = u.Email
+		case "phone":
+			c.Phone = u.Phone
+		case "age":
+			c.Age = u.Age
+		case "created_at":
+			c.CreatedAt = u.CreatedAt
+		case "updated_at":
+			c.UpdatedAt = u.UpdatedAt
+		}
+	}
+	return c
+}
+
+// user 把排序键还原为可以参与比较的用户
+func (c cursor) user() *pb.User {
+	return &pb.User{
+		Id:        c.ID,
+		Name:      c.Name,
+		Email:     c.Email,
+		Phone:     c.Phone,
+		Age:       c.Age,
+		CreatedAt: c.CreatedAt,
+		UpdatedAt: c.UpdatedAt,
+	}
+}
+
+// encode 把令牌编码为对客户端不透明的字符串
+func (t pageToken) encode() string {
+	data, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodePageToken 解析客户端传回的翻页令牌
+func decodePageToken(s string) (pageToken, error) {
+	var t pageToken
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return t, err
+	}
+	err = json.Unmarshal(data, &t)
+	return t, err
+}
+
+// matches 判断令牌是否由参数相同的请求生成
+func (t pageToken) matches(req *pb.ListUsersRequest) bool {
+	return t.ShowDeleted == req.ShowDeleted && t.Filter == req.Filter && t.OrderBy == req.OrderBy
+}
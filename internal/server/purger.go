@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// DefaultRetention 软删除用户的默认保留期
+const DefaultRetention = 30 * 24 * time.Hour
+
+// PurgeDeleted 彻底删除所有租户中软删除时间早于 retention 之前的用户，返回清除的用户数
+func (s *UserServer) PurgeDeleted(ctx context.Context, retention time.Duration) (int, error) {
+	tenants, err := s.allTenants()
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-retention).Unix()
+	purged := 0
+	for _, t := range tenants {
+		n, err := t.purge(ctx, cutoff)
+		purged += n
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+// purge 彻底删除软删除时间不晚于 cutoff 的用户
+func (t *tenant) purge(ctx context.Context, cutoff int64) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	users, err := t.store.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, user := range users {
+		if user.DeletedAt == 0 || user.DeletedAt > cutoff {
+			continue
+		}
+		if err := t.store.Delete(ctx, user.Id); err != nil {
+			return purged, err
+		}
+		if err := t.server.credentials.DeletePassword(ctx, t.name, user.Id); err != nil {
+			log.Printf("Failed to delete password of purged user %d: %v", user.Id, err)
+		}
+		t.changed(ctx, "PurgeDeleted", user, nil)
+		purged++
+	}
+	return purged, nil
+}
+
+// RunPurger 每隔 interval 清除一次超过保留期的软删除用户，直到 ctx 被取消；interval 不是正数时不清理
+func (s *UserServer) RunPurger(ctx context.Context, retention, interval time.Duration) {
+	if interval <= 0 {
+		log.Printf("Purger disabled: interval %v is not positive", interval)
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purged, err := s.PurgeDeleted(ctx, retention)
+			if err != nil {
+				log.Printf("Purge deleted users failed: %v", err)
+				continue
+			}
+			if purged > 0 {
+				log.Printf("Purged %d deleted users older than %v", purged, retention)
+			}
+		}
+	}
+}
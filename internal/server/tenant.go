@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/liverlong/rpc-learning/internal/auth"
+	"github.com/liverlong/rpc-learning/internal/search"
+	"github.com/liverlong/rpc-learning/internal/store"
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+// tenantHeader 请求元数据中的租户ID
+const tenantHeader = "x-tenant-id"
+
+// tenantPattern 合法的租户ID：小写字母、数字和横线，以字母或数字开头和结尾，最长63个字符。
+// 持久化存储直接用租户ID作为目录名。
+var tenantPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// tenantResource 租户资源，资源名为 tenants/{tenant}
+func tenantResource(name string) resource {
+	return resource{typ: tenantResourceType, name: "tenants/" + name}
+}
+
+// tenant 一个租户的数据
+//
+// 每个租户有独立的存储（因此ID、邮箱和手机号的唯一性只在租户内）、搜索索引、变更事件、
+// 幂等请求记录和聊天室，写操作也只在租户内串行化。
+type tenant struct {
+	name        string // 单租户模式下为空
+	server      *UserServer
+	store       store.UserStore
+	mu          sync.Mutex    // 串行化写操作，保证读-改-写的原子性
+	index       *search.Index // 未删除用户的全文索引，随每次写操作更新
+	feed        *changeFeed   // 用户变更事件，供 WatchUsers 使用
+	requests    *requestCache // 最近成功的修改请求，用于按 request_id 去重
+	held        []change      // 原子批量操作期间暂存的审计记录，受 mu 保护
+	holding     bool
+	chatClients map[int64]*ChatClient
+	chatMu      sync.RWMutex
+}
+
+// newTenant 创建租户，并为存储中已有的用户建立搜索索引
+func (s *UserServer) newTenant(name string, userStore store.UserStore) *tenant {
+	t := &tenant{
+		name:        name,
+		server:      s,
+		store:       userStore,
+		index:       search.NewIndex(),
+		feed:        newChangeFeed(s.watchHistory),
+		requests:    newRequestCache(s.idempotencyTTL),
+		chatClients: make(map[int64]*ChatClient),
+	}
+
+	users, err := userStore.List(context.Background())
+	if err != nil {
+		log.Printf("Failed to build search index for tenant %q: %v", name, err)
+	}
+	for _, user := range users {
+		if user.DeletedAt == 0 {
+			t.index.Put(user)
+		}
+	}
+	return t
+}
+
+// NewMultiTenantServer 创建多租户的用户服务服务器
+//
+// 每个请求必须在元数据 x-tenant-id 中指定租户，否则返回 INVALID_ARGUMENT（reason 为 TENANT_REQUIRED）。
+// 租户必须已有数据（stores.List 中的租户）或由 WithTenants 允许，否则返回 NOT_FOUND（reason 为 TENANT_NOT_FOUND），
+// 因此调用方不能通过任意的租户ID创建新的存储，拼错的租户ID也不会被当作空租户。
+// 租户的存储在第一次收到它的请求时由 stores 打开，Close 时关闭。
+func NewMultiTenantServer(stores store.Tenants, opts ...Option) *UserServer {
+	s := newServer(opts)
+	s.stores = stores
+	return s
+}
+
+// tenant 返回请求所属的租户，单租户模式下总是唯一的租户
+//
+// 调用方是用访问令牌认证的用户时，令牌必须是在该租户中签发的，否则返回 PERMISSION_DENIED。
+func (s *UserServer) tenant(ctx context.Context) (*tenant, error) {
+	t, err := s.requestTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if id, ok := auth.FromContext(ctx); ok && !id.IsService() && id.Tenant != t.name {
+		return nil, newError(codes.PermissionDenied, pb.ErrorReason_TENANT_MISMATCH, tenantResource(t.name),
+			map[string]string{"token_tenant": id.Tenant}, "访问令牌不属于该租户")
+	}
+	return t, nil
+}
+
+// requestTenant 返回请求元数据指定的租户
+func (s *UserServer) requestTenant(ctx context.Context) (*tenant, error) {
+	if s.stores == nil {
+		return s.tenants[""], nil
+	}
+
+	values := metadata.ValueFromIncomingContext(ctx, tenantHeader)
+	if len(values) == 0 || values[0] == "" {
+		return nil, newError(codes.InvalidArgument, pb.ErrorReason_TENANT_REQUIRED, tenantResource(""),
+			map[string]string{"header": tenantHeader}, fmt.Sprintf("请求元数据中缺少租户ID（%s）", tenantHeader))
+	}
+	name := values[0]
+	if !tenantPattern.MatchString(name) {
+		return nil, newError(codes.InvalidArgument, pb.ErrorReason_INVALID_TENANT, tenantResource(name),
+			map[string]string{"header": tenantHeader}, "租户ID只能包含小写字母、数字和横线，最长63个字符")
+	}
+	return s.openTenant(name)
+}
+
+// openTenant 返回已打开的租户，没有时打开它的存储
+func (s *UserServer) openTenant(name string) (*tenant, error) {
+	s.tenantsMu.Lock()
+	defer s.tenantsMu.Unlock()
+
+	if t, ok := s.tenants[name]; ok {
+		return t, nil
+	}
+	exists, err := s.tenantExists(name)
+	if err != nil {
+		log.Printf("Failed to list tenants: %v", err)
+		return nil, newError(codes.Internal, pb.ErrorReason_STORAGE_ERROR, tenantResource(name), nil, "打开租户存储失败")
+	}
+	if !exists {
+		return nil, newError(codes.NotFound, pb.ErrorReason_TENANT_NOT_FOUND, tenantResource(name),
+			map[string]string{"header": tenantHeader}, fmt.Sprintf("租户 %s 不存在", name))
+	}
+	userStore, err := s.stores.Open(name)
+	if err != nil {
+		log.Printf("Failed to open store for tenant %q: %v", name, err)
+		return nil, newError(codes.Internal, pb.ErrorReason_STORAGE_ERROR, tenantResource(name), nil, "打开租户存储失败")
+	}
+	t := s.newTenant(name, userStore)
+	s.tenants[name] = t
+	log.Printf("Opened tenant %q", name)
+	return t, nil
+}
+
+// tenantExists 租户是否由 WithTenants 允许或已有数据，调用方持有 s.tenantsMu
+func (s *UserServer) tenantExists(name string) (bool, error) {
+	if s.allowedTenants[name] {
+		return true, nil
+	}
+	names, err := s.stores.List()
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(names, name), nil
+}
+
+// allTenants 返回全部租户，包括已有数据但还没有收到请求的租户，按租户ID排序
+func (s *UserServer) allTenants() ([]*tenant, error) {
+	if s.stores != nil {
+		names, err := s.stores.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if !tenantPattern.MatchString(name) {
+				continue // 数据目录中的其他文件
+			}
+			if _, err := s.openTenant(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	s.tenantsMu.Lock()
+	defer s.tenantsMu.Unlock()
+	tenants := make([]*tenant, 0, len(s.tenants))
+	for _, t := range s.tenants {
+		tenants = append(tenants, t)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].name < tenants[j].name })
+	return tenants, nil
+}
+
+// ListTenants 列出全部租户及其用量，不需要 x-tenant-id
+func (s *UserServer) ListTenants(ctx context.Context, req *pb.ListTenantsRequest) (*pb.ListTenantsResponse, error) {
+	log.Printf("ListTenants called")
+
+	tenants, err := s.allTenants()
+	if err != nil {
+		log.Printf("Failed to list tenants: %v", err)
+		return nil, newError(codes.Internal, pb.ErrorReason_STORAGE_ERROR, tenantResource("-"), nil, "列出租户失败")
+	}
+
+	usage := make([]*pb.TenantUsage, len(tenants))
+	for i, t := range tenants {
+		users, err := t.store.List(ctx)
+		if err != nil {
+			return nil, tenantResource(t.name).storeError(err)
+		}
+		u := &pb.TenantUsage{Tenant: t.name}
+		for _, user := range users {
+			if user.DeletedAt == 0 {
+				u.UserCount++
+			} else {
+				u.DeletedUserCount++
+			}
+		}
+		t.chatMu.RLock()
+		u.OnlineChatUsers = int32(len(t.chatClients))
+		t.chatMu.RUnlock()
+		usage[i] = u
+	}
+
+	return &pb.ListTenantsResponse{
+		Tenants: usage,
+		Message: fmt.Sprintf("共%d个租户", len(usage)),
+	}, nil
+}
+
+// Close 关闭多租户模式下打开的各租户存储；单租户模式的存储由调用方关闭
+func (s *UserServer) Close() error {
+	if s.stores == nil {
+		return nil
+	}
+
+	s.tenantsMu.Lock()
+	defer s.tenantsMu.Unlock()
+	var errs []error
+	for name, t := range s.tenants {
+		if err := t.store.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("close tenant %q: %w", name, err))
+		}
+		delete(s.tenants, name)
+	}
+	return errors.Join(errs...)
+}
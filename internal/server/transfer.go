@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+)
+
+// maxImportErrors ImportUsers 响应中最多返回的失败行数，超出的只计入 failed
+const maxImportErrors = 1000
+
+// ImportUsers 客户端流式导入用户
+//
+// 每条记录按 CreateUser 的规则单独创建，某一行失败不影响其他行；
+// 客户端发送完毕后返回汇总结果和失败的行。
+func (s *UserServer) ImportUsers(stream pb.UserService_ImportUsersServer) error {
+	log.Printf("ImportUsers started")
+
+	t, err := s.tenant(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	ctx := stream.Context()
+	resp := &pb.ImportUsersResponse{}
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("ImportUsers aborted after %d rows: %v", resp.Total, err)
+			return err
+		}
+
+		resp.Total++
+		t.mu.Lock()
+		_, err = t.createUser(ctx, req)
+		t.mu.Unlock()
+		if err == nil {
+			resp.Imported++
+			continue
+		}
+		resp.Failed++
+		if len(resp.Errors) < maxImportErrors {
+			resp.Errors = append(resp.Errors, &pb.ImportError{Row: resp.Total, Status: batchStatus(err)})
+		}
+	}
+
+	resp.Message = fmt.Sprintf("共%d条记录，成功导入%d个用户，失败%d条", resp.Total, resp.Imported, resp.Failed)
+	log.Printf("ImportUsers finished: %s", resp.Message)
+	return stream.SendAndClose(resp)
+}
+
+// ExportUsers 服务端流式导出用户，按用户ID升序逐个发送
+func (s *UserServer) ExportUsers(req *pb.ExportUsersRequest, stream pb.UserService_ExportUsersServer) error {
+	log.Printf("ExportUsers called with: %+v", req)
+
+	t, err := s.tenant(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	filter, err := parseFilter(req.Filter)
+	if err != nil {
+		return invalidArgument(usersResource, "filter", "无效的filter，%v", err)
+	}
+
+	// List 返回的是某一时刻的快照，导出期间的写操作不会影响本次导出
+	users, err := t.store.List(stream.Context())
+	if err != nil {
+		return usersResource.storeError(err)
+	}
+
+	sent := 0
+	for _, user := range users {
+		if (user.DeletedAt != 0 && !req.ShowDeleted) || !filter.match(user) {
+			continue
+		}
+		if err := stream.Send(user); err != nil {
+			log.Printf("ExportUsers aborted after %d users: %v", sent, err)
+			return err
+		}
+		sent++
+	}
+
+	log.Printf("ExportUsers finished: %d users", sent)
+	return nil
+}
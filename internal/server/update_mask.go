@@ -0,0 +1,106 @@
+package server
+
+import pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+
+// updatableFields UpdateUser 的 update_mask 中允许出现的字段，"*" 表示全部
+var updatableFields = []string{"name", "email", "age", "phone"}
+
+// applyUpdate 校验 UpdateUserRequest 中要写入的字段并写入 user
+//
+// 没有 update_mask 时保持旧的语义：空字符串和 age 为 0 表示不修改；
+// 有 update_mask 时只写入列出的字段，值按请求原样写入（可以清空）。
+// 要写入的字段按 CreateUser 的规则校验，不合法时返回附带 BadRequest 详情的错误。
+func applyUpdate(user *pb.User, req *pb.UpdateUserRequest) error {
+	var v violations
+	fields := maskFields(&v, req.GetUpdateMask().GetPaths())
+	if fields == nil {
+		// 没有 update_mask：只写入非零值的字段
+		if req.Name != "" {
+			fields = append(fields, "name")
+		}
+		if req.Email != "" {
+			fields = append(fields, "email")
+		}
+		if req.Age != 0 {
+			fields = append(fields, "age")
+		}
+		if req.Phone != "" {
+			fields = append(fields, "phone")
+		}
+	}
+
+	for _, field := range fields {
+		switch field {
+		case "name":
+			validateName(&v, req.Name)
+		case "email":
+			validateEmail(&v, req.Email)
+		case "age":
+			validateAge(&v, req.Age)
+		case "phone":
+			validatePhone(&v, req.Phone)
+		}
+	}
+	if err := v.err(userResource(req.Id)); err != nil {
+		return err
+	}
+
+	for _, field := range fields {
+		switch field {
+		case "name":
+			user.Name = req.Name
+		case "email":
+			user.Email = req.Email
+		case "age":
+			user.Age = req.Age
+		case "phone":
+			user.Phone = req.Phone
+		}
+	}
+	return nil
+}
+
+// maskFields 校验 update_mask 的路径并展开 "*"，重复的路径只保留一次；
+// 没有路径时返回 nil，非法的路径记录到 v
+func maskFields(v *violations, paths []string) []string {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	seen := make(map[string]bool, len(paths))
+	fields := []string{}
+	add := func(field string) {
+		if !seen[field] {
+			seen[field] = true
+			fields = append(fields, field)
+		}
+	}
+
+	for _, path := range paths {
+		if path == "*" {
+			if len(paths) != 1 {
+				v.add("update_mask", "update_mask 中的 \"*\" 不能与其他字段同时使用")
+				continue
+			}
+			for _, field := range updatableFields {
+				add(field)
+			}
+			continue
+		}
+		if !updatable(path) {
+			v.add("update_mask", "update_mask 包含不支持的字段 %q，可用字段: name, email, age, phone", path)
+			continue
+		}
+		add(path)
+	}
+	return fields
+}
+
+func updatable(path string) bool {
+	for _, field := range updatableFields {
+		if path == field {
+			return true
+		}
+	}
+	return false
+}
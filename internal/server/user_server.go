@@ -2,14 +2,21 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/liverlong/rpc-learning/internal/audit"
+	"github.com/liverlong/rpc-learning/internal/auth"
+	"github.com/liverlong/rpc-learning/internal/idgen"
+	"github.com/liverlong/rpc-learning/internal/store"
 	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 // ChatClient 聊天客户端信息
@@ -20,128 +27,299 @@ type ChatClient struct {
 }
 
 // UserServer 用户服务服务器
+//
+// 用户数据按租户隔离，见 tenant。NewUserServer 创建的服务器只有一个租户，请求不需要租户ID；
+// NewMultiTenantServer 创建的服务器按请求元数据中的 x-tenant-id 选择租户。
 type UserServer struct {
 	pb.UnimplementedUserServiceServer
-	users       map[int64]*pb.User
-	nextID      int64
-	mu          sync.RWMutex
-	chatClients map[int64]*ChatClient
-	chatMu      sync.RWMutex
+	audit          audit.Log // 用户修改的审计日志，所有租户共用，记录中带有租户ID
+	ids            idgen.Generator
+	watchHistory   int
+	idempotencyTTL time.Duration
+	credentials    store.Credentials // 用户的密码哈希，所有租户共用
+	tokens         *auth.TokenIssuer
+	lockout        *auth.Lockout
+	stores         store.Tenants   // 多租户模式下打开各租户的存储，单租户模式为 nil
+	allowedTenants map[string]bool // 多租户模式下还没有数据时也可以使用的租户
+	tenantsMu      sync.Mutex
+	tenants        map[string]*tenant // 已打开的租户，单租户模式下只有 ""
 }
 
-// NewUserServer 创建新的用户服务服务器
-func NewUserServer() *UserServer {
-	return &UserServer{
-		users:       make(map[int64]*pb.User),
-		nextID:      1,
-		chatClients: make(map[int64]*ChatClient),
+// Option 配置 UserServer 的可选参数
+type Option func(*UserServer)
+
+// WithWatchHistory 设置 WatchUsers 为断线重连保留的最近事件数，默认 DefaultWatchHistory
+func WithWatchHistory(n int) Option {
+	return func(s *UserServer) {
+		s.watchHistory = n
 	}
 }
 
-// CreateUser 创建用户
-func (s *UserServer) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb.CreateUserResponse, error) {
-	log.Printf("CreateUser called with: %+v", req)
+// WithAuditLog 设置审计日志，默认使用内存中的审计日志
+func WithAuditLog(l audit.Log) Option {
+	return func(s *UserServer) {
+		s.audit = l
+	}
+}
 
-	// 验证请求参数
-	if req.Name == "" {
-		return nil, status.Error(codes.InvalidArgument, "用户名不能为空")
+// WithIdempotencyTTL 设置服务器记住成功修改请求的 request_id 的时间，默认 DefaultIdempotencyTTL
+func WithIdempotencyTTL(ttl time.Duration) Option {
+	return func(s *UserServer) {
+		s.idempotencyTTL = ttl
 	}
-	if req.Email == "" {
-		return nil, status.Error(codes.InvalidArgument, "邮箱不能为空")
+}
+
+// WithIDGenerator 设置新用户的ID生成器，默认 idgen.Sequential（由存储分配递增的ID）
+func WithIDGenerator(g idgen.Generator) Option {
+	return func(s *UserServer) {
+		s.ids = g
 	}
+}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// WithCredentials 设置保存密码哈希的存储，默认保存在内存中
+func WithCredentials(c store.Credentials) Option {
+	return func(s *UserServer) {
+		s.credentials = c
+	}
+}
 
-	// 检查邮箱是否已存在
-	for _, user := range s.users {
-		if user.Email == req.Email {
-			return nil, status.Error(codes.AlreadyExists, "邮箱已存在")
+// WithTokenIssuer 设置签发和校验令牌的签发器，默认使用启动时随机生成的密钥，重启后之前的令牌全部失效
+func WithTokenIssuer(i *auth.TokenIssuer) Option {
+	return func(s *UserServer) {
+		s.tokens = i
+	}
+}
+
+// WithLockout 设置登录失败锁定策略，默认连续失败 auth.DefaultMaxFailures 次后锁定 auth.DefaultLockoutDuration
+func WithLockout(l *auth.Lockout) Option {
+	return func(s *UserServer) {
+		s.lockout = l
+	}
+}
+
+// WithTenants 设置多租户模式下允许使用的租户，这些租户第一次收到请求时创建存储；
+// 其他租户必须已有数据，否则请求返回 NOT_FOUND
+func WithTenants(names ...string) Option {
+	return func(s *UserServer) {
+		s.allowedTenants = make(map[string]bool, len(names))
+		for _, name := range names {
+			s.allowedTenants[name] = true
 		}
 	}
+}
+
+// newServer 创建没有租户的服务器
+func newServer(opts []Option) *UserServer {
+	s := &UserServer{
+		audit:          audit.NewMemoryLog(),
+		ids:            idgen.Sequential{},
+		watchHistory:   DefaultWatchHistory,
+		idempotencyTTL: DefaultIdempotencyTTL,
+		credentials:    store.NewMemoryCredentials(),
+		lockout:        auth.NewLockout(auth.DefaultMaxFailures, auth.DefaultLockoutDuration),
+		tenants:        make(map[string]*tenant),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.tokens == nil {
+		s.tokens = randomTokenIssuer()
+	}
+	return s
+}
 
-	// 创建新用户
+// NewUserServer 创建只有一个租户的用户服务服务器，并为存储中已有的用户建立搜索索引
+func NewUserServer(userStore store.UserStore, opts ...Option) *UserServer {
+	s := newServer(opts)
+	s.tenants[""] = s.newTenant("", userStore)
+	return s
+}
+
+// CreateUser 创建用户，带 request_id 的重复请求返回第一次的响应
+func (s *UserServer) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb.CreateUserResponse, error) {
+	log.Printf("CreateUser called with: %+v", req)
+
+	t, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return idempotent(ctx, t.requests, usersResource, req,
+		func(ctx context.Context, req *pb.CreateUserRequest) (*pb.CreateUserResponse, error) {
+			user, err := t.createUser(ctx, req)
+			if err != nil {
+				return nil, err
+			}
+
+			return &pb.CreateUserResponse{
+				User:    user,
+				Message: "用户创建成功",
+			}, nil
+		})
+}
+
+// createUser 校验请求并创建用户，调用方持有 t.mu
+func (t *tenant) createUser(ctx context.Context, req *pb.CreateUserRequest) (*pb.User, error) {
+	// 验证请求参数
+	if err := validateCreate(req); err != nil {
+		return nil, err
+	}
+
+	id, uid, err := t.server.ids.NewID()
+	if err != nil {
+		log.Printf("ID generator error: %v", err)
+		return nil, newError(codes.Internal, pb.ErrorReason_ID_GENERATION_FAILED, usersResource, nil, "生成用户ID失败")
+	}
+
+	// 创建新用户，邮箱和手机号的唯一性由存储层检查
 	now := time.Now().Unix()
-	user := &pb.User{
-		Id:        s.nextID,
+	user, err := t.store.Create(ctx, &pb.User{
+		Id:        id,
+		Uid:       uid,
 		Name:      req.Name,
 		Email:     req.Email,
 		Age:       req.Age,
 		Phone:     req.Phone,
 		CreatedAt: now,
 		UpdatedAt: now,
+		Version:   1,
+	})
+	if err != nil {
+		return nil, usersResource.storeError(err)
 	}
+	t.changed(ctx, "CreateUser", nil, user)
+	return user, nil
+}
 
-	s.users[s.nextID] = user
-	s.nextID++
+// GetUser 获取用户
+func (s *UserServer) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.GetUserResponse, error) {
+	log.Printf("GetUser called with: %+v", req)
 
-	return &pb.CreateUserResponse{
+	t, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var user *pb.User
+	if req.Uid != "" {
+		user, err = userKeyResource(req.Uid).live(t.store.GetByUID(ctx, req.Uid))
+	} else {
+		if req.Id <= 0 {
+			return nil, invalidID(req.Id)
+		}
+		user, err = userResource(req.Id).live(t.store.Get(ctx, req.Id))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.GetUserResponse{
 		User:    user,
-		Message: "用户创建成功",
+		Message: "获取用户成功",
 	}, nil
 }
 
-// GetUser 获取用户
-func (s *UserServer) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.GetUserResponse, error) {
-	log.Printf("GetUser called with: %+v", req)
+// GetUserByEmail 按邮箱获取用户
+func (s *UserServer) GetUserByEmail(ctx context.Context, req *pb.GetUserByEmailRequest) (*pb.GetUserByEmailResponse, error) {
+	log.Printf("GetUserByEmail called with: %+v", req)
 
-	if req.Id <= 0 {
-		return nil, status.Error(codes.InvalidArgument, "用户ID必须大于0")
+	t, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	if store.NormalizeEmail(req.Email) == "" {
+		return nil, invalidArgument(userKeyResource(req.Email), "email", "邮箱不能为空")
+	}
 
-	user, exists := s.users[req.Id]
-	if !exists {
-		return nil, status.Error(codes.NotFound, "用户不存在")
+	user, err := userKeyResource(req.Email).live(t.store.GetByEmail(ctx, req.Email))
+	if err != nil {
+		return nil, err
 	}
 
-	return &pb.GetUserResponse{
+	return &pb.GetUserByEmailResponse{
 		User:    user,
 		Message: "获取用户成功",
 	}, nil
 }
 
-// UpdateUser 更新用户
-func (s *UserServer) UpdateUser(ctx context.Context, req *pb.UpdateUserRequest) (*pb.UpdateUserResponse, error) {
-	log.Printf("UpdateUser called with: %+v", req)
+// GetUserByPhone 按手机号获取用户
+func (s *UserServer) GetUserByPhone(ctx context.Context, req *pb.GetUserByPhoneRequest) (*pb.GetUserByPhoneResponse, error) {
+	log.Printf("GetUserByPhone called with: %+v", req)
 
-	if req.Id <= 0 {
-		return nil, status.Error(codes.InvalidArgument, "用户ID必须大于0")
+	t, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if store.NormalizePhone(req.Phone) == "" {
+		return nil, invalidArgument(userKeyResource(req.Phone), "phone", "手机号不能为空")
+	}
 
-	user, exists := s.users[req.Id]
-	if !exists {
-		return nil, status.Error(codes.NotFound, "用户不存在")
+	user, err := userKeyResource(req.Phone).live(t.store.GetByPhone(ctx, req.Phone))
+	if err != nil {
+		return nil, err
 	}
 
-	// 检查邮箱是否已被其他用户使用
-	if req.Email != "" && req.Email != user.Email {
-		for _, u := range s.users {
-			if u.Id != req.Id && u.Email == req.Email {
-				return nil, status.Error(codes.AlreadyExists, "邮箱已被其他用户使用")
-			}
-		}
+	return &pb.GetUserByPhoneResponse{
+		User:    user,
+		Message: "获取用户成功",
+	}, nil
+}
+
+// UpdateUser 更新用户，带 request_id 的重复请求返回第一次的响应
+func (s *UserServer) UpdateUser(ctx context.Context, req *pb.UpdateUserRequest) (*pb.UpdateUserResponse, error) {
+	log.Printf("UpdateUser called with: %+v", req)
+
+	t, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	// 更新用户信息
-	if req.Name != "" {
-		user.Name = req.Name
+	if req.Id <= 0 {
+		return nil, invalidID(req.Id)
 	}
-	if req.Email != "" {
-		user.Email = req.Email
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return idempotent(ctx, t.requests, userResource(req.Id), req, t.updateUser)
+}
+
+// updateUser 更新用户，调用方持有 t.mu
+func (t *tenant) updateUser(ctx context.Context, req *pb.UpdateUserRequest) (*pb.UpdateUserResponse, error) {
+	user, err := userResource(req.Id).live(t.store.Get(ctx, req.Id))
+	if err != nil {
+		return nil, err
 	}
-	if req.Age > 0 {
-		user.Age = req.Age
+	if err := checkVersion(user, req.ExpectedVersion); err != nil {
+		return nil, err
 	}
-	if req.Phone != "" {
-		user.Phone = req.Phone
+	before := proto.Clone(user).(*pb.User)
+
+	// 更新用户信息
+	if err := applyUpdate(user, req); err != nil {
+		return nil, err
 	}
 	user.UpdatedAt = time.Now().Unix()
+	user.Version++
+
+	// 邮箱和手机号是否已被其他用户使用由存储层检查
+	user, err = t.store.Update(ctx, user)
+	switch {
+	case errors.Is(err, store.ErrEmailExists):
+		return nil, newError(codes.AlreadyExists, pb.ErrorReason_EMAIL_ALREADY_EXISTS, userResource(req.Id),
+			map[string]string{"field": "email"}, "邮箱已被其他用户使用")
+	case errors.Is(err, store.ErrPhoneExists):
+		return nil, newError(codes.AlreadyExists, pb.ErrorReason_PHONE_ALREADY_EXISTS, userResource(req.Id),
+			map[string]string{"field": "phone"}, "手机号已被其他用户使用")
+	case err != nil:
+		return nil, userResource(req.Id).storeError(err)
+	}
+	t.changed(ctx, "UpdateUser", before, user)
 
 	return &pb.UpdateUserResponse{
 		User:    user,
@@ -150,32 +328,116 @@ func (s *UserServer) UpdateUser(ctx context.Context, req *pb.UpdateUserRequest)
 }
 
 // DeleteUser 删除用户
+//
+// 只做软删除：记录删除时间，用户仍占用邮箱和手机号，可以通过 UndeleteUser 恢复，
+// 超过保留期后由 RunPurger 彻底清除。带 request_id 的重复请求返回第一次的响应。
 func (s *UserServer) DeleteUser(ctx context.Context, req *pb.DeleteUserRequest) (*pb.DeleteUserResponse, error) {
 	log.Printf("DeleteUser called with: %+v", req)
 
+	t, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return idempotent(ctx, t.requests, userResource(req.Id), req,
+		func(ctx context.Context, req *pb.DeleteUserRequest) (*pb.DeleteUserResponse, error) {
+			if _, _, err := t.deleteUser(ctx, req); err != nil {
+				return nil, err
+			}
+
+			return &pb.DeleteUserResponse{
+				Message: "用户删除成功",
+			}, nil
+		})
+}
+
+// deleteUser 软删除用户，返回删除前后的用户以便撤销，调用方持有 t.mu
+func (t *tenant) deleteUser(ctx context.Context, req *pb.DeleteUserRequest) (before, after *pb.User, err error) {
 	if req.Id <= 0 {
-		return nil, status.Error(codes.InvalidArgument, "用户ID必须大于0")
+		return nil, nil, invalidID(req.Id)
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	user, err := userResource(req.Id).live(t.store.Get(ctx, req.Id))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkVersion(user, req.ExpectedVersion); err != nil {
+		return nil, nil, err
+	}
+
+	before = proto.Clone(user).(*pb.User)
+	now := time.Now().Unix()
+	user.DeletedAt = now
+	user.UpdatedAt = now
+	user.Version++
+	after, err = t.store.Update(ctx, user)
+	if err != nil {
+		return nil, nil, userResource(req.Id).storeError(err)
+	}
+	t.changed(ctx, "DeleteUser", before, after)
+	return before, after, nil
+}
 
-	_, exists := s.users[req.Id]
-	if !exists {
-		return nil, status.Error(codes.NotFound, "用户不存在")
+// UndeleteUser 恢复已软删除的用户，带 request_id 的重复请求返回第一次的响应
+func (s *UserServer) UndeleteUser(ctx context.Context, req *pb.UndeleteUserRequest) (*pb.UndeleteUserResponse, error) {
+	log.Printf("UndeleteUser called with: %+v", req)
+
+	t, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Id <= 0 {
+		return nil, invalidID(req.Id)
 	}
 
-	delete(s.users, req.Id)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return idempotent(ctx, t.requests, userResource(req.Id), req, t.undeleteUser)
+}
 
-	return &pb.DeleteUserResponse{
-		Message: "用户删除成功",
+// undeleteUser 恢复已软删除的用户，调用方持有 t.mu
+func (t *tenant) undeleteUser(ctx context.Context, req *pb.UndeleteUserRequest) (*pb.UndeleteUserResponse, error) {
+	user, err := t.store.Get(ctx, req.Id)
+	if err != nil {
+		return nil, userResource(req.Id).storeError(err)
+	}
+	if user.DeletedAt == 0 {
+		return nil, newError(codes.FailedPrecondition, pb.ErrorReason_USER_NOT_DELETED, userResource(req.Id), nil, "用户未被删除")
+	}
+
+	before := proto.Clone(user).(*pb.User)
+	user.DeletedAt = 0
+	user.UpdatedAt = time.Now().Unix()
+	user.Version++
+	user, err = t.store.Update(ctx, user)
+	if err != nil {
+		return nil, userResource(req.Id).storeError(err)
+	}
+	t.changed(ctx, "UndeleteUser", before, user)
+
+	return &pb.UndeleteUserResponse{
+		User:    user,
+		Message: "用户恢复成功",
 	}, nil
 }
 
 // ListUsers 列出用户
+//
+// 结果先按 filter 过滤、按 order_by 排序，再分页；
+// 支持 page_token 游标翻页和旧的 page 偏移量分页。
 func (s *UserServer) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
 	log.Printf("ListUsers called with: %+v", req)
 
+	t, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	// 设置默认分页参数
 	page := req.Page
 	if page <= 0 {
@@ -189,52 +451,155 @@ func (s *UserServer) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*
 		pageSize = 100 // 限制最大页面大小
 	}
 
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	// 获取所有用户
-	allUsers := make([]*pb.User, 0, len(s.users))
-	for _, user := range s.users {
-		allUsers = append(allUsers, user)
+	filter, err := parseFilter(req.Filter)
+	if err != nil {
+		return nil, invalidArgument(usersResource, "filter", "无效的filter，%v", err)
+	}
+	order, err := parseOrderBy(req.OrderBy)
+	if err != nil {
+		return nil, invalidArgument(usersResource, "order_by", "无效的order_by，%v", err)
 	}
 
-	total := int32(len(allUsers))
-
-	// 计算分页
-	start := (page - 1) * pageSize
-	end := start + pageSize
+	var token pageToken
+	if req.PageToken != "" {
+		token, err = decodePageToken(req.PageToken)
+		if err != nil || !token.matches(req) {
+			return nil, invalidArgument(usersResource, "page_token", "无效的page_token")
+		}
+	}
 
-	var users []*pb.User
-	if start < total {
-		if end > total {
-			end = total
+	// 获取所有用户，默认隐藏已删除的用户，然后过滤和排序
+	stored, err := t.store.List(ctx)
+	if err != nil {
+		return nil, usersResource.storeError(err)
+	}
+	allUsers := stored[:0]
+	for _, user := range stored {
+		if (user.DeletedAt == 0 || req.ShowDeleted) && filter.match(user) {
+			allUsers = append(allUsers, user)
 		}
-		users = allUsers[start:end]
+	}
+	sort.Slice(allUsers, func(i, j int) bool {
+		return order.compare(allUsers[i], allUsers[j]) < 0
+	})
+
+	total := len(allUsers)
+
+	// 计算分页：有令牌时从排在上一页最后一个用户之后的位置开始，否则按页码偏移
+	var start int
+	if req.PageToken != "" {
+		after := token.After.user()
+		start = sort.Search(total, func(i int) bool {
+			return order.compare(allUsers[i], after) > 0
+		})
 	} else {
-		users = []*pb.User{}
+		// 页码很大时 (page-1)*pageSize 会超出 int32，按 int64 计算后限制在 [0, total]
+		start = int(min(int64(page-1)*int64(pageSize), int64(total)))
+	}
+	end := min(start+int(pageSize), total)
+	users := allUsers[start:end]
+
+	var nextPageToken string
+	if end < total {
+		nextPageToken = pageToken{
+			After:       cursorOf(users[len(users)-1], order),
+			ShowDeleted: req.ShowDeleted,
+			Filter:      req.Filter,
+			OrderBy:     req.OrderBy,
+		}.encode()
 	}
 
 	return &pb.ListUsersResponse{
-		Users:   users,
-		Total:   total,
-		Message: fmt.Sprintf("获取用户列表成功，共%d个用户", total),
+		Users:         users,
+		Total:         int32(total),
+		Message:       fmt.Sprintf("获取用户列表成功，共%d个用户", total),
+		NextPageToken: nextPageToken,
 	}, nil
 }
 
+// SearchUsers 按姓名、邮箱或手机号片段搜索未删除的用户，结果按相关度排序
+func (s *UserServer) SearchUsers(ctx context.Context, req *pb.SearchUsersRequest) (*pb.SearchUsersResponse, error) {
+	log.Printf("SearchUsers called with: %+v", req)
+
+	t, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSpace(req.Query) == "" {
+		return nil, invalidArgument(usersResource, "query", "搜索关键词不能为空")
+	}
+	pageSize := req.PageSize
+	if pageSize <= 0 {
+		pageSize = 10
+	}
+	if pageSize > 100 {
+		pageSize = 100 // 限制最大结果数
+	}
+
+	results := make([]*pb.SearchResult, 0, pageSize)
+	for _, hit := range t.index.Search(req.Query, int(pageSize)) {
+		user, err := t.store.Get(ctx, hit.ID)
+		if errors.Is(err, store.ErrNotFound) {
+			continue // 索引命中后用户恰好被清除
+		}
+		if err != nil {
+			return nil, userResource(hit.ID).storeError(err)
+		}
+		results = append(results, &pb.SearchResult{User: user, Score: hit.Score})
+	}
+
+	return &pb.SearchUsersResponse{
+		Results: results,
+		Message: fmt.Sprintf("搜索到%d个用户", len(results)),
+	}, nil
+}
+
+// changed 在用户数据写入存储后调用，同步更新派生数据并记录审计日志（调用方持有 t.mu）
+//
+// before 为 nil 表示新建用户，after 为 nil 表示用户被彻底清除；
+// method 是不经过 gRPC 调用时审计记录使用的接口名。
+func (t *tenant) changed(ctx context.Context, method string, before, after *pb.User) {
+	switch {
+	case after == nil:
+		t.index.Remove(before.Id)
+	case after.DeletedAt != 0:
+		t.index.Remove(after.Id)
+	default:
+		t.index.Put(after)
+	}
+
+	if event := userEvent(before, after); event != nil {
+		t.feed.publish(event)
+	}
+	if t.holding {
+		t.held = append(t.held, change{method: method, before: before, after: after})
+		return
+	}
+	t.server.record(ctx, t.name, method, before, after)
+}
+
 // Chat 双向流聊天接口
+//
+// 会话在 join 时绑定到一个存在的用户（见 chatUser），之后的消息都以这个用户的ID和名字发送，请求中的 user_id 和 username 被忽略。
 func (s *UserServer) Chat(stream pb.UserService_ChatServer) error {
 	log.Printf("Chat stream started")
 
+	t, err := s.tenant(stream.Context())
+	if err != nil {
+		return err
+	}
+
 	var client *ChatClient
 	defer func() {
 		// 清理客户端连接
 		if client != nil {
-			s.chatMu.Lock()
-			delete(s.chatClients, client.UserID)
-			s.chatMu.Unlock()
+			t.chatMu.Lock()
+			t.removeChatClient(client)
+			t.chatMu.Unlock()
 
 			// 广播用户离开消息
-			s.broadcastMessage(&pb.ChatMessage{
+			t.broadcastMessage(&pb.ChatMessage{
 				UserId:      client.UserID,
 				Username:    client.Username,
 				Content:     fmt.Sprintf("%s 离开了聊天室", client.Username),
@@ -257,24 +622,46 @@ func (s *UserServer) Chat(stream pb.UserService_ChatServer) error {
 
 		switch req.Action {
 		case "join":
+			if client != nil {
+				// 会话已经绑定到用户，不能再以其他身份加入
+				if err := stream.Send(chatError(fmt.Sprintf("已经以 %s 的身份加入聊天室", client.Username))); err != nil {
+					log.Printf("Error sending error response: %v", err)
+					return err
+				}
+				continue
+			}
+			user, err := t.chatUser(stream.Context(), req.UserId)
+			if err != nil {
+				log.Printf("Rejected chat join as user %d: %v", req.UserId, err)
+				return err
+			}
+
 			// 用户加入聊天室
-			client = &ChatClient{
-				UserID:   req.UserId,
-				Username: req.Username,
+			joined := &ChatClient{
+				UserID:   user.Id,
+				Username: user.Name,
 				Stream:   stream,
 			}
 
-			s.chatMu.Lock()
-			s.chatClients[req.UserId] = client
-			onlineUsers := len(s.chatClients)
-			s.chatMu.Unlock()
+			// 会话按用户ID登记，同一个用户在另一个连接中加入时拒绝，避免两个连接互相覆盖和删除对方的会话
+			t.chatMu.Lock()
+			if _, ok := t.chatClients[user.Id]; ok {
+				t.chatMu.Unlock()
+				log.Printf("Rejected chat join as user %d: already joined on another stream", user.Id)
+				return newError(codes.AlreadyExists, pb.ErrorReason_CHAT_SESSION_EXISTS, userResource(user.Id), nil,
+					"该用户已经在另一个连接中加入了聊天室")
+			}
+			t.chatClients[joined.UserID] = joined
+			onlineUsers := len(t.chatClients)
+			t.chatMu.Unlock()
+			client = joined
 
 			// 发送加入确认
 			joinResponse := &pb.ChatResponse{
 				Message: &pb.ChatMessage{
 					UserId:      0,
 					Username:    "系统",
-					Content:     fmt.Sprintf("欢迎 %s 加入聊天室！", req.Username),
+					Content:     fmt.Sprintf("欢迎 %s 加入聊天室！", client.Username),
 					Timestamp:   time.Now().Unix(),
 					MessageType: "system",
 				},
@@ -288,41 +675,29 @@ func (s *UserServer) Chat(stream pb.UserService_ChatServer) error {
 			}
 
 			// 广播用户加入消息
-			s.broadcastMessage(&pb.ChatMessage{
-				UserId:      req.UserId,
-				Username:    req.Username,
-				Content:     fmt.Sprintf("%s 加入了聊天室", req.Username),
+			t.broadcastMessage(&pb.ChatMessage{
+				UserId:      client.UserID,
+				Username:    client.Username,
+				Content:     fmt.Sprintf("%s 加入了聊天室", client.Username),
 				Timestamp:   time.Now().Unix(),
 				MessageType: "join",
-			}, req.UserId)
+			}, client.UserID)
 
 		case "message":
 			// 处理聊天消息
 			if client == nil {
 				// 用户未加入聊天室
-				errorResponse := &pb.ChatResponse{
-					Message: &pb.ChatMessage{
-						UserId:      0,
-						Username:    "系统",
-						Content:     "请先加入聊天室",
-						Timestamp:   time.Now().Unix(),
-						MessageType: "system",
-					},
-					Status:      "error",
-					OnlineUsers: 0,
-				}
-
-				if err := stream.Send(errorResponse); err != nil {
+				if err := stream.Send(chatError("请先加入聊天室")); err != nil {
 					log.Printf("Error sending error response: %v", err)
 					return err
 				}
 				continue
 			}
 
-			// 广播用户消息
-			s.broadcastMessage(&pb.ChatMessage{
-				UserId:      req.UserId,
-				Username:    req.Username,
+			// 广播用户消息，发送者是加入时绑定的用户
+			t.broadcastMessage(&pb.ChatMessage{
+				UserId:      client.UserID,
+				Username:    client.Username,
 				Content:     req.Content,
 				Timestamp:   time.Now().Unix(),
 				MessageType: "text",
@@ -331,12 +706,12 @@ func (s *UserServer) Chat(stream pb.UserService_ChatServer) error {
 		case "leave":
 			// 用户主动离开
 			if client != nil {
-				s.chatMu.Lock()
-				delete(s.chatClients, client.UserID)
-				s.chatMu.Unlock()
+				t.chatMu.Lock()
+				t.removeChatClient(client)
+				t.chatMu.Unlock()
 
 				// 广播用户离开消息
-				s.broadcastMessage(&pb.ChatMessage{
+				t.broadcastMessage(&pb.ChatMessage{
 					UserId:      client.UserID,
 					Username:    client.Username,
 					Content:     fmt.Sprintf("%s 离开了聊天室", client.Username),
@@ -354,26 +729,76 @@ func (s *UserServer) Chat(stream pb.UserService_ChatServer) error {
 	}
 }
 
-// broadcastMessage 广播消息给所有在线用户
-func (s *UserServer) broadcastMessage(message *pb.ChatMessage, excludeUserID int64) {
-	s.chatMu.RLock()
-	defer s.chatMu.RUnlock()
+// chatUser 返回以 userID 加入聊天室的用户
+//
+// 调用方是通过认证的用户时只能以自己的身份加入，userID 为0时使用调用方的ID；服务可以代表任何用户加入。
+// 用户必须存在且未被删除。
+func (t *tenant) chatUser(ctx context.Context, userID int64) (*pb.User, error) {
+	if id, ok := auth.FromContext(ctx); ok && !id.IsService() {
+		if userID == 0 {
+			userID = id.UserID
+		}
+		if userID != id.UserID {
+			return nil, newError(codes.PermissionDenied, pb.ErrorReason_PERMISSION_DENIED, userResource(userID),
+				map[string]string{"role": id.Role}, "只能以自己的身份加入聊天室")
+		}
+	}
+	if userID <= 0 {
+		return nil, invalidArgument(userResource(userID), "user_id", "用户ID必须大于0")
+	}
+	return userResource(userID).live(t.store.Get(ctx, userID))
+}
+
+// chatError 发送给单个客户端的错误提示
+func chatError(content string) *pb.ChatResponse {
+	return &pb.ChatResponse{
+		Message: &pb.ChatMessage{
+			UserId:      0,
+			Username:    "系统",
+			Content:     content,
+			Timestamp:   time.Now().Unix(),
+			MessageType: "system",
+		},
+		Status:      "error",
+		OnlineUsers: 0,
+	}
+}
 
+// removeChatClient 删除客户端的会话，会话已属于其他连接时不删除，调用方持有 t.chatMu 的写锁
+func (t *tenant) removeChatClient(client *ChatClient) {
+	if t.chatClients[client.UserID] == client {
+		delete(t.chatClients, client.UserID)
+	}
+}
+
+// broadcastMessage 广播消息给所有在线用户
+func (t *tenant) broadcastMessage(message *pb.ChatMessage, excludeUserID int64) {
+	t.chatMu.RLock()
 	response := &pb.ChatResponse{
 		Message:     message,
 		Status:      "broadcast",
-		OnlineUsers: int32(len(s.chatClients)),
+		OnlineUsers: int32(len(t.chatClients)),
 	}
 
-	for userID, client := range s.chatClients {
+	var failed []*ChatClient
+	for userID, client := range t.chatClients {
 		if excludeUserID != 0 && userID == excludeUserID {
 			continue // 跳过指定用户
 		}
 
 		if err := client.Stream.Send(response); err != nil {
 			log.Printf("Error broadcasting to user %d: %v", userID, err)
-			// 删除断开连接的客户端
-			delete(s.chatClients, userID)
+			failed = append(failed, client)
+		}
+	}
+	t.chatMu.RUnlock()
+
+	// 删除断开连接的客户端，读锁下不能修改 map，换成写锁后再删除
+	if len(failed) > 0 {
+		t.chatMu.Lock()
+		for _, client := range failed {
+			t.removeChatClient(client)
 		}
+		t.chatMu.Unlock()
 	}
 }
@@ -1,16 +1,44 @@
 package server
 
 import (
+	"cmp"
 	"context"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/liverlong/rpc-learning/internal/audit"
+	"github.com/liverlong/rpc-learning/internal/auth"
+	"github.com/liverlong/rpc-learning/internal/idgen"
+	"github.com/liverlong/rpc-learning/internal/store"
+	"github.com/liverlong/rpc-learning/internal/tlsconfig"
+	"github.com/liverlong/rpc-learning/internal/tlsconfig/tlstest"
 	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+	pbv2 "github.com/liverlong/rpc-learning/pkg/pb/user/v2"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 )
 
 func TestUserServer_CreateUser(t *testing.T) {
-	server := NewUserServer()
+	server := NewUserServer(store.NewMemoryStore())
 
 	tests := []struct {
 		name    string
@@ -64,7 +92,7 @@ func TestUserServer_CreateUser(t *testing.T) {
 }
 
 func TestUserServer_GetUser(t *testing.T) {
-	server := NewUserServer()
+	server := NewUserServer(store.NewMemoryStore())
 
 	// 先创建一个用户
 	createReq := &pb.CreateUserRequest{
@@ -121,7 +149,7 @@ func TestUserServer_GetUser(t *testing.T) {
 }
 
 func TestUserServer_DeleteUser(t *testing.T) {
-	server := NewUserServer()
+	server := NewUserServer(store.NewMemoryStore())
 
 	// 先创建一个用户
 	createReq := &pb.CreateUserRequest{
@@ -144,7 +172,7 @@ func TestUserServer_DeleteUser(t *testing.T) {
 		t.Errorf("DeleteUser() error = %v", err)
 	}
 
-	// 验证用户已被删除
+	// 验证用户已被删除，软删除的用户返回 FailedPrecondition 以区别于不存在的用户
 	getReq := &pb.GetUserRequest{
 		Id: createResp.User.Id,
 	}
@@ -152,13 +180,117 @@ func TestUserServer_DeleteUser(t *testing.T) {
 	if err == nil {
 		t.Error("Expected error when getting deleted user")
 	}
-	if status.Code(err) != codes.NotFound {
-		t.Errorf("Expected NotFound error, got %v", status.Code(err))
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected FailedPrecondition error, got %v", status.Code(err))
+	}
+}
+
+func TestUserServer_SoftDelete(t *testing.T) {
+	server := NewUserServer(store.NewMemoryStore())
+	ctx := context.Background()
+
+	var ids []int64
+	for _, email := range []string{"a@example.com", "b@example.com"} {
+		resp, err := server.CreateUser(ctx, &pb.CreateUserRequest{Name: "测试用户", Email: email})
+		if err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+		ids = append(ids, resp.User.Id)
+	}
+	if _, err := server.DeleteUser(ctx, &pb.DeleteUserRequest{Id: ids[0]}); err != nil {
+		t.Fatalf("DeleteUser() error = %v", err)
+	}
+
+	// 默认隐藏已删除的用户
+	resp, err := server.ListUsers(ctx, &pb.ListUsersRequest{})
+	if err != nil {
+		t.Fatalf("ListUsers() error = %v", err)
+	}
+	if resp.Total != 1 {
+		t.Errorf("ListUsers() total = %d, want 1", resp.Total)
+	}
+	resp, err = server.ListUsers(ctx, &pb.ListUsersRequest{ShowDeleted: true})
+	if err != nil {
+		t.Fatalf("ListUsers(show_deleted) error = %v", err)
+	}
+	if resp.Total != 2 {
+		t.Errorf("ListUsers(show_deleted) total = %d, want 2", resp.Total)
+	}
+
+	// 已删除的用户不能再次删除或更新
+	if _, err := server.DeleteUser(ctx, &pb.DeleteUserRequest{Id: ids[0]}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("DeleteUser() twice code = %v, want FailedPrecondition", status.Code(err))
+	}
+	if _, err := server.UpdateUser(ctx, &pb.UpdateUserRequest{Id: ids[0], Name: "新名字"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("UpdateUser() deleted user code = %v, want FailedPrecondition", status.Code(err))
+	}
+
+	undeleted, err := server.UndeleteUser(ctx, &pb.UndeleteUserRequest{Id: ids[0]})
+	if err != nil {
+		t.Fatalf("UndeleteUser() error = %v", err)
+	}
+	if undeleted.User.DeletedAt != 0 {
+		t.Errorf("UndeleteUser() deleted_at = %d, want 0", undeleted.User.DeletedAt)
+	}
+	if _, err := server.GetUser(ctx, &pb.GetUserRequest{Id: ids[0]}); err != nil {
+		t.Errorf("GetUser() after undelete error = %v", err)
+	}
+	if _, err := server.UndeleteUser(ctx, &pb.UndeleteUserRequest{Id: ids[1]}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("UndeleteUser() live user code = %v, want FailedPrecondition", status.Code(err))
+	}
+}
+
+func TestUserServer_PurgeDeleted(t *testing.T) {
+	server := NewUserServer(store.NewMemoryStore())
+	ctx := context.Background()
+
+	resp, err := server.CreateUser(ctx, &pb.CreateUserRequest{Name: "测试用户", Email: "test@example.com"})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	id := resp.User.Id
+	if _, err := server.DeleteUser(ctx, &pb.DeleteUserRequest{Id: id}); err != nil {
+		t.Fatalf("DeleteUser() error = %v", err)
+	}
+
+	// 仍在保留期内，不应被清除
+	purged, err := server.PurgeDeleted(ctx, time.Hour)
+	if err != nil {
+		t.Fatalf("PurgeDeleted() error = %v", err)
+	}
+	if purged != 0 {
+		t.Errorf("PurgeDeleted() within retention = %d, want 0", purged)
+	}
+
+	purged, err = server.PurgeDeleted(ctx, 0)
+	if err != nil {
+		t.Fatalf("PurgeDeleted() error = %v", err)
+	}
+	if purged != 1 {
+		t.Errorf("PurgeDeleted() = %d, want 1", purged)
+	}
+	if _, err := server.GetUser(ctx, &pb.GetUserRequest{Id: id}); status.Code(err) != codes.NotFound {
+		t.Errorf("GetUser() after purge code = %v, want NotFound", status.Code(err))
+	}
+	if _, err := server.UndeleteUser(ctx, &pb.UndeleteUserRequest{Id: id}); status.Code(err) != codes.NotFound {
+		t.Errorf("UndeleteUser() after purge code = %v, want NotFound", status.Code(err))
+	}
+
+	// 间隔不是正数时 RunPurger 直接返回，而不是在 time.NewTicker 中 panic
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.RunPurger(ctx, time.Hour, 0)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("RunPurger() with a zero interval did not return")
 	}
 }
 
 func TestUserServer_ListUsers(t *testing.T) {
-	server := NewUserServer()
+	server := NewUserServer(store.NewMemoryStore())
 
 	// 创建几个用户
 	for i := 0; i < 3; i++ {
@@ -192,4 +324,2497 @@ func TestUserServer_ListUsers(t *testing.T) {
 	if len(resp.Users) != 3 {
 		t.Errorf("Expected 3 users in response, got %d", len(resp.Users))
 	}
+
+	// 页码很大时偏移量超出 int32，返回空页而不是 panic
+	resp, err = server.ListUsers(context.Background(), &pb.ListUsersRequest{Page: 30000000, PageSize: 100})
+	if err != nil {
+		t.Fatalf("ListUsers() with a huge page error = %v", err)
+	}
+	if len(resp.Users) != 0 || resp.Total != 3 || resp.NextPageToken != "" {
+		t.Errorf("ListUsers() with a huge page = %d users, total %d, next %q, want an empty last page",
+			len(resp.Users), resp.Total, resp.NextPageToken)
+	}
+}
+
+func TestUserServer_DuplicateEmail(t *testing.T) {
+	sqliteStore, err := store.NewSQLiteStore(filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteStore() error = %v", err)
+	}
+	defer sqliteStore.Close()
+	if _, err := sqliteStore.Migrate(context.Background()); err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+
+	stores := map[string]store.UserStore{
+		"memory": store.NewMemoryStore(),
+		"sqlite": sqliteStore,
+	}
+
+	for name, userStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			server := NewUserServer(userStore)
+			ctx := context.Background()
+
+			_, err := server.CreateUser(ctx, &pb.CreateUserRequest{Name: "张三", Email: "zhangsan@example.com"})
+			if err != nil {
+				t.Fatalf("CreateUser() error = %v", err)
+			}
+			other, err := server.CreateUser(ctx, &pb.CreateUserRequest{Name: "李四", Email: "lisi@example.com"})
+			if err != nil {
+				t.Fatalf("CreateUser() error = %v", err)
+			}
+
+			_, err = server.CreateUser(ctx, &pb.CreateUserRequest{Name: "王五", Email: "zhangsan@example.com"})
+			if status.Code(err) != codes.AlreadyExists {
+				t.Errorf("CreateUser() duplicate email code = %v, want AlreadyExists", status.Code(err))
+			}
+
+			_, err = server.UpdateUser(ctx, &pb.UpdateUserRequest{Id: other.User.Id, Email: "zhangsan@example.com"})
+			if status.Code(err) != codes.AlreadyExists {
+				t.Errorf("UpdateUser() duplicate email code = %v, want AlreadyExists", status.Code(err))
+			}
+		})
+	}
+}
+
+func TestUserServer_GetUserByEmailAndPhone(t *testing.T) {
+	server := NewUserServer(store.NewMemoryStore())
+	ctx := context.Background()
+
+	createResp, err := server.CreateUser(ctx, &pb.CreateUserRequest{
+		Name:  "测试用户",
+		Email: "Test@Example.com",
+		Age:   25,
+		Phone: "138 0013 8000",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	byEmail, err := server.GetUserByEmail(ctx, &pb.GetUserByEmailRequest{Email: "test@example.COM"})
+	if err != nil {
+		t.Fatalf("GetUserByEmail() error = %v", err)
+	}
+	if byEmail.User.Id != createResp.User.Id {
+		t.Errorf("GetUserByEmail() user id = %v, want %v", byEmail.User.Id, createResp.User.Id)
+	}
+
+	byPhone, err := server.GetUserByPhone(ctx, &pb.GetUserByPhoneRequest{Phone: "138-0013-8000"})
+	if err != nil {
+		t.Fatalf("GetUserByPhone() error = %v", err)
+	}
+	if byPhone.User.Id != createResp.User.Id {
+		t.Errorf("GetUserByPhone() user id = %v, want %v", byPhone.User.Id, createResp.User.Id)
+	}
+
+	_, err = server.GetUserByEmail(ctx, &pb.GetUserByEmailRequest{Email: "nobody@example.com"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("GetUserByEmail() unknown email code = %v, want NotFound", status.Code(err))
+	}
+	_, err = server.GetUserByPhone(ctx, &pb.GetUserByPhoneRequest{Phone: " "})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("GetUserByPhone() empty phone code = %v, want InvalidArgument", status.Code(err))
+	}
+
+	// 仅大小写不同的邮箱视为重复
+	_, err = server.CreateUser(ctx, &pb.CreateUserRequest{Name: "另一个用户", Email: "TEST@example.com"})
+	if status.Code(err) != codes.AlreadyExists {
+		t.Errorf("CreateUser() case-insensitive duplicate code = %v, want AlreadyExists", status.Code(err))
+	}
+}
+
+func TestUserServer_OptimisticConcurrency(t *testing.T) {
+	server := NewUserServer(store.NewMemoryStore())
+	ctx := context.Background()
+
+	createResp, err := server.CreateUser(ctx, &pb.CreateUserRequest{Name: "测试用户", Email: "test@example.com"})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	id := createResp.User.Id
+	if createResp.User.Version != 1 {
+		t.Fatalf("CreateUser() version = %d, want 1", createResp.User.Version)
+	}
+
+	// 两个客户端都基于版本1修改，后到的一个应被拒绝
+	first, err := server.UpdateUser(ctx, &pb.UpdateUserRequest{Id: id, Name: "客户端A", ExpectedVersion: 1})
+	if err != nil {
+		t.Fatalf("UpdateUser() error = %v", err)
+	}
+	if first.User.Version != 2 {
+		t.Errorf("UpdateUser() version = %d, want 2", first.User.Version)
+	}
+	_, err = server.UpdateUser(ctx, &pb.UpdateUserRequest{Id: id, Name: "客户端B", ExpectedVersion: 1})
+	if status.Code(err) != codes.Aborted {
+		t.Errorf("UpdateUser() stale version code = %v, want Aborted", status.Code(err))
+	}
+
+	// 不带期望版本的更新保持原有行为
+	unconditional, err := server.UpdateUser(ctx, &pb.UpdateUserRequest{Id: id, Age: 30})
+	if err != nil {
+		t.Fatalf("UpdateUser() without version error = %v", err)
+	}
+	if unconditional.User.Version != 3 {
+		t.Errorf("UpdateUser() version = %d, want 3", unconditional.User.Version)
+	}
+
+	_, err = server.DeleteUser(ctx, &pb.DeleteUserRequest{Id: id, ExpectedVersion: 2})
+	if status.Code(err) != codes.Aborted {
+		t.Errorf("DeleteUser() stale version code = %v, want Aborted", status.Code(err))
+	}
+	if _, err := server.DeleteUser(ctx, &pb.DeleteUserRequest{Id: id, ExpectedVersion: 3}); err != nil {
+		t.Errorf("DeleteUser() current version error = %v", err)
+	}
+}
+
+func TestUserServer_ListUsersPageToken(t *testing.T) {
+	server := NewUserServer(store.NewMemoryStore())
+	ctx := context.Background()
+
+	stable := make(map[int64]bool)
+	for i := 0; i < 50; i++ {
+		resp, err := server.CreateUser(ctx, &pb.CreateUserRequest{
+			Name:  "测试用户",
+			Email: fmt.Sprintf("stable%d@example.com", i),
+		})
+		if err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+		stable[resp.User.Id] = true
+	}
+
+	// 翻页的同时不断新建和删除其他用户
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			resp, err := server.CreateUser(ctx, &pb.CreateUserRequest{
+				Name:  "临时用户",
+				Email: fmt.Sprintf("churn%d@example.com", i),
+			})
+			if err != nil {
+				t.Errorf("CreateUser() churn error = %v", err)
+				return
+			}
+			if i%2 == 0 {
+				if _, err := server.DeleteUser(ctx, &pb.DeleteUserRequest{Id: resp.User.Id}); err != nil {
+					t.Errorf("DeleteUser() churn error = %v", err)
+					return
+				}
+			}
+		}
+	}()
+
+	seen := make(map[int64]bool)
+	var lastID int64
+	token := ""
+	for pages := 0; ; pages++ {
+		if pages > 1000 {
+			t.Fatal("ListUsers() did not terminate")
+		}
+		resp, err := server.ListUsers(ctx, &pb.ListUsersRequest{PageSize: 7, PageToken: token})
+		if err != nil {
+			t.Fatalf("ListUsers() error = %v", err)
+		}
+		for _, user := range resp.Users {
+			if seen[user.Id] {
+				t.Errorf("ListUsers() returned user %d twice", user.Id)
+			}
+			if user.Id <= lastID {
+				t.Errorf("ListUsers() user %d out of order after %d", user.Id, lastID)
+			}
+			seen[user.Id] = true
+			lastID = user.Id
+		}
+		if resp.NextPageToken == "" {
+			break
+		}
+		token = resp.NextPageToken
+	}
+	close(stop)
+	<-done
+
+	for id := range stable {
+		if !seen[id] {
+			t.Errorf("ListUsers() skipped user %d", id)
+		}
+	}
+
+	// 令牌与请求参数不一致或被篡改时拒绝
+	first, err := server.ListUsers(ctx, &pb.ListUsersRequest{PageSize: 1})
+	if err != nil {
+		t.Fatalf("ListUsers() error = %v", err)
+	}
+	_, err = server.ListUsers(ctx, &pb.ListUsersRequest{PageSize: 1, PageToken: first.NextPageToken, ShowDeleted: true})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListUsers() mismatched token code = %v, want InvalidArgument", status.Code(err))
+	}
+	_, err = server.ListUsers(ctx, &pb.ListUsersRequest{PageToken: "not-a-token"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListUsers() garbage token code = %v, want InvalidArgument", status.Code(err))
+	}
+}
+
+func TestUserServer_ListUsersFilterOrder(t *testing.T) {
+	server := NewUserServer(store.NewMemoryStore())
+	ctx := context.Background()
+
+	for _, req := range []*pb.CreateUserRequest{
+		{Name: "张三", Email: "zhangsan@example.com", Age: 25},
+		{Name: "张三丰", Email: "zhangsanfeng@Example.COM", Age: 90},
+		{Name: "李四", Email: "lisi@example.com", Age: 30},
+		{Name: "王五", Email: "wangwu@other.org", Age: 25},
+		{Name: "张伟", Email: "zhangwei@other.org", Age: 17},
+	} {
+		if _, err := server.CreateUser(ctx, req); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		filter    string
+		orderBy   string
+		wantNames []string
+	}{
+		{
+			name:      "name prefix",
+			filter:    `name = "张*"`,
+			wantNames: []string{"张三", "张三丰", "张伟"},
+		},
+		{
+			name:      "email domain is case-insensitive",
+			filter:    `email = "*@example.com"`,
+			wantNames: []string{"张三", "张三丰", "李四"},
+		},
+		{
+			name:      "age range",
+			filter:    `age >= 18 AND age < 90`,
+			wantNames: []string{"张三", "李四", "王五"},
+		},
+		{
+			name:      "created_at range",
+			filter:    `created_at >= "2000-01-01T00:00:00Z" AND created_at < 4102444800`,
+			wantNames: []string{"张三", "张三丰", "李四", "王五", "张伟"},
+		},
+		{
+			name:      "order by age desc then name",
+			orderBy:   "age desc, name",
+			wantNames: []string{"张三丰", "李四", "张三", "王五", "张伟"},
+		},
+		{
+			name:      "filter and order",
+			filter:    `name != "张*"`,
+			orderBy:   "age",
+			wantNames: []string{"王五", "李四"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 每页2个，验证翻页是在过滤和排序之后进行的
+			var names []string
+			token := ""
+			for {
+				resp, err := server.ListUsers(ctx, &pb.ListUsersRequest{
+					PageSize:  2,
+					PageToken: token,
+					Filter:    tt.filter,
+					OrderBy:   tt.orderBy,
+				})
+				if err != nil {
+					t.Fatalf("ListUsers() error = %v", err)
+				}
+				if int(resp.Total) != len(tt.wantNames) {
+					t.Errorf("ListUsers() total = %d, want %d", resp.Total, len(tt.wantNames))
+				}
+				for _, user := range resp.Users {
+					names = append(names, user.Name)
+				}
+				if resp.NextPageToken == "" {
+					break
+				}
+				token = resp.NextPageToken
+			}
+			if fmt.Sprint(names) != fmt.Sprint(tt.wantNames) {
+				t.Errorf("ListUsers() names = %v, want %v", names, tt.wantNames)
+			}
+		})
+	}
+
+	invalid := []struct {
+		name    string
+		filter  string
+		orderBy string
+		wantPos string
+	}{
+		{name: "unknown field", filter: `age > 1 AND nickname = "x"`, wantPos: "第13个字符"},
+		{name: "missing operator", filter: `age 18`, wantPos: "第5个字符"},
+		{name: "string op on text", filter: `name > "张"`, wantPos: "第6个字符"},
+		{name: "unterminated string", filter: `name = "张`, wantPos: "第8个字符"},
+		{name: "bad time", filter: `created_at > "yesterday"`, wantPos: "第14个字符"},
+		{name: "bad direction", orderBy: "age down", wantPos: "第5个字符"},
+		{name: "unknown order field", orderBy: "age, nickname", wantPos: "第6个字符"},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := server.ListUsers(ctx, &pb.ListUsersRequest{Filter: tt.filter, OrderBy: tt.orderBy})
+			if status.Code(err) != codes.InvalidArgument {
+				t.Fatalf("ListUsers() code = %v, want InvalidArgument", status.Code(err))
+			}
+			if msg := status.Convert(err).Message(); !strings.Contains(msg, tt.wantPos) {
+				t.Errorf("ListUsers() message = %q, want position %q", msg, tt.wantPos)
+			}
+		})
+	}
+}
+
+func TestUserServer_SearchUsers(t *testing.T) {
+	userStore := store.NewMemoryStore()
+	ctx := context.Background()
+
+	// 启动前已存在的用户也应能被搜索到
+	if _, err := userStore.Create(ctx, &pb.User{Name: "李四", Email: "lisi@example.com", Phone: "13800138002"}); err != nil {
+		t.Fatalf("Failed to seed store: %v", err)
+	}
+	server := NewUserServer(userStore)
+
+	zhang, err := server.CreateUser(ctx, &pb.CreateUserRequest{Name: "张三", Email: "zhangsan@example.com", Phone: "13800138001"})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	search := func(query string) []string {
+		t.Helper()
+		resp, err := server.SearchUsers(ctx, &pb.SearchUsersRequest{Query: query})
+		if err != nil {
+			t.Fatalf("SearchUsers(%q) error = %v", query, err)
+		}
+		var names []string
+		for _, r := range resp.Results {
+			names = append(names, r.User.Name)
+		}
+		return names
+	}
+
+	if got := search("李四"); fmt.Sprint(got) != "[李四]" {
+		t.Errorf("SearchUsers(李四) = %v, want [李四]", got)
+	}
+	if got := search("0138001"); fmt.Sprint(got) != "[张三]" {
+		t.Errorf("SearchUsers(0138001) = %v, want [张三]", got)
+	}
+
+	// 更新后按新名字搜索
+	if _, err := server.UpdateUser(ctx, &pb.UpdateUserRequest{Id: zhang.User.Id, Name: "张三丰"}); err != nil {
+		t.Fatalf("UpdateUser() error = %v", err)
+	}
+	if got := search("三丰"); fmt.Sprint(got) != "[张三丰]" {
+		t.Errorf("SearchUsers(三丰) after update = %v, want [张三丰]", got)
+	}
+
+	// 删除后搜不到，恢复后又能搜到
+	if _, err := server.DeleteUser(ctx, &pb.DeleteUserRequest{Id: zhang.User.Id}); err != nil {
+		t.Fatalf("DeleteUser() error = %v", err)
+	}
+	if got := search("zhangsan"); len(got) != 0 {
+		t.Errorf("SearchUsers(zhangsan) after delete = %v, want none", got)
+	}
+	if _, err := server.UndeleteUser(ctx, &pb.UndeleteUserRequest{Id: zhang.User.Id}); err != nil {
+		t.Fatalf("UndeleteUser() error = %v", err)
+	}
+	if got := search("zhangsan"); fmt.Sprint(got) != "[张三丰]" {
+		t.Errorf("SearchUsers(zhangsan) after undelete = %v, want [张三丰]", got)
+	}
+
+	if _, err := server.SearchUsers(ctx, &pb.SearchUsersRequest{Query: "  "}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("SearchUsers() empty query code = %v, want InvalidArgument", status.Code(err))
+	}
+}
+
+func TestUserServer_UpdateMask(t *testing.T) {
+	server := NewUserServer(store.NewMemoryStore())
+	ctx := context.Background()
+
+	created, err := server.CreateUser(ctx, &pb.CreateUserRequest{Name: "测试用户", Email: "test@example.com", Age: 25, Phone: "13800138000"})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	id := created.User.Id
+
+	// 只写入 mask 中的字段：清空手机号、年龄设为0，忽略请求中的 name
+	resp, err := server.UpdateUser(ctx, &pb.UpdateUserRequest{
+		Id:         id,
+		Name:       "不会被写入",
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"phone", "age"}},
+	})
+	if err != nil {
+		t.Fatalf("UpdateUser() with mask error = %v", err)
+	}
+	if u := resp.User; u.Phone != "" || u.Age != 0 || u.Name != "测试用户" || u.Email != "test@example.com" {
+		t.Errorf("UpdateUser() with mask = %+v, want phone and age cleared only", u)
+	}
+
+	// 清空手机号后，其他用户可以使用这个号码
+	if _, err := server.CreateUser(ctx, &pb.CreateUserRequest{Name: "另一个用户", Email: "other@example.com", Phone: "13800138000"}); err != nil {
+		t.Errorf("CreateUser() with released phone error = %v", err)
+	}
+
+	// 不带 mask 时保持旧语义：空值不修改
+	resp, err = server.UpdateUser(ctx, &pb.UpdateUserRequest{Id: id, Age: 30})
+	if err != nil {
+		t.Fatalf("UpdateUser() without mask error = %v", err)
+	}
+	if u := resp.User; u.Age != 30 || u.Name != "测试用户" || u.Email != "test@example.com" {
+		t.Errorf("UpdateUser() without mask = %+v, want only age changed", u)
+	}
+
+	// "*" 写入全部字段
+	resp, err = server.UpdateUser(ctx, &pb.UpdateUserRequest{
+		Id:         id,
+		Name:       "新名字",
+		Email:      "new@example.com",
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"*"}},
+	})
+	if err != nil {
+		t.Fatalf("UpdateUser() with * mask error = %v", err)
+	}
+	if u := resp.User; u.Name != "新名字" || u.Email != "new@example.com" || u.Age != 0 || u.Phone != "" {
+		t.Errorf("UpdateUser() with * mask = %+v, want full replacement", u)
+	}
+
+	invalid := []struct {
+		name  string
+		paths []string
+		req   *pb.UpdateUserRequest
+	}{
+		{name: "unknown path", paths: []string{"name", "nickname"}},
+		{name: "output only field", paths: []string{"version"}},
+		{name: "wildcard mixed with fields", paths: []string{"*", "name"}},
+		{name: "clear required name", paths: []string{"name"}},
+		{name: "clear required email", paths: []string{"email"}},
+		{name: "negative age", paths: []string{"age"}, req: &pb.UpdateUserRequest{Age: -1}},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			if req == nil {
+				req = &pb.UpdateUserRequest{}
+			}
+			req.Id = id
+			req.UpdateMask = &fieldmaskpb.FieldMask{Paths: tt.paths}
+
+			_, err := server.UpdateUser(ctx, req)
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("UpdateUser() code = %v, want InvalidArgument", status.Code(err))
+			}
+		})
+	}
+
+	got, err := server.GetUser(ctx, &pb.GetUserRequest{Id: id})
+	if err != nil {
+		t.Fatalf("GetUser() error = %v", err)
+	}
+	if got.User.Name != "新名字" || got.User.Version != 4 {
+		t.Errorf("GetUser() after rejected updates = %+v, want unchanged", got.User)
+	}
+}
+
+func TestUserServer_Batch(t *testing.T) {
+	server := NewUserServer(store.NewMemoryStore())
+	ctx := context.Background()
+
+	codesOf := func(statuses ...*pb.BatchStatus) []codes.Code {
+		var got []codes.Code
+		for _, st := range statuses {
+			got = append(got, codes.Code(st.Code))
+		}
+		return got
+	}
+
+	// 非原子：成功的条目生效，失败的条目单独报告
+	created, err := server.BatchCreateUsers(ctx, &pb.BatchCreateUsersRequest{Requests: []*pb.CreateUserRequest{
+		{Name: "张三", Email: "zhangsan@example.com"},
+		{Name: "李四", Email: "ZhangSan@example.com"},
+		{Name: "王五", Email: "wangwu@example.com"},
+		{Email: "noname@example.com"},
+	}})
+	if err != nil {
+		t.Fatalf("BatchCreateUsers() error = %v", err)
+	}
+	var createStatuses []*pb.BatchStatus
+	for _, r := range created.Results {
+		createStatuses = append(createStatuses, r.Status)
+	}
+	want := []codes.Code{codes.OK, codes.AlreadyExists, codes.OK, codes.InvalidArgument}
+	if got := codesOf(createStatuses...); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("BatchCreateUsers() codes = %v, want %v", got, want)
+	}
+	if created.SuccessCount != 2 || created.Results[1].User != nil || created.Results[2].User.Name != "王五" {
+		t.Errorf("BatchCreateUsers() = %+v, want 2 users created", created)
+	}
+	zhangID, wangID := created.Results[0].User.Id, created.Results[2].User.Id
+
+	// 原子：第二项重复导致整批不生效，已创建的第一项被撤销
+	atomic, err := server.BatchCreateUsers(ctx, &pb.BatchCreateUsersRequest{Atomic: true, Requests: []*pb.CreateUserRequest{
+		{Name: "赵六", Email: "zhaoliu@example.com"},
+		{Name: "重复", Email: "wangwu@example.com"},
+		{Name: "孙七", Email: "sunqi@example.com"},
+	}})
+	if err != nil {
+		t.Fatalf("BatchCreateUsers(atomic) error = %v", err)
+	}
+	createStatuses = createStatuses[:0]
+	for _, r := range atomic.Results {
+		createStatuses = append(createStatuses, r.Status)
+		if r.User != nil {
+			t.Errorf("BatchCreateUsers(atomic) returned user %+v after rollback", r.User)
+		}
+	}
+	want = []codes.Code{codes.Aborted, codes.AlreadyExists, codes.Aborted}
+	if got := codesOf(createStatuses...); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("BatchCreateUsers(atomic) codes = %v, want %v", got, want)
+	}
+	if _, err := server.GetUserByEmail(ctx, &pb.GetUserByEmailRequest{Email: "zhaoliu@example.com"}); status.Code(err) != codes.NotFound {
+		t.Errorf("GetUserByEmail() rolled back user code = %v, want NotFound", status.Code(err))
+	}
+	if results, _ := server.SearchUsers(ctx, &pb.SearchUsersRequest{Query: "赵六"}); len(results.Results) != 0 {
+		t.Errorf("SearchUsers() rolled back user = %v, want none", results.Results)
+	}
+	// 撤销的批量操作不留下审计记录，审计日志中只有非原子批量创建的两个用户
+	events, err := server.ListAuditEvents(ctx, &pb.ListAuditEventsRequest{})
+	if err != nil {
+		t.Fatalf("ListAuditEvents() error = %v", err)
+	}
+	if len(events.Events) != 2 {
+		t.Errorf("ListAuditEvents() after rollback = %v, want only the 2 committed creates", events.Events)
+	}
+
+	// 原子删除：不存在的ID导致整批不生效
+	deleted, err := server.BatchDeleteUsers(ctx, &pb.BatchDeleteUsersRequest{Atomic: true, Requests: []*pb.DeleteUserRequest{
+		{Id: zhangID}, {Id: 999}, {Id: wangID},
+	}})
+	if err != nil {
+		t.Fatalf("BatchDeleteUsers(atomic) error = %v", err)
+	}
+	var deleteStatuses []*pb.BatchStatus
+	for _, r := range deleted.Results {
+		deleteStatuses = append(deleteStatuses, r.Status)
+	}
+	want = []codes.Code{codes.Aborted, codes.NotFound, codes.Aborted}
+	if got := codesOf(deleteStatuses...); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("BatchDeleteUsers(atomic) codes = %v, want %v", got, want)
+	}
+	// 恢复后的版本号不回退：创建为1，删除为2，恢复为3
+	if restored, err := server.GetUser(ctx, &pb.GetUserRequest{Id: zhangID}); err != nil || restored.User.Version != 3 {
+		t.Errorf("GetUser() after rolled back delete = %v, %v, want version 3", restored, err)
+	}
+
+	// 非原子删除
+	deleted, err = server.BatchDeleteUsers(ctx, &pb.BatchDeleteUsersRequest{Requests: []*pb.DeleteUserRequest{
+		{Id: zhangID}, {Id: 999},
+	}})
+	if err != nil {
+		t.Fatalf("BatchDeleteUsers() error = %v", err)
+	}
+	if deleted.SuccessCount != 1 {
+		t.Errorf("BatchDeleteUsers() success count = %d, want 1", deleted.SuccessCount)
+	}
+
+	got, err := server.BatchGetUsers(ctx, &pb.BatchGetUsersRequest{Ids: []int64{wangID, zhangID, 999, 0}})
+	if err != nil {
+		t.Fatalf("BatchGetUsers() error = %v", err)
+	}
+	var getStatuses []*pb.BatchStatus
+	for _, r := range got.Results {
+		getStatuses = append(getStatuses, r.Status)
+	}
+	want = []codes.Code{codes.OK, codes.FailedPrecondition, codes.NotFound, codes.InvalidArgument}
+	if got := codesOf(getStatuses...); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("BatchGetUsers() codes = %v, want %v", got, want)
+	}
+	if got.Results[0].User.Name != "王五" {
+		t.Errorf("BatchGetUsers() first user = %+v, want 王五", got.Results[0].User)
+	}
+
+	if _, err := server.BatchGetUsers(ctx, &pb.BatchGetUsersRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("BatchGetUsers() empty code = %v, want InvalidArgument", status.Code(err))
+	}
+	if _, err := server.BatchGetUsers(ctx, &pb.BatchGetUsersRequest{Ids: make([]int64, maxBatchSize+1)}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("BatchGetUsers() oversized code = %v, want InvalidArgument", status.Code(err))
+	}
+}
+
+// newTestClient 在内存连接上启动 gRPC 服务器，返回连接到它的客户端，用于测试流式接口
+func newTestClient(t *testing.T, server *UserServer, opts ...grpc.ServerOption) pb.UserServiceClient {
+	t.Helper()
+	return pb.NewUserServiceClient(newTestConn(t, server, opts...))
+}
+
+// newTestConn 在内存连接上启动同时提供 v1 和 v2 接口的 gRPC 服务器，返回连接到它的客户端连接
+func newTestConn(t *testing.T, server *UserServer, opts ...grpc.ServerOption) *grpc.ClientConn {
+	t.Helper()
+
+	lis := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer(opts...)
+	RegisterServices(s, server)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Failed to dial test server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestUserServer_ImportExport(t *testing.T) {
+	server := NewUserServer(store.NewMemoryStore())
+	client := newTestClient(t, server)
+	ctx := context.Background()
+
+	stream, err := client.ImportUsers(ctx)
+	if err != nil {
+		t.Fatalf("ImportUsers() error = %v", err)
+	}
+	rows := []*pb.CreateUserRequest{
+		{Name: "张三", Email: "zhangsan@example.com", Age: 25},
+		{Name: "李四", Email: "ZHANGSAN@example.com"},
+		{Name: "王五", Email: "wangwu@example.com", Age: 40},
+		{Name: "", Email: "empty@example.com"},
+	}
+	// 超过 ListUsers 单页上限的记录数
+	for i := 0; i < 150; i++ {
+		rows = append(rows, &pb.CreateUserRequest{Name: "批量用户", Email: fmt.Sprintf("bulk%d@example.com", i)})
+	}
+	for _, row := range rows {
+		if err := stream.Send(row); err != nil {
+			t.Fatalf("Send() error = %v", err)
+		}
+	}
+	summary, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("CloseAndRecv() error = %v", err)
+	}
+	if summary.Total != 154 || summary.Imported != 152 || summary.Failed != 2 {
+		t.Errorf("ImportUsers() summary = %+v, want 154 total, 152 imported, 2 failed", summary)
+	}
+	var failedRows []string
+	for _, e := range summary.Errors {
+		failedRows = append(failedRows, fmt.Sprintf("%d:%v", e.Row, codes.Code(e.Status.Code)))
+	}
+	if got, want := strings.Join(failedRows, ","), "2:AlreadyExists,4:InvalidArgument"; got != want {
+		t.Errorf("ImportUsers() errors = %s, want %s", got, want)
+	}
+
+	if _, err := server.DeleteUser(ctx, &pb.DeleteUserRequest{Id: 1}); err != nil {
+		t.Fatalf("DeleteUser() error = %v", err)
+	}
+
+	export := func(req *pb.ExportUsersRequest) ([]*pb.User, error) {
+		t.Helper()
+		stream, err := client.ExportUsers(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		var users []*pb.User
+		for {
+			user, err := stream.Recv()
+			if err == io.EOF {
+				return users, nil
+			}
+			if err != nil {
+				return users, err
+			}
+			users = append(users, user)
+		}
+	}
+
+	users, err := export(&pb.ExportUsersRequest{})
+	if err != nil {
+		t.Fatalf("ExportUsers() error = %v", err)
+	}
+	if len(users) != 151 || users[0].Name != "王五" {
+		t.Errorf("ExportUsers() returned %d users starting with %v, want 151 starting with 王五", len(users), users[0])
+	}
+	for i := 1; i < len(users); i++ {
+		if users[i-1].Id >= users[i].Id {
+			t.Fatalf("ExportUsers() not ordered by id at %d: %d >= %d", i, users[i-1].Id, users[i].Id)
+		}
+	}
+
+	users, err = export(&pb.ExportUsersRequest{ShowDeleted: true, Filter: "age >= 18"})
+	if err != nil {
+		t.Fatalf("ExportUsers(filter) error = %v", err)
+	}
+	if len(users) != 2 || users[0].Name != "张三" || users[1].Name != "王五" {
+		t.Errorf("ExportUsers(filter) = %v, want 张三 and 王五", users)
+	}
+
+	if _, err := export(&pb.ExportUsersRequest{Filter: "age >"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ExportUsers() invalid filter code = %v, want InvalidArgument", status.Code(err))
+	}
+}
+
+func TestUserServer_WatchUsers(t *testing.T) {
+	server := NewUserServer(store.NewMemoryStore(), WithWatchHistory(2))
+	client := newTestClient(t, server)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// watch 从当前 revision 开始，起始 revision 在响应头中
+	stream, err := client.WatchUsers(ctx, &pb.WatchUsersRequest{})
+	if err != nil {
+		t.Fatalf("WatchUsers() error = %v", err)
+	}
+	header, err := stream.Header()
+	if err != nil {
+		t.Fatalf("Header() error = %v", err)
+	}
+	start, err := strconv.ParseInt(header.Get("revision")[0], 10, 64)
+	if err != nil {
+		t.Fatalf("invalid revision header: %v", err)
+	}
+
+	// 每次修改后立即读取事件，避免容量很小的历史被压缩
+	expect := func(wantType pb.UserEvent_Type, wantRevision int64) *pb.UserEvent {
+		t.Helper()
+		event, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv() error = %v", err)
+		}
+		if event.Type != wantType || event.Revision != wantRevision {
+			t.Errorf("Recv() = %v, want %v at revision %d", event, wantType, wantRevision)
+		}
+		return event
+	}
+
+	created, err := server.CreateUser(ctx, &pb.CreateUserRequest{Name: "张三", Email: "zhangsan@example.com"})
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	id := created.User.Id
+	if event := expect(pb.UserEvent_CREATED, start+1); event.User.Name != "张三" {
+		t.Errorf("CREATED event user = %v, want 张三", event.User)
+	}
+	if _, err := server.UpdateUser(ctx, &pb.UpdateUserRequest{Id: id, Age: 30}); err != nil {
+		t.Fatalf("UpdateUser() error = %v", err)
+	}
+	if event := expect(pb.UserEvent_UPDATED, start+2); event.User.Age != 30 {
+		t.Errorf("UPDATED event user = %v, want age 30", event.User)
+	}
+	// 被撤销的原子批量操作不产生事件
+	if _, err := server.BatchCreateUsers(ctx, &pb.BatchCreateUsersRequest{Atomic: true, Requests: []*pb.CreateUserRequest{
+		{Name: "李四", Email: "lisi@example.com"},
+		{Name: "重复", Email: "zhangsan@example.com"},
+	}}); err != nil {
+		t.Fatalf("BatchCreateUsers() error = %v", err)
+	}
+	if _, err := server.DeleteUser(ctx, &pb.DeleteUserRequest{Id: id}); err != nil {
+		t.Fatalf("DeleteUser() error = %v", err)
+	}
+	expect(pb.UserEvent_DELETED, start+3)
+	if _, err := server.UndeleteUser(ctx, &pb.UndeleteUserRequest{Id: id}); err != nil {
+		t.Fatalf("UndeleteUser() error = %v", err)
+	}
+	expect(pb.UserEvent_UPDATED, start+4)
+
+	// 断线后从收到的最后一个 revision 继续
+	resumed, err := client.WatchUsers(ctx, &pb.WatchUsersRequest{AfterRevision: start + 2})
+	if err != nil {
+		t.Fatalf("WatchUsers(resume) error = %v", err)
+	}
+	for _, wantRevision := range []int64{start + 3, start + 4} {
+		event, err := resumed.Recv()
+		if err != nil {
+			t.Fatalf("Recv() resumed error = %v", err)
+		}
+		if event.Revision != wantRevision {
+			t.Errorf("resumed event revision = %d, want %d", event.Revision, wantRevision)
+		}
+	}
+
+	// 只保留最近的事件，再产生两个事件后前4个事件都被压缩
+	if _, err := server.UpdateUser(ctx, &pb.UpdateUserRequest{Id: id, Age: 31}); err != nil {
+		t.Fatalf("UpdateUser() error = %v", err)
+	}
+	other, err := server.CreateUser(ctx, &pb.CreateUserRequest{Name: "王五", Email: "wangwu@example.com"})
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		req      *pb.WatchUsersRequest
+		wantCode codes.Code
+		wantType pb.UserEvent_Type
+	}{
+		{name: "compacted revision", req: &pb.WatchUsersRequest{AfterRevision: start}, wantCode: codes.OutOfRange},
+		{name: "future revision", req: &pb.WatchUsersRequest{AfterRevision: start + 100}, wantCode: codes.OutOfRange},
+		{name: "revision before restart", req: &pb.WatchUsersRequest{AfterRevision: 1}, wantCode: codes.OutOfRange},
+		{name: "filter by user", req: &pb.WatchUsersRequest{AfterRevision: start + 4, UserId: other.User.Id}, wantType: pb.UserEvent_CREATED},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream, err := client.WatchUsers(ctx, tt.req)
+			if err != nil {
+				t.Fatalf("WatchUsers() error = %v", err)
+			}
+			event, err := stream.Recv()
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("Recv() code = %v, want %v (err %v)", status.Code(err), tt.wantCode, err)
+			}
+			if err == nil && (event.Type != tt.wantType || event.User.Id != other.User.Id) {
+				t.Errorf("Recv() = %v, want %v for user %d", event, tt.wantType, other.User.Id)
+			}
+		})
+	}
+}
+
+func TestUserServer_AuditLog(t *testing.T) {
+	server := NewUserServer(store.NewMemoryStore())
+	client := newTestClient(t, server)
+	asCaller := func(caller string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "x-caller", caller)
+	}
+
+	created, err := client.CreateUser(asCaller("alice"), &pb.CreateUserRequest{Name: "张三", Email: "zhangsan@example.com"})
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	id := created.User.Id
+	if _, err := client.UpdateUser(asCaller("bob"), &pb.UpdateUserRequest{Id: id, Email: "zhangsan@new.example.com"}); err != nil {
+		t.Fatalf("UpdateUser() error = %v", err)
+	}
+	if _, err := client.CreateUser(asCaller("alice"), &pb.CreateUserRequest{Name: "李四", Email: "lisi@example.com"}); err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	// 失败的修改不产生审计记录
+	if _, err := client.UpdateUser(asCaller("bob"), &pb.UpdateUserRequest{Id: id, Email: "lisi@example.com"}); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("UpdateUser() duplicate email code = %v, want AlreadyExists", status.Code(err))
+	}
+	if _, err := client.DeleteUser(context.Background(), &pb.DeleteUserRequest{Id: id}); err != nil {
+		t.Fatalf("DeleteUser() error = %v", err)
+	}
+
+	resp, err := client.ListAuditEvents(context.Background(), &pb.ListAuditEventsRequest{UserId: id})
+	if err != nil {
+		t.Fatalf("ListAuditEvents() error = %v", err)
+	}
+	var got []string
+	for _, e := range resp.Events {
+		var changes []string
+		for _, c := range e.Changes {
+			if c.Field != "deleted_at" {
+				changes = append(changes, fmt.Sprintf("%s:%q->%q", c.Field, c.Before, c.After))
+			} else if c.Before == "" && c.After != "" {
+				changes = append(changes, "deleted_at:set")
+			}
+		}
+		caller := e.Caller
+		if strings.HasPrefix(caller, "anonymous@") {
+			caller = "anonymous"
+		}
+		got = append(got, fmt.Sprintf("%s by %s [%s]", e.Method, caller, strings.Join(changes, " ")))
+	}
+	want := []string{
+		`CreateUser by alice [name:""->"张三" email:""->"zhangsan@example.com"]`,
+		`UpdateUser by bob [email:"zhangsan@example.com"->"zhangsan@new.example.com"]`,
+		`DeleteUser by anonymous [deleted_at:set]`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ListAuditEvents(user) =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if err := audit.Verify(resp.Events[:1]); err != nil {
+		t.Errorf("Verify() first event error = %v", err)
+	}
+
+	// 按接口过滤并翻页
+	page, err := client.ListAuditEvents(context.Background(), &pb.ListAuditEventsRequest{Method: "CreateUser", PageSize: 1})
+	if err != nil {
+		t.Fatalf("ListAuditEvents(method) error = %v", err)
+	}
+	if len(page.Events) != 1 || page.NextPageToken == "" {
+		t.Fatalf("ListAuditEvents(method) first page = %v, want 1 event and a token", page)
+	}
+	page, err = client.ListAuditEvents(context.Background(), &pb.ListAuditEventsRequest{Method: "CreateUser", PageSize: 1, PageToken: page.NextPageToken})
+	if err != nil {
+		t.Fatalf("ListAuditEvents(method) second page error = %v", err)
+	}
+	if len(page.Events) != 1 || page.Events[0].UserId == id || page.NextPageToken != "" {
+		t.Errorf("ListAuditEvents(method) second page = %v, want 李四 and no token", page)
+	}
+
+	// 时间范围
+	now := time.Now().Unix()
+	future, err := client.ListAuditEvents(context.Background(), &pb.ListAuditEventsRequest{StartTime: now + 60})
+	if err != nil || len(future.Events) != 0 {
+		t.Errorf("ListAuditEvents(future) = %v, %v, want none", future, err)
+	}
+	if _, err := client.ListAuditEvents(context.Background(), &pb.ListAuditEventsRequest{StartTime: now, EndTime: now - 1}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListAuditEvents() inverted range code = %v, want InvalidArgument", status.Code(err))
+	}
+}
+
+// fieldViolations 返回错误中 BadRequest 详情里的违规字段
+func fieldViolations(err error) []string {
+	var fields []string
+	for _, detail := range status.Convert(err).Details() {
+		if br, ok := detail.(*errdetails.BadRequest); ok {
+			for _, fv := range br.FieldViolations {
+				fields = append(fields, fv.Field)
+			}
+		}
+	}
+	return fields
+}
+
+func TestUserServer_Validation(t *testing.T) {
+	server := NewUserServer(store.NewMemoryStore())
+	ctx := context.Background()
+
+	valid := func() *pb.CreateUserRequest {
+		return &pb.CreateUserRequest{Name: "测试用户", Email: "test@example.com", Age: 25, Phone: "+86 138-0013-8000"}
+	}
+	tests := []struct {
+		name   string
+		modify func(req *pb.CreateUserRequest)
+		want   []string
+	}{
+		{name: "valid", modify: func(req *pb.CreateUserRequest) {}},
+		{name: "phone without plus", modify: func(req *pb.CreateUserRequest) { req.Phone = "13800138000" }},
+		{name: "no phone and age", modify: func(req *pb.CreateUserRequest) { req.Phone, req.Age = "", 0 }},
+		{name: "blank name", modify: func(req *pb.CreateUserRequest) { req.Name = "   " }, want: []string{"name"}},
+		{name: "long name", modify: func(req *pb.CreateUserRequest) { req.Name = strings.Repeat("张", 10000) }, want: []string{"name"}},
+		{name: "invalid utf8 name", modify: func(req *pb.CreateUserRequest) { req.Name = "张\xff三" }, want: []string{"name"}},
+		{name: "control character in name", modify: func(req *pb.CreateUserRequest) { req.Name = "张\n三" }, want: []string{"name"}},
+		{name: "email without at", modify: func(req *pb.CreateUserRequest) { req.Email = "test.example.com" }, want: []string{"email"}},
+		{name: "email with display name", modify: func(req *pb.CreateUserRequest) { req.Email = "Test <test@example.com>" }, want: []string{"email"}},
+		{name: "email without domain dot", modify: func(req *pb.CreateUserRequest) { req.Email = "test@localhost" }, want: []string{"email"}},
+		{name: "negative age", modify: func(req *pb.CreateUserRequest) { req.Age = -1 }, want: []string{"age"}},
+		{name: "age too large", modify: func(req *pb.CreateUserRequest) { req.Age = 200 }, want: []string{"age"}},
+		{name: "garbage phone", modify: func(req *pb.CreateUserRequest) { req.Phone = "call me" }, want: []string{"phone"}},
+		{name: "phone with trunk prefix", modify: func(req *pb.CreateUserRequest) { req.Phone = "010-12345678" }, want: []string{"phone"}},
+		{name: "phone too long", modify: func(req *pb.CreateUserRequest) { req.Phone = "+1234567890123456" }, want: []string{"phone"}},
+		{
+			name:   "every field invalid",
+			modify: func(req *pb.CreateUserRequest) { *req = pb.CreateUserRequest{Email: "bad", Age: -5, Phone: "x"} },
+			want:   []string{"name", "email", "age", "phone"},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := valid()
+			tt.modify(req)
+			if tt.want == nil {
+				// 避免和其他合法用例的邮箱、手机号冲突
+				req.Email = fmt.Sprintf("valid%d@example.com", i)
+				req.Phone = ""
+			}
+
+			_, err := server.CreateUser(ctx, req)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("CreateUser() error = %v", err)
+				}
+				return
+			}
+			if status.Code(err) != codes.InvalidArgument {
+				t.Fatalf("CreateUser() code = %v, want InvalidArgument", status.Code(err))
+			}
+			if got := fieldViolations(err); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("CreateUser() violations = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// UpdateUser 只校验要写入的字段，规则与 CreateUser 相同
+	created, err := server.CreateUser(ctx, &pb.CreateUserRequest{Name: "张三", Email: "zhangsan@example.com"})
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	_, err = server.UpdateUser(ctx, &pb.UpdateUserRequest{Id: created.User.Id, Email: "not-an-email", Age: -1})
+	if got := fieldViolations(err); fmt.Sprint(got) != "[email age]" {
+		t.Errorf("UpdateUser() violations = %v, want [email age]", got)
+	}
+	_, err = server.UpdateUser(ctx, &pb.UpdateUserRequest{Id: created.User.Id, UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"phone", "nickname"}}})
+	if got := fieldViolations(err); fmt.Sprint(got) != "[update_mask]" {
+		t.Errorf("UpdateUser() unknown mask path violations = %v, want [update_mask]", got)
+	}
+
+	// 批量接口中每个条目的状态带有同样的详情
+	batch, err := server.BatchCreateUsers(ctx, &pb.BatchCreateUsersRequest{Requests: []*pb.CreateUserRequest{
+		{Name: "李四", Email: "lisi@example.com"},
+		{Name: "王五", Email: "wangwu@example.com", Phone: "12"},
+	}})
+	if err != nil {
+		t.Fatalf("BatchCreateUsers() error = %v", err)
+	}
+	item := batch.Results[1].Status
+	st := status.FromProto(&spb.Status{Code: item.Code, Message: item.Message, Details: item.Details})
+	if got := fieldViolations(st.Err()); fmt.Sprint(got) != "[phone]" {
+		t.Errorf("BatchCreateUsers() item violations = %v, want [phone]", got)
+	}
+}
+
+func TestUserServer_ErrorDetails(t *testing.T) {
+	server := NewUserServer(store.NewMemoryStore())
+	ctx := context.Background()
+
+	created, err := server.CreateUser(ctx, &pb.CreateUserRequest{Name: "张三", Email: "zhangsan@example.com", Phone: "13800138000"})
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	id := created.User.Id
+	deleted, err := server.CreateUser(ctx, &pb.CreateUserRequest{Name: "李四", Email: "lisi@example.com"})
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	if _, err := server.DeleteUser(ctx, &pb.DeleteUserRequest{Id: deleted.User.Id}); err != nil {
+		t.Fatalf("DeleteUser() error = %v", err)
+	}
+	deletedName := "users/" + strconv.FormatInt(deleted.User.Id, 10)
+
+	tests := []struct {
+		name     string
+		call     func() error
+		code     codes.Code
+		reason   pb.ErrorReason
+		typ      string // 为空时是 userResourceType
+		resource string
+		metadata map[string]string
+	}{
+		{
+			name: "invalid id",
+			call: func() error {
+				_, err := server.GetUser(ctx, &pb.GetUserRequest{Id: -1})
+				return err
+			},
+			code: codes.InvalidArgument, reason: pb.ErrorReason_INVALID_ARGUMENT, resource: "users/-1",
+			metadata: map[string]string{"fields": "id"},
+		},
+		{
+			name: "not found",
+			call: func() error {
+				_, err := server.GetUser(ctx, &pb.GetUserRequest{Id: 999})
+				return err
+			},
+			code: codes.NotFound, reason: pb.ErrorReason_USER_NOT_FOUND, resource: "users/999",
+		},
+		{
+			name: "not found by email",
+			call: func() error {
+				_, err := server.GetUserByEmail(ctx, &pb.GetUserByEmailRequest{Email: "nobody@example.com"})
+				return err
+			},
+			code: codes.NotFound, reason: pb.ErrorReason_USER_NOT_FOUND, resource: "nobody@example.com",
+		},
+		{
+			name: "deleted",
+			call: func() error {
+				_, err := server.GetUser(ctx, &pb.GetUserRequest{Id: deleted.User.Id})
+				return err
+			},
+			code: codes.FailedPrecondition, reason: pb.ErrorReason_USER_DELETED, resource: deletedName,
+		},
+		{
+			name: "not deleted",
+			call: func() error {
+				_, err := server.UndeleteUser(ctx, &pb.UndeleteUserRequest{Id: id})
+				return err
+			},
+			code: codes.FailedPrecondition, reason: pb.ErrorReason_USER_NOT_DELETED, resource: "users/" + strconv.FormatInt(id, 10),
+		},
+		{
+			name: "duplicate email",
+			call: func() error {
+				_, err := server.CreateUser(ctx, &pb.CreateUserRequest{Name: "王五", Email: "zhangsan@example.com"})
+				return err
+			},
+			code: codes.AlreadyExists, reason: pb.ErrorReason_EMAIL_ALREADY_EXISTS, resource: "users",
+			metadata: map[string]string{"field": "email"},
+		},
+		{
+			name: "duplicate phone on update",
+			call: func() error {
+				_, err := server.UndeleteUser(ctx, &pb.UndeleteUserRequest{Id: deleted.User.Id})
+				if err != nil {
+					return err
+				}
+				_, err = server.UpdateUser(ctx, &pb.UpdateUserRequest{Id: deleted.User.Id, Phone: "138 0013 8000"})
+				return err
+			},
+			code: codes.AlreadyExists, reason: pb.ErrorReason_PHONE_ALREADY_EXISTS, resource: deletedName,
+			metadata: map[string]string{"field": "phone"},
+		},
+		{
+			name: "version mismatch",
+			call: func() error {
+				_, err := server.UpdateUser(ctx, &pb.UpdateUserRequest{Id: id, Age: 30, ExpectedVersion: 7})
+				return err
+			},
+			code: codes.Aborted, reason: pb.ErrorReason_VERSION_MISMATCH, resource: "users/" + strconv.FormatInt(id, 10),
+			metadata: map[string]string{"expected_version": "7", "current_version": "1"},
+		},
+		{
+			name: "invalid filter",
+			call: func() error {
+				_, err := server.ListUsers(ctx, &pb.ListUsersRequest{Filter: "height > 3"})
+				return err
+			},
+			code: codes.InvalidArgument, reason: pb.ErrorReason_INVALID_ARGUMENT, resource: "users",
+			metadata: map[string]string{"fields": "filter"},
+		},
+		{
+			name: "invalid audit page token",
+			call: func() error {
+				_, err := server.ListAuditEvents(ctx, &pb.ListAuditEventsRequest{PageToken: "!"})
+				return err
+			},
+			code: codes.InvalidArgument, reason: pb.ErrorReason_INVALID_ARGUMENT, typ: auditEventResourceType, resource: "auditEvents",
+			metadata: map[string]string{"fields": "page_token"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := status.Convert(tt.call())
+			if st.Code() != tt.code {
+				t.Fatalf("code = %v, want %v (%s)", st.Code(), tt.code, st.Message())
+			}
+
+			var info *errdetails.ErrorInfo
+			var res *errdetails.ResourceInfo
+			for _, detail := range st.Details() {
+				switch d := detail.(type) {
+				case *errdetails.ErrorInfo:
+					info = d
+				case *errdetails.ResourceInfo:
+					res = d
+				}
+			}
+			if info == nil || res == nil {
+				t.Fatalf("details = %v, want ErrorInfo and ResourceInfo", st.Details())
+			}
+			if info.Reason != tt.reason.String() || info.Domain != errorDomain {
+				t.Errorf("ErrorInfo = %s/%s, want %s/%s", info.Domain, info.Reason, errorDomain, tt.reason)
+			}
+			if fmt.Sprint(info.Metadata) != fmt.Sprint(tt.metadata) && len(info.Metadata)+len(tt.metadata) > 0 {
+				t.Errorf("ErrorInfo.Metadata = %v, want %v", info.Metadata, tt.metadata)
+			}
+			if typ := cmp.Or(tt.typ, userResourceType); res.ResourceType != typ {
+				t.Errorf("ResourceInfo.ResourceType = %q, want %q", res.ResourceType, typ)
+			}
+			if res.ResourceName != tt.resource {
+				t.Errorf("ResourceInfo.ResourceName = %q, want %q", res.ResourceName, tt.resource)
+			}
+		})
+	}
+}
+
+func TestUserServer_Idempotency(t *testing.T) {
+	server := NewUserServer(store.NewMemoryStore())
+	client := newTestClient(t, server)
+	ctx := context.Background()
+
+	req := &pb.CreateUserRequest{Name: "张三", Email: "zhangsan@example.com", RequestId: "req-1"}
+	first, err := client.CreateUser(ctx, req)
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+
+	// 同一个 request_id 的重试返回第一次的响应，响应头标明是重放
+	var header metadata.MD
+	second, err := client.CreateUser(ctx, req, grpc.Header(&header))
+	if err != nil {
+		t.Fatalf("CreateUser() retry error = %v", err)
+	}
+	if !proto.Equal(first, second) {
+		t.Errorf("CreateUser() retry = %v, want %v", second, first)
+	}
+	if got := header.Get(replayedHeader); len(got) != 1 || got[0] != "true" {
+		t.Errorf("%s header = %v, want [true]", replayedHeader, got)
+	}
+	if list, _ := server.ListUsers(ctx, &pb.ListUsersRequest{}); list.Total != 1 {
+		t.Errorf("ListUsers() total = %d after retry, want 1", list.Total)
+	}
+
+	// idempotency-key 元数据与 request_id 字段等价
+	keyCtx := metadata.AppendToOutgoingContext(ctx, idempotencyKeyHeader, "req-1")
+	third, err := client.CreateUser(keyCtx, &pb.CreateUserRequest{Name: "张三", Email: "zhangsan@example.com"})
+	if err != nil || third.User.Id != first.User.Id {
+		t.Errorf("CreateUser() with idempotency-key = %v, %v, want user %d", third, err, first.User.Id)
+	}
+	_, err = client.CreateUser(keyCtx, &pb.CreateUserRequest{Name: "张三", Email: "zhangsan@example.com", RequestId: "req-2"})
+	if got := fieldViolations(err); fmt.Sprint(got) != "[request_id]" {
+		t.Errorf("CreateUser() with conflicting idempotency-key violations = %v, want [request_id]", got)
+	}
+
+	// 同一个 request_id 用于内容不同的请求被拒绝
+	_, err = client.CreateUser(ctx, &pb.CreateUserRequest{Name: "李四", Email: "lisi@example.com", RequestId: "req-1"})
+	if status.Code(err) != codes.InvalidArgument || errorReason(err) != pb.ErrorReason_REQUEST_ID_REUSED {
+		t.Errorf("CreateUser() with reused request_id error = %v, want REQUEST_ID_REUSED", err)
+	}
+
+	// 失败的请求不会被记住，修正内容后可以用同一个 request_id 重试
+	_, err = client.CreateUser(ctx, &pb.CreateUserRequest{Name: "李四", Email: "bad", RequestId: "req-3"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("CreateUser() with invalid email error = %v, want InvalidArgument", err)
+	}
+	created, err := client.CreateUser(ctx, &pb.CreateUserRequest{Name: "李四", Email: "lisi@example.com", RequestId: "req-3"})
+	if err != nil {
+		t.Fatalf("CreateUser() after fixing the request error = %v", err)
+	}
+
+	// request_id 按接口区分；重复的删除返回成功而不是“用户已被删除”
+	del := &pb.DeleteUserRequest{Id: created.User.Id, RequestId: "req-1"}
+	for i := 0; i < 2; i++ {
+		if _, err := client.DeleteUser(ctx, del); err != nil {
+			t.Fatalf("DeleteUser() attempt %d error = %v", i+1, err)
+		}
+	}
+	if _, err := client.DeleteUser(ctx, &pb.DeleteUserRequest{Id: created.User.Id}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("DeleteUser() without request_id error = %v, want FailedPrecondition", err)
+	}
+
+	_, err = client.CreateUser(ctx, &pb.CreateUserRequest{Name: "王五", Email: "wangwu@example.com", RequestId: strings.Repeat("x", 129)})
+	if got := fieldViolations(err); fmt.Sprint(got) != "[request_id]" {
+		t.Errorf("CreateUser() with long request_id violations = %v, want [request_id]", got)
+	}
+}
+
+func TestUserServer_IdempotencyTTL(t *testing.T) {
+	server := NewUserServer(store.NewMemoryStore(), WithIdempotencyTTL(10*time.Millisecond))
+	ctx := context.Background()
+
+	req := &pb.CreateUserRequest{Name: "张三", Email: "zhangsan@example.com", RequestId: "req-1"}
+	if _, err := server.CreateUser(ctx, req); err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	if _, err := server.CreateUser(ctx, req); err != nil {
+		t.Fatalf("CreateUser() retry error = %v", err)
+	}
+
+	// 过期后同一个 request_id 被当作新请求
+	time.Sleep(20 * time.Millisecond)
+	if _, err := server.CreateUser(ctx, req); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("CreateUser() after TTL error = %v, want AlreadyExists", err)
+	}
+}
+
+func TestUserServer_IdempotencyPerCaller(t *testing.T) {
+	server := NewUserServer(store.NewMemoryStore())
+	conn, asService := newAuthzTestConn(t, server)
+	client := pb.NewUserServiceClient(conn)
+
+	asAdmin := func(name, email string) context.Context {
+		created, err := client.CreateUser(asService, &pb.CreateUserRequest{Name: name, Email: email})
+		if err != nil {
+			t.Fatalf("CreateUser() error = %v", err)
+		}
+		tokens, err := server.tokens.Issue("", strconv.FormatInt(created.User.Id, 10), auth.RoleAdmin)
+		if err != nil {
+			t.Fatalf("Issue() error = %v", err)
+		}
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+tokens.Access)
+	}
+	alice, bob := asAdmin("Alice", "alice@example.com"), asAdmin("Bob", "bob@example.com")
+
+	// 不同调用方使用相同的 request_id 时各自执行，不会拿到对方的响应，也不会被当作复用
+	first, err := client.CreateUser(alice, &pb.CreateUserRequest{Name: "张三", Email: "zhangsan@example.com", RequestId: "req-1"})
+	if err != nil {
+		t.Fatalf("CreateUser() as alice error = %v", err)
+	}
+	second, err := client.CreateUser(bob, &pb.CreateUserRequest{Name: "李四", Email: "lisi@example.com", RequestId: "req-1"})
+	if err != nil {
+		t.Fatalf("CreateUser() as bob with the same request_id error = %v", err)
+	}
+	if second.User.Id == first.User.Id || second.User.Name != "李四" {
+		t.Errorf("CreateUser() as bob = %v, want a new user", second.User)
+	}
+
+	// 同一个调用方的重试仍然返回第一次的响应
+	retried, err := client.CreateUser(alice, &pb.CreateUserRequest{Name: "张三", Email: "zhangsan@example.com", RequestId: "req-1"})
+	if err != nil || retried.User.Id != first.User.Id {
+		t.Errorf("CreateUser() retry as alice = %v, %v, want the first response", retried, err)
+	}
+}
+
+// fixedIDs 依次返回给定ID的生成器，用于测试ID冲突
+type fixedIDs []int64
+
+func (f *fixedIDs) NewID() (int64, string, error) {
+	id := (*f)[0]
+	*f = (*f)[1:]
+	return id, "", nil
+}
+
+func TestUserServer_IDGenerator(t *testing.T) {
+	ctx := context.Background()
+
+	snowflake, err := idgen.NewSnowflake(7)
+	if err != nil {
+		t.Fatalf("NewSnowflake() error = %v", err)
+	}
+	server := NewUserServer(store.NewMemoryStore(), WithIDGenerator(snowflake))
+	var prev int64
+	for _, email := range []string{"zhangsan@example.com", "lisi@example.com"} {
+		resp, err := server.CreateUser(ctx, &pb.CreateUserRequest{Name: "张三", Email: email})
+		if err != nil {
+			t.Fatalf("CreateUser() error = %v", err)
+		}
+		if resp.User.Id <= prev || resp.User.Id < 1<<22 || resp.User.Uid != "" {
+			t.Errorf("CreateUser() id = %d, uid = %q, want a snowflake id > %d", resp.User.Id, resp.User.Uid, prev)
+		}
+		prev = resp.User.Id
+		if _, err := server.GetUser(ctx, &pb.GetUserRequest{Id: resp.User.Id}); err != nil {
+			t.Errorf("GetUser(%d) error = %v", resp.User.Id, err)
+		}
+	}
+
+	// ULID 生成器：数字ID由存储分配，uid 可用于 GetUser
+	server = NewUserServer(store.NewMemoryStore(), WithIDGenerator(idgen.NewULID()))
+	resp, err := server.CreateUser(ctx, &pb.CreateUserRequest{Name: "张三", Email: "zhangsan@example.com"})
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	if resp.User.Id != 1 || len(resp.User.Uid) != 26 {
+		t.Errorf("CreateUser() id = %d, uid = %q, want 1 and a ULID", resp.User.Id, resp.User.Uid)
+	}
+	got, err := server.GetUser(ctx, &pb.GetUserRequest{Uid: resp.User.Uid})
+	if err != nil || got.User.Id != resp.User.Id {
+		t.Errorf("GetUser(uid) = %v, %v, want user %d", got, err, resp.User.Id)
+	}
+	_, err = server.GetUser(ctx, &pb.GetUserRequest{Uid: "01ARYZ6S41TSV4RRFFQ69G5FAV"})
+	if status.Code(err) != codes.NotFound || errorReason(err) != pb.ErrorReason_USER_NOT_FOUND {
+		t.Errorf("GetUser(unknown uid) error = %v, want USER_NOT_FOUND", err)
+	}
+
+	// 生成的ID已被使用时返回 ID_GENERATION_FAILED，而不是覆盖已有用户
+	ids := fixedIDs{100, 100}
+	server = NewUserServer(store.NewMemoryStore(), WithIDGenerator(&ids))
+	if _, err := server.CreateUser(ctx, &pb.CreateUserRequest{Name: "张三", Email: "zhangsan@example.com"}); err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	_, err = server.CreateUser(ctx, &pb.CreateUserRequest{Name: "李四", Email: "lisi@example.com"})
+	if status.Code(err) != codes.Internal || errorReason(err) != pb.ErrorReason_ID_GENERATION_FAILED {
+		t.Errorf("CreateUser() with a used id error = %v, want ID_GENERATION_FAILED", err)
+	}
+}
+
+func TestV2Server(t *testing.T) {
+	server := NewUserServer(store.NewMemoryStore())
+	v2 := pbv2.NewUserServiceClient(newTestConn(t, server))
+	ctx := context.Background()
+
+	created, err := v2.CreateUser(ctx, &pbv2.CreateUserRequest{User: &pbv2.User{DisplayName: "张三", Email: "zhangsan@example.com", Age: 25}})
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	if created.Name != "users/1" || created.DisplayName != "张三" || created.CreateTime == nil || created.DeleteTime != nil {
+		t.Errorf("CreateUser() = %v", created)
+	}
+
+	// v1 和 v2 使用同一份存储
+	v1resp, err := server.GetUser(ctx, &pb.GetUserRequest{Id: created.Id})
+	if err != nil || v1resp.User.Name != "张三" || v1resp.User.CreatedAt != created.CreateTime.Seconds {
+		t.Errorf("v1 GetUser() = %v, %v, want the user created through v2", v1resp, err)
+	}
+	if _, err := server.CreateUser(ctx, &pb.CreateUserRequest{Name: "李四", Email: "lisi@example.com", Age: 30}); err != nil {
+		t.Fatalf("v1 CreateUser() error = %v", err)
+	}
+	got, err := v2.GetUser(ctx, &pbv2.GetUserRequest{Name: "users/2"})
+	if err != nil || got.DisplayName != "李四" {
+		t.Errorf("GetUser(users/2) = %v, %v, want the user created through v1", got, err)
+	}
+
+	// 字段路径使用 v2 的名称
+	_, err = v2.CreateUser(ctx, &pbv2.CreateUserRequest{User: &pbv2.User{DisplayName: "王五", Email: "bad"}})
+	if fields := fieldViolations(err); strings.Join(fields, ",") != "user.email" {
+		t.Errorf("CreateUser() with invalid email violations = %v, want [user.email]", fields)
+	}
+	for _, name := range []string{"", "1", "users/", "users/0", "groups/1", "users/1/events"} {
+		_, err := v2.GetUser(ctx, &pbv2.GetUserRequest{Name: name})
+		if fields := fieldViolations(err); strings.Join(fields, ",") != "name" {
+			t.Errorf("GetUser(%q) violations = %v, want [name]", name, fields)
+		}
+	}
+	if _, err := v2.GetUser(ctx, &pbv2.GetUserRequest{Name: "users/999"}); status.Code(err) != codes.NotFound {
+		t.Errorf("GetUser(users/999) error = %v, want NotFound", err)
+	}
+
+	updated, err := v2.UpdateUser(ctx, &pbv2.UpdateUserRequest{
+		User:            &pbv2.User{Name: "users/1", DisplayName: "张三丰"},
+		UpdateMask:      &fieldmaskpb.FieldMask{Paths: []string{"display_name", "age"}},
+		ExpectedVersion: created.Version,
+	})
+	if err != nil {
+		t.Fatalf("UpdateUser() error = %v", err)
+	}
+	if updated.DisplayName != "张三丰" || updated.Age != 0 || updated.Version != created.Version+1 {
+		t.Errorf("UpdateUser() = %v", updated)
+	}
+	_, err = v2.UpdateUser(ctx, &pbv2.UpdateUserRequest{
+		User:       &pbv2.User{Name: "users/1", DisplayName: "张三"},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"name"}},
+	})
+	if fields := fieldViolations(err); strings.Join(fields, ",") != "update_mask" {
+		t.Errorf("UpdateUser() with mask path name violations = %v, want [update_mask]", fields)
+	}
+
+	list, err := v2.ListUsers(ctx, &pbv2.ListUsersRequest{Filter: `display_name = "张*"`, OrderBy: "create_time desc"})
+	if err != nil {
+		t.Fatalf("ListUsers() error = %v", err)
+	}
+	if list.TotalSize != 1 || list.Users[0].Name != "users/1" {
+		t.Errorf("ListUsers() = %v, want only users/1", list)
+	}
+
+	// 按 v2 字段名排序时逐页读完全部用户，不重复也不遗漏
+	for i, name := range []string{"赵六", "孙七", "周八"} {
+		user := &pbv2.User{DisplayName: name, Email: fmt.Sprintf("user%d@example.com", i)}
+		if _, err := v2.CreateUser(ctx, &pbv2.CreateUserRequest{User: user}); err != nil {
+			t.Fatalf("CreateUser() error = %v", err)
+		}
+	}
+	for _, orderBy := range []string{"display_name", "create_time desc", "update_time, display_name desc"} {
+		seen := map[string]bool{}
+		var token string
+		for pages := 0; ; pages++ {
+			if pages > 5 {
+				t.Fatalf("ListUsers(order_by=%q) did not finish after %d pages", orderBy, pages)
+			}
+			page, err := v2.ListUsers(ctx, &pbv2.ListUsersRequest{OrderBy: orderBy, PageSize: 2, PageToken: token})
+			if err != nil {
+				t.Fatalf("ListUsers(order_by=%q) error = %v", orderBy, err)
+			}
+			for _, u := range page.Users {
+				if seen[u.Name] {
+					t.Errorf("ListUsers(order_by=%q) returned %s twice", orderBy, u.Name)
+				}
+				seen[u.Name] = true
+			}
+			if token = page.NextPageToken; token == "" {
+				break
+			}
+		}
+		if len(seen) != 5 {
+			t.Errorf("ListUsers(order_by=%q) returned %d users across pages, want 5", orderBy, len(seen))
+		}
+	}
+
+	if _, err := v2.DeleteUser(ctx, &pbv2.DeleteUserRequest{Name: "users/2"}); err != nil {
+		t.Fatalf("DeleteUser() error = %v", err)
+	}
+	if _, err := v2.GetUser(ctx, &pbv2.GetUserRequest{Name: "users/2"}); errorReason(err) != pb.ErrorReason_USER_DELETED {
+		t.Errorf("GetUser() after delete error = %v, want USER_DELETED", err)
+	}
+	restored, err := v2.UndeleteUser(ctx, &pbv2.UndeleteUserRequest{Name: "users/2"})
+	if err != nil || restored.DeleteTime != nil {
+		t.Errorf("UndeleteUser() = %v, %v", restored, err)
+	}
+
+	events, err := v2.ListAuditEvents(ctx, &pbv2.ListAuditEventsRequest{User: "users/1"})
+	if err != nil {
+		t.Fatalf("ListAuditEvents() error = %v", err)
+	}
+	if len(events.Events) != 2 || events.Events[1].Method != "UpdateUser" || events.Events[1].User != "users/1" || events.Events[1].EventTime == nil {
+		t.Errorf("ListAuditEvents() = %v, want CreateUser and UpdateUser of users/1", events.Events)
+	}
+}
+
+// brokenChatStream 发送总是失败的聊天流，模拟已断开的客户端
+type brokenChatStream struct {
+	pb.UserService_ChatServer
+}
+
+func (brokenChatStream) Send(*pb.ChatResponse) error {
+	return status.Error(codes.Unavailable, "transport is closing")
+}
+
+func TestBroadcastMessage_RemovesBrokenClients(t *testing.T) {
+	tenant := NewUserServer(store.NewMemoryStore()).tenants[""]
+	for id := int64(1); id <= 10; id++ {
+		tenant.chatClients[id] = &ChatClient{UserID: id, Stream: brokenChatStream{}}
+	}
+
+	// 并发广播时删除断开的客户端不能与遍历冲突（go test -race）
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tenant.broadcastMessage(&pb.ChatMessage{Content: "你好"}, 0)
+		}()
+	}
+	wg.Wait()
+	if len(tenant.chatClients) != 0 {
+		t.Errorf("chatClients = %d after broadcasting to broken streams, want 0", len(tenant.chatClients))
+	}
+}
+
+func TestV2Server_Chat(t *testing.T) {
+	server := NewUserServer(store.NewMemoryStore())
+	conn := newTestConn(t, server)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, req := range []*pb.CreateUserRequest{
+		{Name: "张三", Email: "zhangsan@example.com"},
+		{Name: "李四", Email: "lisi@example.com"},
+	} {
+		if _, err := pb.NewUserServiceClient(conn).CreateUser(ctx, req); err != nil {
+			t.Fatalf("CreateUser() error = %v", err)
+		}
+	}
+
+	v2, err := pbv2.NewUserServiceClient(conn).Chat(ctx)
+	if err != nil {
+		t.Fatalf("Chat() error = %v", err)
+	}
+	if err := v2.Send(&pbv2.ChatRequest{Action: pbv2.ChatRequest_JOIN, User: "users/1", DisplayName: "张三"}); err != nil {
+		t.Fatalf("Send(JOIN) error = %v", err)
+	}
+	resp, err := v2.Recv()
+	if err != nil {
+		t.Fatalf("Recv() error = %v", err)
+	}
+	if resp.Status != pbv2.ChatResponse_JOINED || resp.Message.Type != pbv2.ChatMessage_SYSTEM || resp.Message.SendTime == nil {
+		t.Errorf("join response = %v", resp)
+	}
+
+	// v1 客户端加入同一个聊天室，v2 客户端收到 JOIN 消息
+	v1, err := pb.NewUserServiceClient(conn).Chat(ctx)
+	if err != nil {
+		t.Fatalf("v1 Chat() error = %v", err)
+	}
+	if err := v1.Send(&pb.ChatRequest{Action: "join", UserId: 2, Username: "李四"}); err != nil {
+		t.Fatalf("v1 Send(join) error = %v", err)
+	}
+	resp, err = v2.Recv()
+	if err != nil {
+		t.Fatalf("Recv() error = %v", err)
+	}
+	if resp.Status != pbv2.ChatResponse_BROADCAST || resp.Message.Type != pbv2.ChatMessage_JOIN || resp.Message.User != "users/2" {
+		t.Errorf("broadcast of v1 join = %v", resp)
+	}
+
+	if err := v2.Send(&pbv2.ChatRequest{Action: pbv2.ChatRequest_MESSAGE, User: "users/1", DisplayName: "张三", Content: "你好"}); err != nil {
+		t.Fatalf("Send(MESSAGE) error = %v", err)
+	}
+	for {
+		msg, err := v1.Recv()
+		if err != nil {
+			t.Fatalf("v1 Recv() error = %v", err)
+		}
+		if msg.Message.MessageType == "text" {
+			if msg.Message.UserId != 1 || msg.Message.Content != "你好" {
+				t.Errorf("v1 received %v, want 你好 from user 1", msg.Message)
+			}
+			break
+		}
+	}
+}
+
+func TestUserServer_ChatIdentity(t *testing.T) {
+	server := NewUserServer(store.NewMemoryStore())
+	client := newTestClient(t, server)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, req := range []*pb.CreateUserRequest{
+		{Name: "张三", Email: "zhangsan@example.com"},
+		{Name: "李四", Email: "lisi@example.com"},
+		{Name: "王五", Email: "wangwu@example.com"},
+	} {
+		if _, err := client.CreateUser(ctx, req); err != nil {
+			t.Fatalf("CreateUser() error = %v", err)
+		}
+	}
+	if _, err := client.DeleteUser(ctx, &pb.DeleteUserRequest{Id: 3}); err != nil {
+		t.Fatalf("DeleteUser() error = %v", err)
+	}
+	join := func(req *pb.ChatRequest) (pb.UserService_ChatClient, *pb.ChatResponse, error) {
+		stream, err := client.Chat(ctx)
+		if err != nil {
+			t.Fatalf("Chat() error = %v", err)
+		}
+		req.Action = "join"
+		if err := stream.Send(req); err != nil {
+			t.Fatalf("Send(join) error = %v", err)
+		}
+		resp, err := stream.Recv()
+		return stream, resp, err
+	}
+
+	// 不存在、已删除和非法的用户不能加入
+	for _, tt := range []struct {
+		userID int64
+		reason pb.ErrorReason
+	}{
+		{99, pb.ErrorReason_USER_NOT_FOUND},
+		{3, pb.ErrorReason_USER_DELETED},
+		{0, pb.ErrorReason_INVALID_ARGUMENT},
+	} {
+		if _, _, err := join(&pb.ChatRequest{UserId: tt.userID, Username: "张三"}); errorReason(err) != tt.reason {
+			t.Errorf("join as %d error = %v, want %v", tt.userID, err, tt.reason)
+		}
+	}
+
+	// 名字取自存储中的用户，而不是请求中的 username
+	zhang, resp, err := join(&pb.ChatRequest{UserId: 1, Username: "管理员"})
+	if err != nil {
+		t.Fatalf("join error = %v", err)
+	}
+	if resp.Message.Content != "欢迎 张三 加入聊天室！" {
+		t.Errorf("join response = %q, want the stored name", resp.Message.Content)
+	}
+	li, _, err := join(&pb.ChatRequest{UserId: 2})
+	if err != nil {
+		t.Fatalf("join error = %v", err)
+	}
+	if msg, err := zhang.Recv(); err != nil || msg.Message.MessageType != "join" || msg.Message.Username != "李四" {
+		t.Fatalf("broadcast of join = %v, %v, want 李四", msg, err)
+	}
+
+	// 加入后不能再以其他身份加入，消息中的 user_id 和 username 被忽略
+	if err := zhang.Send(&pb.ChatRequest{Action: "join", UserId: 2, Username: "李四"}); err != nil {
+		t.Fatalf("Send(join) error = %v", err)
+	}
+	if resp, err := zhang.Recv(); err != nil || resp.Status != "error" {
+		t.Errorf("second join = %v, %v, want an error response", resp, err)
+	}
+	if err := zhang.Send(&pb.ChatRequest{Action: "message", UserId: 2, Username: "李四", Content: "我是李四"}); err != nil {
+		t.Fatalf("Send(message) error = %v", err)
+	}
+	msg, err := li.Recv()
+	if err != nil {
+		t.Fatalf("Recv() error = %v", err)
+	}
+	if msg.Message.UserId != 1 || msg.Message.Username != "张三" || msg.Message.Content != "我是李四" {
+		t.Errorf("message = %v, want it sent by 张三 (1)", msg.Message)
+	}
+
+	// 同一个用户不能在另一个连接中再次加入，已有的会话不受影响
+	if _, _, err := join(&pb.ChatRequest{UserId: 1}); status.Code(err) != codes.AlreadyExists ||
+		errorReason(err) != pb.ErrorReason_CHAT_SESSION_EXISTS {
+		t.Errorf("join as 1 on a second stream error = %v, want CHAT_SESSION_EXISTS", err)
+	}
+	if err := li.Send(&pb.ChatRequest{Action: "message", Content: "你好"}); err != nil {
+		t.Fatalf("Send(message) error = %v", err)
+	}
+	for _, want := range []string{"我是李四", "你好"} {
+		if msg, err := zhang.Recv(); err != nil || msg.Message.Content != want {
+			t.Errorf("zhang Recv() = %v, %v, want %q", msg, err, want)
+		}
+	}
+}
+
+func TestUserServer_ChatIdentity_Authenticated(t *testing.T) {
+	server := NewUserServer(store.NewMemoryStore())
+	conn, asAdmin := newAuthzTestConn(t, server)
+	client := pb.NewUserServiceClient(conn)
+	ctx, cancel := context.WithTimeout(asAdmin, 5*time.Second)
+	defer cancel()
+	for _, req := range []*pb.CreateUserRequest{
+		{Name: "张三", Email: "zhangsan@example.com"},
+		{Name: "李四", Email: "lisi@example.com"},
+	} {
+		if _, err := client.CreateUser(ctx, req); err != nil {
+			t.Fatalf("CreateUser() error = %v", err)
+		}
+	}
+	tokens, err := server.tokens.Issue("", "1", auth.RoleUser)
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+	asZhang := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+tokens.Access)
+	asZhang, cancel = context.WithTimeout(asZhang, 5*time.Second)
+	defer cancel()
+	join := func(ctx context.Context, userID int64) (*pb.ChatResponse, error) {
+		stream, err := client.Chat(ctx)
+		if err != nil {
+			t.Fatalf("Chat() error = %v", err)
+		}
+		if err := stream.Send(&pb.ChatRequest{Action: "join", UserId: userID}); err != nil {
+			t.Fatalf("Send(join) error = %v", err)
+		}
+		return stream.Recv()
+	}
+
+	// 用户只能以自己的身份加入，user_id 为0时使用令牌中的用户
+	if _, err := join(asZhang, 2); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("join as another user error = %v, want PermissionDenied", err)
+	}
+	if resp, err := join(asZhang, 0); err != nil || resp.Message.Content != "欢迎 张三 加入聊天室！" {
+		t.Errorf("join without user_id = %v, %v, want joined as 张三", resp, err)
+	}
+	// 服务可以代表任何存在的用户加入
+	if resp, err := join(ctx, 2); err != nil || resp.Message.Content != "欢迎 李四 加入聊天室！" {
+		t.Errorf("join by service = %v, %v, want joined as 李四", resp, err)
+	}
+	if _, err := join(ctx, 0); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("join by service without user_id error = %v, want InvalidArgument", err)
+	}
+}
+
+func TestUserServer_MultiTenant(t *testing.T) {
+	server := NewMultiTenantServer(store.MemoryTenants{}, WithTenants("acme", "globex"), WithAuditLog(audit.NewMemoryLog()))
+	client := newTestClient(t, server)
+	inTenant := func(tenant string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "x-tenant-id", tenant)
+	}
+	acme, globex := inTenant("acme"), inTenant("globex")
+
+	// 缺少或非法的租户ID
+	if _, err := client.GetUser(context.Background(), &pb.GetUserRequest{Id: 1}); status.Code(err) != codes.InvalidArgument ||
+		errorReason(err) != pb.ErrorReason_TENANT_REQUIRED {
+		t.Errorf("GetUser() without tenant = %v, want TENANT_REQUIRED", err)
+	}
+	if _, err := client.GetUser(inTenant("Acme/../x"), &pb.GetUserRequest{Id: 1}); status.Code(err) != codes.InvalidArgument ||
+		errorReason(err) != pb.ErrorReason_INVALID_TENANT {
+		t.Errorf("GetUser() invalid tenant = %v, want INVALID_TENANT", err)
+	}
+	if _, err := client.CreateUser(inTenant("initech"), &pb.CreateUserRequest{Name: "张三", Email: "zhangsan@example.com"}); status.Code(err) != codes.NotFound ||
+		errorReason(err) != pb.ErrorReason_TENANT_NOT_FOUND {
+		t.Errorf("CreateUser() in an unknown tenant = %v, want TENANT_NOT_FOUND", err)
+	}
+
+	// ID 和邮箱唯一性都在租户内
+	for _, ctx := range []context.Context{acme, globex} {
+		resp, err := client.CreateUser(ctx, &pb.CreateUserRequest{Name: "张三", Email: "zhangsan@example.com"})
+		if err != nil {
+			t.Fatalf("CreateUser() error = %v", err)
+		}
+		if resp.User.Id != 1 {
+			t.Errorf("CreateUser() id = %d, want 1 in every tenant", resp.User.Id)
+		}
+	}
+	if _, err := client.CreateUser(acme, &pb.CreateUserRequest{Name: "李四", Email: "lisi@example.com"}); err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	if _, err := client.GetUserByEmail(globex, &pb.GetUserByEmailRequest{Email: "lisi@example.com"}); status.Code(err) != codes.NotFound {
+		t.Errorf("GetUserByEmail() in other tenant code = %v, want NotFound", status.Code(err))
+	}
+	if _, err := client.DeleteUser(globex, &pb.DeleteUserRequest{Id: 1}); err != nil {
+		t.Fatalf("DeleteUser() error = %v", err)
+	}
+	if _, err := client.GetUser(acme, &pb.GetUserRequest{Id: 1}); err != nil {
+		t.Errorf("GetUser() after delete in other tenant error = %v", err)
+	}
+
+	// 审计记录按租户隔离
+	events, err := client.ListAuditEvents(globex, &pb.ListAuditEventsRequest{})
+	if err != nil {
+		t.Fatalf("ListAuditEvents() error = %v", err)
+	}
+	if len(events.Events) != 2 || events.Events[0].Tenant != "globex" || events.Events[1].Method != "DeleteUser" {
+		t.Errorf("ListAuditEvents(globex) = %v, want CreateUser and DeleteUser", events.Events)
+	}
+
+	// 聊天室按租户隔离
+	ctx, cancel := context.WithTimeout(acme, 5*time.Second)
+	defer cancel()
+	chat, err := client.Chat(ctx)
+	if err != nil {
+		t.Fatalf("Chat() error = %v", err)
+	}
+	if err := chat.Send(&pb.ChatRequest{Action: "join", UserId: 1, Username: "张三"}); err != nil {
+		t.Fatalf("Send(join) error = %v", err)
+	}
+	if _, err := chat.Recv(); err != nil {
+		t.Fatalf("Recv() error = %v", err)
+	}
+
+	resp, err := client.ListTenants(context.Background(), &pb.ListTenantsRequest{})
+	if err != nil {
+		t.Fatalf("ListTenants() error = %v", err)
+	}
+	var got []string
+	for _, u := range resp.Tenants {
+		got = append(got, fmt.Sprintf("%s users=%d deleted=%d online=%d", u.Tenant, u.UserCount, u.DeletedUserCount, u.OnlineChatUsers))
+	}
+	want := []string{"acme users=2 deleted=0 online=1", "globex users=0 deleted=1 online=0"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ListTenants() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestUserServer_Authenticate(t *testing.T) {
+	server := NewUserServer(store.NewMemoryStore(), WithLockout(auth.NewLockout(3, time.Minute)))
+	client := newTestClient(t, server)
+	ctx := context.Background()
+
+	created, err := client.CreateUser(ctx, &pb.CreateUserRequest{Name: "张三", Email: "zhangsan@example.com"})
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	id := created.User.Id
+
+	// 没有设置密码时无法登录
+	if _, err := client.Authenticate(ctx, &pb.AuthenticateRequest{Email: "zhangsan@example.com", Password: "secret-password"}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Authenticate() without password code = %v, want Unauthenticated", status.Code(err))
+	}
+
+	if _, err := client.SetPassword(ctx, &pb.SetPasswordRequest{Id: id, Password: "short"}); !slices.Equal(fieldViolations(err), []string{"password"}) {
+		t.Errorf("SetPassword(short) violations = %v, want [password]", fieldViolations(err))
+	}
+	if _, err := client.SetPassword(ctx, &pb.SetPasswordRequest{Id: id, Password: "secret-password"}); err != nil {
+		t.Fatalf("SetPassword() error = %v", err)
+	}
+	// 修改密码必须提供当前密码
+	if _, err := client.SetPassword(ctx, &pb.SetPasswordRequest{Id: id, Password: "new-password"}); !slices.Equal(fieldViolations(err), []string{"current_password"}) {
+		t.Errorf("SetPassword() without current password violations = %v, want [current_password]", fieldViolations(err))
+	}
+
+	login, err := client.Authenticate(ctx, &pb.AuthenticateRequest{Email: "ZhangSan@example.com", Password: "secret-password"})
+	if err != nil {
+		t.Fatalf("Authenticate() error = %v", err)
+	}
+	if login.User.Id != id || login.Tokens.AccessToken == "" || login.Tokens.TokenType != "Bearer" ||
+		login.Tokens.RefreshTokenExpiresAt <= login.Tokens.AccessTokenExpiresAt {
+		t.Errorf("Authenticate() = %v", login)
+	}
+	claims, err := server.tokens.Verify(login.Tokens.AccessToken, auth.AccessToken)
+	if err != nil || claims.Subject != strconv.FormatInt(id, 10) {
+		t.Errorf("access token claims = %+v, %v, want subject %d", claims, err, id)
+	}
+
+	refreshed, err := client.RefreshToken(ctx, &pb.RefreshTokenRequest{RefreshToken: login.Tokens.RefreshToken})
+	if err != nil {
+		t.Fatalf("RefreshToken() error = %v", err)
+	}
+	if refreshed.Tokens.AccessToken == login.Tokens.AccessToken {
+		t.Error("RefreshToken() returned the same access token")
+	}
+	for name, token := range map[string]string{"access token": login.Tokens.AccessToken, "garbage": "not-a-token"} {
+		if _, err := client.RefreshToken(ctx, &pb.RefreshTokenRequest{RefreshToken: token}); errorReason(err) != pb.ErrorReason_INVALID_TOKEN {
+			t.Errorf("RefreshToken(%s) error = %v, want INVALID_TOKEN", name, err)
+		}
+	}
+
+	// 连续失败3次后锁定，锁定期间正确的密码也无法登录
+	wrong := &pb.AuthenticateRequest{Email: "zhangsan@example.com", Password: "wrong-password"}
+	for i := 1; i < 3; i++ {
+		if _, err := client.Authenticate(ctx, wrong); errorReason(err) != pb.ErrorReason_INVALID_CREDENTIALS {
+			t.Fatalf("Authenticate(wrong) #%d error = %v, want INVALID_CREDENTIALS", i, err)
+		}
+	}
+	if _, err := client.Authenticate(ctx, wrong); status.Code(err) != codes.ResourceExhausted || errorReason(err) != pb.ErrorReason_ACCOUNT_LOCKED {
+		t.Errorf("Authenticate(wrong) #3 error = %v, want ACCOUNT_LOCKED", err)
+	}
+	if _, err := client.Authenticate(ctx, &pb.AuthenticateRequest{Email: "zhangsan@example.com", Password: "secret-password"}); errorReason(err) != pb.ErrorReason_ACCOUNT_LOCKED {
+		t.Errorf("Authenticate() while locked error = %v, want ACCOUNT_LOCKED", err)
+	}
+
+	// 删除的用户无法刷新令牌；审计记录不包含密码
+	if _, err := client.DeleteUser(ctx, &pb.DeleteUserRequest{Id: id}); err != nil {
+		t.Fatalf("DeleteUser() error = %v", err)
+	}
+	if _, err := client.RefreshToken(ctx, &pb.RefreshTokenRequest{RefreshToken: refreshed.Tokens.RefreshToken}); errorReason(err) != pb.ErrorReason_INVALID_TOKEN {
+		t.Errorf("RefreshToken() for deleted user error = %v, want INVALID_TOKEN", err)
+	}
+	events, err := client.ListAuditEvents(ctx, &pb.ListAuditEventsRequest{Method: "SetPassword"})
+	if err != nil {
+		t.Fatalf("ListAuditEvents() error = %v", err)
+	}
+	if len(events.Events) != 1 || events.Events[0].Changes[0].Field != "password" || events.Events[0].Changes[0].After != "" {
+		t.Errorf("ListAuditEvents(SetPassword) = %v, want one password change without values", events.Events)
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	server := NewUserServer(store.NewMemoryStore())
+	apiKey := strings.Repeat("k", 32)
+	apiKeys, err := auth.NewAPIKeys([]auth.APIKey{{Name: "billing", Key: apiKey, Role: auth.RoleAdmin}})
+	if err != nil {
+		t.Fatalf("NewAPIKeys() error = %v", err)
+	}
+	authenticator := NewAuthenticator(server.tokens, apiKeys, DefaultPublicMethods)
+	client := newTestClient(t, server,
+		grpc.UnaryInterceptor(authenticator.UnaryInterceptor()),
+		grpc.StreamInterceptor(authenticator.StreamInterceptor()))
+	bearer := func(credential string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+credential)
+	}
+
+	// 没有凭据或凭据不对
+	if _, err := client.ListUsers(context.Background(), &pb.ListUsersRequest{}); status.Code(err) != codes.Unauthenticated ||
+		errorReason(err) != pb.ErrorReason_CREDENTIALS_REQUIRED {
+		t.Errorf("ListUsers() without credentials = %v, want CREDENTIALS_REQUIRED", err)
+	}
+	for name, ctx := range map[string]context.Context{
+		"unknown token": bearer("not-a-token"),
+		"basic scheme":  metadata.AppendToOutgoingContext(context.Background(), "authorization", "Basic "+apiKey),
+	} {
+		if _, err := client.ListUsers(ctx, &pb.ListUsersRequest{}); errorReason(err) != pb.ErrorReason_INVALID_TOKEN {
+			t.Errorf("ListUsers(%s) = %v, want INVALID_TOKEN", name, err)
+		}
+	}
+
+	// 服务用 API key 创建用户并设置密码
+	asService := bearer(apiKey)
+	created, err := client.CreateUser(asService, &pb.CreateUserRequest{Name: "张三", Email: "zhangsan@example.com"})
+	if err != nil {
+		t.Fatalf("CreateUser() with API key error = %v", err)
+	}
+	id := created.User.Id
+	if _, err := client.SetPassword(asService, &pb.SetPasswordRequest{Id: id, Password: "secret-password"}); err != nil {
+		t.Fatalf("SetPassword() error = %v", err)
+	}
+
+	// Authenticate 不需要凭据，签发的访问令牌可以调用其他方法
+	login, err := client.Authenticate(context.Background(), &pb.AuthenticateRequest{Email: "zhangsan@example.com", Password: "secret-password"})
+	if err != nil {
+		t.Fatalf("Authenticate() without credentials error = %v", err)
+	}
+	asUser := bearer(login.Tokens.AccessToken)
+	if _, err := client.UpdateUser(asUser, &pb.UpdateUserRequest{Id: id, Age: 30}); err != nil {
+		t.Fatalf("UpdateUser() with access token error = %v", err)
+	}
+	if _, err := client.GetUser(bearer(login.Tokens.RefreshToken), &pb.GetUserRequest{Id: id}); errorReason(err) != pb.ErrorReason_INVALID_TOKEN {
+		t.Errorf("GetUser() with refresh token = %v, want INVALID_TOKEN", err)
+	}
+
+	// 审计记录中的调用方是认证的身份，而不是 x-caller
+	spoofed := metadata.AppendToOutgoingContext(asUser, "x-caller", "admin")
+	if _, err := client.UpdateUser(spoofed, &pb.UpdateUserRequest{Id: id, Age: 31}); err != nil {
+		t.Fatalf("UpdateUser() error = %v", err)
+	}
+	events, err := client.ListAuditEvents(asService, &pb.ListAuditEventsRequest{UserId: id})
+	if err != nil {
+		t.Fatalf("ListAuditEvents() error = %v", err)
+	}
+	var callers []string
+	for _, e := range events.Events {
+		callers = append(callers, e.Method+" by "+e.Caller)
+	}
+	want := []string{"CreateUser by services/billing", "SetPassword by services/billing", "UpdateUser by users/1", "UpdateUser by users/1"}
+	if strings.Join(callers, ", ") != strings.Join(want, ", ") {
+		t.Errorf("audit callers = %v, want %v", callers, want)
+	}
+
+	// 流式接口在建立流时认证
+	stream, err := client.WatchUsers(context.Background(), &pb.WatchUsersRequest{})
+	if err != nil {
+		t.Fatalf("WatchUsers() error = %v", err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("WatchUsers() without credentials Recv() code = %v, want Unauthenticated", status.Code(err))
+	}
+	ctx, cancel := context.WithTimeout(asUser, 5*time.Second)
+	defer cancel()
+	stream, err = client.WatchUsers(ctx, &pb.WatchUsersRequest{})
+	if err != nil {
+		t.Fatalf("WatchUsers() error = %v", err)
+	}
+	if _, err := stream.Header(); err != nil {
+		t.Fatalf("Header() error = %v", err)
+	}
+	if _, err := client.UpdateUser(asUser, &pb.UpdateUserRequest{Id: id, Age: 32}); err != nil {
+		t.Fatalf("UpdateUser() error = %v", err)
+	}
+	if event, err := stream.Recv(); err != nil || event.User.Id != id {
+		t.Errorf("WatchUsers() with access token Recv() = %v, %v", event, err)
+	}
+}
+
+func TestUserServer_MultiTenantExistingData(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "acme"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	tenants := store.DirTenants{Dir: dir, OpenDir: func(string) (store.UserStore, error) {
+		return store.NewMemoryStore(), nil
+	}}
+	client := newTestClient(t, NewMultiTenantServer(tenants))
+	inTenant := func(tenant string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "x-tenant-id", tenant)
+	}
+
+	// 已有数据目录的租户可以使用，其他租户返回 NOT_FOUND，也不会创建数据目录
+	if _, err := client.ListUsers(inTenant("acme"), &pb.ListUsersRequest{}); err != nil {
+		t.Errorf("ListUsers() in an existing tenant error = %v", err)
+	}
+	if _, err := client.ListUsers(inTenant("acne"), &pb.ListUsersRequest{}); errorReason(err) != pb.ErrorReason_TENANT_NOT_FOUND {
+		t.Errorf("ListUsers() in a misspelled tenant = %v, want TENANT_NOT_FOUND", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "acne")); !os.IsNotExist(err) {
+		t.Errorf("Stat() of the misspelled tenant's directory error = %v, want not exist", err)
+	}
+}
+
+func TestAuthenticator_TenantMismatch(t *testing.T) {
+	server := NewMultiTenantServer(store.MemoryTenants{}, WithTenants("acme", "globex"))
+	authenticator := NewAuthenticator(server.tokens, nil, DefaultPublicMethods)
+	client := newTestClient(t, server, grpc.UnaryInterceptor(authenticator.UnaryInterceptor()))
+
+	tokens, err := server.tokens.Issue("acme", "1", auth.RoleUser)
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+	inTenant := func(tenant string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(),
+			"authorization", "Bearer "+tokens.Access, "x-tenant-id", tenant)
+	}
+	if _, err := client.ListUsers(inTenant("acme"), &pb.ListUsersRequest{}); err != nil {
+		t.Errorf("ListUsers() in the token's tenant error = %v", err)
+	}
+	if _, err := client.ListUsers(inTenant("globex"), &pb.ListUsersRequest{}); status.Code(err) != codes.PermissionDenied ||
+		errorReason(err) != pb.ErrorReason_TENANT_MISMATCH {
+		t.Errorf("ListUsers() in another tenant = %v, want TENANT_MISMATCH", err)
+	}
+}
+
+func TestAuthorize_ListTenants(t *testing.T) {
+	server := NewMultiTenantServer(store.MemoryTenants{}, WithTenants("acme", "globex"))
+	conn, asService := newAuthzTestConn(t, server)
+	client := pb.NewUserServiceClient(conn)
+
+	if _, err := client.CreateUser(metadata.AppendToOutgoingContext(asService, "x-tenant-id", "globex"),
+		&pb.CreateUserRequest{Name: "张三", Email: "zhangsan@example.com"}); err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	if _, err := client.ListTenants(asService, &pb.ListTenantsRequest{}); err != nil {
+		t.Errorf("ListTenants() as an admin service error = %v", err)
+	}
+
+	// 租户 acme 中的管理员不能列出其他租户
+	tokens, err := server.tokens.Issue("acme", "1", auth.RoleAdmin)
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+	asTenantAdmin := metadata.AppendToOutgoingContext(context.Background(),
+		"authorization", "Bearer "+tokens.Access, "x-tenant-id", "acme")
+	if _, err := client.ListTenants(asTenantAdmin, &pb.ListTenantsRequest{}); status.Code(err) != codes.PermissionDenied ||
+		errorReason(err) != pb.ErrorReason_PERMISSION_DENIED {
+		t.Errorf("ListTenants() as a tenant admin = %v, want PERMISSION_DENIED", err)
+	}
+}
+
+// newAuthzTestConn 启用认证和授权的测试连接，返回连接和带有管理员 API key 的 context
+func newAuthzTestConn(t *testing.T, server *UserServer) (*grpc.ClientConn, context.Context) {
+	t.Helper()
+	apiKey := strings.Repeat("a", 32)
+	apiKeys, err := auth.NewAPIKeys([]auth.APIKey{{Name: "ops", Key: apiKey, Role: auth.RoleAdmin}})
+	if err != nil {
+		t.Fatalf("NewAPIKeys() error = %v", err)
+	}
+	authenticator := NewAuthenticator(server.tokens, apiKeys, DefaultPublicMethods)
+	conn := newTestConn(t, server,
+		grpc.ChainUnaryInterceptor(authenticator.UnaryInterceptor(), AuthorizeUnary),
+		grpc.ChainStreamInterceptor(authenticator.StreamInterceptor(), AuthorizeStream))
+	return conn, metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+apiKey)
+}
+
+func TestAuthorize(t *testing.T) {
+	// ULID 使每个用户都有 uid
+	server := NewUserServer(store.NewMemoryStore(), WithIDGenerator(idgen.NewULID()))
+	conn, asAdmin := newAuthzTestConn(t, server)
+	client := pb.NewUserServiceClient(conn)
+
+	alice, err := client.CreateUser(asAdmin, &pb.CreateUserRequest{Name: "Alice", Email: "alice@example.com"})
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	bob, err := client.CreateUser(asAdmin, &pb.CreateUserRequest{Name: "Bob", Email: "bob@example.com"})
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	tokens, err := server.tokens.Issue("", strconv.FormatInt(alice.User.Id, 10), auth.RoleUser)
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+	asAlice := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+tokens.Access)
+
+	// call 以 ctx 的身份对用户 id 调用方法；只检查是否被拒绝，管理员的调用使用不存在的用户避免修改数据
+	tests := []struct {
+		method string
+		call   func(ctx context.Context, id int64) error
+		own    bool // 普通用户能否访问自己的记录
+		other  bool // 普通用户能否访问其他用户的记录
+	}{
+		{method: "CreateUser", call: func(ctx context.Context, id int64) error {
+			_, err := client.CreateUser(ctx, &pb.CreateUserRequest{Name: "Eve", Email: fmt.Sprintf("eve%d@example.com", id)})
+			return err
+		}},
+		{method: "GetUser", own: true, call: func(ctx context.Context, id int64) error {
+			_, err := client.GetUser(ctx, &pb.GetUserRequest{Id: id})
+			return err
+		}},
+		// uid 非空时 GetUser 忽略 id，普通用户不能用自己的 id 加上其他用户的 uid 读取其他用户
+		{method: "GetUser", call: func(ctx context.Context, id int64) error {
+			_, err := client.GetUser(ctx, &pb.GetUserRequest{Id: id, Uid: bob.User.Uid})
+			return err
+		}},
+		{method: "GetUserByEmail", call: func(ctx context.Context, id int64) error {
+			_, err := client.GetUserByEmail(ctx, &pb.GetUserByEmailRequest{Email: "alice@example.com"})
+			return err
+		}},
+		{method: "GetUserByPhone", call: func(ctx context.Context, id int64) error {
+			_, err := client.GetUserByPhone(ctx, &pb.GetUserByPhoneRequest{Phone: "13800138000"})
+			return err
+		}},
+		{method: "UpdateUser", own: true, call: func(ctx context.Context, id int64) error {
+			_, err := client.UpdateUser(ctx, &pb.UpdateUserRequest{Id: id, Age: 30})
+			return err
+		}},
+		{method: "DeleteUser", call: func(ctx context.Context, id int64) error {
+			_, err := client.DeleteUser(ctx, &pb.DeleteUserRequest{Id: id})
+			return err
+		}},
+		{method: "UndeleteUser", call: func(ctx context.Context, id int64) error {
+			_, err := client.UndeleteUser(ctx, &pb.UndeleteUserRequest{Id: id})
+			return err
+		}},
+		{method: "ListUsers", call: func(ctx context.Context, id int64) error {
+			_, err := client.ListUsers(ctx, &pb.ListUsersRequest{})
+			return err
+		}},
+		{method: "SearchUsers", call: func(ctx context.Context, id int64) error {
+			_, err := client.SearchUsers(ctx, &pb.SearchUsersRequest{Query: "alice"})
+			return err
+		}},
+		{method: "BatchCreateUsers", call: func(ctx context.Context, id int64) error {
+			_, err := client.BatchCreateUsers(ctx, &pb.BatchCreateUsersRequest{})
+			return err
+		}},
+		{method: "BatchGetUsers", call: func(ctx context.Context, id int64) error {
+			_, err := client.BatchGetUsers(ctx, &pb.BatchGetUsersRequest{Ids: []int64{id}})
+			return err
+		}},
+		{method: "BatchDeleteUsers", call: func(ctx context.Context, id int64) error {
+			_, err := client.BatchDeleteUsers(ctx, &pb.BatchDeleteUsersRequest{Requests: []*pb.DeleteUserRequest{{Id: id}}})
+			return err
+		}},
+		{method: "ImportUsers", call: func(ctx context.Context, id int64) error {
+			stream, err := client.ImportUsers(ctx)
+			if err != nil {
+				return err
+			}
+			_, err = stream.CloseAndRecv()
+			return err
+		}},
+		{method: "ExportUsers", call: func(ctx context.Context, id int64) error {
+			stream, err := client.ExportUsers(ctx, &pb.ExportUsersRequest{})
+			if err != nil {
+				return err
+			}
+			for {
+				if _, err := stream.Recv(); err != nil {
+					if err == io.EOF {
+						return nil
+					}
+					return err
+				}
+			}
+		}},
+		{method: "WatchUsers", call: func(ctx context.Context, id int64) error {
+			// 过早的 after_revision 使允许的调用立即返回 OUT_OF_RANGE，而不是等待事件
+			stream, err := client.WatchUsers(ctx, &pb.WatchUsersRequest{UserId: id, AfterRevision: 1})
+			if err != nil {
+				return err
+			}
+			_, err = stream.Recv()
+			return err
+		}},
+		{method: "ListAuditEvents", call: func(ctx context.Context, id int64) error {
+			_, err := client.ListAuditEvents(ctx, &pb.ListAuditEventsRequest{UserId: id})
+			return err
+		}},
+		{method: "ListTenants", call: func(ctx context.Context, id int64) error {
+			_, err := client.ListTenants(ctx, &pb.ListTenantsRequest{})
+			return err
+		}},
+		{method: "SetPassword", own: true, call: func(ctx context.Context, id int64) error {
+			_, err := client.SetPassword(ctx, &pb.SetPasswordRequest{Id: id, Password: "secret-password"})
+			return err
+		}},
+		{method: "SetRole", call: func(ctx context.Context, id int64) error {
+			_, err := client.SetRole(ctx, &pb.SetRoleRequest{Id: id, Role: pb.Role_ROLE_ADMIN})
+			return err
+		}},
+		{method: "Authenticate", own: true, other: true, call: func(ctx context.Context, id int64) error {
+			_, err := client.Authenticate(ctx, &pb.AuthenticateRequest{Email: "nobody@example.com", Password: "secret-password"})
+			return err
+		}},
+		{method: "RefreshToken", own: true, other: true, call: func(ctx context.Context, id int64) error {
+			_, err := client.RefreshToken(ctx, &pb.RefreshTokenRequest{RefreshToken: tokens.Refresh})
+			return err
+		}},
+		// 策略允许所有调用方，但用户只能以自己的身份加入聊天室
+		{method: "Chat", own: true, call: func(ctx context.Context, id int64) error {
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			stream, err := client.Chat(ctx)
+			if err != nil {
+				return err
+			}
+			if err := stream.Send(&pb.ChatRequest{Action: "join", UserId: id, Username: "Alice"}); err != nil {
+				return err
+			}
+			_, err = stream.Recv()
+			return err
+		}},
+	}
+
+	// 表中必须包含 UserServiceServer 的每个方法
+	var methods []string
+	for _, m := range pb.UserService_ServiceDesc.Methods {
+		methods = append(methods, m.MethodName)
+	}
+	for _, s := range pb.UserService_ServiceDesc.Streams {
+		methods = append(methods, s.StreamName)
+	}
+	var tested []string
+	for _, tt := range tests {
+		tested = append(tested, tt.method)
+	}
+	slices.Sort(methods)
+	slices.Sort(tested)
+	if tested = slices.Compact(tested); !slices.Equal(methods, tested) {
+		t.Fatalf("tested methods = %v, want every method of UserService %v", tested, methods)
+	}
+
+	denied := func(err error) bool {
+		return status.Code(err) == codes.PermissionDenied && errorReason(err) == pb.ErrorReason_PERMISSION_DENIED
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			if err := tt.call(asAdmin, 999); denied(err) {
+				t.Errorf("admin call error = %v, want allowed", err)
+			}
+			if err := tt.call(asAlice, alice.User.Id); denied(err) == tt.own {
+				t.Errorf("own record error = %v, want allowed = %v", err, tt.own)
+			}
+			if err := tt.call(asAlice, bob.User.Id); denied(err) == tt.other {
+				t.Errorf("other user error = %v, want allowed = %v", err, tt.other)
+			}
+		})
+	}
+}
+
+func TestAuthorize_V2(t *testing.T) {
+	server := NewUserServer(store.NewMemoryStore())
+	conn, asAdmin := newAuthzTestConn(t, server)
+	client := pbv2.NewUserServiceClient(conn)
+
+	alice, err := client.CreateUser(asAdmin, &pbv2.CreateUserRequest{User: &pbv2.User{DisplayName: "Alice", Email: "alice@example.com"}})
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	tokens, err := server.tokens.Issue("", strconv.FormatInt(alice.Id, 10), auth.RoleUser)
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+	asAlice := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+tokens.Access)
+
+	if _, err := client.GetUser(asAlice, &pbv2.GetUserRequest{Name: alice.Name}); err != nil {
+		t.Errorf("GetUser(own) error = %v", err)
+	}
+	if _, err := client.UpdateUser(asAlice, &pbv2.UpdateUserRequest{User: &pbv2.User{Name: alice.Name, Age: 30}}); err != nil {
+		t.Errorf("UpdateUser(own) error = %v", err)
+	}
+	for name, call := range map[string]func() error{
+		"GetUser(other)": func() error { _, err := client.GetUser(asAlice, &pbv2.GetUserRequest{Name: "users/2"}); return err },
+		"GetUser(by uid)": func() error {
+			_, err := client.GetUser(asAlice, &pbv2.GetUserRequest{Name: "users/" + alice.Uid})
+			return err
+		},
+		"ListUsers": func() error { _, err := client.ListUsers(asAlice, &pbv2.ListUsersRequest{}); return err },
+		"DeleteUser(own)": func() error {
+			_, err := client.DeleteUser(asAlice, &pbv2.DeleteUserRequest{Name: alice.Name})
+			return err
+		},
+		"UpdateUser(other)": func() error {
+			_, err := client.UpdateUser(asAlice, &pbv2.UpdateUserRequest{User: &pbv2.User{Name: "users/2"}})
+			return err
+		},
+	} {
+		if err := call(); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("%s error = %v, want PermissionDenied", name, err)
+		}
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	// 每个方法都要有明确的策略，新增方法时必须决定普通用户能否调用
+	for _, desc := range []grpc.ServiceDesc{pb.UserService_ServiceDesc, pbv2.UserService_ServiceDesc} {
+		var methods []string
+		for _, m := range desc.Methods {
+			methods = append(methods, m.MethodName)
+		}
+		for _, s := range desc.Streams {
+			methods = append(methods, s.StreamName)
+		}
+		for _, m := range methods {
+			if _, ok := policies["/"+desc.ServiceName+"/"+m]; !ok {
+				t.Errorf("no policy for /%s/%s", desc.ServiceName, m)
+			}
+		}
+	}
+}
+
+func TestUserServer_SetRole(t *testing.T) {
+	server := NewUserServer(store.NewMemoryStore())
+	conn, asAdmin := newAuthzTestConn(t, server)
+	client := pb.NewUserServiceClient(conn)
+
+	created, err := client.CreateUser(asAdmin, &pb.CreateUserRequest{Name: "Bob", Email: "bob@example.com"})
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	id := created.User.Id
+	if _, err := client.SetPassword(asAdmin, &pb.SetPasswordRequest{Id: id, Password: "secret-password"}); err != nil {
+		t.Fatalf("SetPassword() error = %v", err)
+	}
+	login, err := client.Authenticate(context.Background(), &pb.AuthenticateRequest{Email: "bob@example.com", Password: "secret-password"})
+	if err != nil {
+		t.Fatalf("Authenticate() error = %v", err)
+	}
+	asBob := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+login.Tokens.AccessToken)
+	if _, err := client.ListUsers(asBob, &pb.ListUsersRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("ListUsers() as user error = %v, want PermissionDenied", err)
+	}
+
+	// 管理员重置密码不需要当前密码
+	if _, err := client.SetPassword(asAdmin, &pb.SetPasswordRequest{Id: id, Password: "new-secret-password"}); err != nil {
+		t.Errorf("SetPassword() by admin without current password error = %v", err)
+	}
+
+	for _, req := range []*pb.SetRoleRequest{
+		{Id: 0, Role: pb.Role_ROLE_ADMIN},
+		{Id: id, Role: pb.Role(7)},
+	} {
+		if _, err := client.SetRole(asAdmin, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("SetRole(%v) error = %v, want InvalidArgument", req, err)
+		}
+	}
+	if _, err := client.SetRole(asAdmin, &pb.SetRoleRequest{Id: id, Role: pb.Role_ROLE_ADMIN, ExpectedVersion: 99}); status.Code(err) != codes.Aborted {
+		t.Errorf("SetRole() with stale version error = %v, want Aborted", err)
+	}
+	resp, err := client.SetRole(asAdmin, &pb.SetRoleRequest{Id: id, Role: pb.Role_ROLE_ADMIN})
+	if err != nil {
+		t.Fatalf("SetRole() error = %v", err)
+	}
+	if resp.User.Role != pb.Role_ROLE_ADMIN || resp.User.Version != created.User.Version+1 {
+		t.Errorf("SetRole() user = %v, want admin with a new version", resp.User)
+	}
+
+	// 新角色在刷新令牌后生效
+	refreshed, err := client.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: login.Tokens.RefreshToken})
+	if err != nil {
+		t.Fatalf("RefreshToken() error = %v", err)
+	}
+	asBob = metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+refreshed.Tokens.AccessToken)
+	if _, err := client.ListUsers(asBob, &pb.ListUsersRequest{}); err != nil {
+		t.Errorf("ListUsers() as promoted admin error = %v", err)
+	}
+
+	events, err := client.ListAuditEvents(asAdmin, &pb.ListAuditEventsRequest{Method: "SetRole"})
+	if err != nil {
+		t.Fatalf("ListAuditEvents() error = %v", err)
+	}
+	if len(events.Events) != 1 || events.Events[0].Changes[0].Field != "role" || events.Events[0].Changes[0].After != "ROLE_ADMIN" {
+		t.Errorf("ListAuditEvents(SetRole) = %v, want one role change", events.Events)
+	}
+}
+
+func TestAuthenticator_ClientCerts(t *testing.T) {
+	ca := tlstest.NewCA(t, "test CA")
+	serverCert, serverKey := ca.Issue(t, "server", pkix.Name{CommonName: "user-service"}, "localhost")
+	billingCert, billingKey := ca.Issue(t, "billing", pkix.Name{CommonName: "billing", Organization: []string{"Acme"}})
+	malloryCert, malloryKey := ca.Issue(t, "mallory", pkix.Name{CommonName: "mallory"})
+
+	serverTLS, err := tlsconfig.Server(tlsconfig.ServerOptions{CertFile: serverCert, KeyFile: serverKey, ClientCAFile: ca.CertFile})
+	if err != nil {
+		t.Fatalf("tlsconfig.Server() error = %v", err)
+	}
+	certs, err := auth.NewClientCerts([]auth.ClientCert{{Subject: "CN=billing,O=Acme", Name: "billing", Role: auth.RoleAdmin}})
+	if err != nil {
+		t.Fatalf("NewClientCerts() error = %v", err)
+	}
+	userServer := NewUserServer(store.NewMemoryStore())
+	authenticator := NewAuthenticator(userServer.tokens, nil, DefaultPublicMethods, WithClientCerts(certs))
+
+	lis := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer(grpc.Creds(credentials.NewTLS(serverTLS)),
+		grpc.ChainUnaryInterceptor(authenticator.UnaryInterceptor(), AuthorizeUnary),
+		grpc.ChainStreamInterceptor(authenticator.StreamInterceptor(), AuthorizeStream))
+	RegisterServices(s, userServer)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	dial := func(certFile, keyFile string) pb.UserServiceClient {
+		config, err := tlsconfig.Client(tlsconfig.ClientOptions{CAFile: ca.CertFile, CertFile: certFile, KeyFile: keyFile, ServerName: "localhost"})
+		if err != nil {
+			t.Fatalf("tlsconfig.Client() error = %v", err)
+		}
+		conn, err := grpc.NewClient("passthrough:///bufnet",
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return lis.DialContext(ctx)
+			}),
+			grpc.WithTransportCredentials(credentials.NewTLS(config)),
+		)
+		if err != nil {
+			t.Fatalf("Failed to dial test server: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return pb.NewUserServiceClient(conn)
+	}
+	ctx := context.Background()
+
+	// 映射到管理员的客户端证书不需要令牌
+	billing := dial(billingCert, billingKey)
+	created, err := billing.CreateUser(ctx, &pb.CreateUserRequest{Name: "张三", Email: "zhangsan@example.com"})
+	if err != nil {
+		t.Fatalf("CreateUser() with client certificate error = %v", err)
+	}
+	events, err := billing.ListAuditEvents(ctx, &pb.ListAuditEventsRequest{UserId: created.User.Id})
+	if err != nil {
+		t.Fatalf("ListAuditEvents() error = %v", err)
+	}
+	if len(events.Events) != 1 || events.Events[0].Caller != "services/billing" {
+		t.Errorf("audit events = %v, want CreateUser by services/billing", events.Events)
+	}
+
+	// 没有证书或证书的主题没有映射时需要其他凭据
+	for name, client := range map[string]pb.UserServiceClient{
+		"no certificate":   dial("", ""),
+		"unmapped subject": dial(malloryCert, malloryKey),
+	} {
+		if _, err := client.ListUsers(ctx, &pb.ListUsersRequest{}); errorReason(err) != pb.ErrorReason_CREDENTIALS_REQUIRED {
+			t.Errorf("ListUsers(%s) error = %v, want CREDENTIALS_REQUIRED", name, err)
+		}
+	}
+
+	// authorization 元数据优先于客户端证书
+	tokens, err := userServer.tokens.Issue("", strconv.FormatInt(created.User.Id, 10), auth.RoleUser)
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+	asUser := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+tokens.Access)
+	if _, err := billing.ListUsers(asUser, &pb.ListUsersRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("ListUsers() with certificate and user token error = %v, want PermissionDenied", err)
+	}
+}
+
+// errorReason 返回错误详情 ErrorInfo 中的 reason
+func errorReason(err error) pb.ErrorReason {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return pb.ErrorReason(pb.ErrorReason_value[info.Reason])
+		}
+	}
+	return pb.ErrorReason_ERROR_REASON_UNSPECIFIED
 }
@@ -0,0 +1,448 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+	pbv2 "github.com/liverlong/rpc-learning/pkg/pb/user/v2"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// V2Server 提供 user.v2 接口
+//
+// 每个 v2 请求被转换为 v1 请求交给 UserServer 处理，响应再转换回 v2 消息，
+// 因此两个版本共享存储、校验、幂等去重、变更事件、审计日志和聊天室。
+type V2Server struct {
+	pbv2.UnimplementedUserServiceServer
+	v1 *UserServer
+}
+
+// NewV2Server 创建基于 v1 服务器的 v2 服务器
+func NewV2Server(v1 *UserServer) *V2Server {
+	return &V2Server{v1: v1}
+}
+
+// v1 校验错误中的字段名到 v2 字段路径的映射
+var (
+	v2UserFields = map[string]string{
+		"id":    "user.name",
+		"name":  "user.display_name",
+		"email": "user.email",
+		"age":   "user.age",
+		"phone": "user.phone",
+	}
+	v2NameFields  = map[string]string{"id": "name"}
+	v2WatchFields = map[string]string{"user_id": "user"}
+	v2AuditFields = map[string]string{"user_id": "user"}
+	v2ChatFields  = map[string]string{"user_id": "user"}
+)
+
+// v2UpdatePaths v2 的 update_mask 路径对应的 v1 路径
+var v2UpdatePaths = map[string]string{
+	"display_name": "name",
+	"email":        "email",
+	"age":          "age",
+	"phone":        "phone",
+	"*":            "*",
+}
+
+// CreateUser 创建用户
+func (s *V2Server) CreateUser(ctx context.Context, req *pbv2.CreateUserRequest) (*pbv2.User, error) {
+	u := req.GetUser()
+	resp, err := s.v1.CreateUser(ctx, &pb.CreateUserRequest{
+		Name:      u.GetDisplayName(),
+		Email:     u.GetEmail(),
+		Age:       u.GetAge(),
+		Phone:     u.GetPhone(),
+		RequestId: req.RequestId,
+	})
+	if err != nil {
+		return nil, v2Error(err, v2UserFields)
+	}
+	return userToV2(resp.User), nil
+}
+
+// GetUser 获取用户
+func (s *V2Server) GetUser(ctx context.Context, req *pbv2.GetUserRequest) (*pbv2.User, error) {
+	id, uid, err := parseUserName("name", req.Name)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.v1.GetUser(ctx, &pb.GetUserRequest{Id: id, Uid: uid})
+	if err != nil {
+		return nil, v2Error(err, v2NameFields)
+	}
+	return userToV2(resp.User), nil
+}
+
+// UpdateUser 更新用户
+func (s *V2Server) UpdateUser(ctx context.Context, req *pbv2.UpdateUserRequest) (*pbv2.User, error) {
+	u := req.GetUser()
+	id, err := s.userID(ctx, "user.name", u.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	v1req := &pb.UpdateUserRequest{
+		Id:              id,
+		Name:            u.GetDisplayName(),
+		Email:           u.GetEmail(),
+		Age:             u.GetAge(),
+		Phone:           u.GetPhone(),
+		ExpectedVersion: req.ExpectedVersion,
+		RequestId:       req.RequestId,
+	}
+	if req.UpdateMask != nil {
+		var v violations
+		paths := make([]string, 0, len(req.UpdateMask.Paths))
+		for _, path := range req.UpdateMask.Paths {
+			p, ok := v2UpdatePaths[path]
+			if !ok {
+				v.add("update_mask", "update_mask 包含不支持的字段 %q，可用字段: display_name, email, age, phone", path)
+				continue
+			}
+			paths = append(paths, p)
+		}
+		if err := v.err(userResource(id)); err != nil {
+			return nil, err
+		}
+		v1req.UpdateMask = &fieldmaskpb.FieldMask{Paths: paths}
+	}
+
+	resp, err := s.v1.UpdateUser(ctx, v1req)
+	if err != nil {
+		return nil, v2Error(err, v2UserFields)
+	}
+	return userToV2(resp.User), nil
+}
+
+// DeleteUser 删除用户（软删除）
+func (s *V2Server) DeleteUser(ctx context.Context, req *pbv2.DeleteUserRequest) (*pbv2.DeleteUserResponse, error) {
+	id, err := s.userID(ctx, "name", req.Name)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.v1.DeleteUser(ctx, &pb.DeleteUserRequest{Id: id, ExpectedVersion: req.ExpectedVersion, RequestId: req.RequestId})
+	if err != nil {
+		return nil, v2Error(err, v2NameFields)
+	}
+	return &pbv2.DeleteUserResponse{}, nil
+}
+
+// UndeleteUser 恢复已删除用户
+func (s *V2Server) UndeleteUser(ctx context.Context, req *pbv2.UndeleteUserRequest) (*pbv2.User, error) {
+	id, err := s.userID(ctx, "name", req.Name)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.v1.UndeleteUser(ctx, &pb.UndeleteUserRequest{Id: id, RequestId: req.RequestId})
+	if err != nil {
+		return nil, v2Error(err, v2NameFields)
+	}
+	return userToV2(resp.User), nil
+}
+
+// ListUsers 列出用户
+func (s *V2Server) ListUsers(ctx context.Context, req *pbv2.ListUsersRequest) (*pbv2.ListUsersResponse, error) {
+	resp, err := s.v1.ListUsers(ctx, &pb.ListUsersRequest{
+		PageSize:    req.PageSize,
+		PageToken:   req.PageToken,
+		Filter:      req.Filter,
+		OrderBy:     req.OrderBy,
+		ShowDeleted: req.ShowDeleted,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]*pbv2.User, len(resp.Users))
+	for i, u := range resp.Users {
+		users[i] = userToV2(u)
+	}
+	return &pbv2.ListUsersResponse{Users: users, NextPageToken: resp.NextPageToken, TotalSize: resp.Total}, nil
+}
+
+// SearchUsers 按姓名、邮箱或手机号片段搜索用户
+func (s *V2Server) SearchUsers(ctx context.Context, req *pbv2.SearchUsersRequest) (*pbv2.SearchUsersResponse, error) {
+	resp, err := s.v1.SearchUsers(ctx, &pb.SearchUsersRequest{Query: req.Query, PageSize: req.PageSize})
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*pbv2.SearchResult, len(resp.Results))
+	for i, r := range resp.Results {
+		results[i] = &pbv2.SearchResult{User: userToV2(r.User), Score: r.Score}
+	}
+	return &pbv2.SearchUsersResponse{Results: results}, nil
+}
+
+// WatchUsers 服务端流式推送用户变更事件
+func (s *V2Server) WatchUsers(req *pbv2.WatchUsersRequest, stream pbv2.UserService_WatchUsersServer) error {
+	var userID int64
+	if req.User != "" {
+		id, err := s.userID(stream.Context(), "user", req.User)
+		if err != nil {
+			return err
+		}
+		userID = id
+	}
+
+	err := s.v1.WatchUsers(&pb.WatchUsersRequest{AfterRevision: req.AfterRevision, UserId: userID}, &v2WatchStream{stream})
+	return v2Error(err, v2WatchFields)
+}
+
+// ListAuditEvents 查询用户修改的审计记录
+func (s *V2Server) ListAuditEvents(ctx context.Context, req *pbv2.ListAuditEventsRequest) (*pbv2.ListAuditEventsResponse, error) {
+	v1req := &pb.ListAuditEventsRequest{
+		Method:    req.Method,
+		StartTime: seconds(req.StartTime),
+		EndTime:   seconds(req.EndTime),
+		PageSize:  req.PageSize,
+		PageToken: req.PageToken,
+	}
+	if req.User != "" {
+		id, err := s.userID(ctx, "user", req.User)
+		if err != nil {
+			return nil, err
+		}
+		v1req.UserId = id
+	}
+
+	resp, err := s.v1.ListAuditEvents(ctx, v1req)
+	if err != nil {
+		return nil, v2Error(err, v2AuditFields)
+	}
+
+	events := make([]*pbv2.AuditEvent, len(resp.Events))
+	for i, e := range resp.Events {
+		changes := make([]*pbv2.FieldChange, len(e.Changes))
+		for j, c := range e.Changes {
+			changes[j] = &pbv2.FieldChange{Field: c.Field, Before: c.Before, After: c.After}
+		}
+		events[i] = &pbv2.AuditEvent{
+			Id:        e.Id,
+			EventTime: timestamp(e.Timestamp),
+			Method:    e.Method,
+			Caller:    e.Caller,
+			User:      userName(e.UserId),
+			Changes:   changes,
+			PrevHash:  e.PrevHash,
+			Hash:      e.Hash,
+		}
+	}
+	return &pbv2.ListAuditEventsResponse{Events: events, NextPageToken: resp.NextPageToken}, nil
+}
+
+// Chat 双向流聊天，v1 和 v2 的客户端在同一个聊天室
+func (s *V2Server) Chat(stream pbv2.UserService_ChatServer) error {
+	return v2Error(s.v1.Chat(&v2ChatStream{stream}), v2ChatFields)
+}
+
+// userID 把 users/{id} 或 users/{uid} 形式的资源名解析为用户ID，uid 通过存储查找
+func (s *V2Server) userID(ctx context.Context, field, name string) (int64, error) {
+	id, uid, err := parseUserName(field, name)
+	if err != nil || uid == "" {
+		return id, err
+	}
+	t, err := s.v1.tenant(ctx)
+	if err != nil {
+		return 0, err
+	}
+	user, err := t.store.GetByUID(ctx, uid)
+	if err != nil {
+		return 0, userKeyResource(uid).storeError(err)
+	}
+	return user.Id, nil
+}
+
+// parseUserName 解析资源名，最后一段是数字时返回ID，否则作为 uid 返回
+func parseUserName(field, name string) (id int64, uid string, err error) {
+	rest, ok := strings.CutPrefix(name, "users/")
+	if !ok || rest == "" || strings.Contains(rest, "/") {
+		return 0, "", invalidArgument(resource{typ: userResourceType, name: name}, field,
+			"%s 必须是 users/{id} 或 users/{uid} 形式的资源名", field)
+	}
+	if id, err := strconv.ParseInt(rest, 10, 64); err == nil {
+		if id <= 0 {
+			return 0, "", invalidArgument(resource{typ: userResourceType, name: name}, field, "用户ID必须大于0")
+		}
+		return id, "", nil
+	}
+	return 0, rest, nil
+}
+
+// userName 用户的资源名，id 为0时为空
+func userName(id int64) string {
+	if id == 0 {
+		return ""
+	}
+	return "users/" + strconv.FormatInt(id, 10)
+}
+
+// userToV2 把 v1 用户转换为 v2 用户
+func userToV2(u *pb.User) *pbv2.User {
+	if u == nil {
+		return nil
+	}
+	return &pbv2.User{
+		Name:        userName(u.Id),
+		Id:          u.Id,
+		Uid:         u.Uid,
+		DisplayName: u.Name,
+		Email:       u.Email,
+		Age:         u.Age,
+		Phone:       u.Phone,
+		CreateTime:  timestamp(u.CreatedAt),
+		UpdateTime:  timestamp(u.UpdatedAt),
+		DeleteTime:  timestamp(u.DeletedAt),
+		Version:     u.Version,
+	}
+}
+
+// timestamp 把Unix秒数转换为 Timestamp，0 转换为空
+func timestamp(sec int64) *timestamppb.Timestamp {
+	if sec == 0 {
+		return nil
+	}
+	return &timestamppb.Timestamp{Seconds: sec}
+}
+
+// seconds 把 Timestamp 转换为Unix秒数，空转换为0
+func seconds(ts *timestamppb.Timestamp) int64 {
+	if ts == nil {
+		return 0
+	}
+	return ts.Seconds
+}
+
+// v2Error 把 v1 错误详情 BadRequest 和 ErrorInfo 中的字段名换成 v2 的字段路径，其他错误原样返回
+func v2Error(err error, fields map[string]string) error {
+	st, ok := status.FromError(err)
+	if err == nil || !ok || st.Code() != codes.InvalidArgument {
+		return err
+	}
+	rename := func(field string) string {
+		if f, ok := fields[field]; ok {
+			return f
+		}
+		return field
+	}
+
+	p := st.Proto()
+	for _, detail := range p.Details {
+		var badRequest errdetails.BadRequest
+		var info errdetails.ErrorInfo
+		switch {
+		case detail.MessageIs(&badRequest):
+			if detail.UnmarshalTo(&badRequest) != nil {
+				continue
+			}
+			for _, fv := range badRequest.FieldViolations {
+				fv.Field = rename(fv.Field)
+			}
+			_ = detail.MarshalFrom(&badRequest)
+		case detail.MessageIs(&info):
+			if detail.UnmarshalTo(&info) != nil || info.Metadata["fields"] == "" {
+				continue
+			}
+			names := strings.Split(info.Metadata["fields"], ",")
+			for i, name := range names {
+				names[i] = rename(name)
+			}
+			info.Metadata["fields"] = strings.Join(names, ",")
+			_ = detail.MarshalFrom(&info)
+		}
+	}
+	return status.FromProto(p).Err()
+}
+
+// v2WatchStream 把 v1 的用户变更事件转换为 v2 事件后发送
+type v2WatchStream struct {
+	pbv2.UserService_WatchUsersServer
+}
+
+func (w *v2WatchStream) Send(e *pb.UserEvent) error {
+	return w.UserService_WatchUsersServer.Send(&pbv2.UserEvent{
+		Revision:  e.Revision,
+		Type:      pbv2.UserEvent_Type(e.Type), // 两个版本的枚举值相同
+		User:      userToV2(e.User),
+		EventTime: timestamp(e.Timestamp),
+	})
+}
+
+var _ pb.UserService_WatchUsersServer = (*v2WatchStream)(nil)
+
+// v2ChatStream 在 v1 聊天处理逻辑和 v2 客户端之间转换聊天消息
+type v2ChatStream struct {
+	pbv2.UserService_ChatServer
+}
+
+// v2 的聊天枚举与 v1 字符串的对应关系
+var (
+	chatActions = map[pbv2.ChatRequest_Action]string{
+		pbv2.ChatRequest_JOIN:    "join",
+		pbv2.ChatRequest_LEAVE:   "leave",
+		pbv2.ChatRequest_MESSAGE: "message",
+	}
+	chatMessageTypes = map[string]pbv2.ChatMessage_Type{
+		"text":   pbv2.ChatMessage_TEXT,
+		"join":   pbv2.ChatMessage_JOIN,
+		"leave":  pbv2.ChatMessage_LEAVE,
+		"system": pbv2.ChatMessage_SYSTEM,
+	}
+	chatStatuses = map[string]pbv2.ChatResponse_Status{
+		"joined":    pbv2.ChatResponse_JOINED,
+		"broadcast": pbv2.ChatResponse_BROADCAST,
+		"error":     pbv2.ChatResponse_ERROR,
+	}
+)
+
+func (c *v2ChatStream) Recv() (*pb.ChatRequest, error) {
+	req, err := c.UserService_ChatServer.Recv()
+	if err != nil {
+		return nil, err
+	}
+
+	v1req := &pb.ChatRequest{Username: req.DisplayName, Content: req.Content, Action: chatActions[req.Action]}
+	if req.User != "" {
+		id, uid, err := parseUserName("user", req.User)
+		if err != nil {
+			return nil, err
+		}
+		if uid != "" {
+			return nil, invalidArgument(resource{typ: userResourceType, name: req.User}, "user", "聊天中的 user 必须是 users/{id}")
+		}
+		v1req.UserId = id
+	}
+	return v1req, nil
+}
+
+func (c *v2ChatStream) Send(resp *pb.ChatResponse) error {
+	m := resp.GetMessage()
+	return c.UserService_ChatServer.Send(&pbv2.ChatResponse{
+		Message: &pbv2.ChatMessage{
+			User:        userName(m.GetUserId()),
+			DisplayName: m.GetUsername(),
+			Content:     m.GetContent(),
+			SendTime:    timestamp(m.GetTimestamp()),
+			Type:        chatMessageTypes[m.GetMessageType()],
+		},
+		Status:      chatStatuses[resp.Status],
+		OnlineUsers: resp.OnlineUsers,
+	})
+}
+
+var _ pb.UserService_ChatServer = (*v2ChatStream)(nil)
+
+// RegisterServices 在 s 上注册 v1 和 v2 两个版本的用户服务
+func RegisterServices(s grpc.ServiceRegistrar, v1 *UserServer) {
+	pb.RegisterUserServiceServer(s, v1)
+	pbv2.RegisterUserServiceServer(s, NewV2Server(v1))
+}
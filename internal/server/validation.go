@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/liverlong/rpc-learning/internal/store"
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+)
+
+// 用户字段的取值范围
+const (
+	maxNameLength  = 64  // 姓名最多的字符数
+	maxEmailLength = 254 // 邮箱最多的字节数（RFC 5321）
+	maxAge         = 150
+	minPhoneDigits = 7  // E.164 号码（含国家代码）最少的位数
+	maxPhoneDigits = 15 // E.164 号码（含国家代码）最多的位数
+)
+
+// violations 收集一个请求中所有不合法的字段，最后作为 google.rpc.BadRequest 返回
+type violations []*errdetails.BadRequest_FieldViolation
+
+func (v *violations) add(field, format string, args ...any) {
+	*v = append(*v, &errdetails.BadRequest_FieldViolation{
+		Field:       field,
+		Description: fmt.Sprintf(format, args...),
+	})
+}
+
+// err 没有违规时返回 nil，否则返回附带 BadRequest 详情的 INVALID_ARGUMENT 错误，
+// 错误信息是所有违规描述的拼接，res 是请求涉及的资源
+func (v violations) err(res resource) error {
+	if len(v) == 0 {
+		return nil
+	}
+	descriptions := make([]string, len(v))
+	fields := make([]string, len(v))
+	for i, fv := range v {
+		descriptions[i] = fv.Description
+		fields[i] = fv.Field
+	}
+	return newError(codes.InvalidArgument, pb.ErrorReason_INVALID_ARGUMENT, res,
+		map[string]string{"fields": strings.Join(fields, ",")},
+		strings.Join(descriptions, "；"), &errdetails.BadRequest{FieldViolations: v})
+}
+
+// validateCreate 校验 CreateUser 请求，批量创建和导入使用同样的规则
+func validateCreate(req *pb.CreateUserRequest) error {
+	var v violations
+	validateName(&v, req.Name)
+	validateEmail(&v, req.Email)
+	validateAge(&v, req.Age)
+	validatePhone(&v, req.Phone)
+	return v.err(usersResource)
+}
+
+// validateName 姓名必填，必须是合法的UTF-8，不超过 maxNameLength 个字符且不含控制字符
+func validateName(v *violations, name string) {
+	switch {
+	case strings.TrimSpace(name) == "":
+		v.add("name", "用户名不能为空")
+	case !utf8.ValidString(name):
+		v.add("name", "用户名不是合法的UTF-8字符串")
+	case utf8.RuneCountInString(name) > maxNameLength:
+		v.add("name", "用户名不能超过%d个字符", maxNameLength)
+	case strings.IndexFunc(name, unicode.IsControl) >= 0:
+		v.add("name", "用户名不能包含控制字符")
+	}
+}
+
+// validateEmail 邮箱必填，必须是不带显示名的 local@domain 形式，域名至少包含一个点
+func validateEmail(v *violations, email string) {
+	if email == "" {
+		v.add("email", "邮箱不能为空")
+		return
+	}
+	if len(email) > maxEmailLength {
+		v.add("email", "邮箱不能超过%d个字节", maxEmailLength)
+		return
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email {
+		v.add("email", "邮箱格式不正确")
+		return
+	}
+	domain := email[strings.LastIndexByte(email, '@')+1:]
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		v.add("email", "邮箱域名不正确")
+	}
+}
+
+// validateAge 年龄在 0 到 maxAge 之间，0 表示未填写
+func validateAge(v *violations, age int32) {
+	if age < 0 || age > maxAge {
+		v.add("age", "年龄必须在0到%d之间", maxAge)
+	}
+}
+
+// validatePhone 手机号选填；填写时去掉空格、横线、括号等分隔符后必须是 E.164 格式：
+// 可选的 +，后面是 minPhoneDigits 到 maxPhoneDigits 位数字，首位（国家代码）不为0
+func validatePhone(v *violations, phone string) {
+	if phone == "" {
+		return
+	}
+	digits := strings.TrimPrefix(store.NormalizePhone(phone), "+")
+	valid := len(digits) >= minPhoneDigits && len(digits) <= maxPhoneDigits && digits[0] != '0'
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			valid = false
+		}
+	}
+	if !valid {
+		v.add("phone", "手机号必须是E.164格式，例如 +8613800138000")
+	}
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultWatchHistory 默认为断线重连保留的最近事件数
+const DefaultWatchHistory = 10000
+
+// revisionHeader WatchUsers 响应头中的起始 revision
+const revisionHeader = "revision"
+
+// changeFeed 用户变更事件的内存历史，供 WatchUsers 读取
+//
+// 事件只保存在内存中。为了让 revision 在重启后也不回退，起始 revision 取服务器启动时的微秒时间戳，
+// 重启前的 revision 都小于它，会被当作已压缩处理，客户端据此重新全量同步。
+type changeFeed struct {
+	mu        sync.Mutex
+	history   []*pb.UserEvent // 按 revision 升序，至少保留最近 capacity 条
+	capacity  int
+	compacted int64         // 已被丢弃的最大 revision，大于它的事件都还在 history 中
+	revision  int64         // 最新事件的 revision
+	notify    chan struct{} // 有新事件时关闭并替换，唤醒所有等待的 watcher
+
+	held    []*pb.UserEvent // 原子批量操作期间暂存的事件
+	holding bool
+}
+
+func newChangeFeed(capacity int) *changeFeed {
+	if capacity <= 0 {
+		capacity = DefaultWatchHistory
+	}
+	start := time.Now().UnixMicro()
+	return &changeFeed{
+		capacity:  capacity,
+		compacted: start,
+		revision:  start,
+		notify:    make(chan struct{}),
+	}
+}
+
+// publish 为事件分配 revision 并通知 watcher；处于 hold 状态时先暂存
+func (f *changeFeed) publish(event *pb.UserEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.holding {
+		f.held = append(f.held, event)
+		return
+	}
+	f.append(event)
+}
+
+func (f *changeFeed) append(events ...*pb.UserEvent) {
+	if len(events) == 0 {
+		return
+	}
+	for _, event := range events {
+		f.revision++
+		event.Revision = f.revision
+		f.history = append(f.history, event)
+	}
+	// 攒够两倍容量再整体丢弃旧事件，避免每次发布都搬移切片
+	if len(f.history) >= 2*f.capacity {
+		drop := len(f.history) - f.capacity
+		f.compacted = f.history[drop-1].Revision
+		f.history = append([]*pb.UserEvent(nil), f.history[drop:]...)
+	}
+	close(f.notify)
+	f.notify = make(chan struct{})
+}
+
+// hold 开始暂存事件，直到 release；用于原子批量操作，撤销的修改不应被 watcher 看到
+func (f *changeFeed) hold() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.holding = true
+}
+
+// release 结束暂存，commit 为 true 时发布暂存的事件，否则丢弃
+func (f *changeFeed) release(commit bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if commit {
+		f.append(f.held...)
+	}
+	f.held = nil
+	f.holding = false
+}
+
+// since 返回 revision 大于 after 的事件、最新 revision 和等待新事件的通道
+func (f *changeFeed) since(after int64) ([]*pb.UserEvent, int64, <-chan struct{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if after < f.compacted {
+		return nil, 0, nil, newError(codes.OutOfRange, pb.ErrorReason_REVISION_COMPACTED, userEventsResource,
+			map[string]string{"compacted_revision": strconv.FormatInt(f.compacted, 10)},
+			fmt.Sprintf("revision %d 之后的事件已被压缩，最早可恢复的 revision 为 %d，请重新同步", after, f.compacted))
+	}
+	if after > f.revision {
+		return nil, 0, nil, newError(codes.OutOfRange, pb.ErrorReason_REVISION_NOT_REACHED, userEventsResource,
+			map[string]string{"current_revision": strconv.FormatInt(f.revision, 10)},
+			fmt.Sprintf("revision %d 尚未产生，当前 revision 为 %d", after, f.revision))
+	}
+
+	// history 中的 revision 连续，末尾的 revision-after 条就是 after 之后的事件
+	start := len(f.history) - int(f.revision-after)
+	events := append([]*pb.UserEvent(nil), f.history[start:]...)
+	return events, f.revision, f.notify, nil
+}
+
+// current 返回最新的 revision
+func (f *changeFeed) current() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.revision
+}
+
+// userEvent 根据修改前后的用户生成变更事件，对 watcher 不可见的变化返回 nil
+func userEvent(before, after *pb.User) *pb.UserEvent {
+	event := &pb.UserEvent{Timestamp: time.Now().Unix()}
+	user := after
+	switch {
+	case before == nil:
+		event.Type = pb.UserEvent_CREATED
+	case after == nil:
+		// 清除已软删除的用户时，删除事件已经在软删除时发出
+		if before.DeletedAt != 0 {
+			return nil
+		}
+		event.Type, user = pb.UserEvent_DELETED, before
+	case after.DeletedAt != 0:
+		event.Type = pb.UserEvent_DELETED
+	default:
+		event.Type = pb.UserEvent_UPDATED
+	}
+	// 事件会被多个 watcher 共享，保存一份副本，避免调用方之后修改
+	event.User = proto.Clone(user).(*pb.User)
+	return event
+}
+
+// WatchUsers 服务端流式推送用户变更事件
+//
+// 先补发 after_revision 之后的历史事件，再持续推送新事件，直到客户端断开。
+// watcher 消费过慢、需要的事件已被压缩时返回 OUT_OF_RANGE。
+func (s *UserServer) WatchUsers(req *pb.WatchUsersRequest, stream pb.UserService_WatchUsersServer) error {
+	log.Printf("WatchUsers called with: %+v", req)
+
+	t, err := s.tenant(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	after := req.AfterRevision
+	if after < 0 {
+		return invalidArgument(userEventsResource, "after_revision", "after_revision 不能为负数")
+	}
+	if after == 0 {
+		after = t.feed.current()
+	}
+	if err := stream.SendHeader(metadata.Pairs(revisionHeader, strconv.FormatInt(after, 10))); err != nil {
+		return err
+	}
+
+	ctx := stream.Context()
+	for {
+		events, revision, notify, err := t.feed.since(after)
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			if req.UserId != 0 && event.User.Id != req.UserId {
+				continue
+			}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		}
+		after = revision
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// ErrNoPassword 用户没有设置密码
+var ErrNoPassword = errors.New("store: password not set")
+
+// Credentials 保存用户的密码哈希，所有租户共用，按租户ID和用户ID区分
+//
+// 密码哈希不放在 pb.User 中，避免随用户信息返回给调用方。实现必须是并发安全的。
+type Credentials interface {
+	// SetPassword 保存用户的密码哈希，替换已有的哈希
+	SetPassword(ctx context.Context, tenant string, userID int64, hash string) error
+	// PasswordHash 返回用户的密码哈希，没有设置密码时返回 ErrNoPassword
+	PasswordHash(ctx context.Context, tenant string, userID int64) (string, error)
+	// DeletePassword 删除用户的密码哈希，没有设置密码时不报错
+	DeletePassword(ctx context.Context, tenant string, userID int64) error
+	// Close 释放占用的资源
+	Close() error
+}
+
+// credentialKey 租户ID和用户ID组成的键，租户ID不含 "/"
+func credentialKey(tenant string, userID int64) string {
+	return tenant + "/" + strconv.FormatInt(userID, 10)
+}
+
+// MemoryCredentials 内存中的密码哈希，重启后丢失
+type MemoryCredentials struct {
+	mu     sync.RWMutex
+	hashes map[string]string
+}
+
+// NewMemoryCredentials 创建空的内存凭据存储
+func NewMemoryCredentials() *MemoryCredentials {
+	return &MemoryCredentials{hashes: make(map[string]string)}
+}
+
+// SetPassword 保存用户的密码哈希
+func (m *MemoryCredentials) SetPassword(ctx context.Context, tenant string, userID int64, hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hashes[credentialKey(tenant, userID)] = hash
+	return nil
+}
+
+// PasswordHash 返回用户的密码哈希
+func (m *MemoryCredentials) PasswordHash(ctx context.Context, tenant string, userID int64) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	hash, ok := m.hashes[credentialKey(tenant, userID)]
+	if !ok {
+		return "", ErrNoPassword
+	}
+	return hash, nil
+}
+
+// DeletePassword 删除用户的密码哈希
+func (m *MemoryCredentials) DeletePassword(ctx context.Context, tenant string, userID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.hashes, credentialKey(tenant, userID))
+	return nil
+}
+
+// Close 内存存储无需释放资源
+func (m *MemoryCredentials) Close() error {
+	return nil
+}
+
+// FileCredentials 持久化到JSON文件的密码哈希
+//
+// 数据常驻内存，每次修改后整体写回文件（先写临时文件再重命名），写入失败时不改变内存中的数据。
+type FileCredentials struct {
+	mem  *MemoryCredentials
+	path string
+}
+
+// OpenFileCredentials 打开（或创建）凭据文件，文件权限为 0600
+func OpenFileCredentials(path string) (*FileCredentials, error) {
+	f := &FileCredentials{mem: NewMemoryCredentials(), path: path}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, &f.mem.hashes); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// SetPassword 保存用户的密码哈希并写回文件
+func (f *FileCredentials) SetPassword(ctx context.Context, tenant string, userID int64, hash string) error {
+	return f.mutate(credentialKey(tenant, userID), hash, true)
+}
+
+// PasswordHash 返回用户的密码哈希
+func (f *FileCredentials) PasswordHash(ctx context.Context, tenant string, userID int64) (string, error) {
+	return f.mem.PasswordHash(ctx, tenant, userID)
+}
+
+// DeletePassword 删除用户的密码哈希并写回文件
+func (f *FileCredentials) DeletePassword(ctx context.Context, tenant string, userID int64) error {
+	return f.mutate(credentialKey(tenant, userID), "", false)
+}
+
+// Close 每次修改都已落盘，无需额外处理
+func (f *FileCredentials) Close() error {
+	return nil
+}
+
+// mutate 设置（set 为 true）或删除 key 的哈希，写回文件失败时撤销修改
+func (f *FileCredentials) mutate(key, hash string, set bool) error {
+	f.mem.mu.Lock()
+	defer f.mem.mu.Unlock()
+
+	old, existed := f.mem.hashes[key]
+	if !set && !existed {
+		return nil
+	}
+	if set {
+		f.mem.hashes[key] = hash
+	} else {
+		delete(f.mem.hashes, key)
+	}
+
+	data, err := json.MarshalIndent(f.mem.hashes, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(f.path, data)
+	}
+	if err != nil {
+		if existed {
+			f.mem.hashes[key] = old
+		} else {
+			delete(f.mem.hashes, key)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// FileStore 基于JSON文件的用户存储
+//
+// 数据常驻内存，每次修改后把全部用户整体写回文件。
+// 写文件先落到临时文件再重命名，保证文件内容总是完整的。
+type FileStore struct {
+	mem  *MemoryStore
+	path string
+}
+
+// fileData 数据文件的结构
+type fileData struct {
+	NextID int64             `json:"next_id"`
+	Users  []json.RawMessage `json:"users"`
+}
+
+// NewFileStore 打开（或创建）指定路径的文件存储
+func NewFileStore(path string) (*FileStore, error) {
+	f := &FileStore{
+		mem:  NewMemoryStore(),
+		path: path,
+	}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Create 保存新用户，user.Id 为0时为其分配ID
+func (f *FileStore) Create(ctx context.Context, user *pb.User) (*pb.User, error) {
+	var created *pb.User
+	err := f.mutate(func() (undo func(), err error) {
+		created, undo, err = f.mem.create(user)
+		return undo, err
+	})
+	return created, err
+}
+
+// Get 按ID获取用户
+func (f *FileStore) Get(ctx context.Context, id int64) (*pb.User, error) {
+	return f.mem.Get(ctx, id)
+}
+
+// GetByUID 按字符串ID获取用户
+func (f *FileStore) GetByUID(ctx context.Context, uid string) (*pb.User, error) {
+	return f.mem.GetByUID(ctx, uid)
+}
+
+// GetByEmail 按邮箱获取用户
+func (f *FileStore) GetByEmail(ctx context.Context, email string) (*pb.User, error) {
+	return f.mem.GetByEmail(ctx, email)
+}
+
+// GetByPhone 按手机号获取用户
+func (f *FileStore) GetByPhone(ctx context.Context, phone string) (*pb.User, error) {
+	return f.mem.GetByPhone(ctx, phone)
+}
+
+// Update 用给定内容整体替换已有用户
+func (f *FileStore) Update(ctx context.Context, user *pb.User) (*pb.User, error) {
+	var updated *pb.User
+	err := f.mutate(func() (undo func(), err error) {
+		updated, undo, err = f.mem.update(user)
+		return undo, err
+	})
+	return updated, err
+}
+
+// Delete 按ID删除用户
+func (f *FileStore) Delete(ctx context.Context, id int64) error {
+	return f.mutate(func() (func(), error) {
+		return f.mem.delete(id)
+	})
+}
+
+// List 返回所有用户，按ID升序排列
+func (f *FileStore) List(ctx context.Context) ([]*pb.User, error) {
+	return f.mem.List(ctx)
+}
+
+// Close 文件存储每次修改都已落盘，无需额外处理
+func (f *FileStore) Close() error {
+	return nil
+}
+
+// mutate 执行修改并写回文件
+func (f *FileStore) mutate(fn func() (func(), error)) error {
+	return f.mem.mutate(fn, f.save)
+}
+
+// load 从文件加载数据，文件不存在时视为空存储
+func (f *FileStore) load() error {
+	return readSnapshot(f.path, f.mem)
+}
+
+// save 把内存中的全部数据写回文件，调用方必须持有写锁
+func (f *FileStore) save() error {
+	return writeSnapshot(f.path, f.mem)
+}
+
+// readSnapshot 把数据文件中的用户和ID计数器加载到内存存储，文件不存在时不做任何事
+func readSnapshot(path string, m *MemoryStore) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read %s: %w", path, err)
+	}
+
+	var fd fileData
+	if err := json.Unmarshal(data, &fd); err != nil {
+		return fmt.Errorf("decode %s: %w", path, err)
+	}
+
+	for _, raw := range fd.Users {
+		u := &pb.User{}
+		if err := protojson.Unmarshal(raw, u); err != nil {
+			return fmt.Errorf("decode user in %s: %w", path, err)
+		}
+		m.put(u.Id, u)
+	}
+	if fd.NextID > m.nextID {
+		m.nextID = fd.NextID
+	}
+	return nil
+}
+
+// writeSnapshot 把内存存储中的全部数据原子地写入数据文件，调用方必须持有写锁
+func writeSnapshot(path string, m *MemoryStore) error {
+	fd := fileData{
+		NextID: m.nextID,
+		Users:  make([]json.RawMessage, 0, len(m.users)),
+	}
+	for _, u := range m.users {
+		raw, err := protojson.Marshal(u)
+		if err != nil {
+			return fmt.Errorf("encode user %d: %w", u.Id, err)
+		}
+		fd.Users = append(fd.Users, raw)
+	}
+
+	data, err := json.MarshalIndent(fd, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", path, err)
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic 先写临时文件再重命名，避免留下写了一半的文件
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("rename to %s: %w", path, err)
+	}
+	return nil
+}
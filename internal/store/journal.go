@@ -0,0 +1,330 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	journalFile  = "journal.log"
+	snapshotFile = "snapshot.json"
+
+	// recordHeaderSize 每条日志记录的头部：4字节负载长度 + 4字节CRC32校验和
+	recordHeaderSize = 8
+	// maxRecordSize 单条记录负载的上限，超过视为损坏
+	maxRecordSize = 16 << 20
+
+	// DefaultSnapshotEvery 默认每写入多少条日志做一次快照压缩
+	DefaultSnapshotEvery = 1000
+)
+
+// 日志记录的操作类型
+const (
+	opCreate = "create"
+	opUpdate = "update"
+	opDelete = "delete"
+)
+
+// journalRecord 一条预写日志记录
+type journalRecord struct {
+	Op   string          `json:"op"`
+	ID   int64           `json:"id"`
+	User json.RawMessage `json:"user,omitempty"`
+}
+
+// JournalStore 基于预写日志（WAL）和快照的持久化用户存储
+//
+// 每次修改先追加到 journal.log 并 fsync，成功后才对调用方可见。
+// 日志累积到 snapshotEvery 条后，把全部数据写入 snapshot.json 并清空日志。
+// 启动时先加载快照再重放日志；日志末尾写了一半的记录会被丢弃并截断。
+type JournalStore struct {
+	mem           *MemoryStore
+	dir           string
+	journal       *os.File
+	size          int64 // 日志文件中已确认写入的字节数
+	records       int   // 自上次快照以来的日志条数
+	snapshotEvery int
+}
+
+// NewJournalStore 打开（或创建）指定目录下的日志存储并执行崩溃恢复
+//
+// snapshotEvery 小于等于0时使用 DefaultSnapshotEvery。
+func NewJournalStore(dir string, snapshotEvery int) (*JournalStore, error) {
+	if snapshotEvery <= 0 {
+		snapshotEvery = DefaultSnapshotEvery
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create data dir: %w", err)
+	}
+
+	j := &JournalStore{
+		mem:           NewMemoryStore(),
+		dir:           dir,
+		snapshotEvery: snapshotEvery,
+	}
+	if err := readSnapshot(j.snapshotPath(), j.mem); err != nil {
+		return nil, err
+	}
+	if err := j.replay(); err != nil {
+		return nil, err
+	}
+
+	journal, err := os.OpenFile(j.journalPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open journal: %w", err)
+	}
+	info, err := journal.Stat()
+	if err != nil {
+		journal.Close()
+		return nil, fmt.Errorf("stat journal: %w", err)
+	}
+	j.journal = journal
+	j.size = info.Size()
+	return j, nil
+}
+
+// Create 保存新用户，user.Id 为0时为其分配ID
+func (j *JournalStore) Create(ctx context.Context, user *pb.User) (*pb.User, error) {
+	var created *pb.User
+	err := j.mem.mutate(func() (undo func(), err error) {
+		created, undo, err = j.mem.create(user)
+		return undo, err
+	}, func() error {
+		return j.append(opCreate, created.Id, created)
+	})
+	return created, err
+}
+
+// Get 按ID获取用户
+func (j *JournalStore) Get(ctx context.Context, id int64) (*pb.User, error) {
+	return j.mem.Get(ctx, id)
+}
+
+// GetByUID 按字符串ID获取用户
+func (j *JournalStore) GetByUID(ctx context.Context, uid string) (*pb.User, error) {
+	return j.mem.GetByUID(ctx, uid)
+}
+
+// GetByEmail 按邮箱获取用户
+func (j *JournalStore) GetByEmail(ctx context.Context, email string) (*pb.User, error) {
+	return j.mem.GetByEmail(ctx, email)
+}
+
+// GetByPhone 按手机号获取用户
+func (j *JournalStore) GetByPhone(ctx context.Context, phone string) (*pb.User, error) {
+	return j.mem.GetByPhone(ctx, phone)
+}
+
+// Update 用给定内容整体替换已有用户
+func (j *JournalStore) Update(ctx context.Context, user *pb.User) (*pb.User, error) {
+	var updated *pb.User
+	err := j.mem.mutate(func() (undo func(), err error) {
+		updated, undo, err = j.mem.update(user)
+		return undo, err
+	}, func() error {
+		return j.append(opUpdate, updated.Id, updated)
+	})
+	return updated, err
+}
+
+// Delete 按ID删除用户
+func (j *JournalStore) Delete(ctx context.Context, id int64) error {
+	return j.mem.mutate(func() (func(), error) {
+		return j.mem.delete(id)
+	}, func() error {
+		return j.append(opDelete, id, nil)
+	})
+}
+
+// List 返回所有用户，按ID升序排列
+func (j *JournalStore) List(ctx context.Context) ([]*pb.User, error) {
+	return j.mem.List(ctx)
+}
+
+// Compact 立即把全部数据写入快照并清空日志
+func (j *JournalStore) Compact() error {
+	j.mem.mu.Lock()
+	defer j.mem.mu.Unlock()
+
+	return j.compact()
+}
+
+// Close 关闭日志文件
+func (j *JournalStore) Close() error {
+	j.mem.mu.Lock()
+	defer j.mem.mu.Unlock()
+
+	return j.journal.Close()
+}
+
+func (j *JournalStore) journalPath() string {
+	return filepath.Join(j.dir, journalFile)
+}
+
+func (j *JournalStore) snapshotPath() string {
+	return filepath.Join(j.dir, snapshotFile)
+}
+
+// append 追加一条日志记录并落盘，必要时触发快照压缩，调用方必须持有写锁
+func (j *JournalStore) append(op string, id int64, user *pb.User) error {
+	rec := journalRecord{Op: op, ID: id}
+	if user != nil {
+		raw, err := protojson.Marshal(user)
+		if err != nil {
+			return fmt.Errorf("encode user %d: %w", id, err)
+		}
+		rec.User = raw
+	}
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encode journal record: %w", err)
+	}
+
+	buf := make([]byte, recordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[recordHeaderSize:], payload)
+
+	if err := j.write(buf); err != nil {
+		// 去掉可能写了一半的记录，避免后续记录接在损坏的数据之后
+		if terr := j.journal.Truncate(j.size); terr != nil {
+			log.Printf("Journal: failed to drop partial record: %v", terr)
+		}
+		return err
+	}
+	j.size += int64(len(buf))
+
+	j.records++
+	if j.records >= j.snapshotEvery {
+		// 记录已经落盘，快照失败只影响日志长度，不影响本次修改
+		if err := j.compact(); err != nil {
+			log.Printf("Journal compaction failed: %v", err)
+		}
+	}
+	return nil
+}
+
+func (j *JournalStore) write(buf []byte) error {
+	if _, err := j.journal.Write(buf); err != nil {
+		return fmt.Errorf("write journal: %w", err)
+	}
+	if err := j.journal.Sync(); err != nil {
+		return fmt.Errorf("sync journal: %w", err)
+	}
+	return nil
+}
+
+// compact 写入快照后截断日志，调用方必须持有写锁
+//
+// 快照写入后、日志截断前崩溃是安全的：重放日志中的记录是幂等的。
+func (j *JournalStore) compact() error {
+	if err := writeSnapshot(j.snapshotPath(), j.mem); err != nil {
+		return err
+	}
+	if err := j.journal.Truncate(0); err != nil {
+		return fmt.Errorf("truncate journal: %w", err)
+	}
+	if err := j.journal.Sync(); err != nil {
+		return fmt.Errorf("sync journal: %w", err)
+	}
+	j.size = 0
+	j.records = 0
+	return nil
+}
+
+// replay 把日志中的记录重放到内存，遇到不完整或校验失败的记录时
+// 认为是崩溃时写了一半，丢弃它以及之后的内容并截断日志文件。
+func (j *JournalStore) replay() error {
+	f, err := os.OpenFile(j.journalPath(), os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open journal: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		payload, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Journal: discarding torn tail at offset %d: %v", offset, err)
+			if err := f.Truncate(offset); err != nil {
+				return fmt.Errorf("truncate torn journal: %w", err)
+			}
+			if err := f.Sync(); err != nil {
+				return fmt.Errorf("sync journal: %w", err)
+			}
+			break
+		}
+
+		if err := j.apply(payload); err != nil {
+			return fmt.Errorf("replay journal at offset %d: %w", offset, err)
+		}
+		offset += int64(recordHeaderSize + len(payload))
+		j.records++
+	}
+	return nil
+}
+
+// readRecord 读取一条完整的记录负载，记录为空时返回 io.EOF
+func readRecord(r io.Reader) ([]byte, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+
+	size := binary.LittleEndian.Uint32(header[0:4])
+	if size > maxRecordSize {
+		return nil, fmt.Errorf("record size %d too large", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("read payload: %w", err)
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:8]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return payload, nil
+}
+
+// apply 把一条记录应用到内存存储，重复应用同一条记录结果不变
+func (j *JournalStore) apply(payload []byte) error {
+	var rec journalRecord
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return fmt.Errorf("decode record: %w", err)
+	}
+
+	switch rec.Op {
+	case opCreate, opUpdate:
+		u := &pb.User{}
+		if err := protojson.Unmarshal(rec.User, u); err != nil {
+			return fmt.Errorf("decode user %d: %w", rec.ID, err)
+		}
+		j.mem.put(rec.ID, u)
+	case opDelete:
+		j.mem.put(rec.ID, nil)
+	default:
+		return fmt.Errorf("unknown op %q", rec.Op)
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+)
+
+func TestJournalStore(t *testing.T) {
+	s, err := NewJournalStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("NewJournalStore() error = %v", err)
+	}
+	defer s.Close()
+
+	testUserStore(t, s)
+
+	ids, err := NewJournalStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("NewJournalStore() error = %v", err)
+	}
+	defer ids.Close()
+	testExplicitIDs(t, ids)
+}
+
+func TestJournalStore_Recovery(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s, err := NewJournalStore(dir, 0)
+	if err != nil {
+		t.Fatalf("NewJournalStore() error = %v", err)
+	}
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		if _, err := s.Create(ctx, &pb.User{Name: "用户", Email: email}); err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+	}
+	if err := s.Delete(ctx, 3); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	s.Close()
+
+	s, err = NewJournalStore(dir, 0)
+	if err != nil {
+		t.Fatalf("reopen NewJournalStore() error = %v", err)
+	}
+	defer s.Close()
+
+	users, _ := s.List(ctx)
+	if len(users) != 2 {
+		t.Errorf("List() after reopen = %d users, want 2", len(users))
+	}
+	if _, err := s.Get(ctx, 3); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() deleted user error = %v, want ErrNotFound", err)
+	}
+
+	// 已删除用户的ID不能被复用
+	u, err := s.Create(ctx, &pb.User{Name: "用户", Email: "d@example.com"})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if u.Id != 4 {
+		t.Errorf("Create() after reopen id = %d, want 4", u.Id)
+	}
+}
+
+func TestJournalStore_TornWrite(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		tear      func(t *testing.T, path string)
+		wantUsers int
+	}{
+		{
+			name:      "truncated payload",
+			wantUsers: 2,
+			tear: func(t *testing.T, path string) {
+				info, err := os.Stat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Truncate(path, info.Size()-5); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name:      "truncated header",
+			wantUsers: 3,
+			tear: func(t *testing.T, path string) {
+				appendBytes(t, path, []byte{0x20, 0x00, 0x00})
+			},
+		},
+		{
+			name:      "checksum mismatch",
+			wantUsers: 2,
+			tear: func(t *testing.T, path string) {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data[len(data)-2] ^= 0xff
+				if err := os.WriteFile(path, data, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			s, err := NewJournalStore(dir, 0)
+			if err != nil {
+				t.Fatalf("NewJournalStore() error = %v", err)
+			}
+			for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+				if _, err := s.Create(ctx, &pb.User{Name: "用户", Email: email}); err != nil {
+					t.Fatalf("Create() error = %v", err)
+				}
+			}
+			s.Close()
+
+			tt.tear(t, filepath.Join(dir, journalFile))
+
+			s, err = NewJournalStore(dir, 0)
+			if err != nil {
+				t.Fatalf("NewJournalStore() after torn write error = %v", err)
+			}
+
+			users, _ := s.List(ctx)
+			if len(users) != tt.wantUsers {
+				t.Errorf("List() after recovery = %d users, want %d", len(users), tt.wantUsers)
+			}
+
+			// 恢复后继续写入，并确认再次重启时不受之前损坏数据的影响
+			u, err := s.Create(ctx, &pb.User{Name: "用户", Email: "d@example.com"})
+			if err != nil {
+				t.Fatalf("Create() after recovery error = %v", err)
+			}
+			if u.Id != int64(tt.wantUsers+1) {
+				t.Errorf("Create() after recovery id = %d, want %d", u.Id, tt.wantUsers+1)
+			}
+			s.Close()
+
+			s, err = NewJournalStore(dir, 0)
+			if err != nil {
+				t.Fatalf("second reopen error = %v", err)
+			}
+			defer s.Close()
+			if _, err := s.Get(ctx, u.Id); err != nil {
+				t.Errorf("Get() record written after recovery error = %v", err)
+			}
+		})
+	}
+}
+
+func TestJournalStore_Compaction(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s, err := NewJournalStore(dir, 2)
+	if err != nil {
+		t.Fatalf("NewJournalStore() error = %v", err)
+	}
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		if _, err := s.Create(ctx, &pb.User{Name: "用户", Email: email}); err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+	}
+	if err := s.Delete(ctx, 3); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	s.Close()
+
+	// 第4条记录触发了快照，日志应被清空
+	info, err := os.Stat(filepath.Join(dir, journalFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("journal size after compaction = %d, want 0", info.Size())
+	}
+
+	s, err = NewJournalStore(dir, 2)
+	if err != nil {
+		t.Fatalf("reopen NewJournalStore() error = %v", err)
+	}
+	defer s.Close()
+
+	users, _ := s.List(ctx)
+	if len(users) != 2 {
+		t.Errorf("List() after reopen = %d users, want 2", len(users))
+	}
+	u, err := s.Create(ctx, &pb.User{Name: "用户", Email: "d@example.com"})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if u.Id != 4 {
+		t.Errorf("Create() after compaction id = %d, want 4", u.Id)
+	}
+}
+
+func appendBytes(t *testing.T, path string, b []byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(b); err != nil {
+		t.Fatal(err)
+	}
+}
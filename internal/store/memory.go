@@ -0,0 +1,244 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+	"google.golang.org/protobuf/proto"
+)
+
+// MemoryStore 基于内存map的用户存储，进程退出后数据丢失
+//
+// 邮箱和手机号按规范化后的值建立二级索引，唯一性检查和按邮箱/手机号查询都是O(1)。
+type MemoryStore struct {
+	users   map[int64]*pb.User
+	byEmail map[string]int64 // 规范化邮箱 -> 用户ID
+	byPhone map[string]int64 // 规范化手机号 -> 用户ID
+	byUID   map[string]int64 // 字符串ID -> 用户ID
+	nextID  int64
+	mu      sync.RWMutex
+}
+
+// NewMemoryStore 创建新的内存存储
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:   make(map[int64]*pb.User),
+		byEmail: make(map[string]int64),
+		byPhone: make(map[string]int64),
+		byUID:   make(map[string]int64),
+		nextID:  1,
+	}
+}
+
+// Create 保存新用户，user.Id 为0时为其分配ID
+func (m *MemoryStore) Create(ctx context.Context, user *pb.User) (*pb.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, _, err := m.create(user)
+	return u, err
+}
+
+// Get 按ID获取用户
+func (m *MemoryStore) Get(ctx context.Context, id int64) (*pb.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, exists := m.users[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return proto.Clone(u).(*pb.User), nil
+}
+
+// GetByUID 按字符串ID获取用户
+func (m *MemoryStore) GetByUID(ctx context.Context, uid string) (*pb.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.lookup(m.byUID, uid)
+}
+
+// GetByEmail 按规范化后的邮箱获取用户
+func (m *MemoryStore) GetByEmail(ctx context.Context, email string) (*pb.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.lookup(m.byEmail, NormalizeEmail(email))
+}
+
+// GetByPhone 按规范化后的手机号获取用户
+func (m *MemoryStore) GetByPhone(ctx context.Context, phone string) (*pb.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.lookup(m.byPhone, NormalizePhone(phone))
+}
+
+// Update 用给定内容整体替换已有用户
+func (m *MemoryStore) Update(ctx context.Context, user *pb.User) (*pb.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, _, err := m.update(user)
+	return u, err
+}
+
+// Delete 按ID删除用户
+func (m *MemoryStore) Delete(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := m.delete(id)
+	return err
+}
+
+// List 返回所有用户，按ID升序排列
+func (m *MemoryStore) List(ctx context.Context) ([]*pb.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	users := make([]*pb.User, 0, len(m.users))
+	for _, u := range m.users {
+		users = append(users, proto.Clone(u).(*pb.User))
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Id < users[j].Id
+	})
+	return users, nil
+}
+
+// Close 内存存储无需释放资源
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+// 以下未导出的方法要求调用方持有写锁，供持久化存储复用。
+// 修改类方法额外返回一个撤销函数，持久化失败时用它回滚内存中的修改。
+
+func (m *MemoryStore) create(user *pb.User) (*pb.User, func(), error) {
+	if _, exists := m.users[user.Id]; exists {
+		return nil, nil, ErrIDExists
+	}
+	if err := m.checkUnique(user, 0); err != nil {
+		return nil, nil, err
+	}
+
+	u := proto.Clone(user).(*pb.User)
+	if u.Id == 0 {
+		u.Id = m.nextID
+	}
+	undo := m.replace(u.Id, u)
+
+	return proto.Clone(u).(*pb.User), undo, nil
+}
+
+func (m *MemoryStore) update(user *pb.User) (*pb.User, func(), error) {
+	if _, exists := m.users[user.Id]; !exists {
+		return nil, nil, ErrNotFound
+	}
+	if err := m.checkUnique(user, user.Id); err != nil {
+		return nil, nil, err
+	}
+
+	u := proto.Clone(user).(*pb.User)
+	undo := m.replace(u.Id, u)
+
+	return proto.Clone(u).(*pb.User), undo, nil
+}
+
+func (m *MemoryStore) delete(id int64) (func(), error) {
+	if _, exists := m.users[id]; !exists {
+		return nil, ErrNotFound
+	}
+	return m.replace(id, nil), nil
+}
+
+// mutate 在写锁内执行修改 fn，随后调用 commit 持久化，commit 失败时撤销修改
+func (m *MemoryStore) mutate(fn func() (func(), error), commit func() error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	undo, err := fn()
+	if err != nil {
+		return err
+	}
+	if err := commit(); err != nil {
+		undo()
+		return err
+	}
+	return nil
+}
+
+// replace 把ID为 id 的用户替换为 u（u 为 nil 表示删除），返回恢复原状的撤销函数
+func (m *MemoryStore) replace(id int64, u *pb.User) func() {
+	prev, prevNextID := m.users[id], m.nextID
+	m.put(id, u)
+	return func() {
+		m.put(id, prev)
+		m.nextID = prevNextID
+	}
+}
+
+// put 写入（u 为 nil 时删除）用户，同步维护二级索引并推进ID计数器，也用于从持久化数据恢复
+func (m *MemoryStore) put(id int64, u *pb.User) {
+	if prev, exists := m.users[id]; exists {
+		unindex(m.byEmail, NormalizeEmail(prev.Email), id)
+		unindex(m.byPhone, NormalizePhone(prev.Phone), id)
+		unindex(m.byUID, prev.Uid, id)
+	}
+	if u == nil {
+		delete(m.users, id)
+		return
+	}
+
+	m.users[id] = u
+	if key := NormalizeEmail(u.Email); key != "" {
+		m.byEmail[key] = id
+	}
+	if key := NormalizePhone(u.Phone); key != "" {
+		m.byPhone[key] = id
+	}
+	if u.Uid != "" {
+		m.byUID[u.Uid] = id
+	}
+	if id >= m.nextID {
+		m.nextID = id + 1
+	}
+}
+
+// unindex 仅当索引项仍指向 id 时才删除它
+func unindex(index map[string]int64, key string, id int64) {
+	if index[key] == id {
+		delete(index, key)
+	}
+}
+
+// lookup 通过二级索引查找用户
+func (m *MemoryStore) lookup(index map[string]int64, key string) (*pb.User, error) {
+	id, exists := index[key]
+	if key == "" || !exists {
+		return nil, ErrNotFound
+	}
+	return proto.Clone(m.users[id]).(*pb.User), nil
+}
+
+// checkUnique 检查邮箱、手机号和 uid 是否已被除 excludeID 以外的用户使用
+func (m *MemoryStore) checkUnique(u *pb.User, excludeID int64) error {
+	if u.Uid != "" {
+		if id, exists := m.byUID[u.Uid]; exists && id != excludeID {
+			return ErrIDExists
+		}
+	}
+	if id, exists := m.byEmail[NormalizeEmail(u.Email)]; exists && id != excludeID {
+		return ErrEmailExists
+	}
+	if key := NormalizePhone(u.Phone); key != "" {
+		if id, exists := m.byPhone[key]; exists && id != excludeID {
+			return ErrPhoneExists
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// migration 一次版本化的数据库结构变更
+type migration struct {
+	version int
+	name    string
+	stmts   []string
+	// fn 在 stmts 之后、同一事务内执行，用于SQL难以表达的数据回填
+	fn func(ctx context.Context, tx *sql.Tx) error
+}
+
+// migrations 按版本号递增排列，已发布的迁移不能修改，只能追加新版本
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create users",
+		stmts: []string{
+			`CREATE TABLE users (
+				id         INTEGER PRIMARY KEY AUTOINCREMENT,
+				name       TEXT    NOT NULL,
+				email      TEXT    NOT NULL,
+				age        INTEGER NOT NULL DEFAULT 0,
+				phone      TEXT    NOT NULL DEFAULT '',
+				created_at INTEGER NOT NULL,
+				updated_at INTEGER NOT NULL,
+				CONSTRAINT users_email_unique UNIQUE (email)
+			)`,
+		},
+	},
+	{
+		version: 2,
+		name:    "normalized email and phone keys",
+		stmts: []string{
+			`ALTER TABLE users ADD COLUMN email_key TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE users ADD COLUMN phone_key TEXT NOT NULL DEFAULT ''`,
+		},
+		fn: func(ctx context.Context, tx *sql.Tx) error {
+			// 规范化规则以Go代码为准，回填后再建唯一索引
+			if err := backfillKeys(ctx, tx); err != nil {
+				return err
+			}
+			for _, stmt := range []string{
+				`CREATE UNIQUE INDEX users_email_key ON users (email_key)`,
+				`CREATE UNIQUE INDEX users_phone_key ON users (phone_key) WHERE phone_key <> ''`,
+			} {
+				if _, err := tx.ExecContext(ctx, stmt); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version: 3,
+		name:    "user version",
+		stmts: []string{
+			`ALTER TABLE users ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+		},
+	},
+	{
+		version: 4,
+		name:    "soft delete",
+		stmts: []string{
+			`ALTER TABLE users ADD COLUMN deleted_at INTEGER NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		version: 5,
+		name:    "string user id",
+		stmts: []string{
+			`ALTER TABLE users ADD COLUMN uid TEXT NOT NULL DEFAULT ''`,
+			`CREATE UNIQUE INDEX users_uid ON users (uid) WHERE uid <> ''`,
+		},
+	},
+	{
+		version: 6,
+		name:    "user role",
+		stmts: []string{
+			`ALTER TABLE users ADD COLUMN role INTEGER NOT NULL DEFAULT 0`,
+		},
+	},
+}
+
+// Migrate 把数据库结构升级到最新版本，返回本次应用的迁移版本号
+//
+// 每个迁移在独立事务中执行，已应用的版本记录在 schema_migrations 表中，
+// 重复调用是安全的。
+func (s *SQLiteStore) Migrate(ctx context.Context) ([]int, error) {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT    NOT NULL,
+		applied_at INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	current, err := schemaVersion(ctx, s.db)
+	if err != nil {
+		return nil, fmt.Errorf("read schema version: %w", err)
+	}
+
+	var applied []int
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := s.applyMigration(ctx, m); err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		applied = append(applied, m.version)
+	}
+	return applied, nil
+}
+
+func (s *SQLiteStore) applyMigration(ctx context.Context, m migration) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range m.stmts {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	if m.fn != nil {
+		if err := m.fn(ctx, tx); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+		m.version, m.name, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// schemaVersion 返回数据库当前的结构版本
+func schemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var v int
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&v)
+	return v, err
+}
+
+// backfillKeys 为已有用户计算规范化的邮箱和手机号
+func backfillKeys(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `SELECT id, email, phone FROM users`)
+	if err != nil {
+		return err
+	}
+	type keys struct {
+		id           int64
+		email, phone string
+	}
+	var all []keys
+	for rows.Next() {
+		var k keys
+		if err := rows.Scan(&k.id, &k.email, &k.phone); err != nil {
+			rows.Close()
+			return err
+		}
+		all = append(all, k)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, k := range all {
+		_, err := tx.ExecContext(ctx, `UPDATE users SET email_key = ?, phone_key = ? WHERE id = ?`,
+			NormalizeEmail(k.email), NormalizePhone(k.phone), k.id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
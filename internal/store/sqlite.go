@@ -0,0 +1,196 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// userColumns users 表中与 pb.User 字段一一对应的列
+const userColumns = `id, name, email, age, phone, created_at, updated_at, version, deleted_at, uid, role`
+
+// SQLiteStore 基于SQLite数据库文件的用户存储
+//
+// 使用纯Go实现的 modernc.org/sqlite 驱动，不依赖cgo。
+// 使用前必须调用 Migrate 把数据库结构升级到最新版本。
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore 打开（或创建）指定路径的SQLite数据库
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite %s: %w", path, err)
+	}
+	// SQLite同一时刻只允许一个写者，单连接可以避免 SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open sqlite %s: %w", path, err)
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+// Create 保存新用户，user.Id 为0时为其分配ID
+func (s *SQLiteStore) Create(ctx context.Context, user *pb.User) (*pb.User, error) {
+	// id 为 NULL 时由 AUTOINCREMENT 分配
+	res, err := s.db.ExecContext(ctx,
+		`INSERT INTO users (id, name, email, age, phone, created_at, updated_at, version, deleted_at, uid, role, email_key, phone_key)
+		VALUES (NULLIF(?, 0), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		user.Id, user.Name, user.Email, user.Age, user.Phone, user.CreatedAt, user.UpdatedAt, user.Version, user.DeletedAt,
+		user.Uid, user.Role, NormalizeEmail(user.Email), NormalizePhone(user.Phone))
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return s.Get(ctx, id)
+}
+
+// Get 按ID获取用户
+func (s *SQLiteStore) Get(ctx context.Context, id int64) (*pb.User, error) {
+	return s.getBy(ctx, "id", id)
+}
+
+// GetByUID 按字符串ID获取用户
+func (s *SQLiteStore) GetByUID(ctx context.Context, uid string) (*pb.User, error) {
+	if uid == "" {
+		return nil, ErrNotFound
+	}
+	return s.getBy(ctx, "uid", uid)
+}
+
+// GetByEmail 按邮箱获取用户
+func (s *SQLiteStore) GetByEmail(ctx context.Context, email string) (*pb.User, error) {
+	key := NormalizeEmail(email)
+	if key == "" {
+		return nil, ErrNotFound
+	}
+	return s.getBy(ctx, "email_key", key)
+}
+
+// GetByPhone 按手机号获取用户
+func (s *SQLiteStore) GetByPhone(ctx context.Context, phone string) (*pb.User, error) {
+	key := NormalizePhone(phone)
+	if key == "" {
+		return nil, ErrNotFound
+	}
+	return s.getBy(ctx, "phone_key", key)
+}
+
+// getBy 按指定的唯一列查询用户，column 只能是代码中的常量
+func (s *SQLiteStore) getBy(ctx context.Context, column string, value any) (*pb.User, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE `+column+` = ?`, value)
+	u, err := scanUser(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Update 用给定内容整体替换已有用户
+func (s *SQLiteStore) Update(ctx context.Context, user *pb.User) (*pb.User, error) {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE users SET name = ?, email = ?, age = ?, phone = ?, created_at = ?, updated_at = ?, version = ?,
+		deleted_at = ?, uid = ?, role = ?, email_key = ?, phone_key = ? WHERE id = ?`,
+		user.Name, user.Email, user.Age, user.Phone, user.CreatedAt, user.UpdatedAt, user.Version, user.DeletedAt,
+		user.Uid, user.Role, NormalizeEmail(user.Email), NormalizePhone(user.Phone), user.Id)
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrNotFound
+	}
+	return s.Get(ctx, user.Id)
+}
+
+// Delete 按ID删除用户
+func (s *SQLiteStore) Delete(ctx context.Context, id int64) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM users WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// List 返回所有用户，按ID升序排列
+func (s *SQLiteStore) List(ctx context.Context) ([]*pb.User, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+userColumns+` FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*pb.User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// Close 关闭数据库连接
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// scanner 兼容 *sql.Row 和 *sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row scanner) (*pb.User, error) {
+	u := &pb.User{}
+	err := row.Scan(&u.Id, &u.Name, &u.Email, &u.Age, &u.Phone, &u.CreatedAt, &u.UpdatedAt, &u.Version, &u.DeletedAt, &u.Uid, &u.Role)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// sqliteError 把数据库主键和唯一约束错误转换为存储层的错误
+func sqliteError(err error) error {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return err
+	}
+	if sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY {
+		return fmt.Errorf("%w: %v", ErrIDExists, err)
+	}
+	if sqliteErr.Code() != sqlite3.SQLITE_CONSTRAINT_UNIQUE {
+		return err
+	}
+	// 错误信息形如 "UNIQUE constraint failed: users.phone_key"
+	switch msg := sqliteErr.Error(); {
+	case strings.Contains(msg, "users.phone"):
+		return fmt.Errorf("%w: %v", ErrPhoneExists, err)
+	case strings.Contains(msg, "users.uid"):
+		return fmt.Errorf("%w: %v", ErrIDExists, err)
+	default:
+		return fmt.Errorf("%w: %v", ErrEmailExists, err)
+	}
+}
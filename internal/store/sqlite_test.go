@@ -0,0 +1,106 @@
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+)
+
+func newTestSQLiteStore(t *testing.T, path string) *SQLiteStore {
+	t.Helper()
+	s, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore() error = %v", err)
+	}
+	if _, err := s.Migrate(context.Background()); err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	return s
+}
+
+func TestSQLiteStore(t *testing.T) {
+	s := newTestSQLiteStore(t, filepath.Join(t.TempDir(), "users.db"))
+	defer s.Close()
+
+	testUserStore(t, s)
+
+	ids := newTestSQLiteStore(t, filepath.Join(t.TempDir(), "ids.db"))
+	defer ids.Close()
+	testExplicitIDs(t, ids)
+}
+
+func TestSQLiteStore_Migrate(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "users.db")
+
+	s, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore() error = %v", err)
+	}
+	applied, err := s.Migrate(ctx)
+	if err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	if len(applied) != len(migrations) {
+		t.Errorf("Migrate() applied %v, want all %d migrations", applied, len(migrations))
+	}
+	if _, err := s.Create(ctx, &pb.User{Name: "张三", Email: "zhangsan@example.com"}); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	s.Close()
+
+	// 重新打开后再次迁移不应重复执行，数据保持不变
+	s = newTestSQLiteStore(t, path)
+	defer s.Close()
+
+	applied, err = s.Migrate(ctx)
+	if err != nil {
+		t.Fatalf("second Migrate() error = %v", err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("second Migrate() applied %v, want none", applied)
+	}
+	if v, _ := schemaVersion(ctx, s.db); v != migrations[len(migrations)-1].version {
+		t.Errorf("schema version = %d, want %d", v, migrations[len(migrations)-1].version)
+	}
+	if _, err := s.Get(ctx, 1); err != nil {
+		t.Errorf("Get() after reopen error = %v", err)
+	}
+}
+
+func TestSQLiteStore_MigrateBackfillsKeys(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "users.db")
+
+	// 先只应用第一个版本，模拟升级前的旧数据库
+	all := migrations
+	migrations = all[:1]
+	s, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore() error = %v", err)
+	}
+	if _, err := s.Migrate(ctx); err != nil {
+		migrations = all
+		t.Fatalf("Migrate() to v1 error = %v", err)
+	}
+	migrations = all
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO users (name, email, age, phone, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		"张三", "ZhangSan@Example.com", 25, "138-0013-8000", 1, 1)
+	if err != nil {
+		t.Fatalf("insert v1 row error = %v", err)
+	}
+	s.Close()
+
+	s = newTestSQLiteStore(t, path)
+	defer s.Close()
+
+	if got, err := s.GetByEmail(ctx, "zhangsan@example.com"); err != nil || got.Name != "张三" {
+		t.Errorf("GetByEmail() after backfill = %v, %v", got, err)
+	}
+	if got, err := s.GetByPhone(ctx, "13800138000"); err != nil || got.Name != "张三" {
+		t.Errorf("GetByPhone() after backfill = %v, %v", got, err)
+	}
+}
@@ -0,0 +1,65 @@
+// Package store 定义用户数据的存储接口及其实现
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+)
+
+var (
+	// ErrNotFound 用户不存在
+	ErrNotFound = errors.New("store: user not found")
+	// ErrEmailExists 邮箱已被占用
+	ErrEmailExists = errors.New("store: email already exists")
+	// ErrPhoneExists 手机号已被占用
+	ErrPhoneExists = errors.New("store: phone already exists")
+	// ErrIDExists 创建时指定的ID或uid已被占用
+	ErrIDExists = errors.New("store: id already exists")
+)
+
+// UserStore 用户存储接口
+//
+// 实现必须是并发安全的。传入和返回的 *pb.User 都是副本，
+// 调用方修改返回值不会影响已保存的数据。
+//
+// 邮箱和非空手机号在所有用户中唯一，比较时使用 NormalizeEmail 和
+// NormalizePhone 规范化后的值。非空的 uid 也唯一。
+type UserStore interface {
+	// Create 保存新用户；user.Id 为0时分配比已有ID都大的递增ID，否则使用给定的ID
+	Create(ctx context.Context, user *pb.User) (*pb.User, error)
+	// Get 按ID获取用户
+	Get(ctx context.Context, id int64) (*pb.User, error)
+	// GetByUID 按字符串ID获取用户
+	GetByUID(ctx context.Context, uid string) (*pb.User, error)
+	// GetByEmail 按邮箱获取用户
+	GetByEmail(ctx context.Context, email string) (*pb.User, error)
+	// GetByPhone 按手机号获取用户
+	GetByPhone(ctx context.Context, phone string) (*pb.User, error)
+	// Update 用给定内容整体替换已有用户
+	Update(ctx context.Context, user *pb.User) (*pb.User, error)
+	// Delete 按ID删除用户
+	Delete(ctx context.Context, id int64) error
+	// List 返回所有用户，按ID升序排列
+	List(ctx context.Context) ([]*pb.User, error)
+	// Close 释放存储占用的资源
+	Close() error
+}
+
+// NormalizeEmail 返回用于唯一性比较和索引的邮箱，忽略首尾空白和大小写
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// NormalizePhone 返回用于唯一性比较和索引的手机号，去掉空白以及常见的分隔符
+func NormalizePhone(phone string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '-', '(', ')', '.':
+			return -1
+		}
+		return r
+	}, phone)
+}
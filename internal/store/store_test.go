@@ -0,0 +1,266 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pb "github.com/liverlong/rpc-learning/pkg/pb/user"
+)
+
+// testUserStore 对任意 UserStore 实现执行相同的基本行为检查
+func testUserStore(t *testing.T, s UserStore) {
+	ctx := context.Background()
+
+	u1, err := s.Create(ctx, &pb.User{Name: "张三", Email: "zhangsan@example.com", Age: 25, Phone: "138-0013-8000", Version: 1})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if u1.Id != 1 {
+		t.Errorf("Create() id = %d, want 1", u1.Id)
+	}
+
+	u2, err := s.Create(ctx, &pb.User{Name: "李四", Email: "lisi@example.com", Age: 30})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if u2.Id != 2 {
+		t.Errorf("Create() id = %d, want 2", u2.Id)
+	}
+
+	if _, err := s.Create(ctx, &pb.User{Name: "王五", Email: "lisi@example.com"}); !errors.Is(err, ErrEmailExists) {
+		t.Errorf("Create() duplicate email error = %v, want ErrEmailExists", err)
+	}
+	if _, err := s.Create(ctx, &pb.User{Name: "王五", Email: " LiSi@Example.COM"}); !errors.Is(err, ErrEmailExists) {
+		t.Errorf("Create() email differing only in case error = %v, want ErrEmailExists", err)
+	}
+	if _, err := s.Create(ctx, &pb.User{Name: "王五", Email: "wangwu@example.com", Phone: "138 0013 8000"}); !errors.Is(err, ErrPhoneExists) {
+		t.Errorf("Create() duplicate phone error = %v, want ErrPhoneExists", err)
+	}
+
+	if got, err := s.GetByEmail(ctx, "ZHANGSAN@example.com"); err != nil || got.Id != 1 {
+		t.Errorf("GetByEmail() = %v, %v, want user 1", got, err)
+	}
+	if got, err := s.GetByPhone(ctx, "13800138000"); err != nil || got.Id != 1 {
+		t.Errorf("GetByPhone() = %v, %v, want user 1", got, err)
+	}
+	if _, err := s.GetByPhone(ctx, ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetByPhone(\"\") error = %v, want ErrNotFound", err)
+	}
+
+	// 修改返回值不应影响已保存的数据
+	u1.Name = "被修改"
+	got, err := s.Get(ctx, 1)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got.Name != "张三" {
+		t.Errorf("Get() name = %q, want %q", got.Name, "张三")
+	}
+
+	got.Email = "lisi@example.com"
+	if _, err := s.Update(ctx, got); !errors.Is(err, ErrEmailExists) {
+		t.Errorf("Update() duplicate email error = %v, want ErrEmailExists", err)
+	}
+	got.Email = "zhangsan_new@example.com"
+	got.Version = 2
+	got.Role = pb.Role_ROLE_ADMIN
+	if updated, err := s.Update(ctx, got); err != nil {
+		t.Errorf("Update() error = %v", err)
+	} else if updated.Version != 2 || updated.Role != pb.Role_ROLE_ADMIN {
+		t.Errorf("Update() version, role = %d, %v, want 2, ROLE_ADMIN", updated.Version, updated.Role)
+	}
+	// 旧邮箱的索引项应随更新移除
+	if _, err := s.GetByEmail(ctx, "zhangsan@example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetByEmail() old email error = %v, want ErrNotFound", err)
+	}
+	if _, err := s.Update(ctx, &pb.User{Id: 99}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Update() missing user error = %v, want ErrNotFound", err)
+	}
+
+	if err := s.Delete(ctx, 2); err != nil {
+		t.Errorf("Delete() error = %v", err)
+	}
+	if err := s.Delete(ctx, 2); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete() twice error = %v, want ErrNotFound", err)
+	}
+
+	users, err := s.List(ctx)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(users) != 1 || users[0].Email != "zhangsan_new@example.com" {
+		t.Errorf("List() = %v, want only the updated user 1", users)
+	}
+
+}
+
+func TestMemoryStore(t *testing.T) {
+	testUserStore(t, NewMemoryStore())
+	testExplicitIDs(t, NewMemoryStore())
+}
+
+// testExplicitIDs 检查调用方指定ID和 uid（Snowflake、ULID 等ID生成器）时的行为
+func testExplicitIDs(t *testing.T, s UserStore) {
+	ctx := context.Background()
+
+	u3, err := s.Create(ctx, &pb.User{Id: 1 << 40, Uid: "01ARYZ6S41TSV4RRFFQ69G5FAV", Name: "王五", Email: "wangwu@example.com"})
+	if err != nil {
+		t.Fatalf("Create() with explicit id error = %v", err)
+	}
+	if u3.Id != 1<<40 {
+		t.Errorf("Create() id = %d, want %d", u3.Id, int64(1<<40))
+	}
+	if got, err := s.GetByUID(ctx, "01ARYZ6S41TSV4RRFFQ69G5FAV"); err != nil || got.Id != u3.Id {
+		t.Errorf("GetByUID() = %v, %v, want user %d", got, err, u3.Id)
+	}
+	if _, err := s.GetByUID(ctx, ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetByUID(\"\") error = %v, want ErrNotFound", err)
+	}
+	if _, err := s.Create(ctx, &pb.User{Id: 1 << 40, Name: "赵六", Email: "zhaoliu@example.com"}); !errors.Is(err, ErrIDExists) {
+		t.Errorf("Create() duplicate id error = %v, want ErrIDExists", err)
+	}
+	if _, err := s.Create(ctx, &pb.User{Uid: u3.Uid, Name: "赵六", Email: "zhaoliu@example.com"}); !errors.Is(err, ErrIDExists) {
+		t.Errorf("Create() duplicate uid error = %v, want ErrIDExists", err)
+	}
+	// 不指定ID时分配比已有ID都大的ID
+	if u4, err := s.Create(ctx, &pb.User{Name: "赵六", Email: "zhaoliu@example.com"}); err != nil || u4.Id <= u3.Id {
+		t.Errorf("Create() after explicit id = %v, %v, want id > %d", u4, err, u3.Id)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+	testUserStore(t, s)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// 重新打开后数据和ID计数器都应保留
+	s, err = NewFileStore(path)
+	if err != nil {
+		t.Fatalf("reopen NewFileStore() error = %v", err)
+	}
+	defer s.Close()
+
+	got, err := s.Get(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("Get() after reopen error = %v", err)
+	}
+	if got.Email != "zhangsan_new@example.com" {
+		t.Errorf("Get() after reopen email = %q", got.Email)
+	}
+
+	u, err := s.Create(context.Background(), &pb.User{Name: "赵六", Email: "zhaoliu@example.com"})
+	if err != nil {
+		t.Fatalf("Create() after reopen error = %v", err)
+	}
+	if u.Id != 3 {
+		t.Errorf("Create() after reopen id = %d, want 3", u.Id)
+	}
+
+	ids, err := NewFileStore(filepath.Join(t.TempDir(), "ids.json"))
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+	defer ids.Close()
+	testExplicitIDs(t, ids)
+}
+
+func TestDirTenants(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "tenants")
+	tenants := DirTenants{Dir: dir, OpenDir: func(dir string) (UserStore, error) {
+		return NewFileStore(filepath.Join(dir, "users.json"))
+	}}
+
+	if got, err := tenants.List(); err != nil || len(got) != 0 {
+		t.Errorf("List() before any tenant = %v, %v, want empty", got, err)
+	}
+
+	// 不同租户各自分配ID，邮箱只在租户内唯一
+	ctx := context.Background()
+	for _, name := range []string{"beta", "acme"} {
+		s, err := tenants.Open(name)
+		if err != nil {
+			t.Fatalf("Open(%q) error = %v", name, err)
+		}
+		u, err := s.Create(ctx, &pb.User{Name: "张三", Email: "zhangsan@example.com"})
+		if err != nil || u.Id != 1 {
+			t.Errorf("Create() in %s = %v, %v, want id 1", name, u, err)
+		}
+		s.Close()
+	}
+
+	got, err := tenants.List()
+	if err != nil || strings.Join(got, ",") != "acme,beta" {
+		t.Errorf("List() = %v, %v, want [acme beta]", got, err)
+	}
+
+	// 重新打开后数据仍然属于原来的租户
+	s, err := tenants.Open("acme")
+	if err != nil {
+		t.Fatalf("reopen Open() error = %v", err)
+	}
+	defer s.Close()
+	if users, _ := s.List(ctx); len(users) != 1 {
+		t.Errorf("List() after reopen = %v, want 1 user", users)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	file, err := OpenFileCredentials(path)
+	if err != nil {
+		t.Fatalf("OpenFileCredentials() error = %v", err)
+	}
+
+	for name, c := range map[string]Credentials{"memory": NewMemoryCredentials(), "file": file} {
+		if _, err := c.PasswordHash(ctx, "", 1); !errors.Is(err, ErrNoPassword) {
+			t.Errorf("%s: PasswordHash() before SetPassword error = %v, want ErrNoPassword", name, err)
+		}
+		// 同一个用户ID在不同租户中是不同的用户
+		c.SetPassword(ctx, "", 1, "hash-1")
+		c.SetPassword(ctx, "acme", 1, "hash-acme-1")
+		c.SetPassword(ctx, "", 1, "hash-1b")
+		if got, err := c.PasswordHash(ctx, "", 1); err != nil || got != "hash-1b" {
+			t.Errorf("%s: PasswordHash() = %q, %v, want the replaced hash", name, got, err)
+		}
+		if got, _ := c.PasswordHash(ctx, "acme", 1); got != "hash-acme-1" {
+			t.Errorf("%s: PasswordHash(acme) = %q, want hash-acme-1", name, got)
+		}
+		if err := c.DeletePassword(ctx, "acme", 1); err != nil {
+			t.Errorf("%s: DeletePassword() error = %v", name, err)
+		}
+		if err := c.DeletePassword(ctx, "acme", 2); err != nil {
+			t.Errorf("%s: DeletePassword() of a user without password error = %v", name, err)
+		}
+	}
+
+	// 重新打开后数据仍在，文件只有所有者可读
+	reopened, err := OpenFileCredentials(path)
+	if err != nil {
+		t.Fatalf("reopen OpenFileCredentials() error = %v", err)
+	}
+	if got, _ := reopened.PasswordHash(ctx, "", 1); got != "hash-1b" {
+		t.Errorf("PasswordHash() after reopen = %q, want hash-1b", got)
+	}
+	if _, err := reopened.PasswordHash(ctx, "acme", 1); !errors.Is(err, ErrNoPassword) {
+		t.Errorf("PasswordHash(acme) after reopen error = %v, want ErrNoPassword", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("credentials file mode = %v, want 0600", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,69 @@
+package store
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Tenants 为每个租户打开独立的用户存储
+//
+// 不同租户的存储互不影响：各自分配ID，邮箱、手机号和 uid 只在租户内唯一。
+// 租户ID由调用方校验，实现可以直接把它用作目录名。
+type Tenants interface {
+	// Open 打开租户的存储，租户还没有数据时创建；调用方负责关闭返回的存储
+	Open(tenant string) (UserStore, error)
+	// List 返回已有数据的租户，按租户ID排序
+	List() ([]string, error)
+}
+
+// MemoryTenants 每个租户使用一个新的内存存储，重启后全部丢失，List 总是返回空
+type MemoryTenants struct{}
+
+// Open 返回新的内存存储
+func (MemoryTenants) Open(string) (UserStore, error) {
+	return NewMemoryStore(), nil
+}
+
+// List 返回空，内存存储没有持久化的租户
+func (MemoryTenants) List() ([]string, error) {
+	return nil, nil
+}
+
+// DirTenants 每个租户的数据位于 Dir 下以租户ID命名的子目录中
+type DirTenants struct {
+	Dir string
+	// OpenDir 打开租户目录中的存储，目录已经创建
+	OpenDir func(dir string) (UserStore, error)
+}
+
+// Open 创建租户目录并打开其中的存储
+func (t DirTenants) Open(tenant string) (UserStore, error) {
+	dir := filepath.Join(t.Dir, tenant)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return t.OpenDir(dir)
+}
+
+// List 返回 Dir 下的子目录名，Dir 不存在时返回空
+func (t DirTenants) List() ([]string, error) {
+	entries, err := os.ReadDir(t.Dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var tenants []string
+	for _, e := range entries {
+		if e.IsDir() {
+			tenants = append(tenants, e.Name())
+		}
+	}
+	sort.Strings(tenants)
+	return tenants, nil
+}
@@ -0,0 +1,182 @@
+// Package tlsconfig 从证书文件创建服务器和客户端的 TLS 配置，证书文件更新后无需重启即可生效
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloader 从 PEM 文件加载证书和私钥，文件修改后在下一次握手时重新加载，并发安全
+//
+// 每次握手检查一次文件的修改时间和大小。新文件加载失败（例如证书已更新而私钥还没有）时继续使用旧证书，
+// 下一次握手时重试，因此替换证书时不需要保证两个文件同时更新。
+type CertReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	version [2]fileVersion
+}
+
+// fileVersion 判断文件是否被修改
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewCertReloader 加载证书文件 certFile 和私钥文件 keyFile，文件不存在或不匹配时返回错误
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// versions 返回两个文件的当前版本
+func (r *CertReloader) versions() ([2]fileVersion, error) {
+	var v [2]fileVersion
+	for i, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return v, err
+		}
+		v[i] = fileVersion{modTime: info.ModTime(), size: info.Size()}
+	}
+	return v, nil
+}
+
+// reload 重新加载证书，调用方持有 r.mu 或 r 尚未共享
+func (r *CertReloader) reload() error {
+	v, err := r.versions()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("load %s: %w", r.certFile, err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("parse %s: %w", r.certFile, err)
+		}
+	}
+	r.cert, r.version = &cert, v
+	return nil
+}
+
+// Certificate 返回当前的证书，文件修改过时先重新加载
+func (r *CertReloader) Certificate() *tls.Certificate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	v, err := r.versions()
+	if err != nil || v == r.version {
+		return r.cert
+	}
+	if err := r.reload(); err != nil {
+		log.Printf("Failed to reload certificate, keeping the old one: %v", err)
+		return r.cert
+	}
+	log.Printf("Reloaded certificate %s (subject %s, expires %v)", r.certFile, r.cert.Leaf.Subject, r.cert.Leaf.NotAfter)
+	return r.cert
+}
+
+// GetCertificate 用作 tls.Config.GetCertificate
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// GetClientCertificate 用作 tls.Config.GetClientCertificate
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// LoadCertPool 读取 PEM 格式的 CA 证书文件，文件中可以有多个证书
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s contains no PEM certificates", caFile)
+	}
+	return pool, nil
+}
+
+// ServerOptions 服务器的 TLS 参数
+type ServerOptions struct {
+	CertFile, KeyFile string // 服务器证书和私钥，必须设置
+	// ClientCAFile 签发客户端证书的 CA，设置后启用双向 TLS：客户端提供的证书必须由这个 CA 签发。
+	// 与服务器证书不同，CA 文件只在创建配置时读取一次，更换 CA 需要重启服务器。
+	ClientCAFile string
+	// RequireClientCert 为 true 时拒绝没有客户端证书的连接，否则客户端可以不提供证书而改用令牌认证
+	RequireClientCert bool
+}
+
+// Server 创建服务器的 TLS 配置，服务器证书修改后自动重新加载
+func Server(opts ServerOptions) (*tls.Config, error) {
+	if opts.CertFile == "" || opts.KeyFile == "" {
+		return nil, errors.New("tlsconfig: server certificate and key are required")
+	}
+	if opts.RequireClientCert && opts.ClientCAFile == "" {
+		return nil, errors.New("tlsconfig: requiring client certificates needs a client CA")
+	}
+	cert, err := NewCertReloader(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cert.GetCertificate,
+	}
+	if opts.ClientCAFile != "" {
+		if config.ClientCAs, err = LoadCertPool(opts.ClientCAFile); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if opts.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, nil
+}
+
+// ClientOptions 客户端的 TLS 参数
+type ClientOptions struct {
+	// CAFile 校验服务器证书的 CA，为空时使用系统的根证书
+	CAFile string
+	// CertFile、KeyFile 双向 TLS 的客户端证书和私钥，为空时不提供客户端证书
+	CertFile, KeyFile string
+	// ServerName 校验服务器证书时使用的名字，为空时使用连接地址中的主机名
+	ServerName string
+}
+
+// Client 创建客户端的 TLS 配置，客户端证书修改后自动重新加载
+func Client(opts ClientOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: opts.ServerName,
+	}
+	if opts.CAFile != "" {
+		var err error
+		if config.RootCAs, err = LoadCertPool(opts.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := NewCertReloader(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = cert.GetClientCertificate
+	}
+	return config, nil
+}
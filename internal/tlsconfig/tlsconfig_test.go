@@ -0,0 +1,171 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/liverlong/rpc-learning/internal/tlsconfig/tlstest"
+)
+
+// handshake 在本地回环连接上完成一次握手，返回客户端看到的服务器证书和服务器看到的客户端证书
+func handshake(t *testing.T, server, client *tls.Config) (serverCert, clientCert *x509.Certificate, err error) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	type result struct {
+		peer *x509.Certificate
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer conn.Close()
+		srv := tls.Server(conn, server)
+		if err := srv.Handshake(); err != nil {
+			done <- result{err: err}
+			return
+		}
+		var r result
+		if peers := srv.ConnectionState().PeerCertificates; len(peers) > 0 {
+			r.peer = peers[0]
+		}
+		done <- r
+	}()
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cli := tls.Client(conn, client)
+	err = cli.Handshake()
+	if err != nil {
+		conn.Close()
+		<-done
+		return nil, nil, err
+	}
+	// TLS 1.3 中服务器在客户端完成握手后才校验客户端证书
+	r := <-done
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	return cli.ConnectionState().PeerCertificates[0], r.peer, nil
+}
+
+// touch 把文件的修改时间设为将来，确保重新签发的证书被识别为新文件
+func touch(t *testing.T, files ...string) {
+	t.Helper()
+	future := time.Now().Add(time.Minute)
+	for _, f := range files {
+		if err := os.Chtimes(f, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestServerAndClient(t *testing.T) {
+	ca := tlstest.NewCA(t, "test CA")
+	serverCert, serverKey := ca.Issue(t, "server", pkix.Name{CommonName: "user-service"}, "localhost", "127.0.0.1")
+	clientCert, clientKey := ca.Issue(t, "client", pkix.Name{CommonName: "billing", Organization: []string{"Acme"}})
+
+	server, err := Server(ServerOptions{CertFile: serverCert, KeyFile: serverKey, ClientCAFile: ca.CertFile})
+	if err != nil {
+		t.Fatalf("Server() error = %v", err)
+	}
+	client, err := Client(ClientOptions{CAFile: ca.CertFile, CertFile: clientCert, KeyFile: clientKey, ServerName: "localhost"})
+	if err != nil {
+		t.Fatalf("Client() error = %v", err)
+	}
+	got, peer, err := handshake(t, server, client)
+	if err != nil {
+		t.Fatalf("handshake error = %v", err)
+	}
+	if got.Subject.CommonName != "user-service" || peer == nil || peer.Subject.String() != "CN=billing,O=Acme" {
+		t.Errorf("handshake certificates = %v, %v", got.Subject, peer)
+	}
+
+	// 没有客户端证书时，可选的双向 TLS 仍然可以连接，必须的双向 TLS 拒绝连接
+	anonymous, err := Client(ClientOptions{CAFile: ca.CertFile, ServerName: "localhost"})
+	if err != nil {
+		t.Fatalf("Client() error = %v", err)
+	}
+	if _, peer, err := handshake(t, server, anonymous); err != nil || peer != nil {
+		t.Errorf("handshake without client certificate = %v, %v, want success", peer, err)
+	}
+	strict, err := Server(ServerOptions{CertFile: serverCert, KeyFile: serverKey, ClientCAFile: ca.CertFile, RequireClientCert: true})
+	if err != nil {
+		t.Fatalf("Server() error = %v", err)
+	}
+	if _, _, err := handshake(t, strict, anonymous); err == nil {
+		t.Error("handshake without client certificate succeeded, want required")
+	}
+
+	// 其他 CA 签发的证书和不匹配的服务器名都被拒绝
+	other := tlstest.NewCA(t, "other CA")
+	otherCert, otherKey := other.Issue(t, "client", pkix.Name{CommonName: "mallory"})
+	untrusted, _ := Client(ClientOptions{CAFile: ca.CertFile, CertFile: otherCert, KeyFile: otherKey, ServerName: "localhost"})
+	if _, _, err := handshake(t, server, untrusted); err == nil {
+		t.Error("handshake with a client certificate from another CA succeeded")
+	}
+	wrongName, _ := Client(ClientOptions{CAFile: ca.CertFile, ServerName: "example.com"})
+	if _, _, err := handshake(t, server, wrongName); err == nil {
+		t.Error("handshake with a wrong server name succeeded")
+	}
+
+	for name, opts := range map[string]ServerOptions{
+		"no certificate":         {ClientCAFile: ca.CertFile},
+		"missing file":           {CertFile: serverCert + ".missing", KeyFile: serverKey},
+		"mismatched key":         {CertFile: serverCert, KeyFile: clientKey},
+		"require without a CA":   {CertFile: serverCert, KeyFile: serverKey, RequireClientCert: true},
+		"client CA without PEMs": {CertFile: serverCert, KeyFile: serverKey, ClientCAFile: serverKey},
+	} {
+		if _, err := Server(opts); err == nil {
+			t.Errorf("Server(%s) succeeded", name)
+		}
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	ca := tlstest.NewCA(t, "test CA")
+	certFile, keyFile := ca.Issue(t, "server", pkix.Name{CommonName: "old"}, "localhost")
+	server, err := Server(ServerOptions{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("Server() error = %v", err)
+	}
+	client, err := Client(ClientOptions{CAFile: ca.CertFile, ServerName: "localhost"})
+	if err != nil {
+		t.Fatalf("Client() error = %v", err)
+	}
+	if got, _, err := handshake(t, server, client); err != nil || got.Subject.CommonName != "old" {
+		t.Fatalf("handshake = %v, %v, want the old certificate", got, err)
+	}
+
+	// 替换证书文件后，新的连接使用新证书
+	ca.Issue(t, "server", pkix.Name{CommonName: "new"}, "localhost")
+	touch(t, certFile, keyFile)
+	if got, _, err := handshake(t, server, client); err != nil || got.Subject.CommonName != "new" {
+		t.Fatalf("handshake after renewal = %v, %v, want the new certificate", got, err)
+	}
+
+	// 新文件不完整时继续使用旧证书
+	if err := os.WriteFile(keyFile, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, keyFile)
+	if got, _, err := handshake(t, server, client); err != nil || got.Subject.CommonName != "new" {
+		t.Errorf("handshake with a broken key file = %v, %v, want the previous certificate", got, err)
+	}
+}
@@ -22,6 +22,17 @@ SERVER_PID=$!
 # 等待服务器启动
 sleep 2
 
+# 聊天只能以存在的用户加入，名字取自用户信息
+echo "   导入聊天用户: 张三、李四、王五"
+USERS_FILE=$(mktemp --suffix=.jsonl)
+cat > "$USERS_FILE" <<'USERS'
+{"name":"张三","email":"zhangsan@example.com"}
+{"name":"李四","email":"lisi@example.com"}
+{"name":"王五","email":"wangwu@example.com"}
+USERS
+./bin/client import "$USERS_FILE"
+rm -f "$USERS_FILE"
+
 echo
 echo "2. 启动多个聊天客户端..."
 echo "   将启动3个客户端进行聊天演示"
@@ -40,5 +40,14 @@ protoc \
     --proto_path=api/proto \
     api/proto/user.proto
 
+# user.v2 接口，生成到 pkg/pb/user/v2/
+protoc \
+    --go_out=pkg/pb \
+    --go_opt=paths=source_relative \
+    --go-grpc_out=pkg/pb \
+    --go-grpc_opt=paths=source_relative \
+    --proto_path=api/proto \
+    api/proto/user/v2/user.proto
+
 echo "protobuf代码生成完成!"
-echo "生成的文件位于: pkg/pb/user/" 
\ No newline at end of file
+echo "生成的文件位于: pkg/pb/user/ 和 pkg/pb/user/v2/" 
\ No newline at end of file